@@ -0,0 +1,67 @@
+package executor
+
+import (
+	"context"
+	"github.com/cirruslabs/cirrus-ci-agent/api"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const diagnosticsArtifactName = "cirrus-agent.log"
+
+// uploadDiagnostics makes the agent-internal diagnostics available
+// as an artifact to simplify troubleshooting of the failed tasks.
+func (executor *Executor) uploadDiagnostics(ctx context.Context) {
+	contents := executor.diagnostics.Bytes()
+	if len(contents) == 0 {
+		return
+	}
+
+	dir, err := ioutil.TempDir("", "cirrus-agent-diagnostics")
+	if err != nil {
+		log.Printf("Failed to create a directory for the diagnostics: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, diagnosticsArtifactName), contents, 0600); err != nil {
+		log.Printf("Failed to write the diagnostics: %v", err)
+		return
+	}
+
+	_, err = executor.uploadArtifactsAndParseAnnotations(ctx, "cirrus-agent",
+		&api.ArtifactsInstruction{Paths: []string{diagnosticsArtifactName}},
+		map[string]string{"CIRRUS_WORKING_DIR": dir}, stdLogUploadObserver{})
+	if err != nil {
+		log.Printf("Failed to upload the diagnostics: %v", err)
+	}
+}
+
+// stdLogUploadObserver reports the upload events to the agent's own log.
+type stdLogUploadObserver struct{}
+
+func (stdLogUploadObserver) OnPatternStart(pattern string, paths []string) {}
+
+func (stdLogUploadObserver) OnStaleFilesSkipped(pattern string, numSkipped int, modifiedSince time.Time) {
+	log.Printf("Skipping %d files matching %s that weren't modified since %s",
+		numSkipped, pattern, modifiedSince.Format(time.RFC3339))
+}
+
+func (stdLogUploadObserver) OnFileStart(path string, size int64) {}
+
+func (stdLogUploadObserver) OnFileSkipped(path string, reason string) {
+	log.Printf("Skipping uploading of '%s' because %s", path, reason)
+}
+
+func (stdLogUploadObserver) OnFileDone(path string, bytes int64, duration time.Duration) {
+	log.Printf("Uploaded %s", path)
+}
+
+func (stdLogUploadObserver) OnPatternDone(pattern string, numUploaded int) {}
+
+func (stdLogUploadObserver) OnError(err error) {
+	log.Printf("Failed to upload artifacts: %v", err)
+}
@@ -0,0 +1,32 @@
+package executor
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestUploadDiagnostics(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	executor := newTestArtifactsExecutor()
+	executor.diagnostics.Warnf("Failed to stream logs for %s", "main")
+	executor.diagnostics.Debugf("Not recorded by default")
+
+	executor.uploadDiagnostics(context.Background())
+
+	uploadedFiles := fake.UploadedFiles()
+	assert.Len(t, uploadedFiles, 1)
+	assert.True(t, strings.HasSuffix(uploadedFiles["cirrus-agent.log"], " [WARN] Failed to stream logs for main\n"))
+}
+
+func TestUploadDiagnosticsNothingToUpload(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	newTestArtifactsExecutor().uploadDiagnostics(context.Background())
+
+	assert.Empty(t, fake.Entries())
+}
@@ -0,0 +1,48 @@
+// Package annotationparsers parses the annotations from the formats that the cirrus-ci-annotations
+// module doesn't support yet, falling back to it for the rest of the formats.
+package annotationparsers
+
+import (
+	"github.com/cirruslabs/cirrus-ci-annotations"
+	"github.com/cirruslabs/cirrus-ci-annotations/model"
+	"regexp"
+	"strings"
+)
+
+// Options tune the parsers of the formats that need more than the report itself.
+type Options struct {
+	// Files whose line coverage percentage is below this get annotated by the LCOV parser
+	LCOVThreshold float64
+
+	// Pattern for the regex format, see CompileRegex()
+	Regex *regexp.Regexp
+}
+
+// DefaultOptions annotate every file that is not fully covered.
+var DefaultOptions = Options{
+	LCOVThreshold: 100,
+}
+
+// Parse returns the annotations found in the file at path, which is in the specified format.
+// The unknown formats produce no annotations, just like in the cirrus-ci-annotations module.
+//
+// The gzip-compressed files (e.g. junit.xml.gz) are transparently decompressed.
+func Parse(format string, path string, options Options) ([]model.Annotation, error) {
+	path, cleanup, err := decompressIfGzipped(path)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	switch strings.ToLower(format) {
+	case "checkstyle":
+		return ParseCheckstyle(path)
+	case "lcov":
+		return ParseLCOV(path, options.LCOVThreshold)
+	case "regex":
+		return ParseRegex(path, options.Regex)
+	default:
+		err, result := annotations.ParseAnnotations(format, path)
+		return result, err
+	}
+}
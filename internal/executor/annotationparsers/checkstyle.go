@@ -0,0 +1,72 @@
+package annotationparsers
+
+import (
+	"encoding/xml"
+	"fmt"
+	"github.com/cirruslabs/cirrus-ci-annotations/model"
+	"os"
+	"strings"
+)
+
+type checkstyleReport struct {
+	Files []struct {
+		Name   string `xml:"name,attr"`
+		Errors []struct {
+			Line     int64  `xml:"line,attr"`
+			Column   int64  `xml:"column,attr"`
+			Severity string `xml:"severity,attr"`
+			Message  string `xml:"message,attr"`
+			Source   string `xml:"source,attr"`
+		} `xml:"error"`
+	} `xml:"file"`
+}
+
+// ParseCheckstyle parses the Checkstyle XML report, which is produced by many linters besides
+// Checkstyle itself (e.g. ktlint, detekt, PHP_CodeSniffer and ESLint's checkstyle formatter).
+//
+// The reported paths are left as is, since the annotations get normalized to the working
+// directory later anyway.
+func ParseCheckstyle(path string) ([]model.Annotation, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var report checkstyleReport
+	if err := xml.NewDecoder(file).Decode(&report); err != nil {
+		return nil, fmt.Errorf("failed to parse Checkstyle report: %w", err)
+	}
+
+	result := make([]model.Annotation, 0)
+
+	for _, reportedFile := range report.Files {
+		for _, reportedError := range reportedFile.Errors {
+			var level model.AnnotationLevel
+
+			switch strings.ToLower(reportedError.Severity) {
+			case "ignore":
+				continue
+			case "error":
+				level = model.LevelFailure
+			case "warning":
+				level = model.LevelWarning
+			default:
+				level = model.LevelNotice
+			}
+
+			result = append(result, model.Annotation{
+				Level:       level,
+				Message:     reportedError.Message,
+				RawDetails:  reportedError.Source,
+				Path:        reportedFile.Name,
+				StartLine:   reportedError.Line,
+				EndLine:     reportedError.Line,
+				StartColumn: reportedError.Column,
+				EndColumn:   reportedError.Column,
+			})
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,67 @@
+package annotationparsers_test
+
+import (
+	"github.com/cirruslabs/cirrus-ci-agent/internal/executor/annotationparsers"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/testutil"
+	"github.com/cirruslabs/cirrus-ci-annotations/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const checkstyleReport = `<?xml version="1.0" encoding="UTF-8"?>
+<checkstyle version="8.45">
+  <file name="/build/src/main/java/App.java">
+    <error line="3" column="8" severity="error" message="Unused import - java.util.List."
+      source="com.puppycrawl.tools.checkstyle.checks.imports.UnusedImportsCheck"/>
+    <error line="10" severity="warning" message="Line is longer than 100 characters."/>
+    <error line="12" severity="info" message="Missing a Javadoc comment."/>
+    <error line="15" severity="ignore" message="Ignored."/>
+  </file>
+  <file name="/build/src/main/java/Clean.java"/>
+</checkstyle>
+`
+
+func TestParseCheckstyle(t *testing.T) {
+	path := filepath.Join(testutil.TempDir(t), "checkstyle.xml")
+	require.NoError(t, os.WriteFile(path, []byte(checkstyleReport), 0600))
+
+	result, err := annotationparsers.Parse("checkstyle", path, annotationparsers.DefaultOptions)
+	require.NoError(t, err)
+	assert.Equal(t, []model.Annotation{
+		{
+			Level:       model.LevelFailure,
+			Message:     "Unused import - java.util.List.",
+			RawDetails:  "com.puppycrawl.tools.checkstyle.checks.imports.UnusedImportsCheck",
+			Path:        "/build/src/main/java/App.java",
+			StartLine:   3,
+			EndLine:     3,
+			StartColumn: 8,
+			EndColumn:   8,
+		},
+		{
+			Level:     model.LevelWarning,
+			Message:   "Line is longer than 100 characters.",
+			Path:      "/build/src/main/java/App.java",
+			StartLine: 10,
+			EndLine:   10,
+		},
+		{
+			Level:     model.LevelNotice,
+			Message:   "Missing a Javadoc comment.",
+			Path:      "/build/src/main/java/App.java",
+			StartLine: 12,
+			EndLine:   12,
+		},
+	}, result)
+}
+
+func TestParseCheckstyleMalformed(t *testing.T) {
+	path := filepath.Join(testutil.TempDir(t), "checkstyle.xml")
+	require.NoError(t, os.WriteFile(path, []byte("<checkstyle><file"), 0600))
+
+	_, err := annotationparsers.Parse("checkstyle", path, annotationparsers.DefaultOptions)
+	require.Error(t, err)
+}
@@ -0,0 +1,76 @@
+package annotationparsers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// decompressIfGzipped returns the path to the decompressed copy of the file if it's compressed
+// with gzip, which is detected by the ".gz" extension or the magic bytes, and the function that
+// removes the copy. Other files are returned as is.
+func decompressIfGzipped(path string) (string, func(), error) {
+	noop := func() {}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", noop, err
+	}
+	defer file.Close()
+
+	magic := make([]byte, len(gzipMagic))
+	n, err := io.ReadFull(file, magic)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", noop, err
+	}
+
+	hasGzipExtension := strings.EqualFold(filepath.Ext(path), ".gz")
+	if !bytes.Equal(magic[:n], gzipMagic) && !hasGzipExtension {
+		return path, noop, nil
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", noop, err
+	}
+
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		return "", noop, fmt.Errorf("failed to decompress %s: %w", path, err)
+	}
+	defer reader.Close()
+
+	dir, err := ioutil.TempDir("", "cirrus-annotations")
+	if err != nil {
+		return "", noop, err
+	}
+	cleanup := func() {
+		_ = os.RemoveAll(dir)
+	}
+
+	// Keep the original name without the extension, since some parsers might look at it
+	name := filepath.Base(path)
+	if hasGzipExtension {
+		name = strings.TrimSuffix(name, filepath.Ext(name))
+	}
+	decompressedPath := filepath.Join(dir, name)
+
+	decompressed, err := os.Create(decompressedPath)
+	if err != nil {
+		cleanup()
+		return "", noop, err
+	}
+	defer decompressed.Close()
+
+	if _, err := io.Copy(decompressed, reader); err != nil {
+		cleanup()
+		return "", noop, fmt.Errorf("failed to decompress %s: %w", path, err)
+	}
+
+	return decompressedPath, cleanup, nil
+}
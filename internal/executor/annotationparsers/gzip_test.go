@@ -0,0 +1,60 @@
+package annotationparsers_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/executor/annotationparsers"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/testutil"
+	"github.com/cirruslabs/cirrus-ci-annotations/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const junitReport = `<?xml version="1.0" encoding="UTF-8"?>
+<testsuite name="MathTest" tests="2" failures="1">
+  <testcase classname="com.example.MathTest" name="testAdd"/>
+  <testcase classname="com.example.MathTest" name="testDivide">
+    <failure message="expected 2 but was 3">expected 2 but was 3</failure>
+  </testcase>
+</testsuite>
+`
+
+func gzipped(t *testing.T, contents string) []byte {
+	var buf bytes.Buffer
+
+	writer := gzip.NewWriter(&buf)
+	_, err := writer.Write([]byte(contents))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	return buf.Bytes()
+}
+
+func TestParseGzipped(t *testing.T) {
+	dir := testutil.TempDir(t)
+
+	// Detected by the extension and by the magic bytes
+	for _, name := range []string{"junit.xml.gz", "junit.xml"} {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, gzipped(t, junitReport), 0600))
+
+		result, err := annotationparsers.Parse("junit", path, annotationparsers.DefaultOptions)
+		require.NoError(t, err, name)
+		require.Len(t, result, 2, name)
+		assert.Equal(t, model.LevelNotice, result[0].Level)
+		assert.Equal(t, "com.example.MathTest.testAdd", result[0].Message)
+		assert.Equal(t, model.LevelFailure, result[1].Level)
+		assert.Equal(t, "com.example.MathTest.testDivide", result[1].Message)
+	}
+}
+
+func TestParseGzippedCorrupted(t *testing.T) {
+	path := filepath.Join(testutil.TempDir(t), "junit.xml.gz")
+	require.NoError(t, os.WriteFile(path, []byte(junitReport), 0600))
+
+	_, err := annotationparsers.Parse("junit", path, annotationparsers.DefaultOptions)
+	require.Error(t, err)
+}
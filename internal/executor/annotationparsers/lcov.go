@@ -0,0 +1,137 @@
+package annotationparsers
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/cirruslabs/cirrus-ci-annotations/model"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type lcovFile struct {
+	Path string
+
+	// Whether the line was executed, keyed by the line number
+	Lines map[int64]bool
+}
+
+// ParseLCOV parses the LCOV tracefile (e.g. lcov.info) and emits a summary notice for each file
+// whose line coverage is below the threshold percentage, listing its uncovered lines.
+//
+// The source file paths are left as is, since the annotations get normalized to the working
+// directory later anyway.
+func ParseLCOV(path string, threshold float64) ([]model.Annotation, error) {
+	files, err := parseLCOVFiles(path)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]model.Annotation, 0)
+
+	for _, file := range files {
+		if len(file.Lines) == 0 {
+			continue
+		}
+
+		var uncovered []int64
+		for line, executed := range file.Lines {
+			if !executed {
+				uncovered = append(uncovered, line)
+			}
+		}
+		sort.Slice(uncovered, func(i, j int) bool { return uncovered[i] < uncovered[j] })
+
+		covered := len(file.Lines) - len(uncovered)
+		coverage := float64(covered) * 100 / float64(len(file.Lines))
+		if coverage >= threshold || len(uncovered) == 0 {
+			continue
+		}
+
+		result = append(result, model.Annotation{
+			Level: model.LevelNotice,
+			Message: fmt.Sprintf("Line coverage is %.1f%% (%d of %d lines), which is below %g%%",
+				coverage, covered, len(file.Lines), threshold),
+			RawDetails: "Uncovered lines: " + formatLineRanges(uncovered),
+			Path:       file.Path,
+			StartLine:  uncovered[0],
+			EndLine:    uncovered[0],
+		})
+	}
+
+	return result, nil
+}
+
+func parseLCOVFiles(path string) ([]*lcovFile, error) {
+	tracefile, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer tracefile.Close()
+
+	var result []*lcovFile
+	var current *lcovFile
+
+	scanner := bufio.NewScanner(tracefile)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		record := strings.TrimSpace(scanner.Text())
+
+		switch {
+		case strings.HasPrefix(record, "SF:"):
+			current = &lcovFile{Path: strings.TrimPrefix(record, "SF:"), Lines: map[int64]bool{}}
+			result = append(result, current)
+		case strings.HasPrefix(record, "DA:"):
+			if current == nil {
+				return nil, fmt.Errorf("LCOV line %d: DA record outside of a source file", lineNumber)
+			}
+
+			// DA:<line number>,<execution count>[,<checksum>]
+			fields := strings.Split(strings.TrimPrefix(record, "DA:"), ",")
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("LCOV line %d: malformed DA record %q", lineNumber, record)
+			}
+			line, err := strconv.ParseInt(fields[0], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("LCOV line %d: malformed DA record %q", lineNumber, record)
+			}
+			// Some tools emit negative or fractional counts, only their sign matters
+			hits, err := strconv.ParseFloat(fields[1], 64)
+			if err != nil {
+				return nil, fmt.Errorf("LCOV line %d: malformed DA record %q", lineNumber, record)
+			}
+
+			// The same line might be reported more than once, e.g. for templates
+			current.Lines[line] = current.Lines[line] || hits > 0
+		case record == "end_of_record":
+			current = nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// formatLineRanges formats the sorted line numbers compactly, e.g. "3-5, 9".
+func formatLineRanges(lines []int64) string {
+	var ranges []string
+
+	for i := 0; i < len(lines); {
+		j := i
+		for j+1 < len(lines) && lines[j+1] == lines[j]+1 {
+			j++
+		}
+
+		if i == j {
+			ranges = append(ranges, strconv.FormatInt(lines[i], 10))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", lines[i], lines[j]))
+		}
+
+		i = j + 1
+	}
+
+	return strings.Join(ranges, ", ")
+}
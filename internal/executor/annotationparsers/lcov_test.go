@@ -0,0 +1,71 @@
+package annotationparsers_test
+
+import (
+	"github.com/cirruslabs/cirrus-ci-agent/internal/executor/annotationparsers"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/testutil"
+	"github.com/cirruslabs/cirrus-ci-annotations/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const lcovTracefile = `TN:
+SF:/build/src/math.js
+FN:1,add
+FNDA:3,add
+DA:1,3
+DA:2,3
+DA:3,0
+DA:4,0
+DA:5,0
+DA:7,1
+DA:9,0
+LF:7
+LH:3
+end_of_record
+SF:/build/src/covered.js
+DA:1,1
+DA:2,5
+end_of_record
+SF:/build/src/mostly.cpp
+DA:1,1
+DA:2,1
+DA:3,1
+DA:4,1
+DA:5,0
+end_of_record
+`
+
+func TestParseLCOV(t *testing.T) {
+	path := filepath.Join(testutil.TempDir(t), "lcov.info")
+	require.NoError(t, os.WriteFile(path, []byte(lcovTracefile), 0600))
+
+	result, err := annotationparsers.Parse("lcov", path, annotationparsers.Options{LCOVThreshold: 75})
+	require.NoError(t, err)
+	assert.Equal(t, []model.Annotation{
+		{
+			Level:      model.LevelNotice,
+			Message:    "Line coverage is 42.9% (3 of 7 lines), which is below 75%",
+			RawDetails: "Uncovered lines: 3-5, 9",
+			Path:       "/build/src/math.js",
+			StartLine:  3,
+			EndLine:    3,
+		},
+	}, result)
+
+	result, err = annotationparsers.Parse("lcov", path, annotationparsers.DefaultOptions)
+	require.NoError(t, err)
+	require.Len(t, result, 2)
+	assert.Equal(t, "/build/src/mostly.cpp", result[1].Path)
+	assert.Equal(t, "Uncovered lines: 5", result[1].RawDetails)
+}
+
+func TestParseLCOVMalformed(t *testing.T) {
+	path := filepath.Join(testutil.TempDir(t), "lcov.info")
+	require.NoError(t, os.WriteFile(path, []byte("SF:a.js\nDA:one,1\n"), 0600))
+
+	_, err := annotationparsers.Parse("lcov", path, annotationparsers.DefaultOptions)
+	require.Error(t, err)
+}
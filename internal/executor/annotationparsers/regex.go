@@ -0,0 +1,143 @@
+package annotationparsers
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/cirruslabs/cirrus-ci-annotations/model"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Go's regular expressions run in linear time, so bounding the pattern
+	// and the input lines is enough to keep the matching time in check
+	maxRegexPatternLength = 4096
+	maxRegexLineLength    = 64 * 1024
+)
+
+var ErrRegexPatternMissing = errors.New("no pattern specified for the regex format")
+
+// requiredRegexGroups are the named capture groups without which the annotation is meaningless,
+// the "col" and "severity" groups are optional.
+var requiredRegexGroups = []string{"file", "line", "message"}
+
+// CompileRegex compiles the pattern for the regex format, making sure
+// that it has all the required named capture groups.
+func CompileRegex(pattern string) (*regexp.Regexp, error) {
+	if len(pattern) > maxRegexPatternLength {
+		return nil, fmt.Errorf("regex pattern is longer than %d characters", maxRegexPatternLength)
+	}
+
+	compiled, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid regex pattern: %w", err)
+	}
+
+	var missing []string
+	for _, group := range requiredRegexGroups {
+		if compiled.SubexpIndex(group) == -1 {
+			missing = append(missing, fmt.Sprintf("(?P<%s>...)", group))
+		}
+	}
+	if len(missing) != 0 {
+		return nil, fmt.Errorf("regex pattern is missing the named capture groups %s",
+			strings.Join(missing, ", "))
+	}
+
+	return compiled, nil
+}
+
+// ParseRegex emits an annotation for each line of the file at path that matches the pattern,
+// which should be compiled with CompileRegex(). The lines longer than 64 KiB are ignored.
+//
+// The "severity" group is mapped to the annotation level ("error" and "fatal" are failures,
+// "warning" and "warn" are warnings and the rest are notices), defaulting to a warning.
+func ParseRegex(path string, pattern *regexp.Regexp) ([]model.Annotation, error) {
+	if pattern == nil {
+		return nil, ErrRegexPatternMissing
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	result := make([]model.Annotation, 0)
+
+	reader := bufio.NewReaderSize(file, maxRegexLineLength)
+	for {
+		line, err := readRegexLine(reader)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		match := pattern.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+
+		group := func(name string) string {
+			if index := pattern.SubexpIndex(name); index != -1 {
+				return strings.TrimSpace(match[index])
+			}
+			return ""
+		}
+
+		// The rest of the groups are validated by the pattern itself
+		lineNumber, _ := strconv.ParseInt(group("line"), 10, 64)
+		column, _ := strconv.ParseInt(group("col"), 10, 64)
+
+		result = append(result, model.Annotation{
+			Level:       regexSeverityLevel(group("severity")),
+			Message:     group("message"),
+			Path:        group("file"),
+			StartLine:   lineNumber,
+			EndLine:     lineNumber,
+			StartColumn: column,
+			EndColumn:   column,
+		})
+	}
+
+	return result, nil
+}
+
+// readRegexLine returns the next line without the line ending,
+// skipping the lines that don't fit into the reader's buffer.
+func readRegexLine(reader *bufio.Reader) (string, error) {
+	for {
+		line, isPrefix, err := reader.ReadLine()
+		if err != nil {
+			return "", err
+		}
+
+		if !isPrefix {
+			return string(line), nil
+		}
+
+		for isPrefix {
+			_, isPrefix, err = reader.ReadLine()
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+}
+
+func regexSeverityLevel(severity string) model.AnnotationLevel {
+	switch strings.ToLower(severity) {
+	case "error", "fatal":
+		return model.LevelFailure
+	case "", "warning", "warn":
+		return model.LevelWarning
+	default:
+		return model.LevelNotice
+	}
+}
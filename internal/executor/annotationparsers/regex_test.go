@@ -0,0 +1,81 @@
+package annotationparsers_test
+
+import (
+	"github.com/cirruslabs/cirrus-ci-agent/internal/executor/annotationparsers"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/testutil"
+	"github.com/cirruslabs/cirrus-ci-annotations/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const gccPattern = `^(?P<file>[^:]+):(?P<line>\d+):(?P<col>\d+): (?P<severity>\w+): (?P<message>.*)$`
+
+func TestParseRegex(t *testing.T) {
+	output := "main.c: In function 'main':\n" +
+		"main.c:3:9: warning: unused variable 'x' [-Wunused-variable]\n" +
+		"src/" + strings.Repeat("a", 100*1024) + ".c:1:1: error: too long to match\n" +
+		"main.c:5:5: error: 'y' undeclared (first use in this function)\n" +
+		"lib.c:10:1: note: declared here"
+
+	path := filepath.Join(testutil.TempDir(t), "gcc.log")
+	require.NoError(t, os.WriteFile(path, []byte(output), 0600))
+
+	pattern, err := annotationparsers.CompileRegex(gccPattern)
+	require.NoError(t, err)
+
+	result, err := annotationparsers.Parse("regex", path, annotationparsers.Options{Regex: pattern})
+	require.NoError(t, err)
+	assert.Equal(t, []model.Annotation{
+		{
+			Level:       model.LevelWarning,
+			Message:     "unused variable 'x' [-Wunused-variable]",
+			Path:        "main.c",
+			StartLine:   3,
+			EndLine:     3,
+			StartColumn: 9,
+			EndColumn:   9,
+		},
+		{
+			Level:       model.LevelFailure,
+			Message:     "'y' undeclared (first use in this function)",
+			Path:        "main.c",
+			StartLine:   5,
+			EndLine:     5,
+			StartColumn: 5,
+			EndColumn:   5,
+		},
+		{
+			Level:       model.LevelNotice,
+			Message:     "declared here",
+			Path:        "lib.c",
+			StartLine:   10,
+			EndLine:     10,
+			StartColumn: 1,
+			EndColumn:   1,
+		},
+	}, result)
+}
+
+func TestCompileRegex(t *testing.T) {
+	_, err := annotationparsers.CompileRegex(`(?P<file>[^:]+):(?P<line>\d+`)
+	require.Error(t, err)
+
+	_, err = annotationparsers.CompileRegex(`(?P<file>[^:]+):(?P<lineno>\d+): (?P<msg>.*)`)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "(?P<line>...), (?P<message>...)")
+
+	_, err = annotationparsers.CompileRegex(strings.Repeat("a", 5000))
+	require.Error(t, err)
+}
+
+func TestParseRegexWithoutPattern(t *testing.T) {
+	path := filepath.Join(testutil.TempDir(t), "gcc.log")
+	require.NoError(t, os.WriteFile(path, nil, 0600))
+
+	_, err := annotationparsers.Parse("regex", path, annotationparsers.DefaultOptions)
+	require.ErrorIs(t, err, annotationparsers.ErrRegexPatternMissing)
+}
@@ -1,62 +1,174 @@
 package executor
 
 import (
-	"bufio"
 	"context"
 	"fmt"
 	"github.com/avast/retry-go"
 	"github.com/bmatcuk/doublestar"
 	"github.com/cirruslabs/cirrus-ci-agent/api"
 	"github.com/cirruslabs/cirrus-ci-agent/internal/client"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/executor/annotationparsers"
 	"github.com/cirruslabs/cirrus-ci-annotations"
 	"github.com/cirruslabs/cirrus-ci-annotations/model"
-	"github.com/dustin/go-humanize"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"io"
+	"log"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
 type ProcessedPath struct {
 	Pattern string
 	Paths   []string
+
+	// Files matching the pattern that weren't modified since CIRRUS_ARTIFACTS_MODIFIED_SINCE
+	NumStale int
+
+	// Files matching the pattern whose relative paths were already taken by the preceding patterns
+	Redundant []RedundantPath
+}
+
+// RedundantPath is a file that isn't uploaded since its relative path was already taken by another file,
+// or by the same file matched by one of the preceding patterns.
+type RedundantPath struct {
+	Path         string
+	RelativePath string
+	TakenBy      string
+}
+
+// skipReason explains why the redundant file isn't uploaded.
+func (redundant RedundantPath) skipReason() string {
+	if redundant.TakenBy == redundant.Path {
+		return "it's already matched by one of the preceding patterns"
+	}
+
+	return fmt.Sprintf("%s is already uploaded as %s", redundant.TakenBy, redundant.RelativePath)
 }
 
-var ErrArtifactsPathOutsideWorkingDir = errors.New("path is outside of CIRRUS_WORKING_DIR")
+var (
+	ErrArtifactsPathOutsideWorkingDir = errors.New("path is outside of CIRRUS_WORKING_DIR")
+	ErrArtifactsInvalidOption         = errors.New("invalid artifacts option")
+	ErrArtifactsInvalidWorkingDir     = errors.New("invalid CIRRUS_WORKING_DIR")
+	ErrArtifactChangedDuringUpload    = errors.New("artifact changed during upload")
+	ErrArtifactsBackendUnavailable    = errors.New("backend appears unavailable")
+)
 
+// UploadArtifacts uploads the artifacts and reports the annotations parsed from them,
+// notifying the optional observers about the upload progress in addition to the command's log.
 func (executor *Executor) UploadArtifacts(
 	ctx context.Context,
 	logUploader *LogUploader,
 	name string,
 	artifactsInstruction *api.ArtifactsInstruction,
 	customEnv map[string]string,
-) bool {
+	observers ...UploadObserver,
+) (success bool) {
 	var err error
 	var allAnnotations []model.Annotation
 
-	if len(artifactsInstruction.Paths) == 0 {
+	ctx, span := tracer().Start(ctx, "UploadArtifacts", trace.WithAttributes(
+		attribute.String("artifacts.name", name),
+		attribute.String("artifacts.format", artifactsInstruction.Format),
+	))
+	defer span.End()
+
+	// Make sure the reason of the failed upload makes it to the log even if the task is being stopped
+	defer func() {
+		if err := logUploader.Flush(logFlushTimeout); err != nil {
+			log.Printf("Failed to flush the logs for %s: %v\n", name, err)
+		}
+	}()
+
+	logObserver := NewLogUploadObserver(logUploader)
+	observer := append(multiUploadObserver{logObserver, &spanUploadObserver{span: span}},
+		observers...)
+
+	summaryObserver := newArtifactsSummaryObserver(customEnv, name)
+	if summaryObserver != nil {
+		observer = append(observer, summaryObserver)
+
+		defer func() {
+			if err := summaryObserver.Emit(success, len(allAnnotations)); err != nil {
+				executor.diagnostics.Warnf("Failed to emit the summary of %s artifacts: %v", name, err)
+			}
+		}()
+	}
+
+	if len(artifactsInstruction.Paths) == 0 && artifactsManifestPath(customEnv, name) == "" {
 		logUploader.Write([]byte("\nSkipping artifacts upload because there are no path specified..."))
 		return true
 	}
 
+	if artifactsInstruction.Format != "" {
+		logUploader.Write([]byte(fmt.Sprintf("\nTrying to parse annotations for %s format", artifactsInstruction.Format)))
+	}
+
+	logObserver.heftyThreshold, err = parseHeftyArtifactThreshold(customEnv)
+	if err != nil {
+		recordSpanError(span, err)
+		observer.OnError(err)
+		return false
+	}
+
+	// Retries are triggered by the failing files, so share them between all the files
+	// to avoid multiplying the time a degraded upload takes by the number of files
+	retryBudgetTotal, err := parseArtifactsRetryBudget(customEnv)
+	if err != nil {
+		recordSpanError(span, err)
+		observer.OnError(err)
+		return false
+	}
+	retryBudget := &artifactsRetryBudget{total: retryBudgetTotal}
+	retryBudget.onRetry = func(what string, err error) {
+		executor.diagnostics.Warnf("Failed to upload %s of %s artifacts, re-trying: %v", what, name, err)
+		observer.OnError(err)
+		executor.uploadMetrics.UploadRetried(artifactsInstruction.Type)
+		logUploader.Write([]byte(fmt.Sprintf("\nRe-trying to upload %s (%d of %d retries used)...",
+			what, retryBudget.used, retryBudget.total)))
+	}
+
+	// Shared by the retries of the whole upload, but not with the other artifacts instructions,
+	// which try again in case the backend has recovered in the meantime
+	breaker := newUploadCircuitBreaker()
+
 	err = retry.Do(
 		func() error {
-			allAnnotations, err = executor.uploadArtifactsAndParseAnnotations(ctx, name, artifactsInstruction, customEnv, logUploader)
+			summaryObserver.Reset()
+			allAnnotations, err = executor.uploadArtifactsWithRetryBudget(ctx, name, artifactsInstruction, customEnv,
+				observer, retryBudget, breaker)
+			if err != nil && executor.artifactsGzip.disableIfRejected(customEnv, err) {
+				logUploader.Write([]byte("\nServer doesn't support compressed artifact uploads, uploading without compression..."))
+				summaryObserver.Reset()
+				allAnnotations, err = executor.uploadArtifactsWithRetryBudget(ctx, name, artifactsInstruction, customEnv,
+					observer, retryBudget, breaker)
+			}
 			return err
-		}, retry.OnRetry(func(n uint, err error) {
-			logUploader.Write([]byte(fmt.Sprintf("\nFailed to upload artifacts: %s", err)))
-			logUploader.Write([]byte("\nRe-trying to upload artifacts..."))
-		}),
-		retry.Attempts(2),
+		},
+		// Each retry of the whole upload uses up the budget too, which also limits the number of attempts
+		retry.Attempts(uint(retryBudgetTotal)+1),
 		retry.Context(ctx),
 		retry.RetryIf(func(err error) bool {
-			return !errors.Is(err, ErrArtifactsPathOutsideWorkingDir)
+			return !isPermanentArtifactsError(err) && retryBudget.take("artifacts", err)
 		}),
 		retry.LastErrorOnly(true),
 	)
 	if err != nil {
-		if errors.Is(err, ErrArtifactsPathOutsideWorkingDir) {
-			logUploader.Write([]byte(fmt.Sprintf("\nFailed to upload artifacts: %s", err)))
+		recordSpanError(span, err)
+		observer.OnError(err)
+
+		if isPermanentArtifactsError(err) {
+			return false
+		}
+
+		executor.diagnostics.Warnf("Failed to upload %s artifacts: %v", name, err)
+
+		if retryBudget.exhausted() {
+			logUploader.Write([]byte(fmt.Sprintf("\nFailed to upload artifacts after using up the retry budget of %d: %s",
+				retryBudget.total, err)))
 			return false
 		}
 
@@ -64,8 +176,11 @@ func (executor *Executor) UploadArtifacts(
 		return false
 	}
 
+	span.SetAttributes(attribute.Int("artifacts.annotations", len(allAnnotations)))
+
 	workingDir := customEnv["CIRRUS_WORKING_DIR"]
 	if len(allAnnotations) > 0 {
+		allAnnotations = normalizeWindowsAnnotationPaths(workingDir, allAnnotations)
 		allAnnotations, err = annotations.NormalizeAnnotations(workingDir, allAnnotations)
 		if err != nil {
 			logUploader.Write([]byte(fmt.Sprintf("\nFailed to validate annotations: %s", err)))
@@ -102,144 +217,562 @@ func (executor *Executor) uploadArtifactsAndParseAnnotations(
 	name string,
 	artifactsInstruction *api.ArtifactsInstruction,
 	customEnv map[string]string,
-	logUploader *LogUploader,
+	observer UploadObserver,
+) ([]model.Annotation, error) {
+	retryBudget, err := parseArtifactsRetryBudget(customEnv)
+	if err != nil {
+		return make([]model.Annotation, 0), err
+	}
+
+	return executor.uploadArtifactsWithRetryBudget(ctx, name, artifactsInstruction, customEnv, observer,
+		&artifactsRetryBudget{total: retryBudget}, newUploadCircuitBreaker())
+}
+
+// uploadArtifactsWithRetryBudget is like uploadArtifactsAndParseAnnotations, but the failed files are re-tried
+// using up the retryBudget, which can be shared with the retries of the whole upload, and so can the breaker.
+func (executor *Executor) uploadArtifactsWithRetryBudget(
+	ctx context.Context,
+	name string,
+	artifactsInstruction *api.ArtifactsInstruction,
+	customEnv map[string]string,
+	observer UploadObserver,
+	retryBudget *artifactsRetryBudget,
+	breaker *uploadCircuitBreaker,
 ) ([]model.Annotation, error) {
 	allAnnotations := make([]model.Annotation, 0)
 
 	workingDir := customEnv["CIRRUS_WORKING_DIR"]
+	if err := validateWorkingDir(workingDir); err != nil {
+		return allAnnotations, err
+	}
+
+	// Paths returned by the globbing might be spelled differently than the working
+	// directory (e.g. /private/tmp vs. /tmp on macOS), so compare canonicalized paths too
+	canonicalWorkingDir, err := filepath.EvalSymlinks(workingDir)
+	if err != nil {
+		return allAnnotations, fmt.Errorf("%w: %v", ErrArtifactsInvalidWorkingDir, err)
+	}
+
+	// Fail instead of silently expanding undefined variables to empty strings
+	strictExpansion := customEnv["CIRRUS_ARTIFACTS_STRICT_EXPANSION"] == "true"
+
+	typeOverrides, err := ParseArtifactTypeOverrides(artifactTypeOverridesOption(customEnv, name))
+	if err != nil {
+		return allAnnotations, err
+	}
+
+	sizeLimits, err := parseArtifactSizeLimits(customEnv)
+	if err != nil {
+		return allAnnotations, err
+	}
+
+	modifiedSince, filterStale, err := parseArtifactsModifiedSince(customEnv)
+	if err != nil {
+		return allAnnotations, err
+	}
+
+	annotationOptions, err := parseAnnotationParserOptions(artifactsInstruction.Format, customEnv)
+	if err != nil {
+		return allAnnotations, err
+	}
+
+	sortBy, err := parseArtifactsSortBy(customEnv)
+	if err != nil {
+		return allAnnotations, err
+	}
+
+	breakerThreshold, err := parseArtifactsCircuitBreakerThreshold(customEnv)
+	if err != nil {
+		return allAnnotations, err
+	}
+	if err := breaker.Err(breakerThreshold); err != nil {
+		return allAnnotations, err
+	}
+
+	bundleDirs := artifactsBundleDirs(customEnv, name)
+	mirrorDir := artifactsMirrorDir(customEnv)
+	allowOutsideWorkingDir := artifactsAllowOutsideWorkingDir(customEnv, name)
+
+	patterns := artifactsInstruction.Paths
+
+	if manifestPath := artifactsManifestPath(customEnv, name); manifestPath != "" {
+		manifestPaths, err := readArtifactsManifest(manifestPath, workingDir,
+			artifactsManifestIsNulDelimited(customEnv, name))
+		if err != nil {
+			return allAnnotations, err
+		}
+		patterns = append(append([]string{}, patterns...), manifestPaths...)
+	}
 
 	var processedPaths []ProcessedPath
 
-	for _, path := range artifactsInstruction.Paths {
-		pattern := ExpandText(path, customEnv)
+	// The pattern bases of the paths outside of the CIRRUS_WORKING_DIR, which are uploaded relative to them
+	outsideBases := map[string]string{}
+
+	var globPatterns []string
+	var outsideAllowed []bool
+
+	for _, path := range patterns {
+		pattern, err := expandArtifactsPattern(path, customEnv, strictExpansion)
+		if err != nil {
+			return allAnnotations, err
+		}
+
+		patternOutsideAllowed := allowOutsideWorkingDir && filepath.IsAbs(pattern)
+		if patternOutsideAllowed {
+			pattern = filepath.Clean(pattern)
+		} else if patternHasParentSegments(pattern) {
+			return allAnnotations, fmt.Errorf("%w: pattern %q contains \"..\" segments",
+				ErrArtifactsPathOutsideWorkingDir, pattern)
+		}
 		if !filepath.IsAbs(pattern) {
 			pattern = filepath.Join(workingDir, pattern)
 		}
 
-		paths, err := doublestar.Glob(pattern)
-		if err != nil {
-			return allAnnotations, errors.Wrap(err, "Failed to list artifacts")
+		globPatterns = append(globPatterns, pattern)
+		outsideAllowed = append(outsideAllowed, patternOutsideAllowed)
+	}
+
+	globbedPaths, err := globArtifactsPatterns(ctx, globPatterns)
+	if err != nil {
+		return allAnnotations, err
+	}
+
+	artifactRelativePath := func(artifactPath string) (string, error) {
+		if base, ok := outsideBases[artifactPath]; ok {
+			return filepath.Rel(base, artifactPath)
 		}
 
+		return relativeArtifactPath(workingDir, canonicalWorkingDir, artifactPath)
+	}
+
+	// The files the relative paths were taken by, to avoid uploading the same path twice
+	takenRelativePaths := map[string]string{}
+
+	// Each file is only stat'ed once (which is expensive on the network filesystems), the paths
+	// that can't be stat'ed are left out and are dealt with during the upload just like before
+	infos := map[string]os.FileInfo{}
+	statArtifactPath := func(artifactPath string) {
+		if info, err := os.Stat(artifactPath); err == nil {
+			infos[artifactPath] = info
+		}
+	}
+
+	for i, pattern := range globPatterns {
+		paths := globbedPaths[i]
+
 		// Ensure that the all resulting paths are scoped to the CIRRUS_WORKING_DIR
 		for _, artifactPath := range paths {
-			matcher := filepath.Join(workingDir, "**")
-			matched, err := doublestar.PathMatch(matcher, artifactPath)
+			matched, err := artifactPathIsWithinWorkingDir(workingDir, canonicalWorkingDir, artifactPath)
 			if err != nil {
 				return allAnnotations, errors.Wrapf(err, "failed to match the path: %v", err)
 			}
+			if !matched && outsideAllowed[i] {
+				outsideBases[artifactPath] = artifactsPatternBase(pattern)
+				continue
+			}
 			if !matched {
 				return allAnnotations, fmt.Errorf("%w: path %s should be relative to %s",
 					ErrArtifactsPathOutsideWorkingDir, artifactPath, workingDir)
 			}
 		}
 
-		processedPaths = append(processedPaths, ProcessedPath{Pattern: pattern, Paths: paths})
+		var redundant []RedundantPath
+		var uniquePaths []string
+
+		for _, artifactPath := range paths {
+			relativePath, err := artifactRelativePath(artifactPath)
+			if err != nil {
+				// Reported once the file is uploaded
+				statArtifactPath(artifactPath)
+				uniquePaths = append(uniquePaths, artifactPath)
+				continue
+			}
+
+			if takenBy, ok := takenRelativePaths[relativePath]; ok {
+				redundant = append(redundant, RedundantPath{
+					Path:         artifactPath,
+					RelativePath: filepath.ToSlash(relativePath),
+					TakenBy:      takenBy,
+				})
+				continue
+			}
+
+			takenRelativePaths[relativePath] = artifactPath
+			statArtifactPath(artifactPath)
+			uniquePaths = append(uniquePaths, artifactPath)
+		}
+		paths = uniquePaths
+
+		var numStale int
+		if filterStale {
+			paths, numStale = withoutStaleArtifactPaths(paths, infos, modifiedSince)
+		}
+
+		if sortBy == artifactsSortBySizeDesc {
+			sortArtifactPathsBySize(paths, infos)
+		}
+
+		processedPaths = append(processedPaths, ProcessedPath{
+			Pattern:   pattern,
+			Paths:     paths,
+			NumStale:  numStale,
+			Redundant: redundant,
+		})
 	}
 
-	readBufferSize := int(1024 * 1024)
-	readBuffer := make([]byte, readBufferSize)
+	// newUploader creates the uploader, wrapping its errors for the circuit breaker
+	newUploader := func() (Uploader, error) {
+		uploader, err := executor.newArtifactsUploader(ctx, name, artifactsInstruction, customEnv)
+		if err != nil && !isPermanentArtifactsError(err) {
+			return nil, &artifactsUploaderError{err: err}
+		}
+		return uploader, err
+	}
 
-	uploadArtifactsClient, err := client.CirrusClient.UploadArtifacts(ctx)
+	uploader, err := newUploader()
 	if err != nil {
-		return allAnnotations, errors.Wrapf(err, "failed to initialize artifacts upload client")
+		breaker.FailureIf(err)
+		return allAnnotations, err
 	}
-
 	defer func() {
-		_, err := uploadArtifactsClient.CloseAndRecv()
+		_ = uploader.Close()
+	}()
+
+	// uploadArtifactReader uploads the reader contents of the artifactPath under the specified
+	// relative path, size is the expected size of the contents, negative when unknown
+	uploadArtifactReader := func(
+		reader io.Reader,
+		artifactPath string,
+		relativeArtifactPath string,
+		size int64,
+	) (int64, string, error) {
+		uploadPath := filepath.ToSlash(relativeArtifactPath)
+		fileType := artifactType(typeOverrides, uploadPath, artifactsInstruction.Type)
+
+		// Tee the reader so that the artifact is only read once
+		if mirrorDir != "" {
+			mirror := newArtifactMirror(mirrorDir, relativeArtifactPath)
+			defer func() {
+				if err := mirror.Close(); err != nil {
+					executor.diagnostics.Warnf("Failed to mirror artifact %s to %s: %v", artifactPath, mirrorDir, err)
+				}
+			}()
+			reader = io.TeeReader(reader, mirror)
+		}
+
+		countingReader := &countingReader{reader: reader}
+		uploadStart := time.Now()
+
+		err := uploader.UploadFile(ctx, uploadPath, countingReader, FileMeta{Type: fileType, Size: size})
 		if err != nil {
-			logUploader.Write([]byte(fmt.Sprintf("\nError from upload stream: %s", err)))
+			return 0, fileType, &artifactsUploaderError{err: err}
+		}
+
+		executor.uploadMetrics.FileUploaded(fileType, countingReader.n, time.Since(uploadStart))
+
+		return countingReader.n, fileType, nil
+	}
+
+	// info is the result of stat'ing the file while resolving the paths, nil when it has failed
+	uploadSingleArtifactFile := func(artifactPath string, info os.FileInfo) (int64, error) {
+		expectedSize := int64(-1)
+		if info != nil {
+			expectedSize = info.Size()
 		}
-	}()
 
-	uploadSingleArtifactFile := func(artifactPath string) error {
 		artifactFile, err := os.Open(artifactPath)
 		if err != nil {
-			return errors.Wrapf(err, "failed to read artifact file %s", artifactPath)
+			return 0, errors.Wrapf(err, "failed to read artifact file %s", artifactPath)
 		}
 		defer artifactFile.Close()
 
-		relativeArtifactPath, err := filepath.Rel(workingDir, artifactPath)
+		relativeArtifactPath, err := artifactRelativePath(artifactPath)
 		if err != nil {
-			return errors.Wrapf(err, "failed to get artifact relative path for %s", artifactPath)
+			return 0, errors.Wrapf(err, "failed to get artifact relative path for %s", artifactPath)
 		}
 
-		bytesUploaded := 0
-		bufferedFileReader := bufio.NewReaderSize(artifactFile, readBufferSize)
+		bytesUploaded, fileType, err := uploadArtifactReader(artifactFile, artifactPath, relativeArtifactPath,
+			expectedSize)
+		if err != nil {
+			return 0, err
+		}
 
-		for {
-			n, err := bufferedFileReader.Read(readBuffer)
+		// The file might still be written to by the build, in which case the server
+		// would end up with the contents that never existed on disk
+		if expectedSize >= 0 && bytesUploaded != expectedSize {
+			return 0, fmt.Errorf("%w: file %s changed during upload (expected %d, sent %d)",
+				ErrArtifactChangedDuringUpload, artifactPath, expectedSize, bytesUploaded)
+		}
 
-			if n > 0 {
-				chunk := api.ArtifactEntry_ArtifactChunk{ArtifactPath: filepath.ToSlash(relativeArtifactPath), Data: readBuffer[:n]}
-				chunkMsg := api.ArtifactEntry_Chunk{Chunk: &chunk}
-				err := uploadArtifactsClient.Send(&api.ArtifactEntry{Value: &chunkMsg})
-				if err != nil {
-					return errors.Wrapf(err, "failed to upload artifact file %s", artifactPath)
-				}
-				bytesUploaded += n
-			}
+		artifactAnnotations, err := annotationparsers.Parse(artifactsInstruction.Format, artifactPath, annotationOptions)
+		if err != nil {
+			return 0, errors.Wrapf(err, "failed to create annotations from %s", artifactPath)
+		}
+		executor.uploadMetrics.AnnotationsParsed(fileType, len(artifactAnnotations))
+		allAnnotations = append(allAnnotations, artifactAnnotations...)
+		return bytesUploaded, nil
+	}
 
-			if err == io.EOF || n == 0 {
-				break
-			}
-			if err != nil {
-				return errors.Wrapf(err, "failed to read artifact file %s", artifactPath)
-			}
+	// The archive is produced while it's being uploaded, so it's never stored
+	// on disk or buffered in memory as a whole
+	uploadArtifactDirectoryTar := func(artifactPath string) (int64, error) {
+		relativeArtifactPath, err := artifactRelativePath(artifactPath)
+		if err != nil {
+			return 0, errors.Wrapf(err, "failed to get artifact relative path for %s", artifactPath)
 		}
-		logUploader.Write([]byte(fmt.Sprintf("\nUploaded %s", artifactPath)))
+		if relativeArtifactPath == "." {
+			relativeArtifactPath = filepath.Base(canonicalWorkingDir)
+		}
+
+		pipeReader, pipeWriter := io.Pipe()
+		archiveErrChan := make(chan error, 1)
+
+		go func() {
+			err := writeDirectoryTar(pipeWriter, artifactPath)
+			_ = pipeWriter.CloseWithError(err)
+			archiveErrChan <- err
+		}()
 
-		if artifactsInstruction.Format != "" {
-			logUploader.Write([]byte(fmt.Sprintf("\nTrying to parse annotations for %s format", artifactsInstruction.Format)))
+		bytesUploaded, _, err := uploadArtifactReader(pipeReader, artifactPath, relativeArtifactPath+".tar", -1)
+
+		// Unblock the archiver in case the upload has failed midway
+		_ = pipeReader.CloseWithError(io.ErrClosedPipe)
+		archiveErr := <-archiveErrChan
+
+		if archiveErr != nil && !errors.Is(archiveErr, io.ErrClosedPipe) {
+			return 0, errors.Wrapf(archiveErr, "failed to archive artifact folder %s", artifactPath)
 		}
-		err, artifactAnnotations := annotations.ParseAnnotations(artifactsInstruction.Format, artifactPath)
 		if err != nil {
-			return errors.Wrapf(err, "failed to create annotations from %s", artifactPath)
+			return 0, err
 		}
-		allAnnotations = append(allAnnotations, artifactAnnotations...)
+
+		return bytesUploaded, nil
+	}
+
+	// reopenUploader replaces the uploader after a file has failed, since the upload can't
+	// be resumed midway through the file and might be broken altogether (e.g. the gRPC stream)
+	reopenUploader := func() error {
+		// Closing it again once done is harmless
+		_ = uploader.Close()
+
+		reopened, err := newUploader()
+		if err != nil {
+			return err
+		}
+		uploader = reopened
+
+		if err := uploader.Begin(ctx); err != nil {
+			return &artifactsUploaderError{err: err}
+		}
+
 		return nil
 	}
 
-	for index, processedPath := range processedPaths {
-		if index > 0 {
-			logUploader.Write([]byte("\n"))
+	for _, processedPath := range processedPaths {
+		observer.OnPatternStart(processedPath.Pattern, processedPath.Paths)
+		if processedPath.NumStale != 0 {
+			observer.OnStaleFilesSkipped(processedPath.Pattern, processedPath.NumStale, modifiedSince)
+		}
+		for _, redundant := range processedPath.Redundant {
+			observer.OnFileSkipped(redundant.Path, redundant.skipReason())
 		}
-		logUploader.Write([]byte(fmt.Sprintf("Uploading %d artifacts for %s",
-			len(processedPath.Paths), processedPath.Pattern)))
 
-		chunkMsg := api.ArtifactEntry_ArtifactsUpload_{
-			ArtifactsUpload: &api.ArtifactEntry_ArtifactsUpload{
-				TaskIdentification: executor.taskIdentification,
-				Name:               name,
-				Type:               artifactsInstruction.Type,
-				Format:             artifactsInstruction.Format,
-			},
+		// Don't create an empty artifacts group on the server
+		if len(processedPath.Paths) == 0 {
+			observer.OnPatternDone(processedPath.Pattern, 0)
+			continue
 		}
-		err = uploadArtifactsClient.Send(&api.ArtifactEntry{Value: &chunkMsg})
-		if err != nil {
-			return allAnnotations, errors.Wrap(err, "failed to initialize artifacts upload")
+
+		if err := uploader.Begin(ctx); err != nil {
+			breaker.Failure()
+			return allAnnotations, err
 		}
 
+		var numUploaded int
+
 		for _, artifactPath := range processedPath.Paths {
-			info, err := os.Stat(artifactPath)
+			if err := breaker.Err(breakerThreshold); err != nil {
+				return allAnnotations, err
+			}
+
+			info := infos[artifactPath]
 
-			if err == nil && info.IsDir() {
-				logUploader.Write([]byte(fmt.Sprintf("\nSkipping uploading of '%s' because it's a folder", artifactPath)))
+			bundle := info != nil && info.IsDir() && bundleDirs
+			if info != nil && info.IsDir() && !bundle {
+				observer.OnFileSkipped(artifactPath, "it's a folder")
 				continue
 			}
 
-			if err == nil && info.Size() > 100*humanize.MByte {
-				humanFriendlySize := humanize.Bytes(uint64(info.Size()))
-				logUploader.Write([]byte(fmt.Sprintf("\nUploading a quite hefty artifact '%s' of size %s",
-					artifactPath, humanFriendlySize)))
+			// Annotations aren't parsed from the skipped files either
+			if info != nil && !bundle {
+				if reason := sizeLimits.skipReason(info.Size()); reason != "" {
+					observer.OnFileSkipped(artifactPath, reason)
+					continue
+				}
+			}
+
+			var size int64
+			if info != nil && !bundle {
+				size = info.Size()
 			}
+			observer.OnFileStart(artifactPath, size)
+
+			fileUploadStart := time.Now()
+
+			_, fileSpan := tracer().Start(ctx, "uploadSingleArtifactFile", trace.WithAttributes(
+				attribute.String("artifact.path", artifactPath),
+				attribute.String("artifact.pattern", processedPath.Pattern),
+				attribute.String("artifacts.format", artifactsInstruction.Format),
+			))
+			var bytesUploaded int64
+			var err error
+			for {
+				if bundle {
+					bytesUploaded, err = uploadArtifactDirectoryTar(artifactPath)
+				} else {
+					bytesUploaded, err = uploadSingleArtifactFile(artifactPath, info)
+				}
+				if err == nil || isPermanentArtifactsError(err) {
+					break
+				}
 
-			err = uploadSingleArtifactFile(artifactPath)
+				// Each of the failed attempts counts, so that the remaining files
+				// aren't tried once the backend appears to be unavailable
+				breaker.FailureIf(err)
+				if breakerErr := breaker.Err(breakerThreshold); breakerErr != nil {
+					err = breakerErr
+					break
+				}
+
+				if !retryBudget.take(artifactPath, err) {
+					break
+				}
 
+				// Only the failed file is re-tried, the ones uploaded before it are kept
+				if err = reopenUploader(); err != nil {
+					breaker.FailureIf(err)
+					break
+				}
+			}
+			fileSpan.SetAttributes(attribute.Int64("artifact.bytes", bytesUploaded))
+			recordSpanError(fileSpan, err)
+			fileSpan.End()
 			if err != nil {
 				return allAnnotations, err
 			}
+
+			observer.OnFileDone(artifactPath, bytesUploaded, time.Since(fileUploadStart))
+			numUploaded++
 		}
+
+		observer.OnPatternDone(processedPath.Pattern, numUploaded)
 	}
+
+	if err := uploader.Finish(ctx); err != nil {
+		breaker.Failure()
+		return allAnnotations, err
+	}
+
 	return allAnnotations, nil
 }
+
+// validateWorkingDir ensures that the CIRRUS_WORKING_DIR can be used
+// as a base for the relative patterns and the relative artifact paths.
+func validateWorkingDir(workingDir string) error {
+	if workingDir == "" {
+		return fmt.Errorf("%w: variable is not set", ErrArtifactsInvalidWorkingDir)
+	}
+
+	if !filepath.IsAbs(workingDir) {
+		return fmt.Errorf("%w: %q is not an absolute path", ErrArtifactsInvalidWorkingDir, workingDir)
+	}
+
+	info, err := os.Stat(workingDir)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrArtifactsInvalidWorkingDir, err)
+	}
+
+	if !info.IsDir() {
+		return fmt.Errorf("%w: %q is not a directory", ErrArtifactsInvalidWorkingDir, workingDir)
+	}
+
+	return nil
+}
+
+// canonicalArtifactPath resolves the symbolic links in the path's parent directories,
+// but not in the final element, so that the symlinked artifacts keep their names.
+func canonicalArtifactPath(path string) string {
+	dir, err := filepath.EvalSymlinks(filepath.Dir(path))
+	if err != nil {
+		return path
+	}
+
+	return filepath.Join(dir, filepath.Base(path))
+}
+
+func artifactPathIsWithinWorkingDir(workingDir string, canonicalWorkingDir string, path string) (bool, error) {
+	matched, err := pathIsWithinWorkingDir(canonicalWorkingDir, canonicalArtifactPath(path))
+	if err != nil || matched {
+		return matched, err
+	}
+
+	return pathIsWithinWorkingDir(workingDir, path)
+}
+
+// relativeArtifactPath prefers the canonicalized paths to avoid
+// something like "../../private/tmp/..." on macOS.
+func relativeArtifactPath(workingDir string, canonicalWorkingDir string, path string) (string, error) {
+	canonicalPath := canonicalArtifactPath(path)
+
+	matched, err := pathIsWithinWorkingDir(canonicalWorkingDir, canonicalPath)
+	if err != nil {
+		return "", err
+	}
+	if matched {
+		return filepath.Rel(canonicalWorkingDir, canonicalPath)
+	}
+
+	return filepath.Rel(workingDir, path)
+}
+
+// pathIsWithinWorkingDir checks whether the path is scoped to the working directory.
+//
+// Both paths are converted to the slash-separated form first, because on Windows
+// the CIRRUS_WORKING_DIR is typically slash-separated while doublestar.Glob()
+// returns backslash-separated paths.
+func pathIsWithinWorkingDir(workingDir string, path string) (bool, error) {
+	matcher := filepath.ToSlash(filepath.Join(workingDir, "**"))
+
+	return doublestar.Match(matcher, filepath.ToSlash(path))
+}
+
+// patternHasParentSegments tells whether the pattern refers to the parent directories via "..".
+// Such patterns are rejected before globbing, even though the resolved paths are checked too.
+//
+// Backslashes are treated as separators on all platforms to err on the safe side.
+func patternHasParentSegments(pattern string) bool {
+	for _, segment := range strings.FieldsFunc(pattern, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if segment == ".." {
+			return true
+		}
+	}
+
+	return false
+}
+
+func expandArtifactsPattern(path string, customEnv map[string]string, strict bool) (string, error) {
+	if strict {
+		return ExpandTextStrict(path, customEnv)
+	}
+
+	return ExpandText(path, customEnv), nil
+}
+
+// isPermanentArtifactsError returns true for errors caused by the artifacts
+// instruction itself, which won't go away when retrying the upload.
+func isPermanentArtifactsError(err error) bool {
+	return errors.Is(err, ErrArtifactsPathOutsideWorkingDir) || errors.Is(err, ErrUndefinedVariable) ||
+		errors.Is(err, ErrArtifactsInvalidOption) || errors.Is(err, ErrArtifactsInvalidWorkingDir) ||
+		errors.Is(err, ErrArtifactsBackendUnavailable)
+}
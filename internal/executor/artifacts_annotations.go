@@ -0,0 +1,90 @@
+package executor
+
+import (
+	"fmt"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/executor/annotationparsers"
+	"github.com/cirruslabs/cirrus-ci-annotations/model"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var windowsDrivePrefix = regexp.MustCompile(`^[A-Za-z]:/`)
+
+// parseAnnotationParserOptions returns the options for the annotation parsers, configured via
+// the CIRRUS_LCOV_COVERAGE_THRESHOLD (a percentage, e.g. "80") and CIRRUS_ANNOTATIONS_REGEX
+// (a pattern with the file, line, message and optionally col and severity named capture groups)
+// behavioral environment variables.
+func parseAnnotationParserOptions(format string, customEnv map[string]string) (annotationparsers.Options, error) {
+	options := annotationparsers.DefaultOptions
+
+	if value := customEnv["CIRRUS_LCOV_COVERAGE_THRESHOLD"]; value != "" {
+		threshold, err := strconv.ParseFloat(value, 64)
+		if err != nil || threshold < 0 || threshold > 100 {
+			return options, fmt.Errorf("%w: CIRRUS_LCOV_COVERAGE_THRESHOLD should be a percentage "+
+				"between 0 and 100, got %q", ErrArtifactsInvalidOption, value)
+		}
+		options.LCOVThreshold = threshold
+	}
+
+	if value := customEnv["CIRRUS_ANNOTATIONS_REGEX"]; value != "" {
+		pattern, err := annotationparsers.CompileRegex(value)
+		if err != nil {
+			return options, fmt.Errorf("%w: CIRRUS_ANNOTATIONS_REGEX: %v", ErrArtifactsInvalidOption, err)
+		}
+		options.Regex = pattern
+	} else if strings.EqualFold(format, "regex") {
+		return options, fmt.Errorf("%w: the regex format requires the CIRRUS_ANNOTATIONS_REGEX pattern",
+			ErrArtifactsInvalidOption)
+	}
+
+	return options, nil
+}
+
+// normalizeWindowsAnnotationPaths rewrites the Windows-style paths (e.g. C:\repo\src\foo.go) found in the reports
+// generated on Windows to the slash-separated ones relative to the working directory where possible, so that
+// NormalizeAnnotations() can make sense of them regardless of the agent's OS.
+//
+// When the absolute path is not within the working directory (e.g. the report was generated on another machine),
+// the longest suffix of it that exists in the working directory is used instead.
+func normalizeWindowsAnnotationPaths(workingDir string, annotations []model.Annotation) []model.Annotation {
+	slashedWorkingDir := strings.TrimSuffix(strings.ReplaceAll(workingDir, `\`, "/"), "/")
+
+	for i, annotation := range annotations {
+		if !strings.Contains(annotation.Path, `\`) && !windowsDrivePrefix.MatchString(annotation.Path) {
+			continue
+		}
+
+		path := strings.ReplaceAll(annotation.Path, `\`, "/")
+
+		if windowsDrivePrefix.MatchString(path) {
+			if strings.HasPrefix(strings.ToLower(path), strings.ToLower(slashedWorkingDir)+"/") {
+				path = path[len(slashedWorkingDir)+1:]
+			} else {
+				path = existingPathSuffix(workingDir, path[len("C:/"):])
+			}
+		}
+
+		annotations[i].Path = path
+	}
+
+	return annotations
+}
+
+// existingPathSuffix returns the longest suffix of the slash-separated path
+// that exists in the working directory, or the path itself when there's none.
+func existingPathSuffix(workingDir string, path string) string {
+	components := strings.Split(path, "/")
+
+	for i := range components {
+		suffix := strings.Join(components[i:], "/")
+
+		if _, err := os.Stat(filepath.Join(workingDir, filepath.FromSlash(suffix))); err == nil {
+			return suffix
+		}
+	}
+
+	return path
+}
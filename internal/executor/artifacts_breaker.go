@@ -0,0 +1,130 @@
+package executor
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+const defaultArtifactsCircuitBreakerThreshold = 5
+
+// uploadCircuitBreaker counts the failures to talk to the backend during a single artifacts instruction
+// (including the failed attempts to upload the individual files and the retries of the whole upload),
+// so that once the backend appears to be unavailable, the remaining files fail fast instead of each
+// of them going through the retries. The files sent in between don't reset it, since they're only
+// acknowledged once the whole upload succeeds.
+//
+// Each instruction starts with a new one, so a bad stretch of the backend
+// doesn't fail the later instructions once it has recovered.
+type uploadCircuitBreaker struct {
+	failures int
+}
+
+func newUploadCircuitBreaker() *uploadCircuitBreaker {
+	return &uploadCircuitBreaker{}
+}
+
+func (breaker *uploadCircuitBreaker) Failure() {
+	breaker.failures++
+}
+
+// FailureIf counts the err as a failure unless it's a local one, e.g. the file
+// couldn't be read, which says nothing about the backend.
+func (breaker *uploadCircuitBreaker) FailureIf(err error) {
+	var uploaderErr *artifactsUploaderError
+	if errors.As(err, &uploaderErr) {
+		breaker.Failure()
+	}
+}
+
+// Err returns ErrArtifactsBackendUnavailable once the threshold of failures
+// is reached, zero or negative threshold disables the circuit breaker.
+func (breaker *uploadCircuitBreaker) Err(threshold int) error {
+	if threshold <= 0 || breaker.failures < threshold {
+		return nil
+	}
+
+	return fmt.Errorf("%w: %d attempts to upload have failed, not trying the remaining ones",
+		ErrArtifactsBackendUnavailable, breaker.failures)
+}
+
+// artifactsUploaderError is the error returned by the Uploader, as opposed to the errors
+// of reading the artifacts, which uploadCircuitBreaker.FailureIf doesn't count.
+type artifactsUploaderError struct {
+	err error
+}
+
+func (err *artifactsUploaderError) Error() string {
+	return err.err.Error()
+}
+
+func (err *artifactsUploaderError) Unwrap() error {
+	return err.err
+}
+
+// parseArtifactsCircuitBreakerThreshold parses the CIRRUS_ARTIFACTS_CIRCUIT_BREAKER_THRESHOLD behavioral
+// environment variable, which is the number of upload failures during an instruction after which the remaining
+// uploads are aborted ("0" disables the circuit breaker).
+func parseArtifactsCircuitBreakerThreshold(customEnv map[string]string) (int, error) {
+	value, ok := customEnv["CIRRUS_ARTIFACTS_CIRCUIT_BREAKER_THRESHOLD"]
+	if !ok || value == "" {
+		return defaultArtifactsCircuitBreakerThreshold, nil
+	}
+
+	threshold, err := strconv.Atoi(value)
+	if err != nil || threshold < 0 {
+		return 0, fmt.Errorf("%w: CIRRUS_ARTIFACTS_CIRCUIT_BREAKER_THRESHOLD should be a non-negative number, got %q",
+			ErrArtifactsInvalidOption, value)
+	}
+
+	return threshold, nil
+}
+
+// By default, a single file or the whole upload is re-tried once
+const defaultArtifactsRetryBudget = 1
+
+// artifactsRetryBudget is the number of retries shared by all files of the artifacts instruction,
+// which are used up both by re-trying the individual files and by re-trying the whole upload
+// (e.g. when the server fails to persist the artifacts in the end).
+type artifactsRetryBudget struct {
+	total int
+	used  int
+
+	// Called for each of the retries taken, with what is re-tried and why
+	onRetry func(what string, err error)
+}
+
+// take uses up one of the retries, returns false once there's none left.
+func (budget *artifactsRetryBudget) take(what string, err error) bool {
+	if budget.used >= budget.total {
+		return false
+	}
+	budget.used++
+
+	if budget.onRetry != nil {
+		budget.onRetry(what, err)
+	}
+
+	return true
+}
+
+func (budget *artifactsRetryBudget) exhausted() bool {
+	return budget.total != 0 && budget.used == budget.total
+}
+
+// parseArtifactsRetryBudget parses the CIRRUS_ARTIFACTS_RETRY_BUDGET behavioral environment variable,
+// which is the total number of retries shared by all files of the artifacts instruction.
+func parseArtifactsRetryBudget(customEnv map[string]string) (int, error) {
+	value, ok := customEnv["CIRRUS_ARTIFACTS_RETRY_BUDGET"]
+	if !ok || value == "" {
+		return defaultArtifactsRetryBudget, nil
+	}
+
+	budget, err := strconv.Atoi(value)
+	if err != nil || budget < 0 {
+		return 0, fmt.Errorf("%w: CIRRUS_ARTIFACTS_RETRY_BUDGET should be a non-negative number, got %q",
+			ErrArtifactsInvalidOption, value)
+	}
+
+	return budget, nil
+}
@@ -0,0 +1,103 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"github.com/cirruslabs/cirrus-ci-agent/api"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/encoding/gzip"
+	"io"
+	"io/ioutil"
+	mathrand "math/rand"
+	"path/filepath"
+	"testing"
+)
+
+func TestUploadArtifactsGzip(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	workingDir := testutil.TempDir(t)
+	writeTestFile(t, filepath.Join(workingDir, "build.log"), "lots of text")
+
+	executor := newTestArtifactsExecutor()
+	logUploader := newTestLogUploader(t, executor)
+
+	success := executor.UploadArtifacts(context.Background(), logUploader, "logs",
+		&api.ArtifactsInstruction{Paths: []string{"build.log"}},
+		map[string]string{"CIRRUS_WORKING_DIR": workingDir, "CIRRUS_ARTIFACTS_GRPC_GZIP": "true"})
+	logUploader.Finalize()
+	require.True(t, success)
+
+	assert.Equal(t, 1, fake.compressedUploads)
+	assert.Equal(t, map[string]string{"build.log": "lots of text"}, fake.UploadedFiles())
+}
+
+func TestUploadArtifactsGzipRejected(t *testing.T) {
+	fake := &fakeCirrusClient{rejectCompressedUploads: true}
+	withFakeClient(t, fake)
+
+	workingDir := testutil.TempDir(t)
+	writeTestFile(t, filepath.Join(workingDir, "build.log"), "lots of text")
+	env := map[string]string{
+		"CIRRUS_WORKING_DIR":            workingDir,
+		"CIRRUS_ARTIFACTS_GRPC_GZIP":    "true",
+		"CIRRUS_ARTIFACTS_RETRY_BUDGET": "0",
+	}
+
+	executor := newTestArtifactsExecutor()
+	logUploader := newTestLogUploader(t, executor)
+
+	for i := 0; i < 2; i++ {
+		success := executor.UploadArtifacts(context.Background(), logUploader, "logs",
+			&api.ArtifactsInstruction{Paths: []string{"build.log"}}, env)
+		require.True(t, success)
+	}
+	logUploader.Finalize()
+
+	// The fallback doesn't use up the retries, and the compression isn't attempted again
+	assert.Equal(t, 1, fake.compressedUploads)
+	assert.Contains(t, fake.Logs(), "Server doesn't support compressed artifact uploads")
+}
+
+func benchmarkGzipCompressor(b *testing.B, chunk []byte) {
+	compressor := encoding.GetCompressor(gzip.Name)
+
+	b.SetBytes(int64(len(chunk)))
+
+	var compressedSize int
+	for i := 0; i < b.N; i++ {
+		var buffer bytes.Buffer
+		writer, err := compressor.Compress(&buffer)
+		require.NoError(b, err)
+		_, err = writer.Write(chunk)
+		require.NoError(b, err)
+		require.NoError(b, writer.Close())
+		compressedSize = buffer.Len()
+	}
+
+	b.ReportMetric(float64(len(chunk))/float64(compressedSize), "ratio")
+}
+
+func BenchmarkGzipCompressorText(b *testing.B) {
+	// Test report lines that differ in the names, timings and hashes, like the real ones do
+	random := mathrand.New(mathrand.NewSource(42))
+	var chunk bytes.Buffer
+	for chunk.Len() < 1024*1024 {
+		fmt.Fprintf(&chunk, "<testcase name=\"test%s%d\" classname=\"org.example.module%d.Suite%d\" time=\"%.3f\">"+
+			"<system-out>commit %x</system-out></testcase>\n", []string{"Upload", "Download", "Parse", "Retry"}[random.Intn(4)],
+			random.Intn(1000), random.Intn(50), random.Intn(200), random.Float64()*10, random.Uint64())
+	}
+	benchmarkGzipCompressor(b, chunk.Bytes())
+}
+
+func BenchmarkGzipCompressorRandom(b *testing.B) {
+	chunk, err := ioutil.ReadAll(io.LimitReader(rand.Reader, 1024*1024))
+	require.NoError(b, err)
+	benchmarkGzipCompressor(b, chunk)
+}
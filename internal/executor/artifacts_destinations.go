@@ -0,0 +1,162 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"github.com/cirruslabs/cirrus-ci-agent/api"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// The artifacts destination that stands for the Cirrus CI storage
+const artifactsDestinationCirrus = "cirrus"
+
+// artifactsDestinations returns the destinations the artifacts are uploaded to, configured
+// via the CIRRUS_ARTIFACTS_DESTINATIONS_<COMMAND> or CIRRUS_ARTIFACTS_DESTINATIONS as a comma
+// or newline-separated list of "cirrus", local folders and "http(s)://" URLs.
+func artifactsDestinations(customEnv map[string]string, name string) []string {
+	if destinations := cacheListOption(customEnv, "CIRRUS_ARTIFACTS_DESTINATIONS", name); len(destinations) != 0 {
+		return destinations
+	}
+
+	if destinations := splitListOption(customEnv["CIRRUS_ARTIFACTS_DESTINATIONS"], customEnv); len(destinations) != 0 {
+		return destinations
+	}
+
+	return []string{artifactsDestinationCirrus}
+}
+
+// parseArtifactsFanoutPolicy parses the CIRRUS_ARTIFACTS_FANOUT_POLICY behavioral environment variable.
+func parseArtifactsFanoutPolicy(customEnv map[string]string) (FanoutPolicy, error) {
+	switch policy := FanoutPolicy(customEnv["CIRRUS_ARTIFACTS_FANOUT_POLICY"]); policy {
+	case "", FanoutAllMustSucceed:
+		return FanoutAllMustSucceed, nil
+	case FanoutBestEffort:
+		return FanoutBestEffort, nil
+	default:
+		return "", fmt.Errorf("%w: CIRRUS_ARTIFACTS_FANOUT_POLICY should be either %q or %q, got %q",
+			ErrArtifactsInvalidOption, FanoutAllMustSucceed, FanoutBestEffort, policy)
+	}
+}
+
+// newArtifactsDestinationUploader creates the Uploader for a single destination.
+func (executor *Executor) newArtifactsDestinationUploader(
+	ctx context.Context,
+	destination string,
+	name string,
+	artifactsInstruction *api.ArtifactsInstruction,
+	customEnv map[string]string,
+) (Uploader, error) {
+	if destination == artifactsDestinationCirrus {
+		return executor.newGRPCArtifactsUploader(ctx, name, artifactsInstruction, customEnv)
+	}
+
+	if strings.HasPrefix(destination, "http://") || strings.HasPrefix(destination, "https://") {
+		baseURL, err := url.Parse(destination)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid artifacts destination %q: %v", ErrArtifactsInvalidOption, destination, err)
+		}
+
+		return &httpArtifactsUploader{baseURL: baseURL, name: name}, nil
+	}
+
+	dir := strings.TrimPrefix(destination, "file://")
+	if !filepath.IsAbs(dir) {
+		return nil, fmt.Errorf("%w: artifacts destination %q should be either %q, an absolute path or an URL",
+			ErrArtifactsInvalidOption, destination, artifactsDestinationCirrus)
+	}
+
+	return &dirArtifactsUploader{dir: filepath.Join(dir, name)}, nil
+}
+
+// dirArtifactsUploader copies the artifacts to the "<name>" sub-folder of a local folder,
+// which is typically a mount of some network storage.
+type dirArtifactsUploader struct {
+	dir string
+}
+
+func (uploader *dirArtifactsUploader) Begin(ctx context.Context) error {
+	return nil
+}
+
+func (uploader *dirArtifactsUploader) UploadFile(ctx context.Context, relPath string, r io.Reader, meta FileMeta) error {
+	path := filepath.Join(uploader.dir, filepath.FromSlash(relPath))
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(file, r); err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to copy artifact file %s to %s: %w", relPath, uploader.dir, err)
+	}
+
+	return file.Close()
+}
+
+func (uploader *dirArtifactsUploader) Finish(ctx context.Context) error {
+	return nil
+}
+
+func (uploader *dirArtifactsUploader) Close() error {
+	return nil
+}
+
+// httpArtifactsUploader uploads each artifact with a PUT request to "<base URL>/<name>/<relPath>",
+// which works with the object storages supporting plain HTTP uploads.
+type httpArtifactsUploader struct {
+	baseURL *url.URL
+	name    string
+}
+
+func (uploader *httpArtifactsUploader) Begin(ctx context.Context) error {
+	return nil
+}
+
+func (uploader *httpArtifactsUploader) UploadFile(ctx context.Context, relPath string, r io.Reader, meta FileMeta) error {
+	fileURL := *uploader.baseURL
+	fileURL.Path = path.Join("/", fileURL.Path, uploader.name, relPath)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, fileURL.String(), r)
+	if err != nil {
+		return err
+	}
+	if meta.Size >= 0 {
+		req.ContentLength = meta.Size
+	}
+	if meta.Type != "" {
+		req.Header.Set("Content-Type", meta.Type)
+	}
+
+	// Unlike the cache requests, the artifact uploads aren't limited in time
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to upload artifact file %s to %s: %w", relPath, uploader.baseURL.Redacted(), err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("failed to upload artifact file %s to %s: %s",
+			relPath, uploader.baseURL.Redacted(), resp.Status)
+	}
+
+	return nil
+}
+
+func (uploader *httpArtifactsUploader) Finish(ctx context.Context) error {
+	return nil
+}
+
+func (uploader *httpArtifactsUploader) Close() error {
+	return nil
+}
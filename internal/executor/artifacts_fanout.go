@@ -0,0 +1,220 @@
+package executor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// FanoutPolicy decides what happens when one of the MultiUploader destinations fails.
+type FanoutPolicy string
+
+const (
+	// The upload fails as soon as any of the destinations fails
+	FanoutAllMustSucceed FanoutPolicy = "all"
+
+	// The failed destinations are dropped for the rest of the upload,
+	// which only fails when none of the destinations are left
+	FanoutBestEffort FanoutPolicy = "best-effort"
+)
+
+var errFanoutDestinationDone = errors.New("destination has stopped reading")
+
+// FanoutDestination is the Uploader of a single MultiUploader destination.
+type FanoutDestination struct {
+	// Used in the warnings about the dropped destinations
+	Name     string
+	Uploader Uploader
+
+	err error
+}
+
+// MultiUploader fans each file out to several Uploaders, reading it only once and teeing
+// the contents to all of them. The destinations read at their own pace, so the upload
+// is only as fast as the slowest of them.
+type MultiUploader struct {
+	policy       FanoutPolicy
+	destinations []*FanoutDestination
+
+	// Called when the destination is dropped due to the FanoutBestEffort policy
+	onDrop func(destination string, err error)
+}
+
+func NewMultiUploader(
+	policy FanoutPolicy,
+	destinations []*FanoutDestination,
+	onDrop func(destination string, err error),
+) *MultiUploader {
+	return &MultiUploader{
+		policy:       policy,
+		destinations: destinations,
+		onDrop:       onDrop,
+	}
+}
+
+// live returns the destinations that weren't dropped yet.
+func (multi *MultiUploader) live() []*FanoutDestination {
+	var result []*FanoutDestination
+
+	for _, destination := range multi.destinations {
+		if destination.err == nil {
+			result = append(result, destination)
+		}
+	}
+
+	return result
+}
+
+// fail handles the destination error according to the policy, returning
+// the error to fail the whole upload with or nil to carry on without it.
+func (multi *MultiUploader) fail(destination *FanoutDestination, err error) error {
+	if multi.policy != FanoutBestEffort {
+		return err
+	}
+
+	destination.err = err
+	if multi.onDrop != nil {
+		multi.onDrop(destination.Name, err)
+	}
+
+	if len(multi.live()) == 0 {
+		return fmt.Errorf("all artifacts destinations have failed, the last one with: %w", err)
+	}
+
+	return nil
+}
+
+// each calls the function for each of the live destinations sequentially.
+func (multi *MultiUploader) each(f func(uploader Uploader) error) error {
+	for _, destination := range multi.live() {
+		if err := f(destination.Uploader); err != nil {
+			if err := multi.fail(destination, err); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (multi *MultiUploader) Begin(ctx context.Context) error {
+	return multi.each(func(uploader Uploader) error {
+		return uploader.Begin(ctx)
+	})
+}
+
+func (multi *MultiUploader) UploadFile(ctx context.Context, relPath string, r io.Reader, meta FileMeta) error {
+	destinations := multi.live()
+
+	writers := make([]*io.PipeWriter, len(destinations))
+	errs := make([]error, len(destinations))
+
+	var wg sync.WaitGroup
+
+	for i, destination := range destinations {
+		pipeReader, pipeWriter := io.Pipe()
+		writers[i] = pipeWriter
+
+		wg.Add(1)
+		go func(i int, uploader Uploader) {
+			defer wg.Done()
+
+			errs[i] = uploader.UploadFile(ctx, relPath, pipeReader, meta)
+
+			// Unblock the writes in case the uploader hasn't consumed the whole reader
+			_ = pipeReader.CloseWithError(errFanoutDestinationDone)
+		}(i, destination.Uploader)
+	}
+
+	readErr := teeToPipes(r, writers)
+
+	for _, writer := range writers {
+		if writer != nil {
+			_ = writer.CloseWithError(readErr)
+		}
+	}
+	wg.Wait()
+
+	if readErr != nil {
+		return fmt.Errorf("failed to read artifact file %s: %w", relPath, readErr)
+	}
+
+	for i, err := range errs {
+		if err != nil {
+			if err := multi.fail(destinations[i], err); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// teeToPipes copies the reader contents to all the pipes, setting the pipes
+// whose readers have stopped reading to nil and giving up once none are left.
+func teeToPipes(r io.Reader, writers []*io.PipeWriter) error {
+	buffer := make([]byte, 32*1024)
+
+	var emptyReads int
+
+	for {
+		n, err := r.Read(buffer)
+
+		if n == 0 && err == nil {
+			emptyReads++
+			if emptyReads >= maxConsecutiveEmptyReads {
+				return io.ErrNoProgress
+			}
+			continue
+		}
+		emptyReads = 0
+
+		if n > 0 {
+			var numLive int
+
+			for i, writer := range writers {
+				if writer == nil {
+					continue
+				}
+				if _, err := writer.Write(buffer[:n]); err != nil {
+					// The error is reported by the destination's UploadFile()
+					writers[i] = nil
+					continue
+				}
+				numLive++
+			}
+
+			if numLive == 0 {
+				return nil
+			}
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (multi *MultiUploader) Finish(ctx context.Context) error {
+	return multi.each(func(uploader Uploader) error {
+		return uploader.Finish(ctx)
+	})
+}
+
+// Close closes all destinations, including the dropped ones, returning the first error.
+func (multi *MultiUploader) Close() error {
+	var result error
+
+	for _, destination := range multi.destinations {
+		if err := destination.Uploader.Close(); err != nil && result == nil {
+			result = err
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,158 @@
+package executor
+
+import (
+	"context"
+	"errors"
+	"github.com/cirruslabs/cirrus-ci-agent/api"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordingUploader keeps the uploaded files in memory, failing the uploads when failWith is set.
+type recordingUploader struct {
+	failWith error
+	files    map[string]string
+	finished bool
+}
+
+func (uploader *recordingUploader) Begin(ctx context.Context) error {
+	return nil
+}
+
+func (uploader *recordingUploader) UploadFile(ctx context.Context, relPath string, r io.Reader, meta FileMeta) error {
+	if uploader.failWith != nil {
+		return uploader.failWith
+	}
+
+	contents, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	if uploader.files == nil {
+		uploader.files = map[string]string{}
+	}
+	uploader.files[relPath] = string(contents)
+
+	return nil
+}
+
+func (uploader *recordingUploader) Finish(ctx context.Context) error {
+	uploader.finished = true
+	return nil
+}
+
+func (uploader *recordingUploader) Close() error {
+	return nil
+}
+
+func uploadToMultiUploader(multi *MultiUploader) error {
+	if err := multi.Begin(context.Background()); err != nil {
+		return err
+	}
+
+	contents := strings.Repeat("large artifact ", 10_000)
+	if err := multi.UploadFile(context.Background(), "build.log", strings.NewReader(contents),
+		FileMeta{Size: int64(len(contents))}); err != nil {
+		return err
+	}
+
+	return multi.Finish(context.Background())
+}
+
+func TestMultiUploaderAllMustSucceed(t *testing.T) {
+	healthy := &recordingUploader{}
+	failing := &recordingUploader{failWith: errors.New("bucket is gone")}
+
+	multi := NewMultiUploader(FanoutAllMustSucceed, []*FanoutDestination{
+		{Name: "healthy", Uploader: healthy},
+		{Name: "failing", Uploader: failing},
+	}, nil)
+
+	assert.EqualError(t, uploadToMultiUploader(multi), "bucket is gone")
+	assert.False(t, healthy.finished)
+}
+
+func TestMultiUploaderBestEffort(t *testing.T) {
+	healthy := &recordingUploader{}
+	failing := &recordingUploader{failWith: errors.New("bucket is gone")}
+
+	var dropped []string
+	multi := NewMultiUploader(FanoutBestEffort, []*FanoutDestination{
+		{Name: "failing", Uploader: failing},
+		{Name: "healthy", Uploader: healthy},
+	}, func(destination string, err error) {
+		dropped = append(dropped, destination)
+	})
+
+	require.NoError(t, uploadToMultiUploader(multi))
+	assert.Equal(t, []string{"failing"}, dropped)
+	assert.Equal(t, strings.Repeat("large artifact ", 10_000), healthy.files["build.log"])
+	assert.True(t, healthy.finished)
+
+	// The upload fails once there are no destinations left
+	healthy.failWith = errors.New("disk is full")
+	assert.ErrorIs(t, uploadToMultiUploader(multi), healthy.failWith)
+}
+
+func TestUploadArtifactsFanout(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	var mutex sync.Mutex
+	putFiles := map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contents, _ := ioutil.ReadAll(r.Body)
+		mutex.Lock()
+		putFiles[r.Method+" "+r.URL.Path] = string(contents)
+		mutex.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	workingDir := testutil.TempDir(t)
+	writeTestFile(t, filepath.Join(workingDir, "reports", "junit.xml"), "<testsuite/>")
+	mirrorDir := testutil.TempDir(t)
+
+	_, err := newTestArtifactsExecutor().uploadArtifactsAndParseAnnotations(context.Background(), "reports",
+		&api.ArtifactsInstruction{Paths: []string{"reports/*.xml"}},
+		map[string]string{
+			"CIRRUS_WORKING_DIR":                    workingDir,
+			"CIRRUS_ARTIFACTS_DESTINATIONS_REPORTS": "cirrus, " + mirrorDir + "\n" + server.URL + "/bucket",
+		}, multiUploadObserver{})
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]string{"reports/junit.xml": "<testsuite/>"}, fake.UploadedFiles())
+	assert.Equal(t, map[string]string{"PUT /bucket/reports/reports/junit.xml": "<testsuite/>"}, putFiles)
+
+	contents, err := ioutil.ReadFile(filepath.Join(mirrorDir, "reports", "reports", "junit.xml"))
+	require.NoError(t, err)
+	assert.Equal(t, "<testsuite/>", string(contents))
+}
+
+func TestUploadArtifactsInvalidDestination(t *testing.T) {
+	withFakeClient(t, &fakeCirrusClient{})
+
+	workingDir := testutil.TempDir(t)
+	writeTestFile(t, filepath.Join(workingDir, "build.log"), "log")
+
+	for _, env := range []map[string]string{
+		{"CIRRUS_ARTIFACTS_DESTINATIONS": "cirrus,relative/folder"},
+		{"CIRRUS_ARTIFACTS_DESTINATIONS": "cirrus," + workingDir, "CIRRUS_ARTIFACTS_FANOUT_POLICY": "most"},
+	} {
+		env["CIRRUS_WORKING_DIR"] = workingDir
+
+		_, err := newTestArtifactsExecutor().uploadArtifactsAndParseAnnotations(context.Background(), "artifacts",
+			&api.ArtifactsInstruction{Paths: []string{"build.log"}}, env, multiUploadObserver{})
+		assert.ErrorIs(t, err, ErrArtifactsInvalidOption)
+	}
+}
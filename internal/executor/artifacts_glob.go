@@ -0,0 +1,74 @@
+package executor
+
+import (
+	"context"
+	"github.com/bmatcuk/doublestar"
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+	"runtime"
+)
+
+// globArtifactsPatterns evaluates the glob patterns concurrently, since each of them might walk
+// a big tree, returning the matches of each pattern in the same order as the patterns. Once any
+// of the patterns fails, the ones that haven't been started yet are skipped.
+//
+// The repeated patterns are only evaluated once, with their duplicates getting a copy of the result.
+func globArtifactsPatterns(ctx context.Context, patterns []string) ([][]string, error) {
+	results := make([][]string, len(patterns))
+
+	// Index of the first occurrence of each pattern
+	firstOccurrences := map[string]int{}
+
+	group, groupCtx := errgroup.WithContext(ctx)
+	sem := semaphore.NewWeighted(int64(runtime.NumCPU()))
+
+	var canceledErr error
+
+	for i, pattern := range patterns {
+		if _, ok := firstOccurrences[pattern]; ok {
+			continue
+		}
+		firstOccurrences[pattern] = i
+
+		// Acquire() succeeds regardless of the context as long as the pool isn't full
+		if canceledErr = groupCtx.Err(); canceledErr != nil {
+			break
+		}
+		if canceledErr = sem.Acquire(groupCtx, 1); canceledErr != nil {
+			break
+		}
+
+		i, pattern := i, pattern
+
+		group.Go(func() error {
+			defer sem.Release(1)
+
+			paths, err := doublestar.Glob(pattern)
+			if err != nil {
+				return errors.Wrap(err, "Failed to list artifacts")
+			}
+			results[i] = paths
+
+			return nil
+		})
+	}
+
+	if err := group.Wait(); err != nil {
+		return nil, err
+	}
+
+	// The context was canceled by the caller rather than by a failed pattern
+	if canceledErr != nil {
+		return nil, canceledErr
+	}
+
+	// The results are filtered and sorted in-place later on
+	for i, pattern := range patterns {
+		if first := firstOccurrences[pattern]; first != i && results[first] != nil {
+			results[i] = append([]string{}, results[first]...)
+		}
+	}
+
+	return results, nil
+}
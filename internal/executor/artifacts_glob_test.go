@@ -0,0 +1,59 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"testing"
+)
+
+func TestGlobArtifactsPatternsPreservesOrder(t *testing.T) {
+	dir := testutil.TempDir(t)
+
+	var patterns []string
+	var expected [][]string
+
+	for i := 0; i < 50; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("dir%d", i), "file.txt")
+		writeTestFile(t, path, "contents")
+
+		patterns = append(patterns, filepath.Join(dir, fmt.Sprintf("dir%d", i), "*.txt"))
+		expected = append(expected, []string{path})
+	}
+
+	// Repeated patterns get a copy of the first result
+	patterns = append(patterns, patterns[0])
+	expected = append(expected, expected[0])
+
+	// Patterns matching nothing keep their place too
+	patterns = append(patterns, filepath.Join(dir, "*.missing"))
+	expected = append(expected, nil)
+
+	results, err := globArtifactsPatterns(context.Background(), patterns)
+	require.NoError(t, err)
+	assert.Equal(t, expected, results)
+
+	results[0][0] = "modified"
+	assert.Equal(t, expected[0], results[50])
+}
+
+func TestGlobArtifactsPatternsFails(t *testing.T) {
+	dir := testutil.TempDir(t)
+	writeTestFile(t, filepath.Join(dir, "file.txt"), "contents")
+
+	_, err := globArtifactsPatterns(context.Background(), []string{
+		filepath.Join(dir, "*.txt"),
+		filepath.Join(dir, "[unterminated"),
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Failed to list artifacts")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = globArtifactsPatterns(ctx, []string{filepath.Join(dir, "*.txt")})
+	require.ErrorIs(t, err, context.Canceled)
+}
@@ -0,0 +1,154 @@
+package executor
+
+import (
+	"fmt"
+	"github.com/cirruslabs/cirrus-ci-agent/api"
+	"github.com/dustin/go-humanize"
+	"sync"
+	"time"
+)
+
+const defaultArtifactsKeepaliveInterval = 30 * time.Second
+
+// artifactsKeepaliveDisabled is the threshold returned by parseArtifactsKeepalive when
+// the keepalives weren't requested
+const artifactsKeepaliveDisabled = -1
+
+// parseArtifactsKeepalive parses the CIRRUS_ARTIFACTS_KEEPALIVE_THRESHOLD (the artifact size starting
+// from which the keepalives are sent) and CIRRUS_ARTIFACTS_KEEPALIVE_INTERVAL behavioral environment variables.
+//
+// The keepalives are opt-in, since they aren't a part of the upload protocol that every server
+// is known to accept. By default, the connection is only kept alive by the HTTP/2 pings.
+func parseArtifactsKeepalive(customEnv map[string]string) (int64, time.Duration, error) {
+	threshold := int64(artifactsKeepaliveDisabled)
+	if value := customEnv["CIRRUS_ARTIFACTS_KEEPALIVE_THRESHOLD"]; value != "" {
+		parsedThreshold, err := humanize.ParseBytes(value)
+		if err != nil {
+			return 0, 0, fmt.Errorf("%w: failed to parse CIRRUS_ARTIFACTS_KEEPALIVE_THRESHOLD: %v",
+				ErrArtifactsInvalidOption, err)
+		}
+		threshold = int64(parsedThreshold)
+	}
+
+	interval := defaultArtifactsKeepaliveInterval
+	if value := customEnv["CIRRUS_ARTIFACTS_KEEPALIVE_INTERVAL"]; value != "" {
+		var err error
+		interval, err = time.ParseDuration(value)
+		if err != nil || interval <= 0 {
+			return 0, 0, fmt.Errorf("%w: CIRRUS_ARTIFACTS_KEEPALIVE_INTERVAL should be a positive duration, got %q",
+				ErrArtifactsInvalidOption, value)
+		}
+	}
+
+	return threshold, interval, nil
+}
+
+// newArtifactsKeepaliveEntry returns the keepalive message. The real chunks always carry the artifact
+// path, so the chunk with neither the path nor the data can't be mistaken for the contents of a file.
+func newArtifactsKeepaliveEntry() *api.ArtifactEntry {
+	return &api.ArtifactEntry{Value: &api.ArtifactEntry_Chunk{Chunk: &api.ArtifactEntry_ArtifactChunk{}}}
+}
+
+func isArtifactsKeepaliveEntry(entry *api.ArtifactEntry) bool {
+	chunk := entry.GetChunk()
+
+	return chunk != nil && chunk.ArtifactPath == "" && len(chunk.Data) == 0
+}
+
+// uploadKeepalive keeps the upload stream from being considered idle by the server when the chunks
+// of a huge artifact are sent infrequently (e.g. on a slow link), by sending the lightweight
+// keepalive messages whenever nothing was sent for the whole interval.
+//
+// All sends to the stream should go through Do(), since the stream doesn't support concurrent sends.
+type uploadKeepalive struct {
+	// Taken for the duration of each send. The keepalive is skipped rather than waited for
+	// when it's taken, since the stream that's busy sending isn't idle anyway.
+	sending chan struct{}
+
+	mutex    sync.Mutex
+	lastSend time.Time
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func startUploadKeepalive(interval time.Duration, sendKeepalive func() error) *uploadKeepalive {
+	keepalive := &uploadKeepalive{
+		sending:  make(chan struct{}, 1),
+		lastSend: time.Now(),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	go func() {
+		defer close(keepalive.done)
+
+		ticker := time.NewTicker(interval / 4)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-keepalive.stop:
+				return
+			}
+
+			if keepalive.sinceLastSend() < interval {
+				continue
+			}
+
+			select {
+			case keepalive.sending <- struct{}{}:
+			default:
+				continue
+			}
+
+			// A broken stream will be noticed by the next regular send anyway
+			_ = sendKeepalive()
+			keepalive.markSent()
+			<-keepalive.sending
+		}
+	}()
+
+	return keepalive
+}
+
+func (keepalive *uploadKeepalive) sinceLastSend() time.Duration {
+	keepalive.mutex.Lock()
+	defer keepalive.mutex.Unlock()
+
+	return time.Since(keepalive.lastSend)
+}
+
+func (keepalive *uploadKeepalive) markSent() {
+	keepalive.mutex.Lock()
+	defer keepalive.mutex.Unlock()
+
+	keepalive.lastSend = time.Now()
+}
+
+// Do performs the send, serializing it with the keepalives. Nil keepalive simply performs the send.
+func (keepalive *uploadKeepalive) Do(send func() error) error {
+	if keepalive == nil {
+		return send()
+	}
+
+	keepalive.sending <- struct{}{}
+	defer func() {
+		<-keepalive.sending
+	}()
+
+	err := send()
+	keepalive.markSent()
+
+	return err
+}
+
+func (keepalive *uploadKeepalive) Stop() {
+	if keepalive == nil {
+		return
+	}
+
+	close(keepalive.stop)
+	<-keepalive.done
+}
@@ -0,0 +1,167 @@
+package executor
+
+import (
+	"context"
+	"github.com/cirruslabs/cirrus-ci-agent/api"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// idleTimeoutServer mimics the server that considers the stream
+// idle when there are no messages for too long.
+type idleTimeoutServer struct {
+	mutex       sync.Mutex
+	lastMessage time.Time
+	maxGap      time.Duration
+	keepalives  int
+}
+
+func (server *idleTimeoutServer) receive(keepalive bool) error {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	if gap := time.Since(server.lastMessage); gap > server.maxGap {
+		server.maxGap = gap
+	}
+	server.lastMessage = time.Now()
+	if keepalive {
+		server.keepalives++
+	}
+
+	return nil
+}
+
+func TestUploadKeepaliveDuringSlowSends(t *testing.T) {
+	const idleTimeout = 150 * time.Millisecond
+
+	server := &idleTimeoutServer{lastMessage: time.Now()}
+
+	keepalive := startUploadKeepalive(20*time.Millisecond, func() error {
+		return server.receive(true)
+	})
+
+	// Chunks come way less often than the server's idle timeout
+	for i := 0; i < 3; i++ {
+		time.Sleep(2 * idleTimeout)
+		require.NoError(t, keepalive.Do(func() error {
+			return server.receive(false)
+		}))
+	}
+
+	keepalive.Stop()
+
+	assert.Less(t, server.maxGap, idleTimeout)
+	assert.NotZero(t, server.keepalives)
+}
+
+func TestUploadKeepaliveDuringBlockedSend(t *testing.T) {
+	var inSend, concurrentKeepalives int32
+
+	keepalive := startUploadKeepalive(20*time.Millisecond, func() error {
+		if atomic.LoadInt32(&inSend) != 0 {
+			atomic.AddInt32(&concurrentKeepalives, 1)
+		}
+		return nil
+	})
+
+	// The send is stuck, e.g. due to the stream's flow control
+	release := make(chan struct{})
+	sendErr := make(chan error, 1)
+	go func() {
+		sendErr <- keepalive.Do(func() error {
+			atomic.StoreInt32(&inSend, 1)
+			<-release
+			atomic.StoreInt32(&inSend, 0)
+			return nil
+		})
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+
+	// The keepalives don't wait for the blocked send
+	stopped := make(chan struct{})
+	go func() {
+		keepalive.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("keepalive is stuck behind the blocked send")
+	}
+
+	close(release)
+	require.NoError(t, <-sendErr)
+
+	// Nor are they sent concurrently with it
+	assert.Zero(t, atomic.LoadInt32(&concurrentKeepalives))
+}
+
+func TestUploadKeepaliveIsOptIn(t *testing.T) {
+	threshold, _, err := parseArtifactsKeepalive(map[string]string{})
+	require.NoError(t, err)
+	assert.EqualValues(t, artifactsKeepaliveDisabled, threshold)
+
+	threshold, _, err = parseArtifactsKeepalive(map[string]string{"CIRRUS_ARTIFACTS_KEEPALIVE_THRESHOLD": "1GiB"})
+	require.NoError(t, err)
+	assert.EqualValues(t, 1024*1024*1024, threshold)
+}
+
+func TestUploadKeepaliveNil(t *testing.T) {
+	var keepalive *uploadKeepalive
+
+	var called bool
+	require.NoError(t, keepalive.Do(func() error {
+		called = true
+		return nil
+	}))
+	assert.True(t, called)
+	keepalive.Stop()
+}
+
+func TestUploadArtifactsKeepaliveKeepsContents(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	contents := strings.Repeat("0123456789abcdef", 256*1024)
+
+	workingDir := testutil.TempDir(t)
+	writeTestFile(t, filepath.Join(workingDir, "big.bin"), contents)
+	writeTestFile(t, filepath.Join(workingDir, "small.bin"), "small")
+
+	executor := newTestArtifactsExecutor()
+	logUploader := newTestLogUploader(t, executor)
+	defer logUploader.Finalize()
+
+	_, err := executor.uploadArtifactsAndParseAnnotations(context.Background(), "artifacts",
+		&api.ArtifactsInstruction{Paths: []string{"*.bin"}},
+		map[string]string{
+			"CIRRUS_WORKING_DIR":                   workingDir,
+			"CIRRUS_ARTIFACTS_KEEPALIVE_THRESHOLD": "1MiB",
+			"CIRRUS_ARTIFACTS_KEEPALIVE_INTERVAL":  "1ms",
+		}, NewLogUploadObserver(logUploader))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"big.bin": contents, "small.bin": "small"}, fake.UploadedFiles())
+
+	// The keepalives don't refer to any of the files
+	for _, entry := range fake.Entries() {
+		if chunk := entry.GetChunk(); chunk != nil && len(chunk.Data) == 0 {
+			assert.Empty(t, chunk.ArtifactPath)
+		}
+	}
+
+	_, err = executor.uploadArtifactsAndParseAnnotations(context.Background(), "artifacts",
+		&api.ArtifactsInstruction{Paths: []string{"*.bin"}},
+		map[string]string{
+			"CIRRUS_WORKING_DIR":                  workingDir,
+			"CIRRUS_ARTIFACTS_KEEPALIVE_INTERVAL": "soon",
+		}, NewLogUploadObserver(logUploader))
+	assert.ErrorIs(t, err, ErrArtifactsInvalidOption)
+}
@@ -0,0 +1,62 @@
+package executor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// artifactsManifestPath returns the path to the file with the additional artifacts
+// paths, configured for the artifacts command via CIRRUS_ARTIFACTS_PATHS_FROM_<COMMAND>.
+func artifactsManifestPath(customEnv map[string]string, name string) string {
+	return customEnv[commandSpecificEnvName("CIRRUS_ARTIFACTS_PATHS_FROM", name)]
+}
+
+// artifactsManifestIsNulDelimited returns whether the manifest entries are separated by NUL
+// characters instead of newlines (like the output of "find -print0"), configured for the artifacts
+// command via CIRRUS_ARTIFACTS_PATHS_FROM_NUL_<COMMAND>.
+func artifactsManifestIsNulDelimited(customEnv map[string]string, name string) bool {
+	return customEnv[commandSpecificEnvName("CIRRUS_ARTIFACTS_PATHS_FROM_NUL", name)] == "true"
+}
+
+// readArtifactsManifest reads the newline-delimited paths or glob patterns from the manifest,
+// skipping blank lines and comments starting with "#". Relative manifest path is resolved
+// against the working directory.
+//
+// NUL-delimited entries are taken as is, since the file names might
+// legitimately contain whitespace or start with "#".
+func readArtifactsManifest(manifestPath string, workingDir string, nulDelimited bool) ([]string, error) {
+	if !filepath.IsAbs(manifestPath) {
+		manifestPath = filepath.Join(workingDir, manifestPath)
+	}
+
+	contents, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to read the artifacts manifest: %v", ErrArtifactsInvalidOption, err)
+	}
+
+	var paths []string
+
+	if nulDelimited {
+		for _, entry := range strings.Split(string(contents), "\x00") {
+			if entry != "" {
+				paths = append(paths, entry)
+			}
+		}
+
+		return paths, nil
+	}
+
+	for _, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimSpace(line)
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		paths = append(paths, line)
+	}
+
+	return paths, nil
+}
@@ -0,0 +1,59 @@
+package executor
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// artifactsMirrorDir returns the local folder configured via CIRRUS_ARTIFACT_MIRROR_DIR
+// where the uploaded artifacts are copied to for offline inspection.
+func artifactsMirrorDir(customEnv map[string]string) string {
+	if dir := customEnv["CIRRUS_ARTIFACT_MIRROR_DIR"]; dir != "" {
+		return dir
+	}
+
+	return os.Getenv("CIRRUS_ARTIFACT_MIRROR_DIR")
+}
+
+// artifactMirror copies the artifact contents as they're being uploaded to the mirror folder.
+//
+// Mirroring is best-effort, so the errors are remembered instead of failing the writes,
+// which would otherwise abort the upload itself.
+type artifactMirror struct {
+	file *os.File
+	err  error
+}
+
+func newArtifactMirror(mirrorDir string, relativeArtifactPath string) *artifactMirror {
+	mirror := &artifactMirror{}
+
+	path := filepath.Join(mirrorDir, relativeArtifactPath)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		mirror.err = err
+		return mirror
+	}
+
+	mirror.file, mirror.err = os.Create(path)
+
+	return mirror
+}
+
+func (mirror *artifactMirror) Write(p []byte) (int, error) {
+	if mirror.err == nil {
+		_, mirror.err = mirror.file.Write(p)
+	}
+
+	return len(p), nil
+}
+
+// Close returns the first error encountered while mirroring.
+func (mirror *artifactMirror) Close() error {
+	if mirror.file != nil {
+		if err := mirror.file.Close(); err != nil && mirror.err == nil {
+			mirror.err = err
+		}
+	}
+
+	return mirror.err
+}
@@ -0,0 +1,44 @@
+package executor
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// artifactsAllowOutsideWorkingDir returns whether the absolute patterns of the artifacts command may match
+// the files outside of the CIRRUS_WORKING_DIR (e.g. /var/log/system.log or the crash dumps), configured
+// via CIRRUS_ARTIFACTS_ALLOW_OUTSIDE_WORKING_DIR_<COMMAND>. The relative patterns are always scoped
+// to the CIRRUS_WORKING_DIR regardless of it.
+//
+// This is an environment variable and not an ArtifactsInstruction field since the latter is generated
+// from the RPC service definition, which lives outside of this repository.
+//
+// Note that this lets the task upload any file readable by the agent user, including the credentials
+// stored outside of the working directory, so only enable it for the patterns that can't be influenced
+// by the untrusted input like the pull request contents or the variables derived from it.
+func artifactsAllowOutsideWorkingDir(customEnv map[string]string, name string) bool {
+	return customEnv[commandSpecificEnvName("CIRRUS_ARTIFACTS_ALLOW_OUTSIDE_WORKING_DIR", name)] == "true"
+}
+
+// artifactsPatternBase returns the folder the paths matched by the absolute pattern are uploaded relative
+// to when they're outside of the CIRRUS_WORKING_DIR, which is the longest leading part of the pattern
+// without any glob meta characters, e.g. "/var/crash" for "/var/crash/**/*.dmp" and "/var/log" for
+// "/var/log/system.log".
+func artifactsPatternBase(pattern string) string {
+	base := pattern
+
+	for {
+		dir := filepath.Dir(base)
+		if !strings.ContainsAny(base, "*?[{") || dir == base {
+			break
+		}
+		base = dir
+	}
+
+	// Literal patterns match the file itself
+	if base == pattern {
+		return filepath.Dir(pattern)
+	}
+
+	return base
+}
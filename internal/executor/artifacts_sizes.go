@@ -0,0 +1,88 @@
+package executor
+
+import (
+	"fmt"
+	"github.com/dustin/go-humanize"
+	"os"
+	"sort"
+)
+
+// artifactSizeLimits filter the artifact files by their size, configured via
+// the CIRRUS_ARTIFACTS_MIN_FILE_SIZE and CIRRUS_ARTIFACTS_MAX_FILE_SIZE behavioral
+// environment variables (e.g. "1KB" or "50 MiB"). Zero means there's no limit.
+type artifactSizeLimits struct {
+	Min uint64
+	Max uint64
+}
+
+func parseArtifactSizeLimits(customEnv map[string]string) (artifactSizeLimits, error) {
+	var limits artifactSizeLimits
+
+	for name, limit := range map[string]*uint64{
+		"CIRRUS_ARTIFACTS_MIN_FILE_SIZE": &limits.Min,
+		"CIRRUS_ARTIFACTS_MAX_FILE_SIZE": &limits.Max,
+	} {
+		value := customEnv[name]
+		if value == "" {
+			continue
+		}
+
+		parsed, err := humanize.ParseBytes(value)
+		if err != nil {
+			return limits, fmt.Errorf("%w: failed to parse %s: %v", ErrArtifactsInvalidOption, name, err)
+		}
+		*limit = parsed
+	}
+
+	if limits.Min != 0 && limits.Max != 0 && limits.Min > limits.Max {
+		return limits, fmt.Errorf("%w: CIRRUS_ARTIFACTS_MIN_FILE_SIZE (%s) exceeds CIRRUS_ARTIFACTS_MAX_FILE_SIZE (%s)",
+			ErrArtifactsInvalidOption, humanize.Bytes(limits.Min), humanize.Bytes(limits.Max))
+	}
+
+	return limits, nil
+}
+
+// skipReason explains why the file of the specified size should be skipped,
+// or returns an empty string if it fits into the limits.
+func (limits artifactSizeLimits) skipReason(size int64) string {
+	if limits.Min != 0 && uint64(size) < limits.Min {
+		return fmt.Sprintf("it's smaller than %s (%s)", humanize.Bytes(limits.Min), humanize.Bytes(uint64(size)))
+	}
+
+	if limits.Max != 0 && uint64(size) > limits.Max {
+		return fmt.Sprintf("it's larger than %s (%s)", humanize.Bytes(limits.Max), humanize.Bytes(uint64(size)))
+	}
+
+	return ""
+}
+
+// artifactsSortBySizeDesc uploads the largest files first, so that the biggest offenders
+// show up early and the size limits are hit as soon as possible.
+const artifactsSortBySizeDesc = "size-desc"
+
+// parseArtifactsSortBy returns the order to upload each pattern's files in, configured via
+// the CIRRUS_ARTIFACTS_SORT_BY behavioral environment variable. Empty means the glob order.
+func parseArtifactsSortBy(customEnv map[string]string) (string, error) {
+	switch value := customEnv["CIRRUS_ARTIFACTS_SORT_BY"]; value {
+	case "", artifactsSortBySizeDesc:
+		return value, nil
+	default:
+		return "", fmt.Errorf("%w: CIRRUS_ARTIFACTS_SORT_BY should be %q, got %q",
+			ErrArtifactsInvalidOption, artifactsSortBySizeDesc, value)
+	}
+}
+
+// sortArtifactPathsBySize sorts the paths by descending size, keeping the glob order for the files
+// of the same size. Folders and the paths missing from the infos are treated as empty files.
+func sortArtifactPathsBySize(paths []string, infos map[string]os.FileInfo) {
+	sizes := make(map[string]int64, len(paths))
+	for _, path := range paths {
+		if info := infos[path]; info != nil && !info.IsDir() {
+			sizes[path] = info.Size()
+		}
+	}
+
+	sort.SliceStable(paths, func(i, j int) bool {
+		return sizes[paths[i]] > sizes[paths[j]]
+	})
+}
@@ -0,0 +1,50 @@
+package executor
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// parseArtifactsModifiedSince returns the reference time configured via the CIRRUS_ARTIFACTS_MODIFIED_SINCE
+// behavioral environment variable, either as an RFC 3339 timestamp or as a number of seconds since
+// the Unix epoch (e.g. "$CIRRUS_BUILD_START"), so that only the files modified after it get uploaded.
+func parseArtifactsModifiedSince(customEnv map[string]string) (time.Time, bool, error) {
+	value := customEnv["CIRRUS_ARTIFACTS_MODIFIED_SINCE"]
+	if value == "" {
+		return time.Time{}, false, nil
+	}
+
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), true, nil
+	}
+
+	modifiedSince, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("%w: CIRRUS_ARTIFACTS_MODIFIED_SINCE should be an RFC 3339 "+
+			"timestamp or a Unix time, got %q", ErrArtifactsInvalidOption, value)
+	}
+
+	return modifiedSince, true, nil
+}
+
+// withoutStaleArtifactPaths filters out the files that weren't modified after modifiedSince
+// and returns how many of them were skipped. Folders and the paths missing from the infos
+// (the ones that can't be stat'ed) are kept, so that they're dealt with during the upload.
+func withoutStaleArtifactPaths(paths []string, infos map[string]os.FileInfo, modifiedSince time.Time) ([]string, int) {
+	result := paths[:0]
+	var numStale int
+
+	for _, path := range paths {
+		info := infos[path]
+		if info != nil && !info.IsDir() && !info.ModTime().After(modifiedSince) {
+			numStale++
+			continue
+		}
+
+		result = append(result, path)
+	}
+
+	return result, numStale
+}
@@ -0,0 +1,151 @@
+package executor
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// artifactsSummaryStdout is the CIRRUS_ARTIFACTS_SUMMARY value to print the summary to the agent's stdout with
+const artifactsSummaryStdout = "stdout"
+
+// artifactsSummary is the machine-readable outcome of a single artifacts instruction,
+// for the scripts wrapping the agent that can't parse the command's log reliably.
+type artifactsSummary struct {
+	Name        string                    `json:"name"`
+	Success     bool                      `json:"success"`
+	Error       string                    `json:"error,omitempty"`
+	Files       int                       `json:"files"`
+	Bytes       int64                     `json:"bytes"`
+	Skipped     int                       `json:"skipped"`
+	Annotations int                       `json:"annotations"`
+	DurationMs  int64                     `json:"duration_ms"`
+	Patterns    []artifactsPatternSummary `json:"patterns"`
+}
+
+type artifactsPatternSummary struct {
+	Pattern string `json:"pattern"`
+	Matched int    `json:"matched"`
+	Files   int    `json:"files"`
+	Bytes   int64  `json:"bytes"`
+	Skipped int    `json:"skipped"`
+}
+
+// artifactsSummaryObserver collects the artifacts upload events into the summary,
+// which is only emitted when requested via the CIRRUS_ARTIFACTS_SUMMARY behavioral
+// environment variable: either "stdout" or the path of the file to append it to
+// as a single line of JSON, so that the summaries of all the artifacts instructions
+// of the task can be collected in one place.
+//
+// The methods can be called on a nil observer, which does nothing.
+type artifactsSummaryObserver struct {
+	destination string
+	startTime   time.Time
+	summary     artifactsSummary
+}
+
+// newArtifactsSummaryObserver returns nil when the summary wasn't requested.
+func newArtifactsSummaryObserver(customEnv map[string]string, name string) *artifactsSummaryObserver {
+	destination := customEnv["CIRRUS_ARTIFACTS_SUMMARY"]
+	if destination == "" {
+		return nil
+	}
+
+	return &artifactsSummaryObserver{
+		destination: destination,
+		startTime:   time.Now(),
+		summary:     artifactsSummary{Name: name, Patterns: []artifactsPatternSummary{}},
+	}
+}
+
+// Reset forgets the events of the previous upload attempt, since the retried upload starts over.
+func (observer *artifactsSummaryObserver) Reset() {
+	if observer == nil {
+		return
+	}
+
+	observer.summary = artifactsSummary{Name: observer.summary.Name, Patterns: []artifactsPatternSummary{}}
+}
+
+func (observer *artifactsSummaryObserver) currentPattern() *artifactsPatternSummary {
+	if len(observer.summary.Patterns) == 0 {
+		// Skipped files reported before any of the patterns, nothing to attribute them to
+		return &artifactsPatternSummary{}
+	}
+
+	return &observer.summary.Patterns[len(observer.summary.Patterns)-1]
+}
+
+func (observer *artifactsSummaryObserver) OnPatternStart(pattern string, paths []string) {
+	observer.summary.Patterns = append(observer.summary.Patterns, artifactsPatternSummary{
+		Pattern: pattern,
+		Matched: len(paths),
+	})
+}
+
+func (observer *artifactsSummaryObserver) OnStaleFilesSkipped(pattern string, numSkipped int, modifiedSince time.Time) {
+	observer.summary.Skipped += numSkipped
+	observer.currentPattern().Skipped += numSkipped
+}
+
+func (observer *artifactsSummaryObserver) OnFileStart(path string, size int64) {}
+
+func (observer *artifactsSummaryObserver) OnFileSkipped(path string, reason string) {
+	observer.summary.Skipped++
+	observer.currentPattern().Skipped++
+}
+
+func (observer *artifactsSummaryObserver) OnFileDone(path string, bytes int64, duration time.Duration) {
+	observer.summary.Files++
+	observer.summary.Bytes += bytes
+
+	currentPattern := observer.currentPattern()
+	currentPattern.Files++
+	currentPattern.Bytes += bytes
+}
+
+func (observer *artifactsSummaryObserver) OnPatternDone(pattern string, numUploaded int) {}
+
+func (observer *artifactsSummaryObserver) OnError(err error) {
+	observer.summary.Error = err.Error()
+}
+
+// Emit writes the summary to the requested destination.
+func (observer *artifactsSummaryObserver) Emit(success bool, numAnnotations int) error {
+	if observer == nil {
+		return nil
+	}
+
+	summary := observer.summary
+	summary.Success = success
+	summary.Annotations = numAnnotations
+	summary.DurationMs = time.Since(observer.startTime).Milliseconds()
+	if success {
+		// The errors of the retried attempts don't matter in the end
+		summary.Error = ""
+	}
+
+	line, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if observer.destination == artifactsSummaryStdout {
+		_, err := os.Stdout.Write(line)
+		return err
+	}
+
+	file, err := os.OpenFile(observer.destination, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", observer.destination, err)
+	}
+
+	if _, err := file.Write(line); err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to write to %s: %w", observer.destination, err)
+	}
+
+	return file.Close()
+}
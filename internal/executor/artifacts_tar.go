@@ -0,0 +1,83 @@
+package executor
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// artifactsBundleDirs returns whether the folders matched by the artifacts command should be uploaded
+// as a single tar archive each instead of being skipped, configured via CIRRUS_ARTIFACTS_BUNDLE_<COMMAND>.
+func artifactsBundleDirs(customEnv map[string]string, name string) bool {
+	return customEnv[commandSpecificEnvName("CIRRUS_ARTIFACTS_BUNDLE", name)] == "true"
+}
+
+// writeDirectoryTar writes the tar archive of the dir to the writer as it walks the tree, with
+// all entries nested in a folder named after the dir. Empty folders and symbolic links are preserved,
+// while the other special files (sockets, named pipes, devices) are skipped.
+func writeDirectoryTar(writer io.Writer, dir string) error {
+	tarWriter := tar.NewWriter(writer)
+	root := filepath.Base(dir)
+
+	err := filepath.Walk(dir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() && !info.IsDir() && info.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+
+		relativePath, err := filepath.Rel(dir, filePath)
+		if err != nil {
+			return err
+		}
+
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, err = os.Readlink(filePath)
+			if err != nil {
+				return err
+			}
+		}
+
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = path.Join(root, filepath.ToSlash(relativePath))
+		if info.IsDir() {
+			header.Name += "/"
+		}
+
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		file, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		// The header is already written, so the file can't grow or shrink in the archive
+		if _, err := io.CopyN(tarWriter, file, header.Size); err != nil {
+			return fmt.Errorf("%w: file %s changed while archiving: %v",
+				ErrArtifactChangedDuringUpload, filePath, err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return tarWriter.Close()
+}
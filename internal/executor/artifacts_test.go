@@ -0,0 +1,1282 @@
+package executor
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/cirruslabs/cirrus-ci-agent/api"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/executor/uploadmetrics"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/testutil"
+	"github.com/cirruslabs/cirrus-ci-annotations/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUploadArtifacts(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	workingDir := testutil.TempDir(t)
+	writeTestFile(t, filepath.Join(workingDir, "build", "a.txt"), "first")
+	writeTestFile(t, filepath.Join(workingDir, "build", "b.txt"), "second")
+
+	executor := newTestArtifactsExecutor()
+	logUploader := newTestLogUploader(t, executor)
+
+	success := executor.UploadArtifacts(context.Background(), logUploader, "binaries",
+		&api.ArtifactsInstruction{Paths: []string{"build/*.txt"}},
+		map[string]string{"CIRRUS_WORKING_DIR": workingDir})
+	logUploader.Finalize()
+
+	assert.True(t, success)
+	assert.Equal(t, map[string]string{
+		"build/a.txt": "first",
+		"build/b.txt": "second",
+	}, fake.UploadedFiles())
+}
+
+func TestUploadArtifactsSkipsPatternsWithoutMatches(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	workingDir := testutil.TempDir(t)
+	writeTestFile(t, filepath.Join(workingDir, "a.txt"), "contents")
+
+	executor := newTestArtifactsExecutor()
+	logUploader := newTestLogUploader(t, executor)
+	defer logUploader.Finalize()
+
+	_, err := executor.uploadArtifactsAndParseAnnotations(context.Background(), "artifacts",
+		&api.ArtifactsInstruction{Paths: []string{"*.missing", "*.txt"}},
+		map[string]string{"CIRRUS_WORKING_DIR": workingDir}, NewLogUploadObserver(logUploader))
+	require.NoError(t, err)
+
+	var headers int
+	for _, entry := range fake.Entries() {
+		if entry.GetArtifactsUpload() != nil {
+			headers++
+		}
+	}
+	assert.Equal(t, 1, headers)
+	assert.Equal(t, map[string]string{"a.txt": "contents"}, fake.UploadedFiles())
+}
+
+func TestUploadArtifactsPathsFromManifest(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	workingDir := testutil.TempDir(t)
+	writeTestFile(t, filepath.Join(workingDir, "build", "app"), "binary")
+	writeTestFile(t, filepath.Join(workingDir, "reports", "junit.xml"), "<testsuites/>")
+	writeTestFile(t, filepath.Join(workingDir, "reports", "ignored.txt"), "ignored")
+	writeTestFile(t, filepath.Join(workingDir, "artifacts.txt"),
+		"# generated by the build\nbuild/app\n\n  $REPORTS_DIR/*.xml  \n")
+
+	executor := newTestArtifactsExecutor()
+	logUploader := newTestLogUploader(t, executor)
+
+	success := executor.UploadArtifacts(context.Background(), logUploader, "dynamic",
+		&api.ArtifactsInstruction{},
+		map[string]string{
+			"CIRRUS_WORKING_DIR":                  workingDir,
+			"CIRRUS_ARTIFACTS_PATHS_FROM_DYNAMIC": "artifacts.txt",
+			"REPORTS_DIR":                         "reports",
+		})
+	logUploader.Finalize()
+
+	assert.True(t, success)
+	assert.Equal(t, map[string]string{
+		"build/app":         "binary",
+		"reports/junit.xml": "<testsuites/>",
+	}, fake.UploadedFiles())
+}
+
+func TestUploadArtifactsPathsFromNulDelimitedManifest(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	workingDir := testutil.TempDir(t)
+	writeTestFile(t, filepath.Join(workingDir, "#weird name.txt"), "first")
+	writeTestFile(t, filepath.Join(workingDir, " spaces.txt"), "second")
+	writeTestFile(t, filepath.Join(workingDir, "artifacts.txt"), "#weird name.txt\x00 spaces.txt\x00")
+
+	executor := newTestArtifactsExecutor()
+	logUploader := newTestLogUploader(t, executor)
+	defer logUploader.Finalize()
+
+	_, err := executor.uploadArtifactsAndParseAnnotations(context.Background(), "dynamic",
+		&api.ArtifactsInstruction{}, map[string]string{
+			"CIRRUS_WORKING_DIR":                      workingDir,
+			"CIRRUS_ARTIFACTS_PATHS_FROM_DYNAMIC":     "artifacts.txt",
+			"CIRRUS_ARTIFACTS_PATHS_FROM_NUL_DYNAMIC": "true",
+		}, NewLogUploadObserver(logUploader))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"#weird name.txt": "first",
+		" spaces.txt":     "second",
+	}, fake.UploadedFiles())
+}
+
+func TestUploadArtifactsMissingManifest(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	workingDir := testutil.TempDir(t)
+
+	executor := newTestArtifactsExecutor()
+	logUploader := newTestLogUploader(t, executor)
+	defer logUploader.Finalize()
+
+	_, err := executor.uploadArtifactsAndParseAnnotations(context.Background(), "dynamic",
+		&api.ArtifactsInstruction{}, map[string]string{
+			"CIRRUS_WORKING_DIR":                  workingDir,
+			"CIRRUS_ARTIFACTS_PATHS_FROM_DYNAMIC": "missing.txt",
+		}, NewLogUploadObserver(logUploader))
+	assert.ErrorIs(t, err, ErrArtifactsInvalidOption)
+}
+
+func TestUploadArtifactsStrictExpansion(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	workingDir := testutil.TempDir(t)
+	writeTestFile(t, filepath.Join(workingDir, "a.txt"), "contents")
+
+	executor := newTestArtifactsExecutor()
+	logUploader := newTestLogUploader(t, executor)
+	defer logUploader.Finalize()
+
+	env := map[string]string{
+		"CIRRUS_WORKING_DIR":                workingDir,
+		"CIRRUS_ARTIFACTS_STRICT_EXPANSION": "true",
+	}
+
+	_, err := executor.uploadArtifactsAndParseAnnotations(context.Background(), "artifacts",
+		&api.ArtifactsInstruction{Paths: []string{"$CIRRUS_TEST_UNDEFINED_VARIABLE/*.txt"}}, env, NewLogUploadObserver(logUploader))
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrUndefinedVariable))
+	assert.Contains(t, err.Error(), "CIRRUS_TEST_UNDEFINED_VARIABLE")
+	assert.Empty(t, fake.Entries())
+
+	// Variables with default values are not considered undefined
+	_, err = executor.uploadArtifactsAndParseAnnotations(context.Background(), "artifacts",
+		&api.ArtifactsInstruction{Paths: []string{"${CIRRUS_TEST_UNDEFINED_VARIABLE:.}/*.txt"}}, env, NewLogUploadObserver(logUploader))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"a.txt": "contents"}, fake.UploadedFiles())
+}
+
+func TestUploadArtifactsRejectsParentSegments(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	workingDir := testutil.TempDir(t)
+	writeTestFile(t, filepath.Join(workingDir, "src", "a.txt"), "contents")
+	env := map[string]string{"CIRRUS_WORKING_DIR": workingDir, "CIRRUS_TEST_ESCAPE": "../../etc"}
+
+	for _, pattern := range []string{
+		"../../etc/passwd",
+		"src/../../outside/*.txt",
+		"src/**/../a.txt",
+		"$CIRRUS_TEST_ESCAPE/passwd",
+		workingDir + "/src/../src/a.txt",
+	} {
+		_, err := newTestArtifactsExecutor().uploadArtifactsAndParseAnnotations(context.Background(), "artifacts",
+			&api.ArtifactsInstruction{Paths: []string{pattern}}, env, multiUploadObserver{})
+		require.ErrorIs(t, err, ErrArtifactsPathOutsideWorkingDir, pattern)
+		assert.Contains(t, err.Error(), ExpandText(pattern, env))
+	}
+	assert.Empty(t, fake.Entries())
+
+	// Names merely starting with dots are fine
+	writeTestFile(t, filepath.Join(workingDir, "..a", "b..txt"), "dots")
+	_, err := newTestArtifactsExecutor().uploadArtifactsAndParseAnnotations(context.Background(), "artifacts",
+		&api.ArtifactsInstruction{Paths: []string{"..a/*..txt"}}, env, multiUploadObserver{})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"..a/b..txt": "dots"}, fake.UploadedFiles())
+}
+
+func TestUploadArtifactsAllowOutsideWorkingDir(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	workingDir := testutil.TempDir(t)
+	writeTestFile(t, filepath.Join(workingDir, "build.log"), "build")
+
+	outsideDir := testutil.TempDir(t)
+	writeTestFile(t, filepath.Join(outsideDir, "system.log"), "system")
+	writeTestFile(t, filepath.Join(outsideDir, "crash", "app", "1.dmp"), "dump")
+
+	instruction := &api.ArtifactsInstruction{Paths: []string{
+		"build.log",
+		filepath.Join(outsideDir, "system.log"),
+		filepath.Join(outsideDir, "crash", "**", "*.dmp"),
+	}}
+	env := map[string]string{"CIRRUS_WORKING_DIR": workingDir}
+
+	// Absolute paths outside of the working directory are still rejected by default
+	_, err := newTestArtifactsExecutor().uploadArtifactsAndParseAnnotations(context.Background(), "logs",
+		instruction, env, multiUploadObserver{})
+	require.ErrorIs(t, err, ErrArtifactsPathOutsideWorkingDir)
+	assert.Empty(t, fake.Entries())
+
+	env["CIRRUS_ARTIFACTS_ALLOW_OUTSIDE_WORKING_DIR_LOGS"] = "true"
+
+	_, err = newTestArtifactsExecutor().uploadArtifactsAndParseAnnotations(context.Background(), "logs",
+		instruction, env, multiUploadObserver{})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"build.log":  "build",
+		"system.log": "system",
+		"app/1.dmp":  "dump",
+	}, fake.UploadedFiles())
+
+	// Relative patterns are scoped to the working directory regardless
+	_, err = newTestArtifactsExecutor().uploadArtifactsAndParseAnnotations(context.Background(), "logs",
+		&api.ArtifactsInstruction{Paths: []string{"../*/system.log"}}, env, multiUploadObserver{})
+	require.ErrorIs(t, err, ErrArtifactsPathOutsideWorkingDir)
+}
+
+func TestArtifactsPatternBase(t *testing.T) {
+	for pattern, expected := range map[string]string{
+		"/var/log/system.log":  "/var/log",
+		"/var/crash/**/*.dmp":  "/var/crash",
+		"/var/log/*.log":       "/var/log",
+		"/var/log/{a,b}/x.log": "/var/log",
+		"/*.log":               "/",
+	} {
+		assert.Equal(t, filepath.FromSlash(expected), artifactsPatternBase(filepath.FromSlash(pattern)), pattern)
+	}
+}
+
+func TestUploadArtifactsRedundantPatterns(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	workingDir := testutil.TempDir(t)
+	writeTestFile(t, filepath.Join(workingDir, "out", "build.log"), "build")
+	writeTestFile(t, filepath.Join(workingDir, "out", "test.log"), "test")
+
+	executor := newTestArtifactsExecutor()
+	logUploader := newTestLogUploader(t, executor)
+
+	_, err := executor.uploadArtifactsAndParseAnnotations(context.Background(), "artifacts",
+		&api.ArtifactsInstruction{Paths: []string{"out/*.log", "out/build.log", "out/*.log"}},
+		map[string]string{"CIRRUS_WORKING_DIR": workingDir}, NewLogUploadObserver(logUploader))
+	require.NoError(t, err)
+
+	// Each file is only uploaded once
+	assert.Equal(t, map[string]string{"out/build.log": "build", "out/test.log": "test"}, fake.UploadedFiles())
+
+	logUploader.Finalize()
+	assert.Equal(t, 3, strings.Count(fake.Logs(), "because it's already matched by one of the preceding patterns"))
+}
+
+func TestUploadArtifactsTypeOverrides(t *testing.T) {
+	testCases := map[string]struct {
+		env     map[string]string
+		logType string
+	}{
+		"global": {
+			env:     map[string]string{"CIRRUS_ARTIFACTS_TYPES": "**/*.log=text/plain"},
+			logType: "text/plain",
+		},
+		"command-specific": {
+			env:     map[string]string{"CIRRUS_ARTIFACTS_TYPES_LOGS": "**/*.log=text/plain"},
+			logType: "text/plain",
+		},
+		"command-specific takes precedence": {
+			env: map[string]string{
+				"CIRRUS_ARTIFACTS_TYPES":      "**/*.log=text/x-log",
+				"CIRRUS_ARTIFACTS_TYPES_LOGS": "**/*.log=text/plain",
+			},
+			logType: "text/plain",
+		},
+		"other command": {
+			env:     map[string]string{"CIRRUS_ARTIFACTS_TYPES_BINARIES": "**/*.log=text/plain"},
+			logType: "application/octet-stream",
+		},
+	}
+
+	for name, testCase := range testCases {
+		testCase := testCase
+
+		t.Run(name, func(t *testing.T) {
+			fake := &fakeCirrusClient{}
+			withFakeClient(t, fake)
+
+			workingDir := testutil.TempDir(t)
+			writeTestFile(t, filepath.Join(workingDir, "out", "app"), "binary")
+			writeTestFile(t, filepath.Join(workingDir, "out", "build.log"), "log")
+			writeTestFile(t, filepath.Join(workingDir, "out", "test.log"), "log")
+
+			executor := newTestArtifactsExecutor()
+			logUploader := newTestLogUploader(t, executor)
+			defer logUploader.Finalize()
+
+			customEnv := map[string]string{"CIRRUS_WORKING_DIR": workingDir}
+			for key, value := range testCase.env {
+				customEnv[key] = value
+			}
+
+			_, err := executor.uploadArtifactsAndParseAnnotations(context.Background(), "logs",
+				&api.ArtifactsInstruction{Paths: []string{"out/*"}, Type: "application/octet-stream"},
+				customEnv, NewLogUploadObserver(logUploader))
+			require.NoError(t, err)
+
+			// Each file chunk is attributed to the type from the most recent upload header
+			fileTypes := map[string]string{}
+			var currentType string
+			for _, entry := range fake.Entries() {
+				if header := entry.GetArtifactsUpload(); header != nil {
+					currentType = header.Type
+				}
+				if chunk := entry.GetChunk(); chunk != nil {
+					fileTypes[chunk.ArtifactPath] = currentType
+				}
+			}
+
+			assert.Equal(t, map[string]string{
+				"out/app":       "application/octet-stream",
+				"out/build.log": testCase.logType,
+				"out/test.log":  testCase.logType,
+			}, fileTypes)
+		})
+	}
+}
+
+func TestUploadArtifactsInvalidWorkingDir(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	executor := newTestArtifactsExecutor()
+	logUploader := newTestLogUploader(t, executor)
+	defer logUploader.Finalize()
+
+	testCases := map[string]string{
+		"empty":    "",
+		"relative": "relative/dir",
+		"missing":  filepath.Join(testutil.TempDir(t), "missing"),
+	}
+
+	for name, workingDir := range testCases {
+		_, err := executor.uploadArtifactsAndParseAnnotations(context.Background(), "artifacts",
+			&api.ArtifactsInstruction{Paths: []string{"*.txt"}},
+			map[string]string{"CIRRUS_WORKING_DIR": workingDir}, NewLogUploadObserver(logUploader))
+		assert.ErrorIs(t, err, ErrArtifactsInvalidWorkingDir, name)
+	}
+
+	assert.Empty(t, fake.Entries())
+}
+
+func TestUploadArtifactsSymlinkedWorkingDir(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	// Mimic macOS, where /tmp is a symlink to /private/tmp
+	tempDir := testutil.TempDir(t)
+	realDir := filepath.Join(tempDir, "private")
+	writeTestFile(t, filepath.Join(realDir, "build", "a.txt"), "contents")
+	workingDir := filepath.Join(tempDir, "tmp")
+	if err := os.Symlink(realDir, workingDir); err != nil {
+		t.Skipf("failed to create a symlink: %v", err)
+	}
+
+	executor := newTestArtifactsExecutor()
+	logUploader := newTestLogUploader(t, executor)
+	defer logUploader.Finalize()
+
+	_, err := executor.uploadArtifactsAndParseAnnotations(context.Background(), "artifacts",
+		&api.ArtifactsInstruction{Paths: []string{filepath.Join(realDir, "build", "*.txt")}},
+		map[string]string{"CIRRUS_WORKING_DIR": workingDir}, NewLogUploadObserver(logUploader))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"build/a.txt": "contents"}, fake.UploadedFiles())
+}
+
+func TestParseArtifactTypeOverrides(t *testing.T) {
+	overrides, err := ParseArtifactTypeOverrides("**/*.log=text/plain, bin/* = application/octet-stream\n")
+	require.NoError(t, err)
+	assert.Equal(t, []ArtifactTypeOverride{
+		{Pattern: "**/*.log", Type: "text/plain"},
+		{Pattern: "bin/*", Type: "application/octet-stream"},
+	}, overrides)
+
+	_, err = ParseArtifactTypeOverrides("**/*.log")
+	assert.ErrorIs(t, err, ErrArtifactsInvalidOption)
+}
+
+func TestPathIsWithinWorkingDir(t *testing.T) {
+	workingDir := filepath.FromSlash("/tmp/work")
+
+	matched, err := pathIsWithinWorkingDir(workingDir, filepath.FromSlash("/tmp/work/build/a.txt"))
+	require.NoError(t, err)
+	assert.True(t, matched)
+
+	matched, err = pathIsWithinWorkingDir(workingDir, filepath.FromSlash("/tmp/workspace/a.txt"))
+	require.NoError(t, err)
+	assert.False(t, matched)
+
+	matched, err = pathIsWithinWorkingDir(workingDir, filepath.FromSlash("/etc/passwd"))
+	require.NoError(t, err)
+	assert.False(t, matched)
+}
+
+// fileStartHookObserver allows tampering with the artifact files right before they're read
+type fileStartHookObserver struct {
+	UploadObserver
+
+	onFileStart func(path string)
+}
+
+func (observer *fileStartHookObserver) OnFileStart(path string, size int64) {
+	observer.onFileStart(path)
+	observer.UploadObserver.OnFileStart(path, size)
+}
+
+func TestUploadArtifactsFileChangedDuringUpload(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	workingDir := testutil.TempDir(t)
+	writeTestFile(t, filepath.Join(workingDir, "build.log"), "first line\n")
+
+	executor := newTestArtifactsExecutor()
+	logUploader := newTestLogUploader(t, executor)
+	defer logUploader.Finalize()
+
+	observer := &fileStartHookObserver{
+		UploadObserver: NewLogUploadObserver(logUploader),
+		onFileStart: func(path string) {
+			writeTestFile(t, path, "first line\nsecond line\n")
+		},
+	}
+
+	_, err := executor.uploadArtifactsAndParseAnnotations(context.Background(), "logs",
+		&api.ArtifactsInstruction{Paths: []string{"*.log"}},
+		map[string]string{"CIRRUS_WORKING_DIR": workingDir}, observer)
+	require.ErrorIs(t, err, ErrArtifactChangedDuringUpload)
+	assert.Contains(t, err.Error(), "expected 11, sent 23")
+}
+
+func TestUploadArtifactsCloseError(t *testing.T) {
+	rejected := errors.New("storage quota exceeded")
+
+	testCases := map[string]struct {
+		closeErrors []error
+		success     bool
+	}{
+		"retried": {[]error{rejected}, true},
+		"failed":  {[]error{rejected, rejected}, false},
+	}
+
+	for name, testCase := range testCases {
+		testCase := testCase
+
+		t.Run(name, func(t *testing.T) {
+			fake := &fakeCirrusClient{uploadCloseErrors: testCase.closeErrors}
+			withFakeClient(t, fake)
+
+			workingDir := testutil.TempDir(t)
+			writeTestFile(t, filepath.Join(workingDir, "a.txt"), "contents")
+
+			executor := newTestArtifactsExecutor()
+			logUploader := newTestLogUploader(t, executor)
+
+			success := executor.UploadArtifacts(context.Background(), logUploader, "artifacts",
+				&api.ArtifactsInstruction{Paths: []string{"*.txt"}},
+				map[string]string{"CIRRUS_WORKING_DIR": workingDir})
+			logUploader.Finalize()
+
+			assert.Equal(t, testCase.success, success)
+			assert.Equal(t, 2, fake.uploadsClosed)
+			assert.Contains(t, fake.Logs(), "storage quota exceeded")
+		})
+	}
+}
+
+func TestUploadArtifactsMetrics(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	workingDir := testutil.TempDir(t)
+	writeTestFile(t, filepath.Join(workingDir, "out", "app"), "binary")
+	writeTestFile(t, filepath.Join(workingDir, "out", "build.log"), "log")
+
+	executor := newTestArtifactsExecutor()
+	executor.uploadMetrics = uploadmetrics.New()
+	logUploader := newTestLogUploader(t, executor)
+	defer logUploader.Finalize()
+
+	_, err := executor.uploadArtifactsAndParseAnnotations(context.Background(), "artifacts",
+		&api.ArtifactsInstruction{Paths: []string{"out/*"}, Type: "application/octet-stream"},
+		map[string]string{
+			"CIRRUS_WORKING_DIR":     workingDir,
+			"CIRRUS_ARTIFACTS_TYPES": "**/*.log=text/plain",
+		}, NewLogUploadObserver(logUploader))
+	require.NoError(t, err)
+
+	recorder := httptest.NewRecorder()
+	executor.uploadMetrics.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Contains(t, recorder.Body.String(),
+		`cirrus_agent_artifacts_uploaded_bytes_total{type="application/octet-stream"} 6`)
+	assert.Contains(t, recorder.Body.String(), `cirrus_agent_artifacts_uploaded_bytes_total{type="text/plain"} 3`)
+}
+
+func TestUploadArtifactsTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	previousProvider := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previousProvider)
+	})
+
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	workingDir := testutil.TempDir(t)
+	writeTestFile(t, filepath.Join(workingDir, "a.txt"), "first")
+	writeTestFile(t, filepath.Join(workingDir, "b.txt"), "second")
+
+	executor := newTestArtifactsExecutor()
+	logUploader := newTestLogUploader(t, executor)
+
+	success := executor.UploadArtifacts(context.Background(), logUploader, "texts",
+		&api.ArtifactsInstruction{Paths: []string{"*.txt"}},
+		map[string]string{"CIRRUS_WORKING_DIR": workingDir})
+	logUploader.Finalize()
+	require.True(t, success)
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 3)
+
+	// Child spans end first
+	uploadSpan := spans[2]
+	assert.Equal(t, "UploadArtifacts", uploadSpan.Name())
+	assert.Contains(t, uploadSpan.Attributes(), attribute.Int64("artifacts.files", 2))
+	assert.Contains(t, uploadSpan.Attributes(), attribute.Int64("artifacts.bytes", 11))
+
+	for _, fileSpan := range spans[:2] {
+		assert.Equal(t, "uploadSingleArtifactFile", fileSpan.Name())
+		assert.Equal(t, uploadSpan.SpanContext().SpanID(), fileSpan.Parent().SpanID())
+	}
+}
+
+func TestUploadArtifactsAdaptiveChunks(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	contents := strings.Repeat("0123456789abcdef", 128*1024)
+
+	workingDir := testutil.TempDir(t)
+	writeTestFile(t, filepath.Join(workingDir, "big.bin"), contents)
+
+	executor := newTestArtifactsExecutor()
+	logUploader := newTestLogUploader(t, executor)
+	defer logUploader.Finalize()
+
+	_, err := executor.uploadArtifactsAndParseAnnotations(context.Background(), "artifacts",
+		&api.ArtifactsInstruction{Paths: []string{"*.bin"}},
+		map[string]string{
+			"CIRRUS_WORKING_DIR":               workingDir,
+			"CIRRUS_ARTIFACTS_ADAPTIVE_CHUNKS": "true",
+		}, NewLogUploadObserver(logUploader))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"big.bin": contents}, fake.UploadedFiles())
+
+	// The fake client is fast, so the chunks should've grown past the initial size
+	var largestChunk int
+	for _, entry := range fake.Entries() {
+		if chunk := entry.GetChunk(); chunk != nil && len(chunk.Data) > largestChunk {
+			largestChunk = len(chunk.Data)
+		}
+	}
+	assert.Greater(t, largestChunk, adaptiveChunkInitialSize)
+}
+
+func TestUploadArtifactsSizeLimits(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	workingDir := testutil.TempDir(t)
+	writeTestFile(t, filepath.Join(workingDir, "empty.log"), "")
+	writeTestFile(t, filepath.Join(workingDir, "build.log"), strings.Repeat("x", 100))
+	writeTestFile(t, filepath.Join(workingDir, "huge.log"), strings.Repeat("x", 2000))
+
+	executor := newTestArtifactsExecutor()
+	logUploader := newTestLogUploader(t, executor)
+
+	success := executor.UploadArtifacts(context.Background(), logUploader, "logs",
+		&api.ArtifactsInstruction{Paths: []string{"*.log"}},
+		map[string]string{
+			"CIRRUS_WORKING_DIR":             workingDir,
+			"CIRRUS_ARTIFACTS_MIN_FILE_SIZE": "1B",
+			"CIRRUS_ARTIFACTS_MAX_FILE_SIZE": "1kB",
+		})
+	logUploader.Finalize()
+
+	assert.True(t, success)
+	assert.Equal(t, map[string]string{"build.log": strings.Repeat("x", 100)}, fake.UploadedFiles())
+	assert.Contains(t, fake.Logs(), "empty.log' because it's smaller than 1 B (0 B)")
+	assert.Contains(t, fake.Logs(), "huge.log' because it's larger than 1.0 kB (2.0 kB)")
+}
+
+func TestUploadArtifactsSummary(t *testing.T) {
+	// The first attempt fails, which shouldn't be counted twice
+	fake := &fakeCirrusClient{uploadCloseErrors: []error{errors.New("storage is degraded")}}
+	withFakeClient(t, fake)
+
+	workingDir := testutil.TempDir(t)
+	writeTestFile(t, filepath.Join(workingDir, "build.log"), strings.Repeat("x", 100))
+	writeTestFile(t, filepath.Join(workingDir, "huge.log"), strings.Repeat("x", 2000))
+	writeTestFile(t, filepath.Join(workingDir, "report.xml"), "<xml/>")
+
+	summaryPath := filepath.Join(testutil.TempDir(t), "summary.jsonl")
+
+	executor := newTestArtifactsExecutor()
+
+	for _, name := range []string{"logs", "reports"} {
+		logUploader := newTestLogUploader(t, executor)
+		success := executor.UploadArtifacts(context.Background(), logUploader, name,
+			&api.ArtifactsInstruction{Paths: []string{"*.log", "*.xml", "missing/*"}},
+			map[string]string{
+				"CIRRUS_WORKING_DIR":             workingDir,
+				"CIRRUS_ARTIFACTS_MAX_FILE_SIZE": "1kB",
+				"CIRRUS_ARTIFACTS_SUMMARY":       summaryPath,
+			})
+		logUploader.Finalize()
+		require.True(t, success)
+	}
+
+	contents, err := ioutil.ReadFile(summaryPath)
+	require.NoError(t, err)
+
+	// A line for each of the artifacts instructions
+	lines := strings.Split(strings.TrimSpace(string(contents)), "\n")
+	require.Len(t, lines, 2)
+
+	var summary artifactsSummary
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &summary))
+	summary.DurationMs = 0
+
+	assert.Equal(t, artifactsSummary{
+		Name:    "logs",
+		Success: true,
+		Files:   2,
+		Bytes:   106,
+		Skipped: 1,
+		Patterns: []artifactsPatternSummary{
+			{Pattern: filepath.Join(workingDir, "*.log"), Matched: 2, Files: 1, Bytes: 100, Skipped: 1},
+			{Pattern: filepath.Join(workingDir, "*.xml"), Matched: 1, Files: 1, Bytes: 6},
+			{Pattern: filepath.Join(workingDir, "missing/*")},
+		},
+	}, summary)
+
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &summary))
+	assert.Equal(t, "reports", summary.Name)
+}
+
+func TestParseArtifactSizeLimits(t *testing.T) {
+	limits, err := parseArtifactSizeLimits(map[string]string{"CIRRUS_ARTIFACTS_MAX_FILE_SIZE": "50 MiB"})
+	require.NoError(t, err)
+	assert.Equal(t, artifactSizeLimits{Max: 50 * 1024 * 1024}, limits)
+
+	_, err = parseArtifactSizeLimits(map[string]string{"CIRRUS_ARTIFACTS_MIN_FILE_SIZE": "a lot"})
+	assert.ErrorIs(t, err, ErrArtifactsInvalidOption)
+
+	_, err = parseArtifactSizeLimits(map[string]string{
+		"CIRRUS_ARTIFACTS_MIN_FILE_SIZE": "2MB",
+		"CIRRUS_ARTIFACTS_MAX_FILE_SIZE": "1MB",
+	})
+	assert.ErrorIs(t, err, ErrArtifactsInvalidOption)
+}
+
+func TestUploadArtifactsSortBySize(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	workingDir := testutil.TempDir(t)
+	writeTestFile(t, filepath.Join(workingDir, "a.log"), strings.Repeat("x", 10))
+	writeTestFile(t, filepath.Join(workingDir, "b.log"), strings.Repeat("x", 1000))
+	writeTestFile(t, filepath.Join(workingDir, "c.log"), strings.Repeat("x", 100))
+	writeTestFile(t, filepath.Join(workingDir, "d.log"), strings.Repeat("x", 10))
+
+	executor := newTestArtifactsExecutor()
+	logUploader := newTestLogUploader(t, executor)
+
+	success := executor.UploadArtifacts(context.Background(), logUploader, "logs",
+		&api.ArtifactsInstruction{Paths: []string{"*.log"}},
+		map[string]string{
+			"CIRRUS_WORKING_DIR":       workingDir,
+			"CIRRUS_ARTIFACTS_SORT_BY": "size-desc",
+		})
+	logUploader.Finalize()
+	require.True(t, success)
+
+	var order []string
+	for _, entry := range fake.Entries() {
+		if chunk := entry.GetChunk(); chunk != nil && (len(order) == 0 || order[len(order)-1] != chunk.ArtifactPath) {
+			order = append(order, chunk.ArtifactPath)
+		}
+	}
+	assert.Equal(t, []string{"b.log", "c.log", "a.log", "d.log"}, order)
+
+	_, err := parseArtifactsSortBy(map[string]string{"CIRRUS_ARTIFACTS_SORT_BY": "name"})
+	assert.ErrorIs(t, err, ErrArtifactsInvalidOption)
+}
+
+func TestUploadArtifactsModifiedSince(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	workingDir := testutil.TempDir(t)
+	writeTestFile(t, filepath.Join(workingDir, "checkout.log"), "stale")
+	writeTestFile(t, filepath.Join(workingDir, "build.log"), "fresh")
+
+	buildStart := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(workingDir, "checkout.log"),
+		buildStart.Add(-time.Minute), buildStart.Add(-time.Minute)))
+
+	executor := newTestArtifactsExecutor()
+	logUploader := newTestLogUploader(t, executor)
+
+	success := executor.UploadArtifacts(context.Background(), logUploader, "logs",
+		&api.ArtifactsInstruction{Paths: []string{"*.log"}},
+		map[string]string{
+			"CIRRUS_WORKING_DIR":              workingDir,
+			"CIRRUS_ARTIFACTS_MODIFIED_SINCE": strconv.FormatInt(buildStart.Unix(), 10),
+		})
+	logUploader.Finalize()
+
+	assert.True(t, success)
+	assert.Equal(t, map[string]string{"build.log": "fresh"}, fake.UploadedFiles())
+	assert.Contains(t, fake.Logs(), "Skipping 1 files matching "+filepath.Join(workingDir, "*.log")+
+		" that weren't modified since")
+}
+
+func TestParseArtifactsModifiedSince(t *testing.T) {
+	modifiedSince, ok, err := parseArtifactsModifiedSince(map[string]string{
+		"CIRRUS_ARTIFACTS_MODIFIED_SINCE": "2022-03-04T05:06:07Z",
+	})
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.True(t, modifiedSince.Equal(time.Date(2022, 3, 4, 5, 6, 7, 0, time.UTC)))
+
+	_, ok, err = parseArtifactsModifiedSince(map[string]string{})
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	_, _, err = parseArtifactsModifiedSince(map[string]string{"CIRRUS_ARTIFACTS_MODIFIED_SINCE": "yesterday"})
+	assert.ErrorIs(t, err, ErrArtifactsInvalidOption)
+}
+
+func TestUploadArtifactsCheckstyleAnnotations(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	workingDir := testutil.TempDir(t)
+	writeTestFile(t, filepath.Join(workingDir, "src", "App.kt"), "fun main() {}")
+	writeTestFile(t, filepath.Join(workingDir, "build", "ktlint.xml"), `<checkstyle version="8.0">
+  <file name="`+filepath.Join(workingDir, "src", "App.kt")+`">
+    <error line="1" column="5" severity="error" message="Missing newline" source="standard:final-newline"/>
+  </file>
+</checkstyle>`)
+
+	executor := newTestArtifactsExecutor()
+	logUploader := newTestLogUploader(t, executor)
+
+	success := executor.UploadArtifacts(context.Background(), logUploader, "ktlint",
+		&api.ArtifactsInstruction{Paths: []string{"build/*.xml"}, Format: "checkstyle"},
+		map[string]string{"CIRRUS_WORKING_DIR": workingDir})
+	logUploader.Finalize()
+	require.True(t, success)
+
+	annotations := fake.Annotations()
+	require.Len(t, annotations, 1)
+	assert.Equal(t, api.Annotation_FAILURE, annotations[0].Level)
+	assert.Equal(t, "Missing newline", annotations[0].Message)
+	assert.Equal(t, "standard:final-newline", annotations[0].RawDetails)
+	assert.Equal(t, filepath.Join("src", "App.kt"), annotations[0].FileLocation.Path)
+	assert.EqualValues(t, 1, annotations[0].FileLocation.StartLine)
+	assert.EqualValues(t, 5, annotations[0].FileLocation.StartColumn)
+}
+
+func TestUploadArtifactsESLintAnnotations(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	workingDir := testutil.TempDir(t)
+	writeTestFile(t, filepath.Join(workingDir, "web", "app.js"), "var unused = 1")
+	writeTestFile(t, filepath.Join(workingDir, "eslint.json"), `[{
+  "filePath": "`+filepath.ToSlash(filepath.Join(workingDir, "web", "app.js"))+`",
+  "messages": [
+    {"ruleId": "no-unused-vars", "severity": 2, "message": "'unused' is assigned a value but never used.", "line": 1, "column": 5},
+    {"ruleId": "semi", "severity": 1, "message": "Missing semicolon.", "line": 1, "column": 15}
+  ]
+}]`)
+
+	executor := newTestArtifactsExecutor()
+	logUploader := newTestLogUploader(t, executor)
+
+	success := executor.UploadArtifacts(context.Background(), logUploader, "eslint",
+		&api.ArtifactsInstruction{Paths: []string{"eslint.json"}, Format: "eslint"},
+		map[string]string{"CIRRUS_WORKING_DIR": workingDir})
+	logUploader.Finalize()
+	require.True(t, success)
+
+	annotations := fake.Annotations()
+	require.Len(t, annotations, 2)
+	assert.Equal(t, api.Annotation_FAILURE, annotations[0].Level)
+	assert.Equal(t, "no-unused-vars: 'unused' is assigned a value but never used.", annotations[0].Message)
+	assert.Equal(t, filepath.Join("web", "app.js"), annotations[0].FileLocation.Path)
+	assert.Equal(t, api.Annotation_WARNING, annotations[1].Level)
+	assert.Equal(t, "semi: Missing semicolon.", annotations[1].Message)
+	assert.EqualValues(t, 15, annotations[1].FileLocation.StartColumn)
+}
+
+func TestUploadArtifactsLCOVAnnotations(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	workingDir := testutil.TempDir(t)
+	writeTestFile(t, filepath.Join(workingDir, "src", "math.js"), "")
+	writeTestFile(t, filepath.Join(workingDir, "src", "util.js"), "")
+	writeTestFile(t, filepath.Join(workingDir, "coverage", "lcov.info"), "SF:src/math.js\nDA:1,1\nDA:2,0\n"+
+		"end_of_record\nSF:src/util.js\nDA:1,1\nDA:2,1\nDA:3,1\nDA:4,0\nend_of_record\n")
+
+	executor := newTestArtifactsExecutor()
+	logUploader := newTestLogUploader(t, executor)
+
+	success := executor.UploadArtifacts(context.Background(), logUploader, "coverage",
+		&api.ArtifactsInstruction{Paths: []string{"coverage/lcov.info"}, Format: "lcov"},
+		map[string]string{
+			"CIRRUS_WORKING_DIR":             workingDir,
+			"CIRRUS_LCOV_COVERAGE_THRESHOLD": "70",
+		})
+	logUploader.Finalize()
+	require.True(t, success)
+
+	annotations := fake.Annotations()
+	require.Len(t, annotations, 1)
+	assert.Equal(t, api.Annotation_NOTICE, annotations[0].Level)
+	assert.Equal(t, "Line coverage is 50.0% (1 of 2 lines), which is below 70%", annotations[0].Message)
+	assert.Equal(t, filepath.Join("src", "math.js"), annotations[0].FileLocation.Path)
+
+	_, err := parseAnnotationParserOptions("lcov", map[string]string{"CIRRUS_LCOV_COVERAGE_THRESHOLD": "120"})
+	assert.ErrorIs(t, err, ErrArtifactsInvalidOption)
+}
+
+func TestUploadArtifactsRegexAnnotations(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	workingDir := testutil.TempDir(t)
+	writeTestFile(t, filepath.Join(workingDir, "build.log"), "Compiling...\n"+
+		"src/main.go:12: unreachable code\nDone\n")
+
+	executor := newTestArtifactsExecutor()
+	logUploader := newTestLogUploader(t, executor)
+
+	success := executor.UploadArtifacts(context.Background(), logUploader, "build",
+		&api.ArtifactsInstruction{Paths: []string{"build.log"}, Format: "regex"},
+		map[string]string{
+			"CIRRUS_WORKING_DIR":       workingDir,
+			"CIRRUS_ANNOTATIONS_REGEX": `^(?P<file>\S+\.go):(?P<line>\d+): (?P<message>.+)$`,
+		})
+	logUploader.Finalize()
+	require.True(t, success)
+
+	annotations := fake.Annotations()
+	require.Len(t, annotations, 1)
+	assert.Equal(t, api.Annotation_WARNING, annotations[0].Level)
+	assert.Equal(t, "unreachable code", annotations[0].Message)
+	assert.Equal(t, filepath.Join("src", "main.go"), annotations[0].FileLocation.Path)
+	assert.EqualValues(t, 12, annotations[0].FileLocation.StartLine)
+
+	_, err := parseAnnotationParserOptions("regex", map[string]string{})
+	assert.ErrorIs(t, err, ErrArtifactsInvalidOption)
+
+	_, err = parseAnnotationParserOptions("regex", map[string]string{"CIRRUS_ANNOTATIONS_REGEX": `(?P<file>.+)`})
+	assert.ErrorIs(t, err, ErrArtifactsInvalidOption)
+}
+
+func TestUploadArtifactsGzippedAnnotations(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	var report bytes.Buffer
+	writer := gzip.NewWriter(&report)
+	_, err := writer.Write([]byte(`<testsuite name="MathTest"><testcase classname="MathTest" name="testDivide">` +
+		`<failure message="expected 2 but was 3"/></testcase></testsuite>`))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	workingDir := testutil.TempDir(t)
+	writeTestFile(t, filepath.Join(workingDir, "junit.xml.gz"), report.String())
+
+	executor := newTestArtifactsExecutor()
+	logUploader := newTestLogUploader(t, executor)
+
+	success := executor.UploadArtifacts(context.Background(), logUploader, "junit",
+		&api.ArtifactsInstruction{Paths: []string{"junit.xml.gz"}, Format: "junit"},
+		map[string]string{"CIRRUS_WORKING_DIR": workingDir})
+	logUploader.Finalize()
+	require.True(t, success)
+
+	// Only the annotations parsing sees the decompressed report
+	assert.Equal(t, map[string]string{"junit.xml.gz": report.String()}, fake.UploadedFiles())
+
+	annotations := fake.Annotations()
+	require.Len(t, annotations, 1)
+	assert.Equal(t, api.Annotation_FAILURE, annotations[0].Level)
+	assert.Equal(t, "MathTest.testDivide", annotations[0].Message)
+}
+
+func TestUploadArtifactsWindowsAnnotationPaths(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	// The report was generated on a Windows machine with a different checkout directory
+	workingDir := testutil.TempDir(t)
+	writeTestFile(t, filepath.Join(workingDir, "src", "App.kt"), "fun main() {}")
+	writeTestFile(t, filepath.Join(workingDir, "ktlint.xml"), `<checkstyle version="8.0">
+  <file name="D:\a\project\src\App.kt">
+    <error line="1" column="5" severity="error" message="Missing newline" source="standard:final-newline"/>
+  </file>
+</checkstyle>`)
+
+	executor := newTestArtifactsExecutor()
+	logUploader := newTestLogUploader(t, executor)
+
+	success := executor.UploadArtifacts(context.Background(), logUploader, "ktlint",
+		&api.ArtifactsInstruction{Paths: []string{"ktlint.xml"}, Format: "checkstyle"},
+		map[string]string{"CIRRUS_WORKING_DIR": workingDir})
+	logUploader.Finalize()
+	require.True(t, success)
+
+	annotations := fake.Annotations()
+	require.Len(t, annotations, 1)
+	assert.Equal(t, filepath.Join("src", "App.kt"), filepath.FromSlash(annotations[0].FileLocation.Path))
+}
+
+func TestNormalizeWindowsAnnotationPaths(t *testing.T) {
+	workingDir := testutil.TempDir(t)
+	writeTestFile(t, filepath.Join(workingDir, "src", "foo.go"), "package foo")
+
+	testCases := []struct {
+		Name       string
+		WorkingDir string
+		Path       string
+		Expected   string
+	}{
+		{"within working dir", `C:\repo`, `C:\repo\src\foo.go`, "src/foo.go"},
+		{"within working dir with forward slashes", `C:\repo`, `c:/Repo/src/foo.go`, "src/foo.go"},
+		{"within working dir with trailing slash", `C:\repo\`, `C:\repo\src\foo.go`, "src/foo.go"},
+		{"outside of working dir", workingDir, `D:\a\project\src\foo.go`, "src/foo.go"},
+		{"outside of working dir and missing", workingDir, `D:\a\project\src\bar.go`, "a/project/src/bar.go"},
+		{"relative with backslashes", workingDir, `src\foo.go`, "src/foo.go"},
+		{"untouched", workingDir, "src/foo.go", "src/foo.go"},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+
+		t.Run(testCase.Name, func(t *testing.T) {
+			result := normalizeWindowsAnnotationPaths(testCase.WorkingDir, []model.Annotation{{Path: testCase.Path}})
+			assert.Equal(t, testCase.Expected, result[0].Path)
+		})
+	}
+}
+
+func TestUploadArtifactsBundleDirs(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	workingDir := testutil.TempDir(t)
+	writeTestFile(t, filepath.Join(workingDir, "site", "index.html"), "<html></html>")
+	writeTestFile(t, filepath.Join(workingDir, "site", "css", "main.css"), "body {}")
+	require.NoError(t, os.MkdirAll(filepath.Join(workingDir, "site", "empty"), 0755))
+	if runtime.GOOS != "windows" {
+		require.NoError(t, os.Symlink("index.html", filepath.Join(workingDir, "site", "home.html")))
+	}
+
+	executor := newTestArtifactsExecutor()
+	logUploader := newTestLogUploader(t, executor)
+	defer logUploader.Finalize()
+
+	_, err := executor.uploadArtifactsAndParseAnnotations(context.Background(), "site",
+		&api.ArtifactsInstruction{Paths: []string{"site"}},
+		map[string]string{
+			"CIRRUS_WORKING_DIR":           workingDir,
+			"CIRRUS_ARTIFACTS_BUNDLE_SITE": "true",
+		}, NewLogUploadObserver(logUploader))
+	require.NoError(t, err)
+
+	uploadedFiles := fake.UploadedFiles()
+	require.Contains(t, uploadedFiles, "site.tar")
+
+	entries := map[string]*tar.Header{}
+	contents := map[string]string{}
+	tarReader := tar.NewReader(strings.NewReader(uploadedFiles["site.tar"]))
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+
+		entries[header.Name] = header
+		data, err := io.ReadAll(tarReader)
+		require.NoError(t, err)
+		contents[header.Name] = string(data)
+	}
+
+	require.Contains(t, entries, "site/empty/")
+	assert.Equal(t, byte(tar.TypeDir), entries["site/empty/"].Typeflag)
+	assert.Equal(t, "<html></html>", contents["site/index.html"])
+	assert.Equal(t, "body {}", contents["site/css/main.css"])
+	if runtime.GOOS != "windows" {
+		require.Contains(t, entries, "site/home.html")
+		assert.Equal(t, byte(tar.TypeSymlink), entries["site/home.html"].Typeflag)
+		assert.Equal(t, "index.html", entries["site/home.html"].Linkname)
+	}
+}
+
+func TestUploadArtifactsSkipsDirsWithoutBundling(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	workingDir := testutil.TempDir(t)
+	writeTestFile(t, filepath.Join(workingDir, "site", "index.html"), "<html></html>")
+
+	executor := newTestArtifactsExecutor()
+	logUploader := newTestLogUploader(t, executor)
+	defer logUploader.Finalize()
+
+	_, err := executor.uploadArtifactsAndParseAnnotations(context.Background(), "site",
+		&api.ArtifactsInstruction{Paths: []string{"site"}},
+		map[string]string{"CIRRUS_WORKING_DIR": workingDir}, NewLogUploadObserver(logUploader))
+	require.NoError(t, err)
+	assert.Empty(t, fake.UploadedFiles())
+}
+
+func TestUploadArtifactsMirror(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	workingDir := testutil.TempDir(t)
+	writeTestFile(t, filepath.Join(workingDir, "build", "app.log"), "app")
+	writeTestFile(t, filepath.Join(workingDir, "build", "nested", "test.log"), "test")
+
+	mirrorDir := testutil.TempDir(t)
+
+	executor := newTestArtifactsExecutor()
+	logUploader := newTestLogUploader(t, executor)
+	defer logUploader.Finalize()
+
+	_, err := executor.uploadArtifactsAndParseAnnotations(context.Background(), "logs",
+		&api.ArtifactsInstruction{Paths: []string{"build/**/*.log"}},
+		map[string]string{
+			"CIRRUS_WORKING_DIR":         workingDir,
+			"CIRRUS_ARTIFACT_MIRROR_DIR": mirrorDir,
+		}, NewLogUploadObserver(logUploader))
+	require.NoError(t, err)
+
+	for relativePath, contents := range fake.UploadedFiles() {
+		mirrored, err := os.ReadFile(filepath.Join(mirrorDir, filepath.FromSlash(relativePath)))
+		require.NoError(t, err)
+		assert.Equal(t, contents, string(mirrored))
+	}
+	assert.Len(t, fake.UploadedFiles(), 2)
+}
+
+func TestUploadArtifactsMirrorFailureIsIgnored(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	workingDir := testutil.TempDir(t)
+	writeTestFile(t, filepath.Join(workingDir, "app.log"), "app")
+
+	// Can't create anything inside of a regular file
+	mirrorDir := filepath.Join(testutil.TempDir(t), "not-a-folder")
+	writeTestFile(t, mirrorDir, "")
+
+	executor := newTestArtifactsExecutor()
+	logUploader := newTestLogUploader(t, executor)
+	defer logUploader.Finalize()
+
+	_, err := executor.uploadArtifactsAndParseAnnotations(context.Background(), "logs",
+		&api.ArtifactsInstruction{Paths: []string{"*.log"}},
+		map[string]string{
+			"CIRRUS_WORKING_DIR":         workingDir,
+			"CIRRUS_ARTIFACT_MIRROR_DIR": mirrorDir,
+		}, NewLogUploadObserver(logUploader))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"app.log": "app"}, fake.UploadedFiles())
+}
+
+func TestUploadArtifactsCircuitBreaker(t *testing.T) {
+	unavailable := errors.New("service unavailable")
+
+	fake := &fakeCirrusClient{uploadCloseErrors: []error{unavailable, unavailable}}
+	withFakeClient(t, fake)
+
+	workingDir := testutil.TempDir(t)
+	writeTestFile(t, filepath.Join(workingDir, "a.txt"), "contents")
+
+	env := map[string]string{
+		"CIRRUS_WORKING_DIR":                         workingDir,
+		"CIRRUS_ARTIFACTS_CIRCUIT_BREAKER_THRESHOLD": "2",
+		"CIRRUS_ARTIFACTS_RETRY_BUDGET":              "5",
+	}
+
+	executor := newTestArtifactsExecutor()
+
+	upload := func(name string) (bool, string) {
+		logUploader := newTestLogUploader(t, executor)
+		success := executor.UploadArtifacts(context.Background(), logUploader, name,
+			&api.ArtifactsInstruction{Paths: []string{"*.txt"}}, env)
+		logUploader.Finalize()
+
+		return success, fake.Logs()
+	}
+
+	// Fails fast without using up the whole retry budget
+	success, logs := upload("first")
+	assert.False(t, success)
+	assert.Contains(t, logs, "backend appears unavailable: 2 attempts to upload have failed")
+	assert.Equal(t, 2, fake.uploadsClosed)
+
+	// The backend has recovered in the meantime
+	success, _ = upload("second")
+	assert.True(t, success)
+	assert.Equal(t, 3, fake.uploadsClosed)
+}
+
+func TestUploadArtifactsCircuitBreakerSkipsRemainingFiles(t *testing.T) {
+	fake := &fakeCirrusClient{uploadSendFailures: map[string]int{"b.txt": 10}}
+	withFakeClient(t, fake)
+
+	workingDir := testutil.TempDir(t)
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		writeTestFile(t, filepath.Join(workingDir, name), name)
+	}
+
+	executor := newTestArtifactsExecutor()
+	logUploader := newTestLogUploader(t, executor)
+
+	success := executor.UploadArtifacts(context.Background(), logUploader, "artifacts",
+		&api.ArtifactsInstruction{Paths: []string{"*.txt"}},
+		map[string]string{
+			"CIRRUS_WORKING_DIR":                         workingDir,
+			"CIRRUS_ARTIFACTS_CIRCUIT_BREAKER_THRESHOLD": "2",
+			"CIRRUS_ARTIFACTS_RETRY_BUDGET":              "5",
+		})
+	logUploader.Finalize()
+	require.False(t, success)
+
+	assert.Contains(t, fake.Logs(), "backend appears unavailable: 2 attempts to upload have failed")
+
+	// The failed file was only tried until the threshold was reached, despite the retry budget left
+	assert.Equal(t, 8, fake.uploadSendFailures["b.txt"])
+
+	// And the file after it wasn't tried at all
+	for _, entry := range fake.Entries() {
+		if chunk := entry.GetChunk(); chunk != nil {
+			assert.NotEqual(t, "c.txt", chunk.ArtifactPath)
+		}
+	}
+}
+
+func TestUploadArtifactsRetriesFailedFile(t *testing.T) {
+	fake := &fakeCirrusClient{uploadSendFailures: map[string]int{"b.txt": 1}}
+	withFakeClient(t, fake)
+
+	workingDir := testutil.TempDir(t)
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		writeTestFile(t, filepath.Join(workingDir, name), name)
+	}
+
+	executor := newTestArtifactsExecutor()
+	logUploader := newTestLogUploader(t, executor)
+
+	success := executor.UploadArtifacts(context.Background(), logUploader, "artifacts",
+		&api.ArtifactsInstruction{Paths: []string{"*.txt"}},
+		map[string]string{"CIRRUS_WORKING_DIR": workingDir})
+	logUploader.Finalize()
+	require.True(t, success)
+
+	assert.Equal(t, map[string]string{"a.txt": "a.txt", "b.txt": "b.txt", "c.txt": "c.txt"}, fake.UploadedFiles())
+	assert.Contains(t, fake.Logs(), "Re-trying to upload "+filepath.Join(workingDir, "b.txt")+" (1 of 1 retries used)...")
+
+	// Only the failed file was sent again
+	chunks := map[string]int{}
+	for _, entry := range fake.Entries() {
+		if chunk := entry.GetChunk(); chunk != nil {
+			chunks[chunk.ArtifactPath]++
+		}
+	}
+	assert.Equal(t, map[string]int{"a.txt": 1, "b.txt": 1, "c.txt": 1}, chunks)
+}
+
+func TestUploadArtifactsRetryBudget(t *testing.T) {
+	rejected := errors.New("storage is degraded")
+
+	testCases := map[string]struct {
+		budget      string
+		closeErrors []error
+		success     bool
+		attempts    int
+	}{
+		"no retries":       {"0", []error{rejected}, false, 1},
+		"within budget":    {"3", []error{rejected, rejected, rejected}, true, 4},
+		"budget exhausted": {"2", []error{rejected, rejected, rejected}, false, 3},
+	}
+
+	for name, testCase := range testCases {
+		testCase := testCase
+
+		t.Run(name, func(t *testing.T) {
+			fake := &fakeCirrusClient{uploadCloseErrors: testCase.closeErrors}
+			withFakeClient(t, fake)
+
+			workingDir := testutil.TempDir(t)
+			writeTestFile(t, filepath.Join(workingDir, "a.txt"), "contents")
+
+			executor := newTestArtifactsExecutor()
+			logUploader := newTestLogUploader(t, executor)
+
+			success := executor.UploadArtifacts(context.Background(), logUploader, "artifacts",
+				&api.ArtifactsInstruction{Paths: []string{"*.txt"}},
+				map[string]string{
+					"CIRRUS_WORKING_DIR":                         workingDir,
+					"CIRRUS_ARTIFACTS_RETRY_BUDGET":              testCase.budget,
+					"CIRRUS_ARTIFACTS_CIRCUIT_BREAKER_THRESHOLD": "0",
+				})
+			logUploader.Finalize()
+
+			assert.Equal(t, testCase.success, success)
+			assert.Equal(t, testCase.attempts, fake.uploadsClosed)
+			if name == "budget exhausted" {
+				assert.Contains(t, fake.Logs(), "Re-trying to upload artifacts (2 of 2 retries used)...")
+				assert.Contains(t, fake.Logs(), "after using up the retry budget of 2: error from upload stream")
+			}
+		})
+	}
+}
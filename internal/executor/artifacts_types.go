@@ -0,0 +1,64 @@
+package executor
+
+import (
+	"fmt"
+	"github.com/bmatcuk/doublestar"
+	"strings"
+)
+
+// ArtifactTypeOverride assigns a type to the artifact files whose path relative
+// to the CIRRUS_WORKING_DIR matches the Pattern.
+type ArtifactTypeOverride struct {
+	Pattern string
+	Type    string
+}
+
+// artifactTypeOverridesOption returns the type overrides configured for the artifacts command via
+// CIRRUS_ARTIFACTS_TYPES_<COMMAND>, falling back to the CIRRUS_ARTIFACTS_TYPES for all of the commands.
+func artifactTypeOverridesOption(customEnv map[string]string, name string) string {
+	if value, ok := customEnv[commandSpecificEnvName("CIRRUS_ARTIFACTS_TYPES", name)]; ok {
+		return value
+	}
+
+	return customEnv["CIRRUS_ARTIFACTS_TYPES"]
+}
+
+// ParseArtifactTypeOverrides parses the CIRRUS_ARTIFACTS_TYPES behavioral environment variable,
+// which contains newline or comma-separated "glob=type" pairs (e.g. "**/*.log=text/plain").
+func ParseArtifactTypeOverrides(text string) ([]ArtifactTypeOverride, error) {
+	var result []ArtifactTypeOverride
+
+	for _, rawOverride := range strings.FieldsFunc(text, func(r rune) bool {
+		return r == '\n' || r == ','
+	}) {
+		rawOverride = strings.TrimSpace(rawOverride)
+		if rawOverride == "" {
+			continue
+		}
+
+		parts := strings.SplitN(rawOverride, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("%w: artifact type override %q should be in glob=type format",
+				ErrArtifactsInvalidOption, rawOverride)
+		}
+
+		result = append(result, ArtifactTypeOverride{
+			Pattern: strings.TrimSpace(parts[0]),
+			Type:    strings.TrimSpace(parts[1]),
+		})
+	}
+
+	return result, nil
+}
+
+// artifactType returns the type of the first override matching the slash-separated
+// relativePath or the defaultType if there's no match.
+func artifactType(overrides []ArtifactTypeOverride, relativePath string, defaultType string) string {
+	for _, override := range overrides {
+		if matched, _ := doublestar.Match(override.Pattern, relativePath); matched {
+			return override.Type
+		}
+	}
+
+	return defaultType
+}
@@ -0,0 +1,306 @@
+package executor
+
+import (
+	"context"
+	"github.com/cirruslabs/cirrus-ci-agent/api"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/client"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"io"
+	"time"
+)
+
+// FileMeta describes the file passed to the Uploader.
+type FileMeta struct {
+	// Artifact type with the CIRRUS_ARTIFACTS_TYPES overrides applied
+	Type string
+
+	// Expected size of the file, negative when unknown (e.g. for the bundled folders)
+	Size int64
+}
+
+// Uploader is the transport used to upload the files of a single artifacts instruction.
+//
+// Begin is called before uploading the files matched by each of the patterns, then UploadFile
+// is called sequentially for each of these files. The relPath is slash-separated and relative
+// to the CIRRUS_WORKING_DIR.
+//
+// Finish is only called when all the files were uploaded and returns once the artifacts
+// are persisted. Close is always called at the end to release the resources, aborting
+// the upload if it wasn't finished.
+type Uploader interface {
+	Begin(ctx context.Context) error
+	UploadFile(ctx context.Context, relPath string, r io.Reader, meta FileMeta) error
+	Finish(ctx context.Context) error
+	Close() error
+}
+
+// newArtifactsUploader creates the Uploader configured for the artifacts instruction,
+// which fans the files out when there are multiple destinations.
+func (executor *Executor) newArtifactsUploader(
+	ctx context.Context,
+	name string,
+	artifactsInstruction *api.ArtifactsInstruction,
+	customEnv map[string]string,
+) (Uploader, error) {
+	destinations := artifactsDestinations(customEnv, name)
+
+	policy, err := parseArtifactsFanoutPolicy(customEnv)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(destinations) == 1 {
+		return executor.newArtifactsDestinationUploader(ctx, destinations[0], name, artifactsInstruction, customEnv)
+	}
+
+	var fanoutDestinations []*FanoutDestination
+
+	for _, destination := range destinations {
+		uploader, err := executor.newArtifactsDestinationUploader(ctx, destination, name, artifactsInstruction, customEnv)
+		if err != nil {
+			for _, fanoutDestination := range fanoutDestinations {
+				_ = fanoutDestination.Uploader.Close()
+			}
+			return nil, err
+		}
+
+		fanoutDestinations = append(fanoutDestinations, &FanoutDestination{Name: destination, Uploader: uploader})
+	}
+
+	return NewMultiUploader(policy, fanoutDestinations, func(destination string, err error) {
+		executor.diagnostics.Warnf("Dropping artifacts destination %s for %s: %v", destination, name, err)
+	}), nil
+}
+
+// grpcArtifactsUploader streams the artifacts to the Cirrus CI API as api.ArtifactEntry messages.
+type grpcArtifactsUploader struct {
+	executor             *Executor
+	name                 string
+	artifactsInstruction *api.ArtifactsInstruction
+	client               api.CirrusCIService_UploadArtifactsClient
+
+	// All chunks sent after the upload header are attributed to the type specified in it,
+	// so keep track of it to know when a new header is needed for type overrides
+	currentType string
+
+	// Buffer for reading the files, which is as large as the largest chunk
+	copyBuffer []byte
+	// The chunk size adapts to the link speed over the whole upload when enabled
+	chunkSize *adaptiveChunkSize
+
+	keepaliveThreshold int64
+	keepaliveInterval  time.Duration
+
+	// The stream is closed explicitly on success, since only then the server
+	// acknowledges that the artifacts were persisted
+	closed bool
+}
+
+func (executor *Executor) newGRPCArtifactsUploader(
+	ctx context.Context,
+	name string,
+	artifactsInstruction *api.ArtifactsInstruction,
+	customEnv map[string]string,
+) (*grpcArtifactsUploader, error) {
+	keepaliveThreshold, keepaliveInterval, err := parseArtifactsKeepalive(customEnv)
+	if err != nil {
+		return nil, err
+	}
+
+	chunkLimits, err := parseArtifactsChunkLimits(customEnv)
+	if err != nil {
+		return nil, err
+	}
+
+	uploader := &grpcArtifactsUploader{
+		executor:             executor,
+		name:                 name,
+		artifactsInstruction: artifactsInstruction,
+		keepaliveThreshold:   keepaliveThreshold,
+		keepaliveInterval:    keepaliveInterval,
+	}
+
+	copyBufferSize := chunkLimits.chunkSize
+	if customEnv["CIRRUS_ARTIFACTS_ADAPTIVE_CHUNKS"] == "true" {
+		uploader.chunkSize = newAdaptiveChunkSize()
+		uploader.chunkSize.limitTo(chunkLimits.maxChunkSize())
+		copyBufferSize = uploader.chunkSize.max
+	}
+	uploader.copyBuffer = make([]byte, copyBufferSize)
+
+	callOptions := append([]grpc.CallOption{grpc.MaxCallSendMsgSize(chunkLimits.maxMessageSize)},
+		executor.artifactsGzip.callOptions(customEnv)...)
+	uploader.client, err = client.CirrusClient.UploadArtifacts(ctx, callOptions...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to initialize artifacts upload client")
+	}
+
+	return uploader, nil
+}
+
+func (uploader *grpcArtifactsUploader) Begin(ctx context.Context) error {
+	return uploader.sendUploadHeader(uploader.artifactsInstruction.Type)
+}
+
+func (uploader *grpcArtifactsUploader) sendUploadHeader(artifactType string) error {
+	chunkMsg := api.ArtifactEntry_ArtifactsUpload_{
+		ArtifactsUpload: &api.ArtifactEntry_ArtifactsUpload{
+			TaskIdentification: uploader.executor.taskIdentification,
+			Name:               uploader.name,
+			Type:               artifactType,
+			Format:             uploader.artifactsInstruction.Format,
+		},
+	}
+	err := uploader.client.Send(&api.ArtifactEntry{Value: &chunkMsg})
+	if err != nil {
+		return errors.Wrap(err, "failed to initialize artifacts upload")
+	}
+	uploader.currentType = artifactType
+	return nil
+}
+
+func (uploader *grpcArtifactsUploader) UploadFile(
+	ctx context.Context,
+	relPath string,
+	r io.Reader,
+	meta FileMeta,
+) error {
+	if meta.Type != uploader.currentType {
+		if err := uploader.sendUploadHeader(meta.Type); err != nil {
+			return err
+		}
+	}
+
+	var keepalive *uploadKeepalive
+	if uploader.keepaliveThreshold != artifactsKeepaliveDisabled &&
+		(meta.Size < 0 || meta.Size >= uploader.keepaliveThreshold) {
+		keepalive = startUploadKeepalive(uploader.keepaliveInterval, func() error {
+			return uploader.client.Send(newArtifactsKeepaliveEntry())
+		})
+		defer keepalive.Stop()
+	}
+
+	chunkWriter := &artifactChunkWriter{uploader: uploader, relPath: relPath, keepalive: keepalive}
+
+	_, err := io.CopyBuffer(chunkWriter, &progressCheckingReader{reader: r}, uploader.copyBuffer)
+	if chunkWriter.err != nil {
+		return errors.Wrapf(chunkWriter.err, "failed to upload artifact file %s", relPath)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to read artifact file %s", relPath)
+	}
+
+	return nil
+}
+
+// artifactChunkWriter sends the data written to it as the chunks of a single artifact file,
+// splitting the writes larger than the chunk size into multiple chunks.
+type artifactChunkWriter struct {
+	uploader  *grpcArtifactsUploader
+	relPath   string
+	keepalive *uploadKeepalive
+
+	// The error sending the chunks, as opposed to the errors reading the file
+	err error
+}
+
+func (writer *artifactChunkWriter) Write(p []byte) (int, error) {
+	var written int
+
+	for len(p) > 0 {
+		data := p
+		if chunkSize := writer.uploader.nextChunkSize(); len(data) > chunkSize {
+			data = data[:chunkSize]
+		}
+
+		chunkMsg := api.ArtifactEntry_Chunk{Chunk: &api.ArtifactEntry_ArtifactChunk{
+			ArtifactPath: writer.relPath,
+			Data:         data,
+		}}
+		sendStart := time.Now()
+		err := writer.keepalive.Do(func() error {
+			return writer.uploader.client.Send(&api.ArtifactEntry{Value: &chunkMsg})
+		})
+		if err != nil {
+			writer.err = err
+			return written, err
+		}
+		if writer.uploader.chunkSize != nil {
+			writer.uploader.chunkSize.Observe(len(data), time.Since(sendStart))
+		}
+
+		written += len(data)
+		p = p[len(data):]
+	}
+
+	return written, nil
+}
+
+func (uploader *grpcArtifactsUploader) nextChunkSize() int {
+	if uploader.chunkSize != nil {
+		if size := uploader.chunkSize.Size(); size > 0 && size < len(uploader.copyBuffer) {
+			return size
+		}
+	}
+
+	return len(uploader.copyBuffer)
+}
+
+func (uploader *grpcArtifactsUploader) Finish(ctx context.Context) error {
+	uploader.closed = true
+	if _, err := uploader.client.CloseAndRecv(); err != nil {
+		return errors.Wrap(err, "error from upload stream")
+	}
+
+	return nil
+}
+
+func (uploader *grpcArtifactsUploader) Close() error {
+	if uploader.closed {
+		return nil
+	}
+	uploader.closed = true
+
+	_, err := uploader.client.CloseAndRecv()
+	return err
+}
+
+// maxConsecutiveEmptyReads mirrors the limit used by the bufio package
+const maxConsecutiveEmptyReads = 100
+
+// progressCheckingReader fails once the reader keeps returning no data and no error,
+// which is legal, but would make the io.Copy() retry forever if the reader never makes progress.
+type progressCheckingReader struct {
+	reader     io.Reader
+	emptyReads int
+}
+
+func (progressCheckingReader *progressCheckingReader) Read(p []byte) (int, error) {
+	n, err := progressCheckingReader.reader.Read(p)
+
+	if n == 0 && err == nil && len(p) != 0 {
+		progressCheckingReader.emptyReads++
+		if progressCheckingReader.emptyReads >= maxConsecutiveEmptyReads {
+			return 0, io.ErrNoProgress
+		}
+	} else {
+		progressCheckingReader.emptyReads = 0
+	}
+
+	return n, err
+}
+
+// countingReader counts the bytes read through it, which are the bytes
+// uploaded once the Uploader has successfully consumed the whole reader.
+type countingReader struct {
+	reader io.Reader
+	n      int64
+}
+
+func (countingReader *countingReader) Read(p []byte) (int, error) {
+	n, err := countingReader.reader.Read(p)
+	countingReader.n += int64(n)
+
+	return n, err
+}
@@ -0,0 +1,94 @@
+package executor
+
+import (
+	"context"
+	"errors"
+	"github.com/cirruslabs/cirrus-ci-agent/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestGRPCArtifactsUploader(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	executor := newTestArtifactsExecutor()
+	uploader, err := executor.newArtifactsUploader(context.Background(), "artifacts",
+		&api.ArtifactsInstruction{Type: "text/plain"}, map[string]string{})
+	require.NoError(t, err)
+	defer uploader.Close()
+
+	require.NoError(t, uploader.Begin(context.Background()))
+	require.NoError(t, uploader.UploadFile(context.Background(), "build.log",
+		strings.NewReader("log"), FileMeta{Type: "text/plain", Size: 3}))
+	require.NoError(t, uploader.UploadFile(context.Background(), "report.xml",
+		strings.NewReader("<xml/>"), FileMeta{Type: "text/xml", Size: -1}))
+	require.NoError(t, uploader.Finish(context.Background()))
+
+	assert.Equal(t, map[string]string{"build.log": "log", "report.xml": "<xml/>"}, fake.UploadedFiles())
+
+	// A new header is only sent when the type changes
+	var headerTypes []string
+	for _, entry := range fake.Entries() {
+		if header := entry.GetArtifactsUpload(); header != nil {
+			headerTypes = append(headerTypes, header.Type)
+		}
+	}
+	assert.Equal(t, []string{"text/plain", "text/xml"}, headerTypes)
+}
+
+func TestGRPCArtifactsUploaderSplitsChunks(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	executor := newTestArtifactsExecutor()
+	uploader, err := executor.newArtifactsUploader(context.Background(), "artifacts",
+		&api.ArtifactsInstruction{}, map[string]string{"CIRRUS_ARTIFACTS_CHUNK_SIZE": "4B"})
+	require.NoError(t, err)
+	defer uploader.Close()
+
+	require.NoError(t, uploader.Begin(context.Background()))
+	require.NoError(t, uploader.UploadFile(context.Background(), "digits.txt",
+		strings.NewReader("0123456789"), FileMeta{Size: 10}))
+	require.NoError(t, uploader.Finish(context.Background()))
+
+	var chunks []string
+	for _, entry := range fake.Entries() {
+		if chunk := entry.GetChunk(); chunk != nil {
+			chunks = append(chunks, string(chunk.Data))
+		}
+	}
+	assert.Equal(t, []string{"0123", "4567", "89"}, chunks)
+}
+
+type noProgressReader struct{}
+
+func (noProgressReader) Read(p []byte) (int, error) {
+	return 0, nil
+}
+
+func TestGRPCArtifactsUploaderReadErrors(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	executor := newTestArtifactsExecutor()
+	uploader, err := executor.newArtifactsUploader(context.Background(), "artifacts",
+		&api.ArtifactsInstruction{}, map[string]string{})
+	require.NoError(t, err)
+	defer uploader.Close()
+
+	require.NoError(t, uploader.Begin(context.Background()))
+
+	readErr := errors.New("disk is on fire")
+	err = uploader.UploadFile(context.Background(), "broken.log",
+		io.MultiReader(strings.NewReader("partial"), iotest.ErrReader(readErr)), FileMeta{Size: -1})
+	assert.ErrorIs(t, err, readErr)
+	assert.Contains(t, err.Error(), "failed to read artifact file broken.log")
+
+	err = uploader.UploadFile(context.Background(), "stuck.log", noProgressReader{}, FileMeta{Size: -1})
+	assert.ErrorIs(t, err, io.ErrNoProgress)
+}
@@ -0,0 +1,31 @@
+package executor
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestPathIsWithinWorkingDirWindows(t *testing.T) {
+	testCases := []struct {
+		Name       string
+		WorkingDir string
+		Path       string
+		Expected   bool
+	}{
+		{"backslashes", `C:\work`, `C:\work\build\a.txt`, true},
+		{"slash-separated working dir", `C:/work`, `C:\work\build\a.txt`, true},
+		{"mixed separators", `C:/work`, `C:\work/build\a.txt`, true},
+		{"outside", `C:/work`, `C:\other\a.txt`, false},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+
+		t.Run(testCase.Name, func(t *testing.T) {
+			matched, err := pathIsWithinWorkingDir(testCase.WorkingDir, testCase.Path)
+			require.NoError(t, err)
+			assert.Equal(t, testCase.Expected, matched)
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/cirruslabs/cirrus-ci-agent/api"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// processIsRunning treats zombies as not running, since we don't control who reaps them
+func processIsRunning(pid int) bool {
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return false
+	}
+
+	fields := bytes.Fields(stat[bytes.LastIndexByte(stat, ')')+1:])
+
+	return len(fields) != 0 && string(fields[0]) != "Z"
+}
+
+func TestBackgroundCommandProcessTreeIsKilled(t *testing.T) {
+	fake := &fakeCirrusClient{logStreamCapacities: []int{-1}}
+	withFakeClient(t, fake)
+
+	pidFile := filepath.Join(testutil.TempDir(t), "pid")
+
+	executor := newTestArtifactsExecutor()
+
+	_, err := executor.performStep(context.Background(), &api.Command{
+		Name: "server",
+		Instruction: &api.Command_BackgroundScriptInstruction{
+			BackgroundScriptInstruction: &api.BackgroundScriptInstruction{
+				Scripts: []string{"sleep 300 &", "echo $! > " + pidFile + ".tmp", "mv " + pidFile + ".tmp " + pidFile, "wait"},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	var childPid int
+	require.Eventually(t, func() bool {
+		contents, err := ioutil.ReadFile(pidFile)
+		if err != nil {
+			return false
+		}
+		childPid, err = strconv.Atoi(string(bytes.TrimSpace(contents)))
+		return err == nil
+	}, 10*time.Second, 50*time.Millisecond)
+	require.True(t, processIsRunning(childPid))
+
+	executor.cleanupBackgroundCommands()
+
+	assert.Eventually(t, func() bool {
+		return !processIsRunning(childPid)
+	}, 10*time.Second, 50*time.Millisecond)
+	assert.Contains(t, fake.Logs(), "Stopped background script server along with its")
+	assert.Contains(t, fake.Logs(), "Command 'server' was killed by signal 9 (killed) after")
+	assert.Empty(t, executor.backgroundCommands)
+}
+
+func TestBackgroundCommandOutputIsKeptInItsOwnLog(t *testing.T) {
+	fake := &fakeCirrusClient{logStreamCapacities: []int{-1, -1}}
+	withFakeClient(t, fake)
+
+	markerFile := filepath.Join(testutil.TempDir(t), "marker")
+
+	executor := newTestArtifactsExecutor()
+
+	_, err := executor.performStep(context.Background(), &api.Command{
+		Name: "server",
+		Instruction: &api.Command_BackgroundScriptInstruction{
+			BackgroundScriptInstruction: &api.BackgroundScriptInstruction{
+				Scripts: []string{"seq 1 20000", "touch " + markerFile, "sleep 300"},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	_, err = executor.performStep(context.Background(), &api.Command{
+		Name: "main",
+		Instruction: &api.Command_ScriptInstruction{
+			ScriptInstruction: &api.ScriptInstruction{Scripts: []string{"echo main output"}},
+		},
+	})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(markerFile)
+		return err == nil
+	}, 10*time.Second, 50*time.Millisecond)
+
+	executor.cleanupBackgroundCommands()
+
+	serverLogs := fake.CommandLogs("server")
+	assert.Contains(t, serverLogs, "\n20000\n")
+	assert.NotContains(t, serverLogs, "main output")
+	assert.NotContains(t, fake.CommandLogs("main"), "20000")
+}
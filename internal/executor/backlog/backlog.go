@@ -0,0 +1,160 @@
+package backlog
+
+// Backlog is a FIFO of byte chunks bounded by the total number of bytes stored.
+// When the limit is exceeded, the oldest bytes are dropped and accounted for,
+// so that the consumer can signal the gap.
+//
+// The chunks that were sent are kept until they're acknowledged, so that
+// they can be re-sent if the consumer finds out that they were lost.
+type Backlog struct {
+	chunks  [][]byte
+	size    int
+	limit   int
+	dropped uint64
+
+	// Number (and size) of the oldest chunks that were sent, but not yet acknowledged
+	sent     int
+	sentSize int
+
+	// Bytes of the sent chunks dropped before being acknowledged, they only
+	// count as dropped once it turns out that the chunks need to be re-sent
+	sentDropped uint64
+}
+
+func New(limit int) *Backlog {
+	return &Backlog{
+		limit: limit,
+	}
+}
+
+// Push appends the chunk to the end of the backlog, dropping the oldest bytes if necessary.
+func (backlog *Backlog) Push(chunk []byte) {
+	if len(chunk) == 0 {
+		return
+	}
+
+	// Only the tail of a chunk that's bigger than the whole backlog can fit
+	if len(chunk) > backlog.limit {
+		backlog.dropped += uint64(len(chunk) - backlog.limit)
+		chunk = chunk[len(chunk)-backlog.limit:]
+	}
+
+	backlog.chunks = append(backlog.chunks, chunk)
+	backlog.size += len(chunk)
+
+	for backlog.size > backlog.limit {
+		overflow := backlog.size - backlog.limit
+		oldest := backlog.chunks[0]
+
+		dropped := len(oldest)
+		if dropped <= overflow {
+			backlog.chunks = backlog.chunks[1:]
+		} else {
+			dropped = overflow
+			backlog.chunks[0] = oldest[overflow:]
+		}
+		backlog.size -= dropped
+
+		if backlog.sent == 0 {
+			backlog.dropped += uint64(dropped)
+			continue
+		}
+
+		backlog.sentSize -= dropped
+		backlog.sentDropped += uint64(dropped)
+		if dropped == len(oldest) {
+			backlog.sent--
+		}
+	}
+}
+
+// Peek returns the oldest chunk that wasn't sent yet or nil if there's none.
+func (backlog *Backlog) Peek() []byte {
+	if backlog.sent == len(backlog.chunks) {
+		return nil
+	}
+
+	return backlog.chunks[backlog.sent]
+}
+
+// MarkSent marks the chunk returned by Peek() as sent, it's kept until acknowledged.
+func (backlog *Backlog) MarkSent() {
+	if backlog.sent == len(backlog.chunks) {
+		return
+	}
+
+	backlog.sentSize += len(backlog.chunks[backlog.sent])
+	backlog.sent++
+}
+
+// Acknowledge removes the chunks sent so far.
+func (backlog *Backlog) Acknowledge() {
+	for i := 0; i < backlog.sent; i++ {
+		backlog.chunks[i] = nil
+	}
+	backlog.chunks = backlog.chunks[backlog.sent:]
+	backlog.size -= backlog.sentSize
+
+	backlog.sent = 0
+	backlog.sentSize = 0
+	backlog.sentDropped = 0
+}
+
+// Forget removes the oldest sent chunks until at most keep bytes of the sent chunks are left,
+// e.g. when the consumer can't acknowledge them, but the older ones are unlikely to be lost.
+func (backlog *Backlog) Forget(keep int) {
+	var forgotten int
+	for forgotten < backlog.sent && backlog.sentSize > keep {
+		chunk := backlog.chunks[forgotten]
+		backlog.chunks[forgotten] = nil
+		backlog.size -= len(chunk)
+		backlog.sentSize -= len(chunk)
+		forgotten++
+	}
+	backlog.chunks = backlog.chunks[forgotten:]
+	backlog.sent -= forgotten
+
+	if backlog.sent == 0 {
+		backlog.sentDropped = 0
+	}
+}
+
+// Resend marks the chunks sent so far as not sent, e.g. when they were lost
+// along with the broken stream. The bytes of these chunks that were dropped
+// in the meantime are now accounted for.
+func (backlog *Backlog) Resend() {
+	backlog.dropped += backlog.sentDropped
+
+	backlog.sent = 0
+	backlog.sentSize = 0
+	backlog.sentDropped = 0
+}
+
+// Len returns the number of chunks in the backlog that weren't sent yet.
+func (backlog *Backlog) Len() int {
+	return len(backlog.chunks) - backlog.sent
+}
+
+// Size returns the number of bytes in the backlog, including the unacknowledged ones.
+func (backlog *Backlog) Size() int {
+	return backlog.size
+}
+
+// SentSize returns the number of bytes sent, but not yet acknowledged.
+func (backlog *Backlog) SentSize() int {
+	return backlog.sentSize
+}
+
+// TakeDropped returns the number of bytes dropped since the last call and resets the counter.
+func (backlog *Backlog) TakeDropped() uint64 {
+	dropped := backlog.dropped
+	backlog.dropped = 0
+
+	return dropped
+}
+
+// ReturnDropped adds the bytes back to the dropped counter, e.g. when the
+// consumer failed to signal the gap and wants to retry it later.
+func (backlog *Backlog) ReturnDropped(dropped uint64) {
+	backlog.dropped += dropped
+}
@@ -0,0 +1,122 @@
+package backlog_test
+
+import (
+	"github.com/cirruslabs/cirrus-ci-agent/internal/executor/backlog"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func drain(b *backlog.Backlog) (result string) {
+	for b.Len() != 0 {
+		result += string(b.Peek())
+		b.MarkSent()
+	}
+	b.Acknowledge()
+
+	return
+}
+
+func TestWithinLimit(t *testing.T) {
+	b := backlog.New(10)
+	b.Push([]byte("abc"))
+	b.Push([]byte("def"))
+
+	assert.Equal(t, 6, b.Size())
+	assert.Equal(t, "abcdef", drain(b))
+	assert.EqualValues(t, 0, b.TakeDropped())
+}
+
+func TestDropsOldest(t *testing.T) {
+	b := backlog.New(5)
+	b.Push([]byte("abc"))
+	b.Push([]byte("def"))
+	b.Push([]byte("g"))
+
+	assert.Equal(t, 5, b.Size())
+	assert.EqualValues(t, 2, b.TakeDropped())
+	assert.EqualValues(t, 0, b.TakeDropped())
+	assert.Equal(t, "cdefg", drain(b))
+}
+
+func TestHugeChunk(t *testing.T) {
+	b := backlog.New(3)
+	b.Push([]byte("a"))
+	b.Push([]byte("bcdef"))
+
+	assert.EqualValues(t, 3, b.TakeDropped())
+	assert.Equal(t, "def", drain(b))
+}
+
+func TestReturnDropped(t *testing.T) {
+	b := backlog.New(1)
+	b.Push([]byte("ab"))
+
+	dropped := b.TakeDropped()
+	b.ReturnDropped(dropped)
+	assert.EqualValues(t, 1, b.TakeDropped())
+}
+
+func TestAcknowledge(t *testing.T) {
+	b := backlog.New(10)
+	b.Push([]byte("abc"))
+	b.Push([]byte("def"))
+
+	b.MarkSent()
+	assert.Equal(t, 1, b.Len())
+	assert.Equal(t, 3, b.SentSize())
+	assert.Equal(t, 6, b.Size())
+	assert.Equal(t, "def", string(b.Peek()))
+
+	b.Acknowledge()
+	assert.Equal(t, 1, b.Len())
+	assert.Equal(t, 0, b.SentSize())
+	assert.Equal(t, 3, b.Size())
+	assert.Equal(t, "def", drain(b))
+}
+
+func TestForget(t *testing.T) {
+	b := backlog.New(10)
+	b.Push([]byte("abc"))
+	b.Push([]byte("de"))
+	b.Push([]byte("f"))
+	b.MarkSent()
+	b.MarkSent()
+
+	b.Forget(2)
+	assert.Equal(t, 1, b.Len())
+	assert.Equal(t, 2, b.SentSize())
+	assert.Equal(t, 3, b.Size())
+
+	b.Resend()
+	assert.Equal(t, "def", drain(b))
+}
+
+func TestResend(t *testing.T) {
+	b := backlog.New(10)
+	b.Push([]byte("abc"))
+	b.Push([]byte("def"))
+	b.MarkSent()
+	b.MarkSent()
+
+	b.Resend()
+	assert.Equal(t, 2, b.Len())
+	assert.Equal(t, 0, b.SentSize())
+	assert.Equal(t, "abcdef", drain(b))
+}
+
+func TestDropsUnacknowledged(t *testing.T) {
+	b := backlog.New(5)
+	b.Push([]byte("abc"))
+	b.MarkSent()
+	b.Push([]byte("defg"))
+
+	// The dropped bytes were sent and may have arrived after all
+	assert.EqualValues(t, 0, b.TakeDropped())
+	assert.Equal(t, 1, b.SentSize())
+	assert.Equal(t, 5, b.Size())
+
+	// ...but now it turns out they didn't
+	b.Resend()
+	assert.EqualValues(t, 2, b.TakeDropped())
+	assert.Equal(t, "cdefg", drain(b))
+}
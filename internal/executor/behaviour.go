@@ -0,0 +1,35 @@
+package executor
+
+import (
+	"fmt"
+	"github.com/cirruslabs/cirrus-ci-agent/api"
+)
+
+// shouldRunCommand decides whether the command should run given the earlier failures.
+//
+// The ALWAYS commands (e.g. the ones that clean up the cloud resources created by the tests)
+// run regardless, but they can't turn the task successful once it has failed.
+func shouldRunCommand(command *api.Command, failedAtLeastOnce bool) bool {
+	switch command.ExecutionBehaviour {
+	case api.Command_ON_SUCCESS:
+		return !failedAtLeastOnce
+	case api.Command_ON_FAILURE:
+		return failedAtLeastOnce
+	case api.Command_ALWAYS:
+		return true
+	default:
+		return false
+	}
+}
+
+// subsequentFailureMessage explains that the command has failed after the task has already failed,
+// so that it's not mistaken for the cause of the failure. The firstFailedCommand is empty when
+// the original failure happened in a previous agent run.
+func subsequentFailureMessage(commandName string, firstFailedCommand string) string {
+	if firstFailedCommand == "" {
+		return fmt.Sprintf("Command '%s' has failed too, but the task has already failed before", commandName)
+	}
+
+	return fmt.Sprintf("Command '%s' has failed too, but the task has already failed because of '%s'",
+		commandName, firstFailedCommand)
+}
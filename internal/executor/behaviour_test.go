@@ -0,0 +1,35 @@
+package executor
+
+import (
+	"github.com/cirruslabs/cirrus-ci-agent/api"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestShouldRunCommand(t *testing.T) {
+	testCases := []struct {
+		Behaviour         api.Command_CommandExecutionBehavior
+		FailedAtLeastOnce bool
+		Expected          bool
+	}{
+		{api.Command_ON_SUCCESS, false, true},
+		{api.Command_ON_SUCCESS, true, false},
+		{api.Command_ON_FAILURE, false, false},
+		{api.Command_ON_FAILURE, true, true},
+		{api.Command_ALWAYS, false, true},
+		{api.Command_ALWAYS, true, true},
+	}
+
+	for _, testCase := range testCases {
+		command := &api.Command{Name: "cleanup", ExecutionBehaviour: testCase.Behaviour}
+		assert.Equal(t, testCase.Expected, shouldRunCommand(command, testCase.FailedAtLeastOnce),
+			"%s with failedAtLeastOnce=%t", testCase.Behaviour, testCase.FailedAtLeastOnce)
+	}
+}
+
+func TestSubsequentFailureMessage(t *testing.T) {
+	assert.Equal(t, "Command 'cleanup' has failed too, but the task has already failed because of 'test'",
+		subsequentFailureMessage("cleanup", "test"))
+	assert.Equal(t, "Command 'cleanup' has failed too, but the task has already failed before",
+		subsequentFailureMessage("cleanup", ""))
+}
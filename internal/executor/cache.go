@@ -1,22 +1,25 @@
 package executor
 
 import (
-	"bufio"
+	"archive/tar"
 	"context"
 	"crypto/sha256"
+	"errors"
 	"fmt"
 	"github.com/bmatcuk/doublestar"
 	"github.com/cirruslabs/cirrus-ci-agent/api"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/executor/tasktrace"
 	"github.com/cirruslabs/cirrus-ci-agent/internal/hasher"
 	"github.com/cirruslabs/cirrus-ci-agent/internal/http_cache"
 	"github.com/cirruslabs/cirrus-ci-agent/internal/targz"
+	"github.com/dustin/go-humanize"
 	"io/ioutil"
-	"log"
 	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -26,9 +29,14 @@ type Cache struct {
 	Key                      string
 	BaseFolder               string
 	PartiallyExpandedFolders []string
+	ExcludePaths             []string
 	FileHasher               *hasher.Hasher
 	SkipUpload               bool
 	CacheAvailable           bool
+
+	// Set when some of the folders are outside of the working directory,
+	// in which case they're archived along with their locations
+	Roots []string
 }
 
 var caches = make([]Cache, 0)
@@ -44,12 +52,41 @@ func (executor *Executor) DownloadCache(
 	cacheHost string,
 	instruction *api.CacheInstruction,
 	custom_env map[string]string,
+) bool {
+	success := executor.downloadCache(ctx, logUploader, commandName, cacheHost, instruction, custom_env)
+
+	report := executor.cacheAttempts.Report(commandName)
+	if !success {
+		report.Result = CacheResultFailed
+	}
+	logUploader.Write([]byte(fmt.Sprintf("\n%s", report)))
+
+	return success
+}
+
+func (executor *Executor) downloadCache(
+	ctx context.Context,
+	logUploader *LogUploader,
+	commandName string,
+	cacheHost string,
+	instruction *api.CacheInstruction,
+	custom_env map[string]string,
 ) bool {
 	cacheKey, ok := executor.generateCacheKey(ctx, logUploader, commandName, instruction, custom_env)
 	if !ok {
 		return false
 	}
 
+	fallbackKeys, err := cacheFallbackKeys(custom_env, commandName, cacheKey)
+	if err != nil {
+		logUploader.Write([]byte(fmt.Sprintf("\nFailed to resolve fallback keys for %s cache: %s!", commandName, err)))
+		return false
+	}
+
+	report := executor.cacheAttempts.Report(commandName)
+	report.Key = cacheKey
+	report.Result = CacheResultMiss
+
 	// Partially expand cache folders without and keep them for further re-evaluation in UploadCache()
 	//
 	// Once in UploadCache(), the cache will be populated, and the globbing may yield a different result.
@@ -77,34 +114,98 @@ func (executor *Executor) DownloadCache(
 
 	// Perform a sanity check against the base folder
 	//
-	// When we're dealing with multiple cache folders, the semantics is
-	// clearly defined only when all folders are scoped to the current
-	// working directory, otherwise it's impossible to make paths inside
-	// of the archive portable (i.e. independent on the location of the
+	// When we're dealing with multiple cache folders scoped to the current
+	// working directory, the paths inside of the archive are relative to it,
+	// which makes them portable (i.e. independent on the location of the
 	// working directory).
 	//
+	// Otherwise, each folder is archived along with its location, which
+	// is only possible for the folders that are not globs.
+	//
 	// Note: this is not a security stop-gap but merely a hint to the users
 	// that they are doing something wrong.
+	var roots []string
+
 	if len(partiallyExpandedFolders) > 1 {
+		terminatedWorkingDir := baseFolder
+
+		if !strings.HasSuffix(terminatedWorkingDir, string(os.PathSeparator)) {
+			terminatedWorkingDir += string(os.PathSeparator)
+		}
+
+		var outsideFolder string
+
 		for _, partiallyExpandedFolder := range partiallyExpandedFolders {
-			terminatedWorkingDir := baseFolder
+			if !strings.HasPrefix(partiallyExpandedFolder, terminatedWorkingDir) {
+				outsideFolder = partiallyExpandedFolder
+				break
+			}
+		}
 
-			if !strings.HasSuffix(terminatedWorkingDir, string(os.PathSeparator)) {
-				terminatedWorkingDir += string(os.PathSeparator)
+		if outsideFolder != "" {
+			for _, partiallyExpandedFolder := range partiallyExpandedFolders {
+				if pathLooksLikeGlob(partiallyExpandedFolder) {
+					message := fmt.Sprintf("\nWhen using globs, all folders should be relative to "+
+						"the current working directory, yet, folder '%s' points above the current working directory '%s'\n",
+						outsideFolder, terminatedWorkingDir)
+					executor.cacheAttempts.Failed(cacheKey, message)
+					logUploader.Write([]byte(message))
+					return false
+				}
 			}
 
-			if !strings.HasPrefix(partiallyExpandedFolder, terminatedWorkingDir) {
-				message := fmt.Sprintf("\nWhen using globs or multiple cache folders, all folders should be relative to "+
-					"the current working directory, yet, folder '%s' points above the current working directory '%s'\n",
-					partiallyExpandedFolder, terminatedWorkingDir)
-				executor.cacheAttempts.Failed(cacheKey, message)
-				logUploader.Write([]byte(message))
-				return false
+			roots = partiallyExpandedFolders
+		}
+	}
+
+	unarchiveOptions := targz.UnarchiveOptions{
+		Concurrency: cacheConcurrency(logUploader, custom_env),
+		OnWarning: func(message string) {
+			logUploader.Write([]byte(fmt.Sprintf("\nWarning: %s", message)))
+		},
+	}
+	retryBudget := cacheRetryBudget(logUploader, custom_env)
+	localCache := newLocalCache(logUploader, custom_env)
+
+	// Proceeding without the cache is better than spending the whole task timeout on a hung download
+	restoreTimeout := cacheTimeout(logUploader, custom_env, "CIRRUS_CACHE_RESTORE_TIMEOUT", defaultCacheRestoreTimeout)
+	restoreCtx, cancelRestore := context.WithTimeout(ctx, restoreTimeout)
+	defer cancelRestore()
+
+	cachePopulated, cacheAvailable := executor.tryToDownloadAndPopulateCache(restoreCtx, logUploader, commandName, cacheHost, cacheKey, baseFolder, roots,
+		unarchiveOptions, retryBudget, localCache)
+	if cachePopulated {
+		report.Result = CacheResultHit
+	}
+
+	// Fall back to the older entries, which are better than nothing, but can't be considered
+	// as up-to-date, so the cache is still uploaded under the primary key once changed
+	if !cachePopulated && !cacheAvailable {
+		for _, fallbackKey := range fallbackKeys {
+			if restoreCtx.Err() != nil {
+				break
+			}
+
+			logUploader.Write([]byte(fmt.Sprintf("\nNo cache entry for %s, trying fallback key %s...", cacheKey, fallbackKey)))
+
+			populated, _ := executor.tryToDownloadAndPopulateCache(restoreCtx, logUploader, commandName, cacheHost, fallbackKey, baseFolder,
+				roots, unarchiveOptions, retryBudget, localCache)
+			if populated {
+				logUploader.Write([]byte(fmt.Sprintf("\nRestored %s cache from fallback key %s, "+
+					"it will be uploaded as %s if changed.", commandName, fallbackKey, cacheKey)))
+				cachePopulated = true
+				report.Result = CacheResultFallbackHit
+				report.FallbackKey = fallbackKey
+				break
 			}
 		}
 	}
 
-	cachePopulated, cacheAvailable := executor.tryToDownloadAndPopulateCache(ctx, logUploader, commandName, cacheHost, cacheKey, baseFolder)
+	if !cachePopulated && cacheDeadlineExceeded(restoreCtx, ctx) {
+		logUploader.Write([]byte(fmt.Sprintf("\nRestoring %s cache took longer than %s, abandoned it and "+
+			"treating it as a cache miss! Continuing without the cache...", commandName, restoreTimeout)))
+		logUploader.diagnostics.Warnf("Restoring %s cache timed out after %s", commandName, restoreTimeout)
+	}
 
 	// Expand cache folders in case they contain potential globs,
 	// so we can calculate the hashes for directories that already exist
@@ -115,10 +216,13 @@ func (executor *Executor) DownloadCache(
 		return false
 	}
 
-	fileHasher := hasher.New()
+	excludePaths := cacheExcludePaths(custom_env, commandName)
+
+	fileHasher := hasher.NewWithMode(cacheChangeDetection(logUploader, custom_env, commandName))
 	if cachePopulated {
+		excluder := newCacheExcluder(excludePaths)
 		for _, folderToCache := range foldersToCache {
-			if err := fileHasher.AddFolder(baseFolder, folderToCache); err != nil {
+			if err := fileHasher.AddFolderExcluding(baseFolder, folderToCache, excluder.Exclude); err != nil {
 				logUploader.Write([]byte(fmt.Sprintf("\nFailed to calculate hash of %s! %s", folderToCache, err)))
 			}
 		}
@@ -126,10 +230,12 @@ func (executor *Executor) DownloadCache(
 
 	if !cachePopulated && len(instruction.PopulateScripts) > 0 {
 		populateStartTime := time.Now()
-		logUploader.Write([]byte(fmt.Sprintf("\nCache miss for %s! Populating...\n", cacheKey)))
+		logUploader.Write([]byte(fmt.Sprintf("\nCache miss for key '%s'! Populating...\n", cacheKey)))
+		span := executor.trace.Start("cache populate", tasktrace.CategoryAgent)
 		cmd, err := ShellCommandsAndWait(ctx, instruction.PopulateScripts, &custom_env, func(bytes []byte) (int, error) {
 			return logUploader.Write(bytes)
 		}, executor.shouldKillProcesses())
+		span.End()
 		if err != nil || cmd == nil || cmd.ProcessState == nil || !cmd.ProcessState.Success() {
 			message := fmt.Sprintf("\nFailed to execute populate script for %s cache!", commandName)
 			executor.cacheAttempts.Failed(cacheKey, message)
@@ -137,8 +243,9 @@ func (executor *Executor) DownloadCache(
 			return false
 		}
 		executor.cacheAttempts.PopulatedIn(cacheKey, time.Since(populateStartTime))
+		report.PopulatedIn = time.Since(populateStartTime)
 	} else if !cachePopulated {
-		logUploader.Write([]byte(fmt.Sprintf("\nCache miss for %s! No script to populate with.", cacheKey)))
+		logUploader.Write([]byte(fmt.Sprintf("\nCache miss for key '%s'! No script to populate with.", cacheKey)))
 	}
 
 	caches = append(
@@ -148,9 +255,11 @@ func (executor *Executor) DownloadCache(
 			Key:                      cacheKey,
 			BaseFolder:               baseFolder,
 			PartiallyExpandedFolders: partiallyExpandedFolders,
+			ExcludePaths:             excludePaths,
 			FileHasher:               fileHasher,
 			SkipUpload:               cacheAvailable && !instruction.ReuploadOnChanges,
 			CacheAvailable:           cacheAvailable,
+			Roots:                    roots,
 		},
 	)
 	return true
@@ -164,7 +273,14 @@ func (executor *Executor) generateCacheKey(
 	custom_env map[string]string,
 ) (string, bool) {
 	if instruction.FingerprintKey != "" {
-		return instruction.FingerprintKey, true
+		cacheKey, err := resolveCacheKeyPlaceholders(ExpandText(instruction.FingerprintKey, custom_env), custom_env)
+		if err != nil {
+			logUploader.Write([]byte(fmt.Sprintf("\nFailed to resolve cache key for %s: %s!", commandName, err)))
+			return "", false
+		}
+
+		logUploader.Write([]byte(fmt.Sprintf("\nCache key for %s: %s\n", commandName, cacheKey)))
+		return cacheKey, true
 	}
 
 	cacheKeyHash := sha256.New()
@@ -178,12 +294,31 @@ func (executor *Executor) generateCacheKey(
 			logUploader.Write([]byte(fmt.Sprintf("\nFailed to execute fingerprint script for %s cache!", commandName)))
 			return "", false
 		}
-	} else {
+	}
+
+	fingerprintPatterns := cacheFingerprintFiles(custom_env, commandName)
+	if len(fingerprintPatterns) > 0 {
+		files, err := hashFingerprintFiles(cacheKeyHash, custom_env["CIRRUS_WORKING_DIR"], fingerprintPatterns)
+		if err != nil {
+			logUploader.Write([]byte(fmt.Sprintf("\nFailed to hash fingerprint files for %s cache: %s!", commandName, err)))
+			return "", false
+		}
+
+		logUploader.Write([]byte(fmt.Sprintf("\nHashed %d fingerprint files for %s cache:", len(files), commandName)))
+		for _, file := range files {
+			logUploader.Write([]byte(fmt.Sprintf("\n%s %s", file.SHA256, file.Path)))
+		}
+	}
+
+	if len(instruction.FingerprintScripts) == 0 && len(fingerprintPatterns) == 0 {
 		cacheKeyHash.Write([]byte(custom_env["CIRRUS_TASK_NAME"]))
 		cacheKeyHash.Write([]byte(custom_env["CI_NODE_INDEX"]))
 	}
 
-	return fmt.Sprintf("%s-%x", commandName, cacheKeyHash.Sum(nil)), true
+	cacheKey := fmt.Sprintf("%s-%x", commandName, cacheKeyHash.Sum(nil))
+	logUploader.Write([]byte(fmt.Sprintf("\nCache key for %s: %s\n", commandName, cacheKey)))
+
+	return cacheKey, true
 }
 
 func (executor *Executor) expandAndDeduplicateGlobs(folders []string) ([]string, string) {
@@ -219,8 +354,41 @@ func (executor *Executor) tryToDownloadAndPopulateCache(
 	cacheHost string,
 	cacheKey string,
 	folderToCache string,
+	roots []string,
+	unarchiveOptions targz.UnarchiveOptions,
+	retryBudget int,
+	localCache *localCache,
 ) (bool, bool) { // successfully populated, available remotely
-	cacheFile, fetchDuration, err := FetchCache(ctx, logUploader, commandName, cacheHost, cacheKey)
+	restoreStartTime := time.Now()
+
+	var numExtracted int
+	unarchiveOptions.OnEntry = func(header *tar.Header) {
+		if header.Typeflag != tar.TypeDir {
+			numExtracted++
+		}
+	}
+
+	// The archive that doesn't match its checksum is treated as a miss, but remembered,
+	// so that the upload replaces it instead of skipping it as already uploaded
+	fetchRemoteCache := func() (*os.File, time.Duration, error) {
+		cacheFile, fetchDuration, err := fetchVerifiedCache(ctx, logUploader, commandName, cacheHost, cacheKey, retryBudget)
+		if errors.Is(err, errCacheChecksumMismatch) {
+			executor.cacheAttempts.Report(commandName).ChecksumMismatch = cacheKey
+			return nil, 0, nil
+		}
+		return cacheFile, fetchDuration, err
+	}
+
+	span := executor.trace.Start("cache fetch", tasktrace.CategoryAgent)
+	cacheFile, fetchDuration, fromLocalCache := fetchLocalCache(logUploader, localCache, commandName, cacheKey)
+	var err error
+	if !fromLocalCache {
+		cacheFile, fetchDuration, err = fetchRemoteCache()
+		if err == nil && cacheFile != nil {
+			storeLocalCache(logUploader, localCache, cacheKey, cacheFile.Name())
+		}
+	}
+	span.End()
 	if err != nil {
 		logUploader.Write([]byte(fmt.Sprintf("\nFailed to fetch archive for %s cache: %s!", commandName, err)))
 		if err, ok := err.(net.Error); ok && err.Timeout() {
@@ -240,11 +408,27 @@ func (executor *Executor) tryToDownloadAndPopulateCache(
 
 	_, _ = logUploader.Write([]byte(fmt.Sprintf("\nCache hit for %s!", cacheKey)))
 	unarchiveStartTime := time.Now()
-	err = unarchiveCache(cacheFile, folderToCache)
-	if err != nil {
+	span = executor.trace.Start("cache unarchive", tasktrace.CategoryAgent)
+	err = unarchiveCache(logUploader, cacheFile, folderToCache, roots, unarchiveOptions)
+	span.End()
+	if errors.Is(err, targz.ErrUnknownFormat) {
+		// Re-downloading won't help here, the archive was probably created by something else
+		logUploader.Write([]byte(fmt.Sprintf("\nFailed to unarchive %s cache because of %s! Treating this failure as a cache miss...\n", commandName, err)))
+		logUploader.diagnostics.Warnf("Failed to unarchive %s cache: %v", commandName, err)
+		removeCacheFolders(folderToCache, roots)
+		return false, false
+	} else if err != nil {
 		logUploader.Write([]byte(fmt.Sprintf("\nFailed to unarchive %s cache because of %s! Retrying...\n", commandName, err)))
-		os.RemoveAll(folderToCache)
-		cacheFile, fetchDuration, err = FetchCache(ctx, logUploader, commandName, cacheHost, cacheKey)
+		logUploader.diagnostics.Warnf("Failed to unarchive %s cache: %v", commandName, err)
+		removeCacheFolders(folderToCache, roots)
+		numExtracted = 0
+		if fromLocalCache {
+			// Don't let the other tasks on this worker stumble upon the same archive
+			if err := localCache.Remove(cacheKey); err != nil {
+				logUploader.diagnostics.Warnf("Failed to remove %s cache from the local cache: %v", commandName, err)
+			}
+		}
+		cacheFile, fetchDuration, err = fetchRemoteCache()
 		if err != nil {
 			logUploader.Write([]byte(fmt.Sprintf("\nFailed to fetch archive for %s cache: %s!", commandName, err)))
 			if err, ok := err.(net.Error); ok && err.Timeout() {
@@ -256,34 +440,88 @@ func (executor *Executor) tryToDownloadAndPopulateCache(
 		if cacheFile == nil {
 			return false, true
 		}
-		err = unarchiveCache(cacheFile, folderToCache)
+		storeLocalCache(logUploader, localCache, cacheKey, cacheFile.Name())
+		err = unarchiveCache(logUploader, cacheFile, folderToCache, roots, unarchiveOptions)
 		if err != nil {
 			logUploader.Write([]byte(fmt.Sprintf("\nFailed again to unarchive %s cache because of %s!\n", commandName, err)))
-			logUploader.Write([]byte(fmt.Sprintf("\nTreating this failure as a cache miss but won't try to re-upload! Cleaning up %s...\n", folderToCache)))
-			os.RemoveAll(folderToCache)
+			logUploader.diagnostics.Errorf("Failed again to unarchive %s cache: %v", commandName, err)
+			logUploader.Write([]byte(fmt.Sprintf("\nTreating this failure as a cache miss but won't try to re-upload! Cleaning up %s...\n", cacheFoldersDescription(folderToCache, roots))))
+			removeCacheFolders(folderToCache, roots)
 			return false, true
 		}
-	} else {
-		unarchiveDuration := time.Since(unarchiveStartTime)
-		if unarchiveDuration > 10*time.Second {
-			logUploader.Write([]byte(fmt.Sprintf("\nUnarchived %s cache entry in %f seconds!\n", commandName, unarchiveDuration.Seconds())))
-		}
 	}
 
+	archiveSize := "unknown size"
+	if statErr == nil {
+		archiveSize = humanize.Bytes(uint64(cacheFileInfo.Size()))
+	}
+	logUploader.Write([]byte(fmt.Sprintf("\nRestored cache '%s' (%s) in %s, extracted %s files.\n", commandName,
+		archiveSize, formatFooterDuration(time.Since(restoreStartTime)), humanize.Comma(int64(numExtracted)))))
+
 	if statErr == nil {
 		executor.cacheAttempts.Hit(cacheKey, uint64(cacheFileInfo.Size()), fetchDuration, time.Since(unarchiveStartTime))
+
+		report := executor.cacheAttempts.Report(commandName)
+		report.DownloadedBytes = uint64(cacheFileInfo.Size())
+		report.DownloadedIn = fetchDuration
+		report.ExtractedIn = time.Since(unarchiveStartTime)
 	}
 
 	return true, true
 }
 
 func unarchiveCache(
+	logUploader *LogUploader,
 	cacheFile *os.File,
 	folderToCache string,
+	roots []string,
+	options targz.UnarchiveOptions,
 ) error {
 	defer os.Remove(cacheFile.Name())
-	EnsureFolderExists(folderToCache)
-	return targz.Unarchive(cacheFile.Name(), folderToCache)
+
+	staging := newCacheStaging()
+
+	var err error
+	if roots == nil {
+		destination := staging.Stage(folderToCache)
+		EnsureFolderExists(destination)
+		err = targz.UnarchiveWithOptions(cacheFile.Name(), destination, options)
+	} else {
+		options.RootDestination = staging.Stage
+
+		var skippedRoots []string
+		skippedRoots, err = targz.UnarchiveMultiRoot(cacheFile.Name(), roots, options)
+		for _, skippedRoot := range skippedRoots {
+			logUploader.Write([]byte(fmt.Sprintf("\nSkipping restoring of %s since it's not one of the cache folders anymore", skippedRoot)))
+		}
+	}
+	if err != nil {
+		staging.Abort()
+		return err
+	}
+
+	return staging.Commit()
+}
+
+// removeCacheFolders cleans up after the failed unarchiving.
+func removeCacheFolders(folderToCache string, roots []string) {
+	if roots == nil {
+		os.RemoveAll(folderToCache)
+		return
+	}
+
+	// The folder to cache is merely the working directory in this case
+	for _, root := range roots {
+		os.RemoveAll(root)
+	}
+}
+
+func cacheFoldersDescription(folderToCache string, roots []string) string {
+	if roots == nil {
+		return folderToCache
+	}
+
+	return strings.Join(roots, ", ")
 }
 
 func FetchCache(
@@ -292,10 +530,11 @@ func FetchCache(
 	commandName string,
 	cacheHost string,
 	cacheKey string,
+	retryBudget int,
 ) (*os.File, time.Duration, error) {
 	cacheFile, err := ioutil.TempFile(os.TempDir(), commandName)
 	if err != nil {
-		log.Printf("Failed to create a temp file %s: %v\n", commandName, err)
+		logUploader.diagnostics.Warnf("Failed to create a temp file %s: %v", commandName, err)
 		logUploader.Write([]byte(fmt.Sprintf("\nCache miss for %s!", commandName)))
 		return nil, 0, err
 	}
@@ -304,41 +543,36 @@ func FetchCache(
 	downloadStartTime := time.Now()
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://%s/%s", cacheHost, cacheKey), nil)
 	if err != nil {
-		log.Printf("Failed to create a cache request for %s: %v\n", commandName, err)
+		logUploader.diagnostics.Warnf("Failed to create a cache request for %s: %v", commandName, err)
 		return nil, 0, err
 	}
 	resp, err := httpClient.Do(req)
 	if err != nil {
-		log.Printf("HTTP cache request for %s failed: %v\n", commandName, err)
+		logUploader.diagnostics.Warnf("HTTP cache request for %s failed: %v", commandName, err)
 		return nil, 0, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		log.Printf("HTTP cache request for %s status: %s\n", commandName, resp.Status)
+		logUploader.diagnostics.Infof("HTTP cache request for %s status: %s", commandName, resp.Status)
 		return nil, 0, nil
 	}
 
-	bufferedFileWriter := bufio.NewWriter(cacheFile)
-	bytesDownloaded, err := bufferedFileWriter.ReadFrom(bufio.NewReader(resp.Body))
-	if err != nil {
-		log.Printf("Failed to finish downloading %s cache: %v\n", commandName, err)
-		return nil, 0, err
+	blobSize := "unknown size"
+	if resp.ContentLength >= 0 {
+		blobSize = humanize.Bytes(uint64(resp.ContentLength))
 	}
-	err = bufferedFileWriter.Flush()
+	logUploader.Write([]byte(fmt.Sprintf("\nDownloading cache with key '%s' (%s)...", cacheKey, blobSize)))
+
+	progress := startCacheTransferProgress(logUploader, "Downloaded", resp.ContentLength)
+	err = downloadCacheBody(ctx, logUploader, resp, cacheFile, progress, retryBudget)
+	summary := progress.Stop()
 	if err != nil {
-		log.Printf("Failed to flush %s cache: %v\n", commandName, err)
+		logUploader.diagnostics.Warnf("Failed to finish downloading %s cache: %v", commandName, err)
 		return nil, 0, err
 	}
-	downloadDuration := time.Since(downloadStartTime)
-	if bytesDownloaded < 1024 {
-		logUploader.Write([]byte(fmt.Sprintf("\nDownloaded %d bytes.", bytesDownloaded)))
-	} else if bytesDownloaded < 1024*1024 {
-		logUploader.Write([]byte(fmt.Sprintf("\nDownloaded %dKb.", bytesDownloaded/1024)))
-	} else {
-		logUploader.Write([]byte(fmt.Sprintf("\nDownloaded %dMb in %fs.", bytesDownloaded/1024/1024, downloadDuration.Seconds())))
-	}
-	return cacheFile, downloadDuration, nil
+	logUploader.Write([]byte(fmt.Sprintf("\n%s.", summary)))
+	return cacheFile, time.Since(downloadStartTime), nil
 }
 
 func (executor *Executor) UploadCache(
@@ -348,6 +582,23 @@ func (executor *Executor) UploadCache(
 	cacheHost string,
 	instruction *api.UploadCacheInstruction,
 	env map[string]string,
+) bool {
+	success := executor.uploadCache(ctx, logUploader, commandName, cacheHost, instruction, env)
+
+	if FindCache(instruction.CacheName) != nil {
+		logUploader.Write([]byte(fmt.Sprintf("\n%s", executor.cacheAttempts.Report(instruction.CacheName))))
+	}
+
+	return success
+}
+
+func (executor *Executor) uploadCache(
+	ctx context.Context,
+	logUploader *LogUploader,
+	commandName string,
+	cacheHost string,
+	instruction *api.UploadCacheInstruction,
+	env map[string]string,
 ) bool {
 	var err error
 
@@ -358,8 +609,14 @@ func (executor *Executor) UploadCache(
 		return false // cache record should always exists
 	}
 
-	if cache.SkipUpload {
+	report := executor.cacheAttempts.Report(instruction.CacheName)
+
+	// Useful for debugging the cache contents
+	forceUpload := env["CIRRUS_CACHE_FORCE_UPLOAD"] == "true"
+
+	if cache.SkipUpload && !forceUpload {
 		logUploader.Write([]byte(fmt.Sprintf("Skipping change detection for %s cache!", instruction.CacheName)))
+		report.UploadSkipped = "restored from the cache"
 		return true
 	}
 
@@ -369,18 +626,60 @@ func (executor *Executor) UploadCache(
 		return false
 	}
 
+	// Some of the folders might not exist, e.g. when the tool didn't need them this time
+	var existingFoldersToCache []string
+	for _, folder := range foldersToCache {
+		if _, err := os.Stat(folder); os.IsNotExist(err) {
+			logUploader.Write([]byte(fmt.Sprintf("Cache folder %s doesn't exist, skipping it!\n", folder)))
+			continue
+		}
+		existingFoldersToCache = append(existingFoldersToCache, folder)
+	}
+	foldersToCache = existingFoldersToCache
+
 	commaSeparatedFolders := strings.Join(foldersToCache, ", ")
 
 	if allDirsEmpty(foldersToCache) {
 		logUploader.Write([]byte(fmt.Sprintf("All cache folders (%s) are empty! Skipping uploading ...", commaSeparatedFolders)))
+		report.UploadSkipped = "empty"
 		return true
 	}
 
-	fileHasher := hasher.New()
+	if maxSize, mode := cacheSizeLimit(logUploader, env, instruction.CacheName); maxSize != 0 {
+		files, totalSize, err := listCachedFiles(foldersToCache, cache.ExcludePaths)
+		if err != nil {
+			logUploader.Write([]byte(fmt.Sprintf("\nFailed to calculate the size of %s cache: %s!", instruction.CacheName, err)))
+			return false
+		}
+
+		if totalSize > maxSize && mode == cacheSizeLimitSkip {
+			logUploader.Write([]byte(fmt.Sprintf("\n%s cache size (%s) exceeds the limit of %s, skipping uploading!",
+				instruction.CacheName, humanize.Bytes(totalSize), humanize.Bytes(maxSize))))
+			report.UploadSkipped = "exceeds the size limit"
+			return true
+		}
+
+		if totalSize > maxSize {
+			numPruned, bytesPruned, err := pruneCachedFiles(files, totalSize, maxSize)
+			report.PrunedBytes = bytesPruned
+			if err != nil {
+				logUploader.Write([]byte(fmt.Sprintf("\nFailed to prune %s cache: %s!", instruction.CacheName, err)))
+				return false
+			}
+			logUploader.Write([]byte(fmt.Sprintf("\n%s cache size (%s) exceeds the limit of %s, "+
+				"pruned %d least recently modified files (%s).\n", instruction.CacheName, humanize.Bytes(totalSize),
+				humanize.Bytes(maxSize), numPruned, humanize.Bytes(bytesPruned))))
+		}
+	}
+
+	// Only read the files that look modified since the cache was restored
+	fileHasher := hasher.NewIncremental(cache.FileHasher)
+	hashingExcluder := newCacheExcluder(cache.ExcludePaths)
 	for _, folder := range foldersToCache {
-		if err := fileHasher.AddFolder(cache.BaseFolder, folder); err != nil {
+		if err := fileHasher.AddFolderExcluding(cache.BaseFolder, folder, hashingExcluder.Exclude); err != nil {
 			logUploader.Write([]byte(fmt.Sprintf("Failed to calculate hash of %s! %s", folder, err)))
 			logUploader.Write([]byte("Skipping uploading of cache!"))
+			report.UploadSkipped = "failed to calculate the hash"
 			return true
 		}
 	}
@@ -388,27 +687,57 @@ func (executor *Executor) UploadCache(
 	logUploader.Write([]byte(fmt.Sprintf("SHA for cache folders (%s) is '%s'\n", commaSeparatedFolders, fileHasher.SHA())))
 
 	if fileHasher.SHA() == cache.FileHasher.SHA() {
-		logUploader.Write([]byte(fmt.Sprintf("Cache %s hasn't changed! Skipping uploading...", cache.Name)))
-		return true
-	}
-	if cache.FileHasher.Len() != 0 {
-		logUploader.Write([]byte(fmt.Sprintf("Cache %s has changed!", cache.Name)))
+		if !forceUpload {
+			logUploader.Write([]byte(fmt.Sprintf("Cache '%s' unchanged, skipping upload", cache.Name)))
+			report.UploadSkipped = "unchanged"
+			return true
+		}
+
+		logUploader.Write([]byte(fmt.Sprintf("Cache '%s' unchanged, but uploading anyway because of CIRRUS_CACHE_FORCE_UPLOAD", cache.Name)))
+	} else if cache.FileHasher.Len() != 0 {
+		diff := cache.FileHasher.DiffWithNewer(fileHasher)
+
+		logUploader.Write([]byte(fmt.Sprintf("Cache %s has changed (%s)!", cache.Name, summarizeCacheChanges(diff))))
 		logUploader.Write([]byte(fmt.Sprintf("\nList of changes for cache folders (%s):", commaSeparatedFolders)))
 
-		for _, diffEntry := range cache.FileHasher.DiffWithNewer(fileHasher) {
+		for _, diffEntry := range diff {
 			logUploader.Write([]byte(fmt.Sprintf("\n%s: %s", diffEntry.Type.String(), diffEntry.Path)))
 		}
 	}
 
+	compression, err := cacheCompression(env)
+	if err != nil {
+		logUploader.Write([]byte(fmt.Sprintf("\nFailed to archive caches for %s: %s!", commandName, err)))
+		return false
+	}
+
 	cacheFile, _ := ioutil.TempFile(os.TempDir(), cache.Key)
 	defer os.Remove(cacheFile.Name())
 
 	archiveStartTime := time.Now()
-	err = targz.Archive(cache.BaseFolder, foldersToCache, cacheFile.Name())
+	span := executor.trace.Start("cache archive", tasktrace.CategoryAgent)
+	excluder := newCacheExcluder(cache.ExcludePaths)
+	archiveOptions := targz.ArchiveOptions{
+		Compression: compression,
+		Exclude:     excluder.Exclude,
+		Concurrency: cacheConcurrency(logUploader, env),
+	}
+	if cache.Roots != nil {
+		err = targz.ArchiveMultiRoot(foldersToCache, cacheFile.Name(), archiveOptions)
+	} else {
+		err = targz.ArchiveWithOptions(cache.BaseFolder, foldersToCache, cacheFile.Name(), archiveOptions)
+	}
+	span.End()
 	if err != nil {
 		logUploader.Write([]byte(fmt.Sprintf("\nFailed to tar caches for %s with %s!", commandName, err)))
 		return false
 	}
+	if excluder.err != nil {
+		logUploader.Write([]byte(fmt.Sprintf("\nIgnoring %s!", excluder.err)))
+	}
+	if len(cache.ExcludePaths) != 0 {
+		logUploader.Write([]byte(fmt.Sprintf("\nExcluded %d entries from %s cache.", excluder.numExcluded, instruction.CacheName)))
+	}
 	archivingDuration := time.Since(archiveStartTime)
 	fi, err := cacheFile.Stat()
 	if err != nil {
@@ -426,10 +755,15 @@ func (executor *Executor) UploadCache(
 		logUploader.Write([]byte(fmt.Sprintf("\n%s cache size is %dMb.", instruction.CacheName, bytesToUpload/1024/1024)))
 	}
 
-	if !cache.CacheAvailable {
+	// The task can do without the uploaded cache, so don't let a hung upload hold it up
+	uploadTimeout := cacheTimeout(logUploader, env, "CIRRUS_CACHE_UPLOAD_TIMEOUT", defaultCacheUploadTimeout)
+	uploadCtx, cancelUpload := context.WithTimeout(ctx, uploadTimeout)
+	defer cancelUpload()
+
+	if !cache.CacheAvailable && report.ChecksumMismatch != cache.Key {
 		// check if some other task has uploaded the cache already
 		url := fmt.Sprintf("http://%s/%s", cacheHost, cache.Key)
-		req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+		req, err := http.NewRequestWithContext(uploadCtx, http.MethodHead, url, nil)
 		if err != nil {
 			logUploader.Write([]byte(fmt.Sprintf("\nFailed to create cache check request to URL %s!", url)))
 			return false
@@ -442,33 +776,131 @@ func (executor *Executor) UploadCache(
 			} else {
 				logUploader.Write([]byte(fmt.Sprintf("\nSome other task has already uploaded cache entry %s! Skipping upload...", cache.Key)))
 			}
+			report.UploadSkipped = "already uploaded"
+			return true
+		}
+	}
+
+	// The checksum is uploaded first, so it has to go if the archive it belongs to doesn't make it,
+	// otherwise the previous archive would look corrupted next to it
+	clearChecksum := func() {
+		if err := clearCacheChecksum(ctx, cacheHost, cache.Key, uploadTimeout); err != nil {
+			logUploader.diagnostics.Warnf("Failed to clear the checksum of %s cache: %v", commandName, err)
+		}
+	}
+
+	reportUploadTimeout := func() {
+		logUploader.Write([]byte(fmt.Sprintf("\nUploading cache '%s' took longer than %s, abandoned it! "+
+			"This doesn't affect the task result.", commandName, uploadTimeout)))
+		logUploader.diagnostics.Warnf("Uploading %s cache timed out after %s", commandName, uploadTimeout)
+		report.UploadError = fmt.Sprintf("timed out after %s", uploadTimeout)
+		clearChecksum()
+	}
+
+	checksum, err := fileSHA256(cacheFile.Name())
+	if err == nil {
+		err = uploadCacheChecksum(uploadCtx, cacheHost, cache.Key, checksum)
+	}
+	if err != nil && cacheDeadlineExceeded(uploadCtx, ctx) {
+		reportUploadTimeout()
+		return true
+	}
+	if err != nil {
+		logUploader.Write([]byte(fmt.Sprintf("\nFailed to upload the checksum of cache '%s': %s! "+
+			"It will be restored without verification.", commandName, err)))
+		logUploader.diagnostics.Warnf("Failed to upload the checksum of %s cache: %v", commandName, err)
+
+		// Otherwise the checksum of the previous archive would make the new one look corrupted
+		if err := uploadCacheChecksum(uploadCtx, cacheHost, cache.Key, ""); err != nil {
+			logUploader.Write([]byte(fmt.Sprintf("\nFailed to clear the previous checksum of cache '%s': %s! "+
+				"Skipping upload...", commandName, err)))
+			report.UploadError = fmt.Sprintf("failed to clear the previous checksum: %v", err)
 			return true
 		}
 	}
 
 	logUploader.Write([]byte(fmt.Sprintf("\nUploading cache %s...", instruction.CacheName)))
 	uploadStartTime := time.Now()
-	err = UploadCacheFile(ctx, cacheHost, cache.Key, cacheFile)
+	span = executor.trace.Start("cache upload", tasktrace.CategoryAgent)
+	err = UploadCacheFile(uploadCtx, logUploader, cacheHost, cache.Key, cacheFile)
+	span.End()
+	if err != nil && cacheDeadlineExceeded(uploadCtx, ctx) {
+		reportUploadTimeout()
+		return true
+	}
 	if err != nil {
 		logUploader.Write([]byte(fmt.Sprintf("\nFailed to upload cache '%s': %s!", commandName, err)))
 		logUploader.Write([]byte("\nIgnoring the error..."))
+		report.UploadError = err.Error()
+		clearChecksum()
 		return true
 	}
 
 	executor.cacheAttempts.Miss(cache.Key, uint64(bytesToUpload), archivingDuration, time.Since(uploadStartTime))
+	storeLocalCache(logUploader, newLocalCache(logUploader, env), cache.Key, cacheFile.Name())
+	report.UploadedBytes = uint64(bytesToUpload)
+	report.ArchivedIn = archivingDuration
+	report.UploadedIn = time.Since(uploadStartTime)
 
 	return true
 }
 
-func UploadCacheFile(ctx context.Context, cacheHost string, cacheKey string, cacheFile *os.File) error {
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("http://%s/%s", cacheHost, cacheKey), cacheFile)
+// cacheCompression returns the codec to compress the cache archives with, configured via
+// the CIRRUS_CACHE_COMPRESSION variable. Gzip is the default, since the older agents
+// can't restore the caches compressed with anything else.
+func cacheCompression(env map[string]string) (targz.Compression, error) {
+	value := env["CIRRUS_CACHE_COMPRESSION"]
+	if value == "" {
+		return targz.CompressionGzip, nil
+	}
+
+	compression, err := targz.ParseCompression(value)
 	if err != nil {
-		return err
+		return "", fmt.Errorf("invalid CIRRUS_CACHE_COMPRESSION: %w", err)
+	}
+
+	return compression, nil
+}
+
+// cacheConcurrency returns how many CPUs to use for the cache (de)compression, configured via
+// the CIRRUS_CACHE_CONCURRENCY behavioral environment variable to avoid hogging the shared workers.
+// Zero means all the available CPUs.
+func cacheConcurrency(logUploader *LogUploader, env map[string]string) int {
+	value := env["CIRRUS_CACHE_CONCURRENCY"]
+	if value == "" {
+		return 0
+	}
+
+	concurrency, err := strconv.Atoi(value)
+	if err != nil || concurrency < 1 {
+		logUploader.Write([]byte(fmt.Sprintf("\nIgnoring invalid CIRRUS_CACHE_CONCURRENCY value %q, "+
+			"expected a positive number of CPUs\n", value)))
+		return 0
 	}
+
+	return concurrency
+}
+
+func UploadCacheFile(
+	ctx context.Context,
+	logUploader *LogUploader,
+	cacheHost string,
+	cacheKey string,
+	cacheFile *os.File,
+) error {
 	fileStat, err := cacheFile.Stat()
 	if err != nil {
 		return err
 	}
+
+	progress := startCacheTransferProgress(logUploader, "Uploaded", fileStat.Size())
+	defer progress.Stop()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("http://%s/%s", cacheHost, cacheKey),
+		progress.Reader(cacheFile))
+	if err != nil {
+		return err
+	}
 	req.ContentLength = fileStat.Size()
 	req.Header.Set("Content-Type", "application/octet-stream")
 	response, err := httpClient.Do(req)
@@ -478,6 +910,7 @@ func UploadCacheFile(ctx context.Context, cacheHost string, cacheKey string, cac
 	if response.StatusCode != http.StatusCreated && response.StatusCode != http.StatusOK {
 		return fmt.Errorf("bad response status from HTTP cache %d: %s", response.StatusCode, response.Status)
 	}
+	logUploader.Write([]byte(fmt.Sprintf("\n%s.", progress.Stop())))
 	return nil
 }
 
@@ -0,0 +1,47 @@
+package executor
+
+import (
+	"fmt"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/hasher"
+)
+
+// How the cached files are compared to the restored ones to decide whether the cache needs re-uploading
+const (
+	// Only compare the size and modification time, without reading the files at all
+	cacheChangeDetectionFast = "fast"
+
+	// Always compare the contents, even of the files whose size and modification time are the same
+	cacheChangeDetectionExact = "exact"
+)
+
+// cacheChangeDetection returns the hasher mode configured via the CIRRUS_CACHE_CHANGE_DETECTION_<CACHE>
+// behavioral environment variable. By default, the contents are only compared for the files whose size
+// or modification time has changed. Invalid values are ignored with a warning.
+func cacheChangeDetection(logUploader *LogUploader, env map[string]string, cacheName string) hasher.Mode {
+	name := commandSpecificEnvName("CIRRUS_CACHE_CHANGE_DETECTION", cacheName)
+
+	switch value := env[name]; value {
+	case "":
+		return hasher.ModeDefault
+	case cacheChangeDetectionFast:
+		return hasher.ModeFast
+	case cacheChangeDetectionExact:
+		return hasher.ModeExact
+	default:
+		logUploader.Write([]byte(fmt.Sprintf("\nIgnoring invalid %s value %q, expected either %q or %q\n",
+			name, value, cacheChangeDetectionFast, cacheChangeDetectionExact)))
+		return hasher.ModeDefault
+	}
+}
+
+// summarizeCacheChanges returns the short summary of the changes, e.g. "2 created, 1 modified, 0 deleted",
+// so that the reason for the re-upload is clear even when the list of the changes is long.
+func summarizeCacheChanges(diff []hasher.DiffEntry) string {
+	counts := map[hasher.DiffEntryType]int{}
+	for _, diffEntry := range diff {
+		counts[diffEntry.Type]++
+	}
+
+	return fmt.Sprintf("%d created, %d modified, %d deleted",
+		counts[hasher.Created], counts[hasher.Modified], counts[hasher.Deleted])
+}
@@ -0,0 +1,113 @@
+package executor
+
+import (
+	"context"
+	"github.com/cirruslabs/cirrus-ci-agent/api"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUploadCacheChangeDetection(t *testing.T) {
+	testCases := map[string]struct {
+		mode string
+		// Applied to the restored "lib.js"
+		change   func(t *testing.T, path string)
+		uploaded bool
+		summary  string
+	}{
+		"default ignores the rewritten files": {
+			mode:     "",
+			change:   rewriteIdentically,
+			uploaded: false,
+		},
+		"fast reports the rewritten files": {
+			mode:     cacheChangeDetectionFast,
+			change:   rewriteIdentically,
+			uploaded: true,
+			summary:  "Cache deps has changed (0 created, 1 modified, 0 deleted)!",
+		},
+		"default misses the in-place modifications": {
+			mode:     "",
+			change:   modifyInPlace,
+			uploaded: false,
+		},
+		"exact catches the in-place modifications": {
+			mode:     cacheChangeDetectionExact,
+			change:   modifyInPlace,
+			uploaded: true,
+			summary:  "Cache deps has changed (0 created, 1 modified, 0 deleted)!",
+		},
+	}
+
+	for name, testCase := range testCases {
+		testCase := testCase
+
+		t.Run(name, func(t *testing.T) {
+			fake := &fakeCirrusClient{}
+			withFakeClient(t, fake)
+
+			cacheServer := newFakeCacheServer(t)
+			cacheServer.Put(t, "deps", map[string]string{"lib.js": "contents", "README": "readme"})
+
+			workingDir := testutil.TempDir(t)
+			folder := filepath.Join(workingDir, "deps")
+			env := map[string]string{
+				"CIRRUS_WORKING_DIR":                 workingDir,
+				"CIRRUS_CACHE_CHANGE_DETECTION_DEPS": testCase.mode,
+			}
+
+			executor := newTestArtifactsExecutor()
+			logUploader := newTestLogUploader(t, executor)
+
+			success := executor.DownloadCache(context.Background(), logUploader, "deps", cacheServer.Host(),
+				&api.CacheInstruction{Folders: []string{folder}, FingerprintKey: "deps", ReuploadOnChanges: true}, env)
+			require.True(t, success)
+
+			testCase.change(t, filepath.Join(folder, "lib.js"))
+
+			success = executor.UploadCache(context.Background(), logUploader, "upload_deps", cacheServer.Host(),
+				&api.UploadCacheInstruction{CacheName: "deps"}, env)
+			logUploader.Finalize()
+			require.True(t, success)
+
+			if !testCase.uploaded {
+				assert.Empty(t, cacheServer.Uploads())
+				assert.Contains(t, fake.Logs(), "Cache 'deps' unchanged, skipping upload")
+				return
+			}
+
+			assert.Equal(t, []string{"deps"}, cacheServer.Uploads())
+			assert.Contains(t, fake.Logs(), testCase.summary)
+		})
+	}
+}
+
+func TestCacheChangeDetectionInvalidValue(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	logUploader := newTestLogUploader(t, newTestArtifactsExecutor())
+	cacheChangeDetection(logUploader, map[string]string{"CIRRUS_CACHE_CHANGE_DETECTION_DEPS": "paranoid"}, "deps")
+	logUploader.Finalize()
+
+	assert.Contains(t, fake.Logs(), "Ignoring invalid CIRRUS_CACHE_CHANGE_DETECTION_DEPS value \"paranoid\"")
+}
+
+// rewriteIdentically rewrites the file with the same contents, like some tools do.
+func rewriteIdentically(t *testing.T, path string) {
+	later := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(path, later, later))
+}
+
+// modifyInPlace changes the file contents, but preserves both its size and modification time.
+func modifyInPlace(t *testing.T, path string) {
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, []byte("CONTENTS"), 0600))
+	require.NoError(t, os.Chtimes(path, info.ModTime(), info.ModTime()))
+}
@@ -0,0 +1,154 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var cacheChecksumRegex = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// cacheChecksumKey returns the key the SHA-256 checksum of the archive stored under the cacheKey
+// is stored under. The checksum is stored as a separate entry rather than in the metadata of the
+// archive itself, since the HTTP cache doesn't preserve any, and appending it to the archive would
+// make it unreadable by the older agents.
+func cacheChecksumKey(cacheKey string) string {
+	return cacheKey + ".sha256"
+}
+
+// errCacheChecksumMismatch is returned by fetchVerifiedCache when the archive doesn't match its checksum.
+var errCacheChecksumMismatch = errors.New("cache archive doesn't match its checksum")
+
+// uploadCacheChecksum stores the checksum of the archive about to be uploaded under the cacheKey.
+// It's stored before the archive, so that the checksum of the previous archive is never left
+// next to the new one. An empty checksum clears the previous one.
+func uploadCacheChecksum(ctx context.Context, cacheHost string, cacheKey string, checksum string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		fmt.Sprintf("http://%s/%s", cacheHost, cacheChecksumKey(cacheKey)), bytes.NewReader([]byte(checksum)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain")
+
+	response, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusCreated && response.StatusCode != http.StatusOK {
+		return fmt.Errorf("bad response status from HTTP cache %d: %s", response.StatusCode, response.Status)
+	}
+
+	return nil
+}
+
+// cacheChecksumClearTimeout caps the time spent clearing the checksum, which is tiny
+// compared to the archive, so a longer wait means that the cache is unreachable.
+const cacheChecksumClearTimeout = 10 * time.Second
+
+// clearCacheChecksum clears the checksum stored under the cacheKey after the archive it was uploaded
+// ahead of has failed to upload. It doesn't use the context of the upload, since it has likely
+// expired, but it's given the same timeout, up to the cacheChecksumClearTimeout.
+func clearCacheChecksum(ctx context.Context, cacheHost string, cacheKey string, timeout time.Duration) error {
+	if timeout > cacheChecksumClearTimeout {
+		timeout = cacheChecksumClearTimeout
+	}
+
+	clearCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	return uploadCacheChecksum(clearCtx, cacheHost, cacheKey, "")
+}
+
+// fetchCacheChecksum returns the checksum of the archive stored under the cacheKey, or an empty
+// string if there's none, e.g. when the archive was uploaded by an older agent or the checksum
+// was cleared.
+func fetchCacheChecksum(ctx context.Context, cacheHost string, cacheKey string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		fmt.Sprintf("http://%s/%s", cacheHost, cacheChecksumKey(cacheKey)), nil)
+	if err != nil {
+		return "", err
+	}
+
+	response, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotFound {
+		return "", nil
+	}
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("bad response status from HTTP cache %d: %s", response.StatusCode, response.Status)
+	}
+
+	// Anything bigger can't be a checksum
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+	if err != nil {
+		return "", err
+	}
+
+	checksum := strings.TrimSpace(string(body))
+	if checksum == "" {
+		return "", nil
+	}
+	if !cacheChecksumRegex.MatchString(checksum) {
+		return "", fmt.Errorf("malformed checksum %q", checksum)
+	}
+
+	return checksum, nil
+}
+
+// fetchVerifiedCache is like FetchCache, but also verifies the archive against its checksum,
+// so that a corrupted archive is treated as a cache miss (errCacheChecksumMismatch) instead of
+// failing midway through the extraction. The archives without a checksum are returned as is.
+func fetchVerifiedCache(
+	ctx context.Context,
+	logUploader *LogUploader,
+	commandName string,
+	cacheHost string,
+	cacheKey string,
+	retryBudget int,
+) (*os.File, time.Duration, error) {
+	cacheFile, fetchDuration, err := FetchCache(ctx, logUploader, commandName, cacheHost, cacheKey, retryBudget)
+	if err != nil || cacheFile == nil {
+		return cacheFile, fetchDuration, err
+	}
+
+	expectedChecksum, err := fetchCacheChecksum(ctx, cacheHost, cacheKey)
+	if err != nil {
+		logUploader.diagnostics.Warnf("Failed to fetch the checksum of %s cache, not verifying it: %v",
+			commandName, err)
+		return cacheFile, fetchDuration, nil
+	}
+	if expectedChecksum == "" {
+		return cacheFile, fetchDuration, nil
+	}
+
+	actualChecksum, err := fileSHA256(cacheFile.Name())
+	if err != nil {
+		_ = os.Remove(cacheFile.Name())
+		return nil, 0, err
+	}
+
+	if actualChecksum != expectedChecksum {
+		_ = os.Remove(cacheFile.Name())
+		logUploader.Write([]byte(fmt.Sprintf("\nChecksum mismatch for cache with key '%s' (expected %s, got %s)! "+
+			"Treating it as a cache miss...", cacheKey, expectedChecksum, actualChecksum)))
+		logUploader.diagnostics.Warnf("Checksum mismatch for %s cache: expected %s, got %s",
+			commandName, expectedChecksum, actualChecksum)
+		return nil, 0, errCacheChecksumMismatch
+	}
+
+	return cacheFile, fetchDuration, nil
+}
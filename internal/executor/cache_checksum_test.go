@@ -0,0 +1,306 @@
+package executor
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"github.com/cirruslabs/cirrus-ci-agent/api"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/targz"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCacheChecksumRoundTrip(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	cacheServer := newFakeCacheServer(t)
+
+	workingDir := testutil.TempDir(t)
+	folder := filepath.Join(workingDir, "deps")
+	env := map[string]string{"CIRRUS_WORKING_DIR": workingDir}
+
+	executor := newTestArtifactsExecutor()
+	logUploader := newTestLogUploader(t, executor)
+
+	success := executor.DownloadCache(context.Background(), logUploader, "deps", cacheServer.Host(),
+		&api.CacheInstruction{Folders: []string{folder}, FingerprintKey: "deps"}, env)
+	require.True(t, success)
+
+	writeTestFile(t, filepath.Join(folder, "lib.js"), "contents")
+
+	success = executor.UploadCache(context.Background(), logUploader, "upload_deps", cacheServer.Host(),
+		&api.UploadCacheInstruction{CacheName: "deps"}, env)
+	require.True(t, success)
+	logUploader.Finalize()
+
+	require.Equal(t, []string{"deps"}, cacheServer.Uploads())
+	assert.Equal(t, fmt.Sprintf("%x", sha256.Sum256(cacheServer.Get("deps"))), string(cacheServer.Get("deps.sha256")))
+
+	// The archive is verified against it when restoring
+	logUploader = newTestLogUploader(t, executor)
+	cacheFile, _, err := fetchVerifiedCache(context.Background(), logUploader, "deps", cacheServer.Host(), "deps", 1)
+	logUploader.Finalize()
+	require.NoError(t, err)
+	require.NotNil(t, cacheFile)
+	defer os.Remove(cacheFile.Name())
+
+	contents, err := ioutil.ReadFile(cacheFile.Name())
+	require.NoError(t, err)
+	assert.Equal(t, cacheServer.Get("deps"), contents)
+}
+
+func TestDownloadCacheChecksumMismatch(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	cacheServer := newFakeCacheServer(t)
+	cacheServer.Put(t, "deps", map[string]string{"lib.js": "contents"})
+	cacheServer.PutRaw("deps.sha256", []byte(strings.Repeat("0", 64)))
+
+	workingDir := testutil.TempDir(t)
+	folder := filepath.Join(workingDir, "deps")
+
+	executor := newTestArtifactsExecutor()
+	logUploader := newTestLogUploader(t, executor)
+
+	success := executor.DownloadCache(context.Background(), logUploader, "deps", cacheServer.Host(),
+		&api.CacheInstruction{Folders: []string{folder}, FingerprintKey: "deps"},
+		map[string]string{"CIRRUS_WORKING_DIR": workingDir})
+	logUploader.Finalize()
+	require.True(t, success)
+
+	assert.NoFileExists(t, filepath.Join(folder, "lib.js"))
+	assert.Contains(t, fake.Logs(), "Checksum mismatch for cache with key 'deps' (expected "+
+		strings.Repeat("0", 64))
+	assert.Contains(t, fake.Logs(), "Treating it as a cache miss...")
+}
+
+func TestUploadCacheReplacesMismatchedArchive(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	cacheServer := newFakeCacheServer(t)
+	cacheServer.Put(t, "deps", map[string]string{"lib.js": "old"})
+	cacheServer.PutRaw("deps.sha256", []byte(strings.Repeat("0", 64)))
+
+	workingDir := testutil.TempDir(t)
+	folder := filepath.Join(workingDir, "deps")
+	env := map[string]string{"CIRRUS_WORKING_DIR": workingDir}
+
+	executor := newTestArtifactsExecutor()
+	logUploader := newTestLogUploader(t, executor)
+
+	require.True(t, executor.DownloadCache(context.Background(), logUploader, "deps", cacheServer.Host(),
+		&api.CacheInstruction{Folders: []string{folder}, FingerprintKey: "deps"}, env))
+
+	writeTestFile(t, filepath.Join(folder, "lib.js"), "new")
+	require.True(t, executor.UploadCache(context.Background(), logUploader, "upload_deps", cacheServer.Host(),
+		&api.UploadCacheInstruction{CacheName: "deps"}, env))
+	logUploader.Finalize()
+
+	// Not skipped as already uploaded, otherwise the cache would never be restored again
+	assert.Equal(t, []string{"deps"}, cacheServer.Uploads())
+	assert.Equal(t, fmt.Sprintf("%x", sha256.Sum256(cacheServer.Get("deps"))), string(cacheServer.Get("deps.sha256")))
+}
+
+func TestUploadCacheChecksumFailure(t *testing.T) {
+	testCases := map[string]struct {
+		failures int
+		uploaded bool
+		checksum string
+	}{
+		"previous checksum is cleared":             {failures: 1, uploaded: true, checksum: ""},
+		"archive is kept when it can't be cleared": {failures: 2, uploaded: false, checksum: strings.Repeat("a", 64)},
+	}
+
+	for name, testCase := range testCases {
+		testCase := testCase
+
+		t.Run(name, func(t *testing.T) {
+			fake := &fakeCirrusClient{}
+			withFakeClient(t, fake)
+
+			cacheServer := newFakeCacheServer(t)
+			cacheServer.PutRaw("deps.sha256", []byte(strings.Repeat("a", 64)))
+			cacheServer.checksumUploadFailures = testCase.failures
+
+			workingDir := testutil.TempDir(t)
+			folder := filepath.Join(workingDir, "deps")
+			env := map[string]string{"CIRRUS_WORKING_DIR": workingDir}
+
+			executor := newTestArtifactsExecutor()
+			logUploader := newTestLogUploader(t, executor)
+
+			require.True(t, executor.DownloadCache(context.Background(), logUploader, "deps", cacheServer.Host(),
+				&api.CacheInstruction{Folders: []string{folder}, FingerprintKey: "deps"}, env))
+
+			writeTestFile(t, filepath.Join(folder, "lib.js"), "contents")
+			require.True(t, executor.UploadCache(context.Background(), logUploader, "upload_deps", cacheServer.Host(),
+				&api.UploadCacheInstruction{CacheName: "deps"}, env))
+			logUploader.Finalize()
+
+			assert.Contains(t, fake.Logs(), "It will be restored without verification.")
+			assert.Equal(t, testCase.checksum, string(cacheServer.Get("deps.sha256")))
+			if !testCase.uploaded {
+				assert.Empty(t, cacheServer.Uploads())
+				return
+			}
+			assert.Equal(t, []string{"deps"}, cacheServer.Uploads())
+
+			// The archive is restored without verification
+			logUploader = newTestLogUploader(t, executor)
+			cacheFile, _, err := fetchVerifiedCache(context.Background(), logUploader, "deps", cacheServer.Host(), "deps", 1)
+			logUploader.Finalize()
+			require.NoError(t, err)
+			require.NotNil(t, cacheFile)
+			_ = os.Remove(cacheFile.Name())
+		})
+	}
+}
+
+func TestUploadCacheArchiveFailureClearsChecksum(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	cacheServer := newFakeCacheServer(t)
+	cacheServer.Put(t, "deps", map[string]string{"lib.js": "old"})
+	previousArchive := cacheServer.Get("deps")
+	cacheServer.PutRaw("deps.sha256", []byte(fmt.Sprintf("%x", sha256.Sum256(previousArchive))))
+	cacheServer.archiveUploadFailures = 1
+
+	workingDir := testutil.TempDir(t)
+	folder := filepath.Join(workingDir, "deps")
+	env := map[string]string{"CIRRUS_WORKING_DIR": workingDir}
+
+	executor := newTestArtifactsExecutor()
+	logUploader := newTestLogUploader(t, executor)
+
+	require.True(t, executor.DownloadCache(context.Background(), logUploader, "deps", cacheServer.Host(),
+		&api.CacheInstruction{Folders: []string{folder}, FingerprintKey: "deps",
+			ReuploadOnChanges: true}, env))
+
+	writeTestFile(t, filepath.Join(folder, "lib.js"), "new")
+	require.True(t, executor.UploadCache(context.Background(), logUploader, "upload_deps", cacheServer.Host(),
+		&api.UploadCacheInstruction{CacheName: "deps"}, env))
+	logUploader.Finalize()
+
+	assert.Contains(t, fake.Logs(), "Failed to upload cache 'upload_deps'")
+	assert.Equal(t, previousArchive, cacheServer.Get("deps"))
+	assert.Empty(t, cacheServer.Get("deps.sha256"))
+
+	// The previous archive is still restored, just without verification
+	logUploader = newTestLogUploader(t, executor)
+	cacheFile, _, err := fetchVerifiedCache(context.Background(), logUploader, "deps", cacheServer.Host(), "deps", 1)
+	logUploader.Finalize()
+	require.NoError(t, err)
+	require.NotNil(t, cacheFile)
+	_ = os.Remove(cacheFile.Name())
+}
+
+func TestUnarchiveCacheLeavesNoPartialFolders(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	logUploader := newTestLogUploader(t, newTestArtifactsExecutor())
+	defer logUploader.Finalize()
+
+	// Incompressible contents, so that the truncated archive still has some of the files
+	sourceDir := testutil.TempDir(t)
+	random := rand.New(rand.NewSource(42))
+	for i := 0; i < 10; i++ {
+		contents := make([]byte, 64*1024)
+		random.Read(contents)
+		writeTestFile(t, filepath.Join(sourceDir, fmt.Sprintf("%d.bin", i)), string(contents))
+	}
+
+	archivePath := filepath.Join(testutil.TempDir(t), "archive.tar.gz")
+	require.NoError(t, targz.Archive(sourceDir, []string{sourceDir}, archivePath))
+	archive, err := ioutil.ReadFile(archivePath)
+	require.NoError(t, err)
+
+	truncatedArchive := func() *os.File {
+		file, err := ioutil.TempFile(testutil.TempDir(t), "truncated")
+		require.NoError(t, err)
+		_, err = file.Write(archive[:len(archive)/2])
+		require.NoError(t, err)
+		require.NoError(t, file.Close())
+		return file
+	}
+
+	// The missing folders are moved into place only once the whole archive is extracted
+	workingDir := testutil.TempDir(t)
+	folder := filepath.Join(workingDir, "deps")
+
+	err = unarchiveCache(logUploader, truncatedArchive(), folder, nil, targz.UnarchiveOptions{})
+	require.Error(t, err)
+
+	entries, err := ioutil.ReadDir(workingDir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	// While the ones with some contents are extracted in place
+	writeTestFile(t, filepath.Join(folder, "existing.txt"), "existing")
+
+	err = unarchiveCache(logUploader, truncatedArchive(), folder, nil, targz.UnarchiveOptions{})
+	require.Error(t, err)
+	assert.FileExists(t, filepath.Join(folder, "0.bin"))
+
+	// The complete archives are restored as usual
+	completeArchive, err := ioutil.TempFile(testutil.TempDir(t), "complete")
+	require.NoError(t, err)
+	_, err = completeArchive.Write(archive)
+	require.NoError(t, err)
+	require.NoError(t, completeArchive.Close())
+
+	otherFolder := filepath.Join(workingDir, "other")
+	require.NoError(t, unarchiveCache(logUploader, completeArchive, otherFolder, nil, targz.UnarchiveOptions{}))
+
+	restored, err := ioutil.ReadDir(otherFolder)
+	require.NoError(t, err)
+	assert.Len(t, restored, 10)
+
+	info, err := os.Stat(otherFolder)
+	require.NoError(t, err)
+	assert.True(t, info.IsDir())
+}
+
+func TestUnarchiveCacheMultiRootStaging(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	logUploader := newTestLogUploader(t, newTestArtifactsExecutor())
+	defer logUploader.Finalize()
+
+	outside := testutil.TempDir(t)
+	roots := []string{filepath.Join(outside, "first"), filepath.Join(outside, "second")}
+	writeTestFile(t, filepath.Join(roots[0], "a.txt"), "a")
+	writeTestFile(t, filepath.Join(roots[1], "b.txt"), "b")
+
+	archivePath := filepath.Join(testutil.TempDir(t), "archive.tar.gz")
+	require.NoError(t, targz.ArchiveMultiRoot(roots, archivePath, targz.ArchiveOptions{}))
+	for _, root := range roots {
+		require.NoError(t, os.RemoveAll(root))
+	}
+
+	archive, err := os.Open(archivePath)
+	require.NoError(t, err)
+	require.NoError(t, archive.Close())
+
+	require.NoError(t, unarchiveCache(logUploader, archive, testutil.TempDir(t), roots, targz.UnarchiveOptions{}))
+
+	assert.FileExists(t, filepath.Join(roots[0], "a.txt"))
+	assert.FileExists(t, filepath.Join(roots[1], "b.txt"))
+
+	// No staging folders are left behind
+	entries, err := ioutil.ReadDir(outside)
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+}
@@ -0,0 +1,181 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"github.com/avast/retry-go"
+	"github.com/dustin/go-humanize"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// cacheRetryBudget parses the CIRRUS_CACHE_RETRY_BUDGET behavioral environment variable, which mirrors
+// the CIRRUS_ARTIFACTS_RETRY_BUDGET: the total number of times the interrupted cache download is re-tried.
+func cacheRetryBudget(logUploader *LogUploader, env map[string]string) int {
+	value := env["CIRRUS_CACHE_RETRY_BUDGET"]
+	if value == "" {
+		return defaultArtifactsRetryBudget
+	}
+
+	budget, err := strconv.Atoi(value)
+	if err != nil || budget < 0 {
+		logUploader.Write([]byte(fmt.Sprintf("\nIgnoring invalid CIRRUS_CACHE_RETRY_BUDGET value %q, "+
+			"expected a non-negative number\n", value)))
+		return defaultArtifactsRetryBudget
+	}
+
+	return budget
+}
+
+// cacheResumeValidator returns the value for the If-Range header that guarantees that the resumed
+// download continues the very same blob, or an empty string when the response can't be resumed.
+func cacheResumeValidator(resp *http.Response) string {
+	if resp.Header.Get("Accept-Ranges") == "none" {
+		return ""
+	}
+
+	// Weak ETags can't be used with If-Range
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+
+	return resp.Header.Get("Last-Modified")
+}
+
+// downloadCacheBody writes the body of the successful cache response to the cache file.
+//
+// The interrupted downloads are re-tried from the last received offset using the range requests
+// when the server supports them, otherwise the blob is downloaded again from the beginning.
+func downloadCacheBody(
+	ctx context.Context,
+	logUploader *LogUploader,
+	resp *http.Response,
+	cacheFile *os.File,
+	progress *cacheTransferProgress,
+	retryBudget int,
+) error {
+	url := resp.Request.URL.String()
+	validator := cacheResumeValidator(resp)
+	body := resp.Body
+
+	var offset int64
+
+	return retry.Do(
+		func() error {
+			if body == nil {
+				var err error
+				body, offset, err = requestCacheRemainder(ctx, logUploader, url, validator, cacheFile, offset)
+				if err != nil {
+					return err
+				}
+			}
+			defer func() {
+				body.Close()
+				body = nil
+			}()
+
+			fileWriter := &cacheFileWriter{file: cacheFile}
+			n, err := io.Copy(fileWriter, progress.Reader(body))
+			offset += n
+			if fileWriter.err != nil {
+				return retry.Unrecoverable(fmt.Errorf("failed to write the cache file: %w", fileWriter.err))
+			}
+
+			if err != nil && ctx.Err() != nil {
+				return retry.Unrecoverable(err)
+			}
+
+			return err
+		},
+		retry.OnRetry(func(n uint, err error) {
+			if int(n) < retryBudget {
+				logUploader.diagnostics.Warnf("Cache download from %s was interrupted after %s: %v",
+					url, humanize.Bytes(uint64(offset)), err)
+			}
+		}),
+		retry.Attempts(uint(retryBudget)+1),
+		retry.Context(ctx),
+		retry.LastErrorOnly(true),
+	)
+}
+
+// requestCacheRemainder requests the rest of the cache blob starting at the offset, returning
+// the body to read it from and the offset it actually starts at, which is zero when the server
+// has sent the whole blob again and the cache file was truncated to accommodate that.
+func requestCacheRemainder(
+	ctx context.Context,
+	logUploader *LogUploader,
+	url string,
+	validator string,
+	cacheFile *os.File,
+	offset int64,
+) (io.ReadCloser, int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, offset, retry.Unrecoverable(err)
+	}
+
+	resuming := offset != 0 && validator != ""
+	if resuming {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", validator)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, offset, err
+	}
+
+	switch {
+	case resuming && resp.StatusCode == http.StatusPartialContent:
+		expectedRange := fmt.Sprintf("bytes %d-", offset)
+		if !strings.HasPrefix(resp.Header.Get("Content-Range"), expectedRange) {
+			resp.Body.Close()
+			return nil, offset, fmt.Errorf("server responded with range %q, expected it to start with %q",
+				resp.Header.Get("Content-Range"), expectedRange)
+		}
+
+		logUploader.Write([]byte(fmt.Sprintf("\nResuming cache download from %s...",
+			humanize.Bytes(uint64(offset)))))
+
+		return resp.Body, offset, nil
+	case resp.StatusCode == http.StatusOK:
+		// Either ranges aren't supported or the blob has changed since the first request
+		if offset != 0 {
+			logUploader.Write([]byte("\nRe-downloading cache from the beginning..."))
+		}
+
+		if err := cacheFile.Truncate(0); err != nil {
+			resp.Body.Close()
+			return nil, offset, retry.Unrecoverable(err)
+		}
+		if _, err := cacheFile.Seek(0, io.SeekStart); err != nil {
+			resp.Body.Close()
+			return nil, offset, retry.Unrecoverable(err)
+		}
+
+		return resp.Body, 0, nil
+	default:
+		resp.Body.Close()
+		return nil, offset, fmt.Errorf("cache request failed with status %s", resp.Status)
+	}
+}
+
+// cacheFileWriter tells the errors writing the cache file apart from the errors reading
+// the response, since only the latter are worth re-trying.
+type cacheFileWriter struct {
+	file *os.File
+	err  error
+}
+
+func (writer *cacheFileWriter) Write(p []byte) (int, error) {
+	n, err := writer.file.Write(p)
+	if err != nil {
+		writer.err = err
+	}
+
+	return n, err
+}
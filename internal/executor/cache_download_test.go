@@ -0,0 +1,113 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyBlobServer serves the blob, aborting the first response halfway through.
+type flakyBlobServer struct {
+	mutex    sync.Mutex
+	requests []*http.Request
+	blob     func(attempt int) (contents []byte, etag string)
+}
+
+func (flaky *flakyBlobServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flaky.mutex.Lock()
+	attempt := len(flaky.requests)
+	flaky.requests = append(flaky.requests, r)
+	flaky.mutex.Unlock()
+
+	contents, etag := flaky.blob(attempt)
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+
+	if attempt == 0 {
+		w.Header().Set("Content-Length", strconv.Itoa(len(contents)))
+		_, _ = w.Write(contents[:len(contents)/2])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}
+
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(contents))
+}
+
+// fetchFromFlakyServer returns the downloaded cache contents and the resulting log.
+func fetchFromFlakyServer(t *testing.T, flaky *flakyBlobServer) (string, string) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	server := httptest.NewServer(flaky)
+	t.Cleanup(server.Close)
+
+	logUploader := newTestLogUploader(t, newTestArtifactsExecutor())
+
+	cacheFile, _, err := FetchCache(context.Background(), logUploader, "test",
+		strings.TrimPrefix(server.URL, "http://"), "key", 1)
+	logUploader.Finalize()
+	require.NoError(t, err)
+	require.NotNil(t, cacheFile)
+	t.Cleanup(func() { os.Remove(cacheFile.Name()) })
+
+	contents, err := ioutil.ReadFile(cacheFile.Name())
+	require.NoError(t, err)
+
+	return string(contents), fake.Logs()
+}
+
+func TestFetchCacheResumesWithRange(t *testing.T) {
+	blob := []byte(strings.Repeat("0123456789", 100_000))
+	flaky := &flakyBlobServer{blob: func(attempt int) ([]byte, string) {
+		return blob, `"v1"`
+	}}
+
+	contents, logs := fetchFromFlakyServer(t, flaky)
+	assert.Equal(t, string(blob), contents)
+	assert.Contains(t, logs, "Resuming cache download from")
+
+	require.Len(t, flaky.requests, 2)
+	assert.Regexp(t, `^bytes=[1-9]\d*-$`, flaky.requests[1].Header.Get("Range"))
+	assert.Equal(t, `"v1"`, flaky.requests[1].Header.Get("If-Range"))
+}
+
+func TestFetchCacheRestartsWhenBlobChanged(t *testing.T) {
+	oldBlob := []byte(strings.Repeat("old", 100_000))
+	newBlob := []byte(strings.Repeat("new", 100_000))
+	flaky := &flakyBlobServer{blob: func(attempt int) ([]byte, string) {
+		if attempt == 0 {
+			return oldBlob, `"old"`
+		}
+		return newBlob, `"new"`
+	}}
+
+	// Never stitch the halves of different blobs together
+	contents, logs := fetchFromFlakyServer(t, flaky)
+	assert.Equal(t, string(newBlob), contents)
+	assert.Contains(t, logs, "Re-downloading cache from the beginning")
+}
+
+func TestFetchCacheRestartsWithoutValidator(t *testing.T) {
+	blob := []byte(strings.Repeat("0123456789", 100_000))
+	flaky := &flakyBlobServer{blob: func(attempt int) ([]byte, string) {
+		return blob, ""
+	}}
+
+	contents, logs := fetchFromFlakyServer(t, flaky)
+	assert.Equal(t, string(blob), contents)
+	assert.Contains(t, logs, "Re-downloading cache from the beginning")
+
+	require.Len(t, flaky.requests, 2)
+	assert.Empty(t, flaky.requests[1].Header.Get("Range"))
+}
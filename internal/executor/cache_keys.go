@@ -0,0 +1,236 @@
+package executor
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"github.com/bmatcuk/doublestar"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// cacheFallbackKeys returns the ordered keys to restore the cache from when there's no entry
+// for the primary key, configured via the comma- or newline-separated CIRRUS_CACHE_FALLBACK_KEYS_<CACHE>
+// variable. Similarly to the other instruction fields, the keys are expanded against the task environment,
+// after which the cache key placeholders are resolved.
+func cacheFallbackKeys(env map[string]string, cacheName string, primaryKey string) ([]string, error) {
+	var result []string
+
+	for _, key := range cacheListOption(env, "CIRRUS_CACHE_FALLBACK_KEYS", cacheName) {
+		key, err := resolveCacheKeyPlaceholders(key, env)
+		if err != nil {
+			return nil, err
+		}
+
+		if key != primaryKey {
+			result = append(result, key)
+		}
+	}
+
+	return result, nil
+}
+
+var cacheKeyPlaceholderRegex = regexp.MustCompile(`\{([a-z]+(?:\.\w+)?)\}`)
+
+// resolveCacheKeyPlaceholders replaces the "{os}", "{arch}" and "{env.NAME}" placeholders in the cache key
+// with the platform the agent runs on and the task environment variables, so that the same key doesn't end
+// up shared by the tasks with incompatible binaries. Unknown placeholders and undefined variables
+// are reported as errors instead of silently producing the keys that collide.
+func resolveCacheKeyPlaceholders(key string, env map[string]string) (string, error) {
+	var resolveErr error
+
+	lookup := customEnvFirstLookup(env)
+
+	result := cacheKeyPlaceholderRegex.ReplaceAllStringFunc(key, func(placeholder string) string {
+		name := placeholder[1 : len(placeholder)-1]
+
+		switch {
+		case name == "os":
+			return runtime.GOOS
+		case name == "arch":
+			return runtime.GOARCH
+		case strings.HasPrefix(name, "env."):
+			if value, ok := lookup(strings.TrimPrefix(name, "env.")); ok {
+				return value
+			}
+			if resolveErr == nil {
+				resolveErr = fmt.Errorf("cache key %q references undefined variable %s",
+					key, strings.TrimPrefix(name, "env."))
+			}
+		default:
+			if resolveErr == nil {
+				resolveErr = fmt.Errorf("cache key %q contains unknown placeholder %s, "+
+					"expected {os}, {arch} or {env.NAME}", key, placeholder)
+			}
+		}
+
+		return placeholder
+	})
+	if resolveErr != nil {
+		return "", resolveErr
+	}
+
+	return result, nil
+}
+
+// cacheFingerprintFiles returns the glob patterns of the files to derive the cache key from,
+// configured via the comma- or newline-separated CIRRUS_CACHE_FINGERPRINT_FILES_<CACHE> variable.
+func cacheFingerprintFiles(env map[string]string, cacheName string) []string {
+	return cacheListOption(env, "CIRRUS_CACHE_FINGERPRINT_FILES", cacheName)
+}
+
+// cacheExcludePaths returns the glob patterns of the entries to leave out of the cache archive,
+// configured via the comma- or newline-separated CIRRUS_CACHE_EXCLUDE_PATHS_<CACHE> variable.
+func cacheExcludePaths(env map[string]string, cacheName string) []string {
+	return cacheListOption(env, "CIRRUS_CACHE_EXCLUDE_PATHS", cacheName)
+}
+
+// cacheExcluder matches the entries of the cached folders against the exclude patterns,
+// keeping track of how many entries were excluded.
+type cacheExcluder struct {
+	patterns    []string
+	numExcluded int
+
+	// The first pattern that turned out to be malformed, such patterns never match
+	err error
+}
+
+func newCacheExcluder(patterns []string) *cacheExcluder {
+	return &cacheExcluder{patterns: patterns}
+}
+
+// Exclude matches the slash-separated path relative to the cached folder.
+func (excluder *cacheExcluder) Exclude(relativePath string, info os.FileInfo) bool {
+	for _, pattern := range excluder.patterns {
+		matched, err := doublestar.Match(pattern, relativePath)
+		if err != nil {
+			if excluder.err == nil {
+				excluder.err = fmt.Errorf("invalid exclude pattern '%s': %w", pattern, err)
+			}
+			continue
+		}
+
+		if matched {
+			excluder.numExcluded++
+			return true
+		}
+	}
+
+	return false
+}
+
+func cacheListOption(env map[string]string, prefix string, cacheName string) []string {
+	return splitListOption(env[commandSpecificEnvName(prefix, cacheName)], env)
+}
+
+// splitListOption splits the comma or newline-separated list, expanding the variables in its items.
+func splitListOption(value string, env map[string]string) []string {
+	var result []string
+
+	for _, item := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == '\n' }) {
+		if item = strings.TrimSpace(ExpandText(item, env)); item != "" {
+			result = append(result, item)
+		}
+	}
+
+	return result
+}
+
+// fingerprintFile is a file that contributed to the cache key.
+type fingerprintFile struct {
+	Path   string
+	SHA256 string
+}
+
+// hashFingerprintFiles writes the slash-separated paths of the files matching the patterns
+// (relative to the working directory, like the artifacts paths) along with the SHA-256 digests
+// of their contents to the hash, in a stable order. The patterns that match nothing contribute
+// a sentinel instead, so that the key changes once such files appear.
+func hashFingerprintFiles(hash io.Writer, workingDir string, patterns []string) ([]fingerprintFile, error) {
+	seen := map[string]struct{}{}
+	var paths []string
+	var unmatchedPatterns []string
+
+	for _, pattern := range patterns {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(workingDir, pattern)
+		}
+
+		matches, err := doublestar.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("cannot expand fingerprint files glob '%s': %w", pattern, err)
+		}
+
+		numMatched := 0
+
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil {
+				return nil, err
+			}
+			if info.IsDir() {
+				continue
+			}
+
+			numMatched++
+
+			if _, ok := seen[match]; ok {
+				continue
+			}
+			seen[match] = struct{}{}
+			paths = append(paths, match)
+		}
+
+		if numMatched == 0 {
+			unmatchedPatterns = append(unmatchedPatterns, filepath.ToSlash(pattern))
+		}
+	}
+
+	var result []fingerprintFile
+
+	for _, path := range paths {
+		relativePath := path
+		if rel, err := filepath.Rel(workingDir, path); err == nil {
+			relativePath = rel
+		}
+
+		digest, err := fileSHA256(path)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, fingerprintFile{Path: filepath.ToSlash(relativePath), SHA256: digest})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Path < result[j].Path
+	})
+
+	for _, file := range result {
+		_, _ = fmt.Fprintf(hash, "%s\x00%s\n", file.Path, file.SHA256)
+	}
+	for _, pattern := range unmatchedPatterns {
+		_, _ = fmt.Fprintf(hash, "%s\x00<no matches>\n", pattern)
+	}
+
+	return result, nil
+}
+
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", fmt.Errorf("failed to hash %s: %w", path, err)
+	}
+
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
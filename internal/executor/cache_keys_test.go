@@ -0,0 +1,201 @@
+package executor
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"github.com/cirruslabs/cirrus-ci-agent/api"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestCacheFallbackKeys(t *testing.T) {
+	env := map[string]string{
+		"CIRRUS_BRANCH": "main",
+		"CIRRUS_CACHE_FALLBACK_KEYS_NODE_MODULES": "node-$CIRRUS_BRANCH, node-primary\nnode-\n,",
+	}
+
+	keys, err := cacheFallbackKeys(env, "node_modules", "node-primary")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"node-main", "node-"}, keys)
+
+	keys, err = cacheFallbackKeys(env, "gradle", "gradle-primary")
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+
+	env["CIRRUS_CACHE_FALLBACK_KEYS_CARGO"] = "cargo-{os}-{arch}, cargo-{env.UNDEFINED_VARIABLE}"
+	_, err = cacheFallbackKeys(env, "cargo", "cargo-primary")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "undefined variable UNDEFINED_VARIABLE")
+}
+
+func TestResolveCacheKeyPlaceholders(t *testing.T) {
+	env := map[string]string{"RUST_VERSION": "1.60", "EMPTY": ""}
+
+	key, err := resolveCacheKeyPlaceholders("cargo-{os}-{arch}-{env.RUST_VERSION}{env.EMPTY}", env)
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("cargo-%s-%s-1.60", runtime.GOOS, runtime.GOARCH), key)
+
+	// Braces that don't look like placeholders are left as is
+	key, err = resolveCacheKeyPlaceholders("cargo-{}-{Weird Name}", env)
+	require.NoError(t, err)
+	assert.Equal(t, "cargo-{}-{Weird Name}", key)
+
+	_, err = resolveCacheKeyPlaceholders("cargo-{env.CIRRUS_TEST_RUST_TOOLCHAIN}", env)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "undefined variable CIRRUS_TEST_RUST_TOOLCHAIN")
+
+	_, err = resolveCacheKeyPlaceholders("cargo-{archh}", env)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unknown placeholder {archh}")
+}
+
+func TestDownloadCacheKeyPlaceholders(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	cacheServer := newFakeCacheServer(t)
+
+	workingDir := testutil.TempDir(t)
+	env := map[string]string{"CIRRUS_WORKING_DIR": workingDir, "CIRRUS_BRANCH": "main"}
+
+	executor := newTestArtifactsExecutor()
+	logUploader := newTestLogUploader(t, executor)
+
+	success := executor.DownloadCache(context.Background(), logUploader, "cargo", cacheServer.Host(),
+		&api.CacheInstruction{Folders: []string{"target"}, FingerprintKey: "cargo-{os}-{arch}-$CIRRUS_BRANCH"}, env)
+	require.True(t, success)
+
+	success = executor.DownloadCache(context.Background(), logUploader, "gradle", cacheServer.Host(),
+		&api.CacheInstruction{Folders: []string{"build"}, FingerprintKey: "gradle-{env.CIRRUS_TEST_JAVA_VERSION}"}, env)
+	require.False(t, success)
+
+	logUploader.Finalize()
+	assert.Contains(t, fake.Logs(), fmt.Sprintf("Cache key for cargo: cargo-%s-%s-main", runtime.GOOS, runtime.GOARCH))
+	assert.Contains(t, fake.Logs(), "Failed to resolve cache key for gradle: "+
+		"cache key \"gradle-{env.CIRRUS_TEST_JAVA_VERSION}\" references undefined variable CIRRUS_TEST_JAVA_VERSION!")
+}
+
+func TestDownloadCacheFallbackKeys(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	cacheServer := newFakeCacheServer(t)
+	cacheServer.Put(t, "node-old", map[string]string{"lib.js": "old"})
+
+	workingDir := testutil.TempDir(t)
+	env := map[string]string{
+		"CIRRUS_WORKING_DIR":                      workingDir,
+		"CIRRUS_CACHE_FALLBACK_KEYS_NODE_MODULES": "node-missing,node-old",
+	}
+
+	executor := newTestArtifactsExecutor()
+	logUploader := newTestLogUploader(t, executor)
+
+	folder := filepath.Join(workingDir, "node_modules")
+	success := executor.DownloadCache(context.Background(), logUploader, "node_modules", cacheServer.Host(),
+		&api.CacheInstruction{Folders: []string{folder}, FingerprintKey: "node-new"}, env)
+	require.True(t, success)
+
+	contents, err := os.ReadFile(filepath.Join(folder, "lib.js"))
+	require.NoError(t, err)
+	assert.Equal(t, "old", string(contents))
+
+	// Unchanged contents are not worth uploading
+	success = executor.UploadCache(context.Background(), logUploader, "upload_node_modules", cacheServer.Host(),
+		&api.UploadCacheInstruction{CacheName: "node_modules"}, env)
+	require.True(t, success)
+	assert.Empty(t, cacheServer.Uploads())
+
+	// Changed ones are uploaded under the primary key, unlike with the exact hits
+	writeTestFile(t, filepath.Join(folder, "lib.js"), "new")
+
+	success = executor.UploadCache(context.Background(), logUploader, "upload_node_modules", cacheServer.Host(),
+		&api.UploadCacheInstruction{CacheName: "node_modules"}, env)
+	logUploader.Finalize()
+	require.True(t, success)
+	assert.Equal(t, []string{"node-new"}, cacheServer.Uploads())
+
+	logs := string(fake.Logs())
+	assert.Contains(t, logs, "Cache hit for node-old!")
+	assert.Contains(t, logs, "Restored node_modules cache from fallback key node-old, it will be uploaded as node-new if changed.")
+}
+
+func TestHashFingerprintFiles(t *testing.T) {
+	workingDir := testutil.TempDir(t)
+	writeTestFile(t, filepath.Join(workingDir, "package-lock.json"), "{}")
+	writeTestFile(t, filepath.Join(workingDir, "web", "package-lock.json"), "{}")
+
+	digest := func(patterns ...string) (string, []fingerprintFile) {
+		hash := sha256.New()
+		files, err := hashFingerprintFiles(hash, workingDir, patterns)
+		require.NoError(t, err)
+		return fmt.Sprintf("%x", hash.Sum(nil)), files
+	}
+
+	key, files := digest("**/package-lock.json")
+	require.Len(t, files, 2)
+	assert.Equal(t, "package-lock.json", files[0].Path)
+	assert.Equal(t, "web/package-lock.json", files[1].Path)
+	assert.Equal(t, "44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a", files[0].SHA256)
+
+	// The order of patterns and overlapping matches don't matter
+	sameKey, _ := digest("web/*.json", "**/package-lock.json")
+	assert.Equal(t, key, sameKey)
+
+	// Neither does the location of the working directory
+	otherWorkingDir := testutil.TempDir(t)
+	writeTestFile(t, filepath.Join(otherWorkingDir, "package-lock.json"), "{}")
+	writeTestFile(t, filepath.Join(otherWorkingDir, "web", "package-lock.json"), "{}")
+	hash := sha256.New()
+	_, err := hashFingerprintFiles(hash, otherWorkingDir, []string{"**/package-lock.json"})
+	require.NoError(t, err)
+	assert.Equal(t, key, fmt.Sprintf("%x", hash.Sum(nil)))
+
+	// Patterns without matches still affect the key
+	keyWithMissing, _ := digest("**/package-lock.json", "yarn.lock")
+	assert.NotEqual(t, key, keyWithMissing)
+
+	// And so do the contents
+	writeTestFile(t, filepath.Join(workingDir, "web", "package-lock.json"), `{"lockfileVersion": 2}`)
+	changedKey, _ := digest("**/package-lock.json")
+	assert.NotEqual(t, key, changedKey)
+}
+
+func TestGenerateCacheKeyFromFingerprintFiles(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	workingDir := testutil.TempDir(t)
+	writeTestFile(t, filepath.Join(workingDir, "go.sum"), "checksums")
+
+	executor := newTestArtifactsExecutor()
+	logUploader := newTestLogUploader(t, executor)
+
+	generate := func(taskName string) string {
+		key, ok := executor.generateCacheKey(context.Background(), logUploader, "modules", &api.CacheInstruction{},
+			map[string]string{
+				"CIRRUS_WORKING_DIR":                     workingDir,
+				"CIRRUS_TASK_NAME":                       taskName,
+				"CIRRUS_CACHE_FINGERPRINT_FILES_MODULES": "go.sum",
+			})
+		require.True(t, ok)
+		return key
+	}
+
+	// The key is shared between the tasks
+	key := generate("test")
+	assert.Equal(t, key, generate("lint"))
+	assert.True(t, strings.HasPrefix(key, "modules-"))
+
+	logUploader.Finalize()
+	assert.Contains(t, fake.Logs(), "Hashed 1 fingerprint files for modules cache:\n"+
+		"d3beb16ca27a9fc332b55f526e1c8da6db0b2f58d50c9d27d59e15e23a4e35a8 go.sum")
+	assert.Contains(t, fake.Logs(), "Cache key for modules: "+key)
+}
@@ -0,0 +1,320 @@
+package executor
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/dustin/go-humanize"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const defaultLocalCacheMaxSize = 10 * humanize.GByte
+
+var errLocalCacheCorrupted = errors.New("the archive in the local cache is corrupted")
+
+// localCache keeps the cache archives on the persistent workers, so that the tasks running
+// on the same machine don't download the same multi-gigabyte archive from the remote storage
+// over and over again.
+//
+// The archives are stored by their content digest in the "blobs" folder, while the files
+// in the "keys" folder map the (hashed) cache keys to these digests. All tasks on the worker
+// share a single lock file: the lookups take a shared lock, while the stores and the eviction
+// of the least recently used archives take an exclusive one.
+type localCache struct {
+	dir     string
+	maxSize uint64
+}
+
+// newLocalCache returns the local cache configured via the CIRRUS_LOCAL_CACHE_DIR and
+// CIRRUS_LOCAL_CACHE_MAX_SIZE behavioral environment variables, or nil when it's not enabled.
+func newLocalCache(logUploader *LogUploader, env map[string]string) *localCache {
+	dir := env["CIRRUS_LOCAL_CACHE_DIR"]
+	if dir == "" {
+		return nil
+	}
+
+	maxSize := uint64(defaultLocalCacheMaxSize)
+
+	if value := env["CIRRUS_LOCAL_CACHE_MAX_SIZE"]; value != "" {
+		parsed, err := humanize.ParseBytes(value)
+		if err != nil || parsed == 0 {
+			logUploader.Write([]byte(fmt.Sprintf("\nIgnoring invalid CIRRUS_LOCAL_CACHE_MAX_SIZE value %q, "+
+				"expected a positive size like \"20GB\"\n", value)))
+		} else {
+			maxSize = parsed
+		}
+	}
+
+	for _, subdir := range []string{"blobs", "keys"} {
+		if err := os.MkdirAll(filepath.Join(dir, subdir), 0700); err != nil {
+			logUploader.Write([]byte(fmt.Sprintf("\nNot using the local cache since %s can't be created: %s!\n",
+				dir, err)))
+			return nil
+		}
+	}
+
+	return &localCache{dir: dir, maxSize: maxSize}
+}
+
+func (cache *localCache) keyPath(key string) string {
+	return filepath.Join(cache.dir, "keys", fmt.Sprintf("%x", sha256.Sum256([]byte(key))))
+}
+
+func (cache *localCache) blobPath(digest string) string {
+	return filepath.Join(cache.dir, "blobs", digest)
+}
+
+// lock takes the worker-wide lock, returning the function to release it.
+func (cache *localCache) lock(exclusive bool) (func(), error) {
+	file, err := os.OpenFile(filepath.Join(cache.dir, "lock"), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := lockFile(file, exclusive); err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("failed to lock the local cache: %w", err)
+	}
+
+	return func() {
+		_ = unlockFile(file)
+		_ = file.Close()
+	}, nil
+}
+
+// Fetch returns a temporary copy of the archive stored for the key, or nil if there's none.
+func (cache *localCache) Fetch(key string, tempPrefix string) (*os.File, error) {
+	unlock, err := cache.lock(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	digest, err := ioutil.ReadFile(cache.keyPath(key))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	blobDigest := strings.TrimSpace(string(digest))
+	blobPath := cache.blobPath(blobDigest)
+
+	blob, err := os.Open(blobPath)
+	if os.IsNotExist(err) {
+		// The archive was evicted, but the key still points to it
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+
+	cacheFile, err := ioutil.TempFile(os.TempDir(), tempPrefix)
+	if err != nil {
+		return nil, err
+	}
+	defer cacheFile.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(cacheFile, hash), blob); err != nil {
+		_ = os.Remove(cacheFile.Name())
+		return nil, err
+	}
+
+	// The archives are named after their digest, so that's what they're verified against
+	if actualDigest := fmt.Sprintf("%x", hash.Sum(nil)); actualDigest != blobDigest {
+		_ = os.Remove(cacheFile.Name())
+		return nil, fmt.Errorf("%w: expected %s, got %s", errLocalCacheCorrupted, blobDigest, actualDigest)
+	}
+
+	// Mark the archive as recently used
+	now := time.Now()
+	_ = os.Chtimes(blobPath, now, now)
+
+	return cacheFile, nil
+}
+
+// Store copies the archive to the local cache under the key, evicting
+// the least recently used archives if the cache grows too large.
+func (cache *localCache) Store(key string, archivePath string) error {
+	archive, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	// Copy the archive outside of the lock, since it might take a while
+	tempBlob, err := ioutil.TempFile(filepath.Join(cache.dir, "blobs"), ".incoming-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempBlob.Name())
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tempBlob, hash), archive); err != nil {
+		_ = tempBlob.Close()
+		return err
+	}
+	if err := tempBlob.Close(); err != nil {
+		return err
+	}
+
+	digest := fmt.Sprintf("%x", hash.Sum(nil))
+
+	unlock, err := cache.lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := os.Rename(tempBlob.Name(), cache.blobPath(digest)); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(cache.keyPath(key), []byte(digest), 0600); err != nil {
+		return err
+	}
+
+	return cache.evict()
+}
+
+// Remove forgets the archive stored under the key, e.g. when it turned out to be corrupted.
+func (cache *localCache) Remove(key string) error {
+	unlock, err := cache.lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	digest, err := ioutil.ReadFile(cache.keyPath(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(cache.blobPath(strings.TrimSpace(string(digest)))); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return cache.removeDanglingKeys()
+}
+
+// evict removes the least recently used archives until their total size fits into the limit,
+// should be called with the exclusive lock held.
+func (cache *localCache) evict() error {
+	entries, err := ioutil.ReadDir(filepath.Join(cache.dir, "blobs"))
+	if err != nil {
+		return err
+	}
+
+	var blobs []os.FileInfo
+	var totalSize uint64
+
+	for _, entry := range entries {
+		// Archives that are still being copied by the other tasks
+		if !entry.Mode().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		blobs = append(blobs, entry)
+		totalSize += uint64(entry.Size())
+	}
+
+	if totalSize <= cache.maxSize {
+		return nil
+	}
+
+	sort.Slice(blobs, func(i, j int) bool {
+		return blobs[i].ModTime().Before(blobs[j].ModTime())
+	})
+
+	for _, blob := range blobs {
+		if totalSize <= cache.maxSize {
+			break
+		}
+
+		if err := os.Remove(cache.blobPath(blob.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		totalSize -= uint64(blob.Size())
+	}
+
+	return cache.removeDanglingKeys()
+}
+
+// removeDanglingKeys removes the keys pointing to the archives that no longer exist,
+// should be called with the exclusive lock held.
+func (cache *localCache) removeDanglingKeys() error {
+	keys, err := ioutil.ReadDir(filepath.Join(cache.dir, "keys"))
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		keyPath := filepath.Join(cache.dir, "keys", key.Name())
+
+		digest, err := ioutil.ReadFile(keyPath)
+		if err != nil {
+			continue
+		}
+
+		if _, err := os.Stat(cache.blobPath(strings.TrimSpace(string(digest)))); os.IsNotExist(err) {
+			_ = os.Remove(keyPath)
+		}
+	}
+
+	return nil
+}
+
+// fetchLocalCache returns the archive for the key from the local cache if it's enabled and has one.
+func fetchLocalCache(
+	logUploader *LogUploader,
+	localCache *localCache,
+	commandName string,
+	cacheKey string,
+) (*os.File, time.Duration, bool) {
+	if localCache == nil {
+		return nil, 0, false
+	}
+
+	fetchStartTime := time.Now()
+
+	cacheFile, err := localCache.Fetch(cacheKey, commandName)
+	if err != nil {
+		logUploader.diagnostics.Warnf("Failed to fetch %s cache from the local cache: %v", commandName, err)
+	}
+	if errors.Is(err, errLocalCacheCorrupted) {
+		if err := localCache.Remove(cacheKey); err != nil {
+			logUploader.diagnostics.Warnf("Failed to remove %s cache from the local cache: %v", commandName, err)
+		}
+	}
+	if cacheFile == nil {
+		logUploader.Write([]byte(fmt.Sprintf("\nLocal cache miss for key '%s'!", cacheKey)))
+		return nil, 0, false
+	}
+
+	logUploader.Write([]byte(fmt.Sprintf("\nLocal cache hit for key '%s'!", cacheKey)))
+
+	return cacheFile, time.Since(fetchStartTime), true
+}
+
+// storeLocalCache copies the archive to the local cache if it's enabled.
+func storeLocalCache(logUploader *LogUploader, localCache *localCache, cacheKey string, archivePath string) {
+	if localCache == nil {
+		return
+	}
+
+	if err := localCache.Store(cacheKey, archivePath); err != nil {
+		logUploader.Write([]byte(fmt.Sprintf("\nFailed to store cache '%s' in the local cache: %s!", cacheKey, err)))
+		logUploader.diagnostics.Warnf("Failed to store cache %s in the local cache: %v", cacheKey, err)
+	}
+}
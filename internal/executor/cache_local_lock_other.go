@@ -0,0 +1,16 @@
+//go:build !linux && !darwin && !freebsd && !windows
+// +build !linux,!darwin,!freebsd,!windows
+
+package executor
+
+import "os"
+
+// lockFile does nothing on the platforms without file locking,
+// where the concurrent tasks on the same worker aren't supported.
+func lockFile(file *os.File, exclusive bool) error {
+	return nil
+}
+
+func unlockFile(file *os.File) error {
+	return nil
+}
@@ -0,0 +1,23 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package executor
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+// lockFile blocks until the advisory lock on the file is acquired.
+func lockFile(file *os.File, exclusive bool) error {
+	how := unix.LOCK_SH
+	if exclusive {
+		how = unix.LOCK_EX
+	}
+
+	return unix.Flock(int(file.Fd()), how)
+}
+
+func unlockFile(file *os.File) error {
+	return unix.Flock(int(file.Fd()), unix.LOCK_UN)
+}
@@ -0,0 +1,174 @@
+package executor
+
+import (
+	"context"
+	"github.com/cirruslabs/cirrus-ci-agent/api"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLocalCacheEviction(t *testing.T) {
+	cache := &localCache{dir: testutil.TempDir(t), maxSize: 250}
+	for _, subdir := range []string{"blobs", "keys"} {
+		require.NoError(t, os.Mkdir(filepath.Join(cache.dir, subdir), 0700))
+	}
+
+	store := func(key string, contents string) {
+		archivePath := filepath.Join(testutil.TempDir(t), "archive")
+		require.NoError(t, ioutil.WriteFile(archivePath, []byte(contents), 0600))
+		require.NoError(t, cache.Store(key, archivePath))
+	}
+	fetch := func(key string) string {
+		cacheFile, err := cache.Fetch(key, "test")
+		require.NoError(t, err)
+		if cacheFile == nil {
+			return ""
+		}
+		defer os.Remove(cacheFile.Name())
+
+		contents, err := ioutil.ReadFile(cacheFile.Name())
+		require.NoError(t, err)
+		return string(contents)
+	}
+	age := func(key string, age time.Duration) {
+		digest, err := ioutil.ReadFile(cache.keyPath(key))
+		require.NoError(t, err)
+		modTime := time.Now().Add(-age)
+		require.NoError(t, os.Chtimes(cache.blobPath(string(digest)), modTime, modTime))
+	}
+
+	store("a", strings.Repeat("a", 100))
+	store("b", strings.Repeat("b", 100))
+	age("a", 2*time.Hour)
+	age("b", time.Hour)
+
+	// Using the oldest entry makes it the most recently used one
+	assert.Equal(t, strings.Repeat("a", 100), fetch("a"))
+
+	store("c", strings.Repeat("c", 100))
+	assert.Equal(t, strings.Repeat("a", 100), fetch("a"))
+	assert.Empty(t, fetch("b"))
+	assert.Equal(t, strings.Repeat("c", 100), fetch("c"))
+	assert.NoFileExists(t, cache.keyPath("b"))
+
+	// The identical archives are only stored once
+	store("d", strings.Repeat("c", 100))
+	blobs, err := ioutil.ReadDir(filepath.Join(cache.dir, "blobs"))
+	require.NoError(t, err)
+	assert.Len(t, blobs, 2)
+
+	require.NoError(t, cache.Remove("c"))
+	assert.Empty(t, fetch("c"))
+	assert.Empty(t, fetch("d"))
+	assert.Equal(t, strings.Repeat("a", 100), fetch("a"))
+}
+
+func TestLocalCacheConcurrentStores(t *testing.T) {
+	cache := &localCache{dir: testutil.TempDir(t), maxSize: 1000}
+	for _, subdir := range []string{"blobs", "keys"} {
+		require.NoError(t, os.Mkdir(filepath.Join(cache.dir, subdir), 0700))
+	}
+
+	archivePath := filepath.Join(testutil.TempDir(t), "archive")
+	require.NoError(t, ioutil.WriteFile(archivePath, []byte(strings.Repeat("x", 300)), 0600))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, cache.Store("key", archivePath))
+
+			cacheFile, err := cache.Fetch("key", "test")
+			if assert.NoError(t, err) && assert.NotNil(t, cacheFile) {
+				contents, err := ioutil.ReadFile(cacheFile.Name())
+				assert.NoError(t, err)
+				assert.Equal(t, strings.Repeat("x", 300), string(contents))
+				_ = os.Remove(cacheFile.Name())
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestDownloadCacheFromLocalCache(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	cacheServer := newFakeCacheServer(t)
+	cacheServer.Put(t, "gradle", map[string]string{"deps.jar": "deps"})
+
+	env := map[string]string{"CIRRUS_LOCAL_CACHE_DIR": testutil.TempDir(t)}
+
+	executor := newTestArtifactsExecutor()
+	logUploader := newTestLogUploader(t, executor)
+
+	download := func() string {
+		workingDir := testutil.TempDir(t)
+		env["CIRRUS_WORKING_DIR"] = workingDir
+		folder := filepath.Join(workingDir, "gradle")
+
+		success := executor.DownloadCache(context.Background(), logUploader, "gradle", cacheServer.Host(),
+			&api.CacheInstruction{Folders: []string{folder}, FingerprintKey: "gradle"}, env)
+		require.True(t, success)
+
+		return folder
+	}
+
+	// The first task populates the local cache, while the second one restores from it
+	download()
+	folder := download()
+	assert.FileExists(t, filepath.Join(folder, "deps.jar"))
+	assert.Equal(t, []string{"gradle"}, cacheServer.Downloads())
+
+	// The uploads populate the local cache too
+	writeTestFile(t, filepath.Join(folder, "new.jar"), "new")
+	caches = caches[:0]
+	success := executor.DownloadCache(context.Background(), logUploader, "new_gradle", cacheServer.Host(),
+		&api.CacheInstruction{Folders: []string{folder}, FingerprintKey: "new-gradle"}, env)
+	require.True(t, success)
+	success = executor.UploadCache(context.Background(), logUploader, "upload_new_gradle", cacheServer.Host(),
+		&api.UploadCacheInstruction{CacheName: "new_gradle"}, env)
+	require.True(t, success)
+	require.Equal(t, []string{"new-gradle"}, cacheServer.Uploads())
+
+	require.NoError(t, os.RemoveAll(folder))
+	caches = caches[:0]
+	success = executor.DownloadCache(context.Background(), logUploader, "new_gradle", cacheServer.Host(),
+		&api.CacheInstruction{Folders: []string{folder}, FingerprintKey: "new-gradle"}, env)
+	require.True(t, success)
+	assert.FileExists(t, filepath.Join(folder, "new.jar"))
+	assert.Equal(t, []string{"gradle"}, cacheServer.Downloads())
+
+	logUploader.Finalize()
+	assert.Contains(t, fake.Logs(), "Local cache miss for key 'gradle'!")
+	assert.Contains(t, fake.Logs(), "Local cache hit for key 'gradle'!")
+	assert.Contains(t, fake.Logs(), "Local cache hit for key 'new-gradle'!")
+}
+
+func TestLocalCacheCorruptedArchive(t *testing.T) {
+	cache := &localCache{dir: testutil.TempDir(t), maxSize: 1000}
+	for _, subdir := range []string{"blobs", "keys"} {
+		require.NoError(t, os.Mkdir(filepath.Join(cache.dir, subdir), 0700))
+	}
+
+	archivePath := filepath.Join(testutil.TempDir(t), "archive")
+	require.NoError(t, ioutil.WriteFile(archivePath, []byte("archive"), 0600))
+	require.NoError(t, cache.Store("key", archivePath))
+
+	digest, err := ioutil.ReadFile(cache.keyPath("key"))
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(cache.blobPath(string(digest)), []byte("garbage"), 0600))
+
+	cacheFile, err := cache.Fetch("key", "test")
+	assert.ErrorIs(t, err, errLocalCacheCorrupted)
+	assert.Nil(t, cacheFile)
+}
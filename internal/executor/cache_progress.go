@@ -0,0 +1,106 @@
+package executor
+
+import (
+	"fmt"
+	"github.com/dustin/go-humanize"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How often the progress of the cache download and upload is logged
+var cacheProgressInterval = 10 * time.Second
+
+// cacheTransferProgress periodically logs how much of the cache archive was transferred so far
+// and how fast, so that a slow transfer can be told apart from a hung one.
+type cacheTransferProgress struct {
+	// First in the struct to be 64-bit aligned for the atomic operations on 32-bit platforms
+	transferred int64
+
+	logUploader *LogUploader
+	verb        string
+	// Negative when unknown
+	total int64
+	start time.Time
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// startCacheTransferProgress starts logging the progress, the verb is either "Downloaded" or "Uploaded".
+func startCacheTransferProgress(logUploader *LogUploader, verb string, total int64) *cacheTransferProgress {
+	progress := &cacheTransferProgress{
+		logUploader: logUploader,
+		verb:        verb,
+		total:       total,
+		start:       time.Now(),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+
+	go progress.run()
+
+	return progress
+}
+
+func (progress *cacheTransferProgress) run() {
+	defer close(progress.done)
+
+	ticker := time.NewTicker(cacheProgressInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			progress.logUploader.Write([]byte(fmt.Sprintf("\n%s...", progress.describe())))
+		case <-progress.stop:
+			return
+		}
+	}
+}
+
+// Reader counts the bytes read through it as transferred.
+func (progress *cacheTransferProgress) Reader(reader io.Reader) io.Reader {
+	return &cacheProgressReader{reader: reader, progress: progress}
+}
+
+// Stop stops logging the progress and returns the description of the whole transfer.
+func (progress *cacheTransferProgress) Stop() string {
+	progress.stopOnce.Do(func() {
+		close(progress.stop)
+	})
+	<-progress.done
+
+	return progress.describe()
+}
+
+func (progress *cacheTransferProgress) describe() string {
+	transferred := atomic.LoadInt64(&progress.transferred)
+	elapsed := time.Since(progress.start)
+
+	result := fmt.Sprintf("%s %s", progress.verb, humanize.Bytes(uint64(transferred)))
+	if progress.total > 0 {
+		result += fmt.Sprintf(" of %s (%d%%)", humanize.Bytes(uint64(progress.total)), transferred*100/progress.total)
+	}
+
+	result += fmt.Sprintf(" in %s", formatFooterDuration(elapsed))
+	if elapsed >= time.Second {
+		result += fmt.Sprintf(" (%s/s)", humanize.Bytes(uint64(float64(transferred)/elapsed.Seconds())))
+	}
+
+	return result
+}
+
+type cacheProgressReader struct {
+	reader   io.Reader
+	progress *cacheTransferProgress
+}
+
+func (progressReader *cacheProgressReader) Read(p []byte) (int, error) {
+	n, err := progressReader.reader.Read(p)
+	atomic.AddInt64(&progressReader.progress.transferred, int64(n))
+
+	return n, err
+}
@@ -0,0 +1,80 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"github.com/cirruslabs/cirrus-ci-agent/api"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// slowReader returns the data in small pieces, taking its time.
+type slowReader struct {
+	reader io.Reader
+	delay  time.Duration
+}
+
+func (slow *slowReader) Read(p []byte) (int, error) {
+	time.Sleep(slow.delay)
+	if len(p) > 100 {
+		p = p[:100]
+	}
+	return slow.reader.Read(p)
+}
+
+func TestCacheTransferProgress(t *testing.T) {
+	previousInterval := cacheProgressInterval
+	cacheProgressInterval = 10 * time.Millisecond
+	t.Cleanup(func() { cacheProgressInterval = previousInterval })
+
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	logUploader := newTestLogUploader(t, newTestArtifactsExecutor())
+
+	progress := startCacheTransferProgress(logUploader, "Downloaded", 1000)
+	_, err := io.Copy(ioutil.Discard, progress.Reader(&slowReader{
+		reader: bytes.NewReader(make([]byte, 1000)),
+		delay:  5 * time.Millisecond,
+	}))
+	require.NoError(t, err)
+	summary := progress.Stop()
+	logUploader.Finalize()
+
+	assert.Regexp(t, `^Downloaded 1\.0 kB of 1\.0 kB \(100%\) in [\d.]+[mµn]?s$`, summary)
+	assert.Regexp(t, `Downloaded \d+ B of 1\.0 kB \(\d+%\) in [\d.]+[mµn]?s\.\.\.`, fake.Logs())
+}
+
+func TestCacheSummaryLogs(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	cacheServer := newFakeCacheServer(t)
+	cacheServer.Put(t, "gradle", map[string]string{"a.jar": "a", "nested/b.jar": "b"})
+
+	workingDir := testutil.TempDir(t)
+	env := map[string]string{"CIRRUS_WORKING_DIR": workingDir}
+
+	executor := newTestArtifactsExecutor()
+	logUploader := newTestLogUploader(t, executor)
+
+	success := executor.DownloadCache(context.Background(), logUploader, "gradle", cacheServer.Host(),
+		&api.CacheInstruction{Folders: []string{filepath.Join(workingDir, "gradle")}, FingerprintKey: "gradle"}, env)
+	require.True(t, success)
+
+	success = executor.DownloadCache(context.Background(), logUploader, "maven", cacheServer.Host(),
+		&api.CacheInstruction{Folders: []string{filepath.Join(workingDir, "maven")}, FingerprintKey: "maven"}, env)
+	require.True(t, success)
+	logUploader.Finalize()
+
+	assert.Contains(t, fake.Logs(), "Cache key for gradle: gradle")
+	assert.Regexp(t, `Downloading cache with key 'gradle' \(\d+ B\)\.\.\.`, fake.Logs())
+	assert.Regexp(t, `Restored cache 'gradle' \(\d+ B\) in [\d.]+[mµn]?s, extracted 2 files\.`, fake.Logs())
+	assert.Contains(t, fake.Logs(), "Cache miss for key 'maven'! No script to populate with.")
+}
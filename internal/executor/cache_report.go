@@ -0,0 +1,131 @@
+package executor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/cirruslabs/cirrus-ci-agent/api"
+	"github.com/dustin/go-humanize"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const cacheReportArtifactName = "cirrus-cache-report.json"
+
+// Cache results, the fallback hit means that the cache was restored using one of the fallback keys
+const (
+	CacheResultHit         = "hit"
+	CacheResultFallbackHit = "fallback-hit"
+	CacheResultMiss        = "miss"
+	CacheResultFailed      = "failed"
+)
+
+// CacheReport describes what has happened to the cache in both the cache and the upload cache
+// instructions. The api.CacheRetrievalAttempt only carries a part of it, so the whole report
+// is logged as a summary and can be uploaded as an artifact at the end of the task.
+type CacheReport struct {
+	Name        string `json:"name"`
+	Key         string `json:"key"`
+	Result      string `json:"result"`
+	FallbackKey string `json:"fallback_key,omitempty"`
+
+	DownloadedBytes uint64        `json:"downloaded_bytes,omitempty"`
+	DownloadedIn    time.Duration `json:"downloaded_in_nanos,omitempty"`
+	ExtractedIn     time.Duration `json:"extracted_in_nanos,omitempty"`
+	PopulatedIn     time.Duration `json:"populated_in_nanos,omitempty"`
+
+	// Key of the archive that didn't match its checksum and was treated as a miss
+	ChecksumMismatch string `json:"checksum_mismatch,omitempty"`
+
+	// Size of the files removed to fit into the cache size limit
+	PrunedBytes uint64 `json:"pruned_bytes,omitempty"`
+
+	UploadedBytes uint64        `json:"uploaded_bytes,omitempty"`
+	ArchivedIn    time.Duration `json:"archived_in_nanos,omitempty"`
+	UploadedIn    time.Duration `json:"uploaded_in_nanos,omitempty"`
+
+	// Why the cache wasn't uploaded, e.g. "unchanged"
+	UploadSkipped string `json:"upload_skipped,omitempty"`
+	UploadError   string `json:"upload_error,omitempty"`
+}
+
+// String returns the concise single-line summary of the report.
+func (report *CacheReport) String() string {
+	parts := []string{fmt.Sprintf("key %s", report.Key), report.Result}
+
+	if report.FallbackKey != "" {
+		parts[1] += fmt.Sprintf(" (key %s)", report.FallbackKey)
+	}
+	if report.DownloadedBytes != 0 {
+		parts = append(parts, fmt.Sprintf("downloaded %s in %s", humanize.Bytes(report.DownloadedBytes),
+			formatFooterDuration(report.DownloadedIn)))
+	}
+	if report.ExtractedIn != 0 {
+		parts = append(parts, fmt.Sprintf("extracted in %s", formatFooterDuration(report.ExtractedIn)))
+	}
+	if report.PopulatedIn != 0 {
+		parts = append(parts, fmt.Sprintf("populated in %s", formatFooterDuration(report.PopulatedIn)))
+	}
+	if report.PrunedBytes != 0 {
+		parts = append(parts, fmt.Sprintf("pruned %s", humanize.Bytes(report.PrunedBytes)))
+	}
+	if report.UploadedBytes != 0 {
+		parts = append(parts, fmt.Sprintf("archived in %s", formatFooterDuration(report.ArchivedIn)),
+			fmt.Sprintf("uploaded %s in %s", humanize.Bytes(report.UploadedBytes), formatFooterDuration(report.UploadedIn)))
+	}
+	if report.UploadSkipped != "" {
+		parts = append(parts, fmt.Sprintf("upload skipped (%s)", report.UploadSkipped))
+	}
+	if report.UploadError != "" {
+		parts = append(parts, fmt.Sprintf("upload failed (%s)", report.UploadError))
+	}
+
+	return fmt.Sprintf("Cache summary for %s: %s", report.Name, strings.Join(parts, ", "))
+}
+
+// cacheReportArtifactEnabled tells whether the cache report should be uploaded as an artifact,
+// configured via the CIRRUS_CACHE_REPORT_ARTIFACT behavioral environment variable.
+func cacheReportArtifactEnabled(env map[string]string) bool {
+	return env["CIRRUS_CACHE_REPORT_ARTIFACT"] == "true"
+}
+
+// uploadCacheReport makes the reports of all caches used by the task available as an artifact.
+func (executor *Executor) uploadCacheReport(ctx context.Context) {
+	if !cacheReportArtifactEnabled(executor.env) {
+		return
+	}
+
+	reports := executor.cacheAttempts.Reports()
+	if len(reports) == 0 {
+		return
+	}
+
+	contents, err := json.Marshal(reports)
+	if err != nil {
+		log.Printf("Failed to serialize the cache report: %v", err)
+		return
+	}
+
+	dir, err := ioutil.TempDir("", "cirrus-cache-report")
+	if err != nil {
+		log.Printf("Failed to create a directory for the cache report: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, cacheReportArtifactName), contents, 0600); err != nil {
+		log.Printf("Failed to write the cache report: %v", err)
+		return
+	}
+
+	_, err = executor.uploadArtifactsAndParseAnnotations(ctx, "cirrus-cache-report",
+		&api.ArtifactsInstruction{Paths: []string{cacheReportArtifactName}},
+		map[string]string{"CIRRUS_WORKING_DIR": dir}, stdLogUploadObserver{})
+	if err != nil {
+		log.Printf("Failed to upload the cache report: %v", err)
+	}
+}
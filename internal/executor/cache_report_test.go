@@ -0,0 +1,91 @@
+package executor
+
+import (
+	"context"
+	"github.com/cirruslabs/cirrus-ci-agent/api"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"testing"
+)
+
+func TestCacheReportFallbackHit(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	cacheServer := newFakeCacheServer(t)
+	cacheServer.Put(t, "deps-old", map[string]string{"lib.js": "old"})
+
+	workingDir := testutil.TempDir(t)
+	folder := filepath.Join(workingDir, "deps")
+	env := map[string]string{"CIRRUS_WORKING_DIR": workingDir, "CIRRUS_CACHE_FALLBACK_KEYS_DEPS": "deps-old"}
+
+	executor := newTestArtifactsExecutor()
+	logUploader := newTestLogUploader(t, executor)
+
+	require.True(t, executor.DownloadCache(context.Background(), logUploader, "deps", cacheServer.Host(),
+		&api.CacheInstruction{Folders: []string{folder}, FingerprintKey: "deps-new"}, env))
+
+	writeTestFile(t, filepath.Join(folder, "lib.js"), "new")
+	require.True(t, executor.UploadCache(context.Background(), logUploader, "upload_deps", cacheServer.Host(),
+		&api.UploadCacheInstruction{CacheName: "deps"}, env))
+	logUploader.Finalize()
+
+	reports := executor.cacheAttempts.Reports()
+	require.Len(t, reports, 1)
+	report := reports[0]
+	assert.Equal(t, "deps-new", report.Key)
+	assert.Equal(t, CacheResultFallbackHit, report.Result)
+	assert.Equal(t, "deps-old", report.FallbackKey)
+	assert.NotZero(t, report.DownloadedBytes)
+	assert.NotZero(t, report.UploadedBytes)
+	assert.Empty(t, report.UploadSkipped)
+
+	assert.Contains(t, fake.Logs(), "Cache summary for deps: key deps-new, fallback-hit (key deps-old), downloaded ")
+	assert.Regexp(t, `Cache summary for deps: .*, archived in [\d.]+[mµn]?s, uploaded .* in [\d.]+[mµn]?s`, fake.Logs())
+}
+
+func TestCacheReportUnchanged(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	cacheServer := newFakeCacheServer(t)
+	cacheServer.Put(t, "deps", map[string]string{"lib.js": "contents"})
+
+	workingDir := testutil.TempDir(t)
+	env := map[string]string{"CIRRUS_WORKING_DIR": workingDir}
+
+	executor := newTestArtifactsExecutor()
+	logUploader := newTestLogUploader(t, executor)
+
+	require.True(t, executor.DownloadCache(context.Background(), logUploader, "deps", cacheServer.Host(),
+		&api.CacheInstruction{Folders: []string{filepath.Join(workingDir, "deps")}, FingerprintKey: "deps",
+			ReuploadOnChanges: true}, env))
+	require.True(t, executor.UploadCache(context.Background(), logUploader, "upload_deps", cacheServer.Host(),
+		&api.UploadCacheInstruction{CacheName: "deps"}, env))
+	logUploader.Finalize()
+
+	report := executor.cacheAttempts.Report("deps")
+	assert.Equal(t, CacheResultHit, report.Result)
+	assert.Equal(t, "unchanged", report.UploadSkipped)
+	assert.Contains(t, fake.Logs(), "upload skipped (unchanged)")
+}
+
+func TestCacheReportArtifactIsOptIn(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		fake := &fakeCirrusClient{}
+		withFakeClient(t, fake)
+
+		executor := newTestArtifactsExecutor()
+		executor.cacheAttempts.Report("deps").Result = CacheResultMiss
+		if enabled {
+			executor.env["CIRRUS_CACHE_REPORT_ARTIFACT"] = "true"
+		}
+
+		executor.uploadCacheReport(context.Background())
+
+		_, uploaded := fake.UploadedFiles()[cacheReportArtifactName]
+		assert.Equal(t, enabled, uploaded)
+	}
+}
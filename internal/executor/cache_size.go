@@ -0,0 +1,166 @@
+package executor
+
+import (
+	"fmt"
+	"github.com/dustin/go-humanize"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// What to do with the cache that exceeds its size limit
+const (
+	// Remove the least recently modified files until the cache fits
+	cacheSizeLimitPrune = "prune"
+
+	// Don't upload the cache at all
+	cacheSizeLimitSkip = "skip"
+)
+
+// cacheSizeLimit parses the CIRRUS_CACHE_MAX_SIZE_<CACHE> and CIRRUS_CACHE_MAX_SIZE_MODE_<CACHE> behavioral
+// environment variables, returning the maximum total size of the cached files (zero when unlimited) and what
+// to do when it's exceeded. Invalid values are ignored with a warning, so that the cache is uploaded as before.
+func cacheSizeLimit(logUploader *LogUploader, env map[string]string, cacheName string) (uint64, string) {
+	sizeName := commandSpecificEnvName("CIRRUS_CACHE_MAX_SIZE", cacheName)
+	modeName := commandSpecificEnvName("CIRRUS_CACHE_MAX_SIZE_MODE", cacheName)
+
+	value := env[sizeName]
+	if value == "" {
+		return 0, ""
+	}
+
+	maxSize, err := humanize.ParseBytes(value)
+	if err != nil || maxSize == 0 {
+		logUploader.Write([]byte(fmt.Sprintf("\nIgnoring invalid %s value %q, expected a positive size "+
+			"like \"5GB\"\n", sizeName, value)))
+		return 0, ""
+	}
+
+	switch mode := env[modeName]; mode {
+	case "", cacheSizeLimitPrune:
+		return maxSize, cacheSizeLimitPrune
+	case cacheSizeLimitSkip:
+		return maxSize, cacheSizeLimitSkip
+	default:
+		logUploader.Write([]byte(fmt.Sprintf("\nIgnoring invalid %s value %q, expected either %q or %q\n",
+			modeName, mode, cacheSizeLimitPrune, cacheSizeLimitSkip)))
+		return maxSize, cacheSizeLimitPrune
+	}
+}
+
+// cachedFile is a regular file that would end up in the cache archive.
+type cachedFile struct {
+	folder  string
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// listCachedFiles returns the regular files in the cache folders that aren't excluded from the archive,
+// along with their total size. Symbolic links aren't followed, so the files outside of the folders
+// are never listed.
+func listCachedFiles(folders []string, excludePaths []string) ([]cachedFile, uint64, error) {
+	var result []cachedFile
+	var totalSize uint64
+
+	excluder := newCacheExcluder(excludePaths)
+
+	for _, folder := range folders {
+		err := filepath.Walk(folder, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if path != folder {
+				pathInFolder, err := filepath.Rel(folder, path)
+				if err != nil {
+					return err
+				}
+				if excluder.Exclude(filepath.ToSlash(pathInFolder), info) {
+					if info.IsDir() {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+			}
+
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+
+			result = append(result, cachedFile{folder: folder, path: path, size: info.Size(), modTime: info.ModTime()})
+			totalSize += uint64(info.Size())
+
+			return nil
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	return result, totalSize, nil
+}
+
+// pruneCachedFiles removes the least recently modified files until their total size fits into the maxSize,
+// returning the number and the total size of the removed files. The modification time is used instead
+// of the access time since the latter is commonly not updated (e.g. due to the "noatime" mount option).
+func pruneCachedFiles(files []cachedFile, totalSize uint64, maxSize uint64) (int, uint64, error) {
+	sort.SliceStable(files, func(i, j int) bool {
+		if files[i].modTime.Equal(files[j].modTime) {
+			return files[i].path < files[j].path
+		}
+		return files[i].modTime.Before(files[j].modTime)
+	})
+
+	var numPruned int
+	var bytesPruned uint64
+
+	for _, file := range files {
+		if totalSize-bytesPruned <= maxSize {
+			break
+		}
+
+		// The folder might have been re-arranged since it was listed,
+		// e.g. some of its sub-folders might've become symbolic links
+		within, err := fileIsWithinFolder(file.folder, file.path)
+		if err != nil {
+			return numPruned, bytesPruned, err
+		}
+		if !within {
+			return numPruned, bytesPruned, fmt.Errorf("refusing to prune %s since it's outside of %s",
+				file.path, file.folder)
+		}
+
+		if err := os.Remove(file.path); err != nil {
+			return numPruned, bytesPruned, err
+		}
+
+		numPruned++
+		bytesPruned += uint64(file.size)
+	}
+
+	return numPruned, bytesPruned, nil
+}
+
+// fileIsWithinFolder tells whether the file resolves to a location within the folder,
+// after resolving all the symbolic links in the paths of both.
+func fileIsWithinFolder(folder string, path string) (bool, error) {
+	canonicalFolder, err := filepath.EvalSymlinks(folder)
+	if err != nil {
+		return false, err
+	}
+
+	canonicalDir, err := filepath.EvalSymlinks(filepath.Dir(path))
+	if err != nil {
+		return false, err
+	}
+
+	relativePath, err := filepath.Rel(canonicalFolder, filepath.Join(canonicalDir, filepath.Base(path)))
+	if err != nil {
+		return false, nil
+	}
+
+	return relativePath != ".." && !strings.HasPrefix(relativePath, ".."+string(filepath.Separator)), nil
+}
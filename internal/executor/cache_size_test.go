@@ -0,0 +1,128 @@
+package executor
+
+import (
+	"context"
+	"github.com/cirruslabs/cirrus-ci-agent/api"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeAgedTestFile writes a file of the specified size that was last modified the specified time ago.
+func writeAgedTestFile(t *testing.T, path string, size int, age time.Duration) {
+	writeTestFile(t, path, strings.Repeat("x", size))
+
+	modTime := time.Now().Add(-age)
+	require.NoError(t, os.Chtimes(path, modTime, modTime))
+}
+
+func TestPruneCachedFiles(t *testing.T) {
+	folder := testutil.TempDir(t)
+	writeAgedTestFile(t, filepath.Join(folder, "oldest.bin"), 400, 3*time.Hour)
+	writeAgedTestFile(t, filepath.Join(folder, "sub", "older.bin"), 300, 2*time.Hour)
+	writeAgedTestFile(t, filepath.Join(folder, "sub", "newer.bin"), 200, time.Hour)
+	writeAgedTestFile(t, filepath.Join(folder, "newest.bin"), 100, 0)
+	writeAgedTestFile(t, filepath.Join(folder, "excluded", "ancient.bin"), 1000, 24*time.Hour)
+
+	files, totalSize, err := listCachedFiles([]string{folder}, []string{"excluded"})
+	require.NoError(t, err)
+	assert.Len(t, files, 4)
+	assert.EqualValues(t, 1000, totalSize)
+
+	numPruned, bytesPruned, err := pruneCachedFiles(files, totalSize, 400)
+	require.NoError(t, err)
+	assert.Equal(t, 2, numPruned)
+	assert.EqualValues(t, 700, bytesPruned)
+
+	assert.NoFileExists(t, filepath.Join(folder, "oldest.bin"))
+	assert.NoFileExists(t, filepath.Join(folder, "sub", "older.bin"))
+	assert.FileExists(t, filepath.Join(folder, "sub", "newer.bin"))
+	assert.FileExists(t, filepath.Join(folder, "newest.bin"))
+	assert.FileExists(t, filepath.Join(folder, "excluded", "ancient.bin"))
+}
+
+func TestPruneCachedFilesNeverLeavesFolder(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("creating symbolic links requires a privilege on Windows")
+	}
+
+	outside := testutil.TempDir(t)
+	writeAgedTestFile(t, filepath.Join(outside, "precious.bin"), 1000, 24*time.Hour)
+
+	folder := testutil.TempDir(t)
+	writeAgedTestFile(t, filepath.Join(folder, "old.bin"), 100, time.Hour)
+	require.NoError(t, os.Symlink(outside, filepath.Join(folder, "linked")))
+	require.NoError(t, os.Symlink(filepath.Join(outside, "precious.bin"), filepath.Join(folder, "precious.bin")))
+
+	// The links aren't followed, so the files they point to aren't counted nor pruned
+	files, totalSize, err := listCachedFiles([]string{folder}, nil)
+	require.NoError(t, err)
+	assert.EqualValues(t, 100, totalSize)
+
+	_, _, err = pruneCachedFiles(files, totalSize, 1)
+	require.NoError(t, err)
+	assert.NoFileExists(t, filepath.Join(folder, "old.bin"))
+	assert.FileExists(t, filepath.Join(outside, "precious.bin"))
+
+	// Neither are the files that were moved behind a link after being listed
+	writeAgedTestFile(t, filepath.Join(outside, "sub", "moved.bin"), 100, time.Hour)
+	files = []cachedFile{{folder: folder, path: filepath.Join(folder, "linked", "sub", "moved.bin"), size: 100}}
+	_, _, err = pruneCachedFiles(files, 100, 1)
+	require.Error(t, err)
+	assert.FileExists(t, filepath.Join(outside, "sub", "moved.bin"))
+}
+
+func TestUploadCacheSizeLimit(t *testing.T) {
+	for _, mode := range []string{cacheSizeLimitPrune, cacheSizeLimitSkip} {
+		t.Run(mode, func(t *testing.T) {
+			fake := &fakeCirrusClient{}
+			withFakeClient(t, fake)
+
+			cacheServer := newFakeCacheServer(t)
+
+			workingDir := testutil.TempDir(t)
+			folder := filepath.Join(workingDir, "ccache")
+			env := map[string]string{
+				"CIRRUS_WORKING_DIR":                workingDir,
+				"CIRRUS_CACHE_MAX_SIZE_CCACHE":      "1KB",
+				"CIRRUS_CACHE_MAX_SIZE_MODE_CCACHE": mode,
+			}
+
+			executor := newTestArtifactsExecutor()
+			logUploader := newTestLogUploader(t, executor)
+
+			success := executor.DownloadCache(context.Background(), logUploader, "ccache", cacheServer.Host(),
+				&api.CacheInstruction{Folders: []string{folder}, FingerprintKey: "ccache"}, env)
+			require.True(t, success)
+
+			writeAgedTestFile(t, filepath.Join(folder, "old.o"), 800, time.Hour)
+			writeAgedTestFile(t, filepath.Join(folder, "new.o"), 800, 0)
+
+			success = executor.UploadCache(context.Background(), logUploader, "upload_ccache", cacheServer.Host(),
+				&api.UploadCacheInstruction{CacheName: "ccache"}, env)
+			require.True(t, success)
+
+			logUploader.Finalize()
+
+			if mode == cacheSizeLimitSkip {
+				assert.Empty(t, cacheServer.Uploads())
+				assert.FileExists(t, filepath.Join(folder, "old.o"))
+				assert.Contains(t, fake.Logs(), "ccache cache size (1.6 kB) exceeds the limit of 1.0 kB, skipping uploading!")
+				return
+			}
+
+			require.Equal(t, []string{"ccache"}, cacheServer.Uploads())
+			restored := cacheServer.Restore(t, "ccache")
+			assert.NoFileExists(t, filepath.Join(restored, "old.o"))
+			assert.FileExists(t, filepath.Join(restored, "new.o"))
+			assert.Contains(t, fake.Logs(), "ccache cache size (1.6 kB) exceeds the limit of 1.0 kB, "+
+				"pruned 1 least recently modified files (800 B).")
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package executor
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// cacheStaging makes the cache restoration all-or-nothing: the folders that don't exist yet (or are empty)
+// are extracted into the temporary sibling folders, which are only renamed into place once the whole
+// archive is extracted. This way a truncated archive doesn't leave behind a partially restored folder,
+// which is worse than a clean cache miss.
+//
+// The folders that already have some contents are still extracted in place, since a rename can't
+// merge the restored files with the existing ones.
+type cacheStaging struct {
+	// Destination folder to the temporary folder it's extracted into
+	staged map[string]string
+}
+
+func newCacheStaging() *cacheStaging {
+	return &cacheStaging{staged: map[string]string{}}
+}
+
+// Stage returns the folder to extract the destination folder's contents into.
+func (staging *cacheStaging) Stage(destination string) string {
+	mode, ok := stageableFolderMode(destination)
+	if !ok {
+		return destination
+	}
+
+	parent := filepath.Dir(destination)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return destination
+	}
+
+	stagingFolder, err := ioutil.TempDir(parent, "."+filepath.Base(destination)+".restoring-")
+	if err != nil {
+		return destination
+	}
+
+	// ioutil.TempDir() creates the folders that are only accessible by the owner
+	if err := os.Chmod(stagingFolder, mode); err != nil {
+		_ = os.Remove(stagingFolder)
+		return destination
+	}
+
+	staging.staged[destination] = stagingFolder
+
+	return stagingFolder
+}
+
+// Commit moves the extracted folders into place.
+func (staging *cacheStaging) Commit() error {
+	for destination, stagingFolder := range staging.staged {
+		// Only an empty folder could've been there, or the destination wouldn't have been staged
+		if err := os.Remove(destination); err != nil && !os.IsNotExist(err) {
+			staging.Abort()
+			return fmt.Errorf("failed to move the restored %s into place: %w", destination, err)
+		}
+
+		if err := os.Rename(stagingFolder, destination); err != nil {
+			staging.Abort()
+			return fmt.Errorf("failed to move the restored %s into place: %w", destination, err)
+		}
+
+		delete(staging.staged, destination)
+	}
+
+	return nil
+}
+
+// Abort removes the partially extracted folders that weren't moved into place yet.
+func (staging *cacheStaging) Abort() {
+	for destination, stagingFolder := range staging.staged {
+		_ = os.RemoveAll(stagingFolder)
+		delete(staging.staged, destination)
+	}
+}
+
+// stageableFolderMode returns whether the folder is missing or empty and thus can be staged,
+// along with the permissions it should end up with. Symbolic links are never staged,
+// since they'd be replaced by the actual folders otherwise.
+func stageableFolderMode(path string) (os.FileMode, bool) {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return 0755, true
+	}
+	if err != nil || !info.IsDir() || !isEmptyDir(path) {
+		return 0, false
+	}
+
+	return info.Mode().Perm(), true
+}
+
+// isEmptyDir returns true for the folders without any entries.
+func isEmptyDir(path string) bool {
+	dir, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer dir.Close()
+
+	_, err = dir.Readdirnames(1)
+
+	return err == io.EOF
+}
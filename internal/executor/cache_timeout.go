@@ -0,0 +1,37 @@
+package executor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	defaultCacheRestoreTimeout = 15 * time.Minute
+	defaultCacheUploadTimeout  = 15 * time.Minute
+)
+
+// cacheTimeout parses the duration from the behavioral environment variable, such as
+// CIRRUS_CACHE_RESTORE_TIMEOUT or CIRRUS_CACHE_UPLOAD_TIMEOUT, ignoring the invalid values with a warning.
+func cacheTimeout(logUploader *LogUploader, env map[string]string, name string, defaultTimeout time.Duration) time.Duration {
+	value := env[name]
+	if value == "" {
+		return defaultTimeout
+	}
+
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		logUploader.Write([]byte(fmt.Sprintf("\nIgnoring invalid %s value %q, expected a positive duration "+
+			"like \"10m\"\n", name, value)))
+		return defaultTimeout
+	}
+
+	return timeout
+}
+
+// cacheDeadlineExceeded tells whether the cache operation was abandoned due to its own deadline,
+// as opposed to the whole task being canceled or timed out.
+func cacheDeadlineExceeded(operationCtx context.Context, taskCtx context.Context) bool {
+	return errors.Is(operationCtx.Err(), context.DeadlineExceeded) && taskCtx.Err() == nil
+}
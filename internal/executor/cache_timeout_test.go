@@ -0,0 +1,115 @@
+package executor
+
+import (
+	"context"
+	"github.com/cirruslabs/cirrus-ci-agent/api"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newHangingCacheServer returns the host of the cache server that never responds to the requests
+// with the specified method until the test ends, and responds with 404 to the rest of them.
+func newHangingCacheServer(t *testing.T, hangingMethod string) string {
+	done := make(chan struct{})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == hangingMethod {
+			// The request context isn't canceled until the request body is read
+			select {
+			case <-r.Context().Done():
+			case <-done:
+			}
+			return
+		}
+
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { close(done) })
+
+	// The caches are global, so don't let them leak between the tests
+	t.Cleanup(func() { caches = caches[:0] })
+
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+func TestCacheRestoreTimeout(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	cacheHost := newHangingCacheServer(t, http.MethodGet)
+
+	workingDir := testutil.TempDir(t)
+	env := map[string]string{"CIRRUS_WORKING_DIR": workingDir, "CIRRUS_CACHE_RESTORE_TIMEOUT": "100ms"}
+
+	executor := newTestArtifactsExecutor()
+	logUploader := newTestLogUploader(t, executor)
+
+	start := time.Now()
+	success := executor.DownloadCache(context.Background(), logUploader, "node_modules", cacheHost,
+		&api.CacheInstruction{Folders: []string{filepath.Join(workingDir, "node_modules")}, FingerprintKey: "node"}, env)
+	require.True(t, success)
+	assert.Less(t, time.Since(start), 10*time.Second)
+	assert.Equal(t, CacheResultMiss, executor.cacheAttempts.Report("node_modules").Result)
+
+	logUploader.Finalize()
+	assert.Contains(t, fake.Logs(), "Restoring node_modules cache took longer than 100ms, abandoned it "+
+		"and treating it as a cache miss! Continuing without the cache...")
+}
+
+func TestCacheUploadTimeout(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	cacheHost := newHangingCacheServer(t, http.MethodPost)
+
+	workingDir := testutil.TempDir(t)
+	folder := filepath.Join(workingDir, "node_modules")
+	env := map[string]string{"CIRRUS_WORKING_DIR": workingDir, "CIRRUS_CACHE_UPLOAD_TIMEOUT": "100ms"}
+
+	executor := newTestArtifactsExecutor()
+	logUploader := newTestLogUploader(t, executor)
+
+	success := executor.DownloadCache(context.Background(), logUploader, "node_modules", cacheHost,
+		&api.CacheInstruction{Folders: []string{folder}, FingerprintKey: "node"}, env)
+	require.True(t, success)
+
+	writeTestFile(t, filepath.Join(folder, "lib.js"), "contents")
+
+	start := time.Now()
+	success = executor.UploadCache(context.Background(), logUploader, "upload_node_modules", cacheHost,
+		&api.UploadCacheInstruction{CacheName: "node_modules"}, env)
+	require.True(t, success)
+	assert.Less(t, time.Since(start), 10*time.Second)
+	assert.Equal(t, "timed out after 100ms", executor.cacheAttempts.Report("node_modules").UploadError)
+
+	logUploader.Finalize()
+	assert.Contains(t, fake.Logs(), "Uploading cache 'upload_node_modules' took longer than 100ms, abandoned it! "+
+		"This doesn't affect the task result.")
+}
+
+func TestCacheTimeoutOption(t *testing.T) {
+	withFakeClient(t, &fakeCirrusClient{})
+
+	executor := newTestArtifactsExecutor()
+	logUploader := newTestLogUploader(t, executor)
+	defer logUploader.Finalize()
+
+	for value, expected := range map[string]time.Duration{
+		"":     defaultCacheRestoreTimeout,
+		"5m":   5 * time.Minute,
+		"-1m":  defaultCacheRestoreTimeout,
+		"soon": defaultCacheRestoreTimeout,
+	} {
+		env := map[string]string{"CIRRUS_CACHE_RESTORE_TIMEOUT": value}
+		assert.Equal(t, expected, cacheTimeout(logUploader, env, "CIRRUS_CACHE_RESTORE_TIMEOUT",
+			defaultCacheRestoreTimeout), value)
+	}
+}
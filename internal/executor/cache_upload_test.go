@@ -0,0 +1,172 @@
+package executor
+
+import (
+	"context"
+	"github.com/cirruslabs/cirrus-ci-agent/api"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUploadCacheSkipsUnchanged(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	cacheServer := newFakeCacheServer(t)
+	cacheServer.Put(t, "node", map[string]string{"lib.js": "contents"})
+
+	workingDir := testutil.TempDir(t)
+	folder := filepath.Join(workingDir, "node_modules")
+	env := map[string]string{"CIRRUS_WORKING_DIR": workingDir}
+
+	executor := newTestArtifactsExecutor()
+	logUploader := newTestLogUploader(t, executor)
+
+	success := executor.DownloadCache(context.Background(), logUploader, "node_modules", cacheServer.Host(),
+		&api.CacheInstruction{Folders: []string{folder}, FingerprintKey: "node", ReuploadOnChanges: true}, env)
+	require.True(t, success)
+
+	// Rewriting the identical file doesn't count as a change
+	writeTestFile(t, filepath.Join(folder, "lib.js"), "contents")
+	later := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(folder, "lib.js"), later, later))
+
+	upload := func(env map[string]string) {
+		success := executor.UploadCache(context.Background(), logUploader, "upload_node_modules", cacheServer.Host(),
+			&api.UploadCacheInstruction{CacheName: "node_modules"}, env)
+		require.True(t, success)
+	}
+
+	upload(env)
+	assert.Empty(t, cacheServer.Uploads())
+
+	upload(map[string]string{"CIRRUS_WORKING_DIR": workingDir, "CIRRUS_CACHE_FORCE_UPLOAD": "true"})
+	assert.Equal(t, []string{"node"}, cacheServer.Uploads())
+
+	logUploader.Finalize()
+	assert.Contains(t, fake.Logs(), "Cache 'node_modules' unchanged, skipping upload")
+	assert.Contains(t, fake.Logs(), "Cache 'node_modules' unchanged, but uploading anyway because of CIRRUS_CACHE_FORCE_UPLOAD")
+}
+
+func TestCacheFoldersOutsideWorkingDir(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	cacheServer := newFakeCacheServer(t)
+
+	workingDir := testutil.TempDir(t)
+	outsideDir := testutil.TempDir(t)
+	first := filepath.Join(outsideDir, "first")
+	second := filepath.Join(outsideDir, "nested", "second")
+	missing := filepath.Join(outsideDir, "missing")
+	env := map[string]string{"CIRRUS_WORKING_DIR": workingDir}
+	instruction := &api.CacheInstruction{Folders: []string{first, second, missing}, FingerprintKey: "deps"}
+
+	executor := newTestArtifactsExecutor()
+	logUploader := newTestLogUploader(t, executor)
+
+	success := executor.DownloadCache(context.Background(), logUploader, "deps", cacheServer.Host(), instruction, env)
+	require.True(t, success)
+
+	writeTestFile(t, filepath.Join(first, "a.txt"), "a")
+	writeTestFile(t, filepath.Join(second, "b.txt"), "b")
+
+	success = executor.UploadCache(context.Background(), logUploader, "upload_deps", cacheServer.Host(),
+		&api.UploadCacheInstruction{CacheName: "deps"}, env)
+	require.True(t, success)
+	require.Equal(t, []string{"deps"}, cacheServer.Uploads())
+
+	// Restore the cache in a clean environment
+	require.NoError(t, os.RemoveAll(outsideDir))
+	caches = caches[:0]
+
+	success = executor.DownloadCache(context.Background(), logUploader, "deps", cacheServer.Host(), instruction, env)
+	require.True(t, success)
+
+	contents, err := os.ReadFile(filepath.Join(first, "a.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "a", string(contents))
+	contents, err = os.ReadFile(filepath.Join(second, "b.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "b", string(contents))
+
+	logUploader.Finalize()
+	assert.Contains(t, fake.Logs(), "Cache folder "+missing+" doesn't exist, skipping it!")
+}
+
+func TestCacheGlobsOutsideWorkingDir(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	cacheServer := newFakeCacheServer(t)
+
+	workingDir := testutil.TempDir(t)
+	outsideDir := testutil.TempDir(t)
+	env := map[string]string{"CIRRUS_WORKING_DIR": workingDir}
+	instruction := &api.CacheInstruction{
+		Folders:        []string{filepath.Join(outsideDir, "first"), filepath.Join(outsideDir, "*")},
+		FingerprintKey: "deps",
+	}
+
+	executor := newTestArtifactsExecutor()
+	logUploader := newTestLogUploader(t, executor)
+
+	success := executor.DownloadCache(context.Background(), logUploader, "deps", cacheServer.Host(), instruction, env)
+	require.False(t, success)
+
+	logUploader.Finalize()
+	assert.Contains(t, fake.Logs(), "When using globs, all folders should be relative to the current working directory")
+}
+
+func TestUploadCacheExcludesPaths(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	cacheServer := newFakeCacheServer(t)
+	// An archive created before the exclusions were configured
+	cacheServer.Put(t, "pip", map[string]string{"wheel.whl": "wheel", "selfcheck/state.json": "old"})
+
+	workingDir := testutil.TempDir(t)
+	folder := filepath.Join(workingDir, "pip")
+	env := map[string]string{
+		"CIRRUS_WORKING_DIR":             workingDir,
+		"CIRRUS_CACHE_EXCLUDE_PATHS_PIP": "selfcheck, **/*.lock",
+	}
+
+	executor := newTestArtifactsExecutor()
+	logUploader := newTestLogUploader(t, executor)
+
+	success := executor.DownloadCache(context.Background(), logUploader, "pip", cacheServer.Host(),
+		&api.CacheInstruction{Folders: []string{folder}, FingerprintKey: "pip", ReuploadOnChanges: true}, env)
+	require.True(t, success)
+	assert.FileExists(t, filepath.Join(folder, "selfcheck", "state.json"))
+
+	// Changes to the excluded paths don't count
+	writeTestFile(t, filepath.Join(folder, "selfcheck", "state.json"), "new")
+	writeTestFile(t, filepath.Join(folder, "cache", "pip.lock"), "lock")
+
+	upload := func(env map[string]string) {
+		success := executor.UploadCache(context.Background(), logUploader, "upload_pip", cacheServer.Host(),
+			&api.UploadCacheInstruction{CacheName: "pip"}, env)
+		require.True(t, success)
+	}
+
+	upload(env)
+	assert.Empty(t, cacheServer.Uploads())
+
+	env["CIRRUS_CACHE_FORCE_UPLOAD"] = "true"
+	upload(env)
+	require.Equal(t, []string{"pip"}, cacheServer.Uploads())
+
+	restored := cacheServer.Restore(t, "pip")
+	assert.FileExists(t, filepath.Join(restored, "wheel.whl"))
+	assert.NoDirExists(t, filepath.Join(restored, "selfcheck"))
+	assert.NoFileExists(t, filepath.Join(restored, "cache", "pip.lock"))
+
+	logUploader.Finalize()
+	assert.Contains(t, fake.Logs(), "Excluded 2 entries from pip cache.")
+}
@@ -7,6 +7,9 @@ import (
 
 type CacheAttempts struct {
 	cacheRetrievalAttempts map[string]*api.CacheRetrievalAttempt
+
+	// One per cache name, in the order the caches were used
+	reports []*CacheReport
 }
 
 func NewCacheAttempts() *CacheAttempts {
@@ -15,6 +18,24 @@ func NewCacheAttempts() *CacheAttempts {
 	}
 }
 
+// Report returns the report of the named cache, creating it if necessary.
+func (ca *CacheAttempts) Report(name string) *CacheReport {
+	for _, report := range ca.reports {
+		if report.Name == name {
+			return report
+		}
+	}
+
+	report := &CacheReport{Name: name}
+	ca.reports = append(ca.reports, report)
+
+	return report
+}
+
+func (ca *CacheAttempts) Reports() []*CacheReport {
+	return ca.reports
+}
+
 func (ca *CacheAttempts) Failed(key string, error string) {
 	ca.cacheRetrievalAttempts[key] = &api.CacheRetrievalAttempt{Error: error}
 }
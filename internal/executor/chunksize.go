@@ -0,0 +1,151 @@
+package executor
+
+import (
+	"fmt"
+	"github.com/dustin/go-humanize"
+	"sync"
+	"time"
+)
+
+const (
+	defaultArtifactsChunkSize = 1024 * 1024
+
+	// The gRPC servers reject bigger messages unless configured otherwise
+	defaultArtifactsMaxMessageSize = 4 * 1024 * 1024
+
+	// Room for the rest of the chunk message, i.e. the artifact path and the protobuf framing
+	artifactsChunkMessageOverhead = 64 * 1024
+
+	adaptiveChunkMinSize     = 64 * 1024
+	adaptiveChunkInitialSize = 256 * 1024
+
+	// Leave some room for the rest of the message below the default 4 MiB gRPC limit
+	adaptiveChunkMaxSize = 3 * 1024 * 1024
+
+	adaptiveChunkTargetLatency = 500 * time.Millisecond
+)
+
+// adaptiveChunkSize picks the size of the next artifact chunk based on how long
+// it took to send the previous ones, somewhat similar to the TCP congestion control:
+//
+// * sends taking less than half of the target latency double the chunk size,
+// since the per-chunk overhead likely dominates on a fast link
+//
+// * sends taking more than the target latency halve the chunk size,
+// to keep the individual sends well below the timeouts on a slow link
+//
+// * otherwise the chunk size is left as is
+//
+// It's safe for concurrent use, since the chunks are read and sent in different goroutines.
+type adaptiveChunkSize struct {
+	mutex sync.Mutex
+
+	current       int
+	min           int
+	max           int
+	targetLatency time.Duration
+}
+
+func newAdaptiveChunkSize() *adaptiveChunkSize {
+	return &adaptiveChunkSize{
+		current:       adaptiveChunkInitialSize,
+		min:           adaptiveChunkMinSize,
+		max:           adaptiveChunkMaxSize,
+		targetLatency: adaptiveChunkTargetLatency,
+	}
+}
+
+// limitTo lowers the maximum chunk size, e.g. to fit into a smaller gRPC message.
+func (chunkSize *adaptiveChunkSize) limitTo(max int) {
+	chunkSize.mutex.Lock()
+	defer chunkSize.mutex.Unlock()
+
+	if max < chunkSize.max {
+		chunkSize.max = max
+	}
+	if chunkSize.current > chunkSize.max {
+		chunkSize.current = chunkSize.max
+	}
+}
+
+func (chunkSize *adaptiveChunkSize) Size() int {
+	chunkSize.mutex.Lock()
+	defer chunkSize.mutex.Unlock()
+
+	return chunkSize.current
+}
+
+// Observe records how long it took to send a chunk of the specified size.
+func (chunkSize *adaptiveChunkSize) Observe(size int, latency time.Duration) {
+	chunkSize.mutex.Lock()
+	defer chunkSize.mutex.Unlock()
+
+	switch {
+	case latency < chunkSize.targetLatency/2:
+		// Short chunks (e.g. at the end of file) tell nothing about the larger ones
+		if size < chunkSize.current {
+			return
+		}
+
+		chunkSize.current *= 2
+		if chunkSize.current > chunkSize.max {
+			chunkSize.current = chunkSize.max
+		}
+	case latency > chunkSize.targetLatency:
+		chunkSize.current /= 2
+		if chunkSize.current < chunkSize.min {
+			chunkSize.current = chunkSize.min
+		}
+	}
+}
+
+// artifactsChunkLimits are the sizes configured via the CIRRUS_ARTIFACTS_CHUNK_SIZE and
+// CIRRUS_ARTIFACTS_MAX_MESSAGE_SIZE (the biggest message the server accepts) behavioral environment variables.
+type artifactsChunkLimits struct {
+	chunkSize      int
+	maxMessageSize int
+}
+
+// parseArtifactsChunkLimits validates that the chunks fit into the messages up front,
+// rather than letting the sends fail with ResourceExhausted in the middle of the upload.
+func parseArtifactsChunkLimits(customEnv map[string]string) (artifactsChunkLimits, error) {
+	limits := artifactsChunkLimits{
+		chunkSize:      defaultArtifactsChunkSize,
+		maxMessageSize: defaultArtifactsMaxMessageSize,
+	}
+
+	for _, option := range []struct {
+		name   string
+		target *int
+	}{
+		{"CIRRUS_ARTIFACTS_CHUNK_SIZE", &limits.chunkSize},
+		{"CIRRUS_ARTIFACTS_MAX_MESSAGE_SIZE", &limits.maxMessageSize},
+	} {
+		value := customEnv[option.name]
+		if value == "" {
+			continue
+		}
+
+		parsedValue, err := humanize.ParseBytes(value)
+		if err != nil || parsedValue == 0 {
+			return limits, fmt.Errorf("%w: %s should be a positive size, got %q",
+				ErrArtifactsInvalidOption, option.name, value)
+		}
+		*option.target = int(parsedValue)
+	}
+
+	if limits.chunkSize+artifactsChunkMessageOverhead > limits.maxMessageSize {
+		return limits, fmt.Errorf("%w: CIRRUS_ARTIFACTS_CHUNK_SIZE of %s doesn't fit into the %s gRPC message "+
+			"size limit along with the %s of message overhead, lower the chunk size or raise "+
+			"CIRRUS_ARTIFACTS_MAX_MESSAGE_SIZE if the server accepts bigger messages", ErrArtifactsInvalidOption,
+			humanize.IBytes(uint64(limits.chunkSize)), humanize.IBytes(uint64(limits.maxMessageSize)),
+			humanize.IBytes(artifactsChunkMessageOverhead))
+	}
+
+	return limits, nil
+}
+
+// maxChunkSize is the biggest chunk that fits into a message.
+func (limits artifactsChunkLimits) maxChunkSize() int {
+	return limits.maxMessageSize - artifactsChunkMessageOverhead
+}
@@ -0,0 +1,132 @@
+package executor
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestAdaptiveChunkSize(t *testing.T) {
+	chunkSize := newAdaptiveChunkSize()
+	assert.Equal(t, adaptiveChunkInitialSize, chunkSize.Size())
+
+	// Fast sends grow the chunk up to the maximum
+	for i := 0; i < 10; i++ {
+		chunkSize.Observe(chunkSize.Size(), time.Millisecond)
+	}
+	assert.Equal(t, adaptiveChunkMaxSize, chunkSize.Size())
+
+	// Slow sends shrink it down to the minimum
+	for i := 0; i < 10; i++ {
+		chunkSize.Observe(chunkSize.Size(), 5*time.Second)
+	}
+	assert.Equal(t, adaptiveChunkMinSize, chunkSize.Size())
+
+	// Fast, but short sends don't affect the chunk size
+	chunkSize.Observe(1, time.Millisecond)
+	assert.Equal(t, adaptiveChunkMinSize, chunkSize.Size())
+
+	// Sends close to the target latency don't either
+	chunkSize.Observe(chunkSize.Size(), adaptiveChunkTargetLatency)
+	assert.Equal(t, adaptiveChunkMinSize, chunkSize.Size())
+}
+
+// simulatedLink models the send latency as a fixed per-chunk round trip plus the transfer time
+type simulatedLink struct {
+	roundTrip      time.Duration
+	bytesPerSecond float64
+}
+
+func (link simulatedLink) latency(size int) time.Duration {
+	return link.roundTrip + time.Duration(float64(size)/link.bytesPerSecond*float64(time.Second))
+}
+
+// simulateUpload returns the total and the worst single send time of uploading the file
+// over the link, using either the fixed or the adaptive chunk size.
+func simulateUpload(link simulatedLink, fileSize int, adaptive bool) (time.Duration, time.Duration) {
+	chunkSize := newAdaptiveChunkSize()
+
+	var total, worst time.Duration
+
+	for remaining := fileSize; remaining > 0; {
+		size := 1024 * 1024
+		if adaptive {
+			size = chunkSize.Size()
+		}
+		if size > remaining {
+			size = remaining
+		}
+
+		latency := link.latency(size)
+		chunkSize.Observe(size, latency)
+
+		total += latency
+		if latency > worst {
+			worst = latency
+		}
+		remaining -= size
+	}
+
+	return total, worst
+}
+
+// BenchmarkAdaptiveChunkSize reports the simulated upload time of a 256 MiB file in seconds,
+// along with the worst single send time, which is what runs into the timeouts on slow links.
+func BenchmarkAdaptiveChunkSize(b *testing.B) {
+	links := map[string]simulatedLink{
+		"fast-high-latency": {roundTrip: 20 * time.Millisecond, bytesPerSecond: 100 * 1024 * 1024},
+		"slow":              {roundTrip: 50 * time.Millisecond, bytesPerSecond: 256 * 1024},
+	}
+
+	for linkName, link := range links {
+		for _, adaptive := range []bool{false, true} {
+			link := link
+			adaptive := adaptive
+
+			b.Run(fmt.Sprintf("%s/adaptive=%t", linkName, adaptive), func(b *testing.B) {
+				var total, worst time.Duration
+
+				for i := 0; i < b.N; i++ {
+					total, worst = simulateUpload(link, 256*1024*1024, adaptive)
+				}
+
+				b.ReportMetric(total.Seconds(), "simulated-s")
+				b.ReportMetric(worst.Seconds(), "worst-send-s")
+			})
+		}
+	}
+}
+
+func TestParseArtifactsChunkLimits(t *testing.T) {
+	limits, err := parseArtifactsChunkLimits(map[string]string{})
+	require.NoError(t, err)
+	assert.Equal(t, defaultArtifactsChunkSize, limits.chunkSize)
+	assert.Equal(t, defaultArtifactsMaxMessageSize, limits.maxMessageSize)
+
+	limits, err = parseArtifactsChunkLimits(map[string]string{
+		"CIRRUS_ARTIFACTS_CHUNK_SIZE":       "8MiB",
+		"CIRRUS_ARTIFACTS_MAX_MESSAGE_SIZE": "16MiB",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 8*1024*1024, limits.chunkSize)
+	assert.Equal(t, 16*1024*1024-artifactsChunkMessageOverhead, limits.maxChunkSize())
+
+	// The chunk wouldn't fit into the default message size limit
+	_, err = parseArtifactsChunkLimits(map[string]string{"CIRRUS_ARTIFACTS_CHUNK_SIZE": "4MiB"})
+	assert.ErrorIs(t, err, ErrArtifactsInvalidOption)
+	assert.Contains(t, err.Error(), "CIRRUS_ARTIFACTS_MAX_MESSAGE_SIZE")
+
+	_, err = parseArtifactsChunkLimits(map[string]string{"CIRRUS_ARTIFACTS_CHUNK_SIZE": "big"})
+	assert.ErrorIs(t, err, ErrArtifactsInvalidOption)
+}
+
+func TestAdaptiveChunkSizeLimit(t *testing.T) {
+	chunkSize := newAdaptiveChunkSize()
+	chunkSize.limitTo(adaptiveChunkInitialSize / 2)
+	assert.Equal(t, adaptiveChunkInitialSize/2, chunkSize.Size())
+
+	chunkSize.Observe(chunkSize.Size(), time.Millisecond)
+	assert.Equal(t, adaptiveChunkInitialSize/2, chunkSize.Size())
+}
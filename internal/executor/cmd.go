@@ -33,24 +33,44 @@ func createCmd(scripts []string, customEnv *map[string]string) (*exec.Cmd, *os.F
 		return cmd, nil, nil
 	}
 
-	scriptFile, err := TempFileName("scripts", ".sh")
-	if err != nil {
-		return nil, nil, err
+	if isCustomShell(cmdShell) || isPowershell(cmdShell) {
+		createShellCmd := createPowershellCmd
+		if isCustomShell(cmdShell) {
+			createShellCmd = createCustomShellCmd
+		}
+
+		cmd, scriptFile, err := createShellCmd(cmdShell, scripts, customEnv)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// Run CMD in it's own session
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Setsid: true,
+		}
+
+		return cmd, scriptFile, nil
 	}
+
 	// add shebang
-	scriptFile.WriteString(fmt.Sprintf("#!%s\n", cmdShell))
-	scriptFile.WriteString("set -e\n")
+	preamble := []string{fmt.Sprintf("#!%s", cmdShell), "set -e"}
 	if strings.Contains(cmdShell, "bash") {
-		scriptFile.WriteString("set -o pipefail\n")
+		preamble = append(preamble, "set -o pipefail")
 	}
-	scriptFile.WriteString("set -o verbose\n")
-	for i := 0; i < len(scripts); i++ {
-		scriptFile.WriteString(scripts[i])
-		scriptFile.WriteString("\n")
+	preamble = append(preamble, "set -o verbose")
+	script := scriptBody(preamble, scripts)
+
+	var cmd *exec.Cmd
+	scriptFile, err := writeScriptFile(".sh", script)
+	if err != nil {
+		cmd, _, err = inlineScriptCmd(err, script, cmdShell, "-c")
+		if err != nil {
+			return nil, nil, err
+		}
+	} else {
+		_ = os.Chmod(scriptFile.Name(), 0777)
+		cmd = exec.Command(cmdShell, scriptFile.Name())
 	}
-	scriptFile.Close()
-	scriptFile.Chmod(os.FileMode(0777))
-	cmd := exec.Command(cmdShell, scriptFile.Name())
 
 	// Run CMD in it's own session
 	cmd.SysProcAttr = &syscall.SysProcAttr{
@@ -0,0 +1,126 @@
+package executor
+
+import (
+	"fmt"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/shellwords"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// customShellPlaceholder is replaced with the path to the script file in the custom shell's
+// command line, e.g. "bash --noprofile --norc -eo pipefail %s"
+const customShellPlaceholder = "%s"
+
+// scriptFilePrefix hides the script files, so that they're not matched by the typical globs
+const scriptFilePrefix = ".cirrus-script-"
+
+// maxInlineScriptLength keeps the scripts passed via the command line well within
+// its length limits, the strictest of which is 32767 characters on Windows
+const maxInlineScriptLength = 30 * 1024
+
+func isCustomShell(cmdShell string) bool {
+	return strings.Contains(cmdShell, customShellPlaceholder)
+}
+
+func isPowershell(cmdShell string) bool {
+	name := strings.TrimSuffix(strings.ToLower(filepath.Base(cmdShell)), ".exe")
+
+	return name == "powershell" || name == "pwsh"
+}
+
+// shellBinary returns the executable that is going to be run for the shell
+func shellBinary(cmdShell string) string {
+	if isCustomShell(cmdShell) {
+		if argv := shellwords.ToArgv(cmdShell); len(argv) != 0 {
+			return argv[0]
+		}
+	}
+
+	return cmdShell
+}
+
+// createCustomShellCmd runs the scripts as is using the custom shell's command line,
+// so things like failing fast are completely up to the user.
+func createCustomShellCmd(cmdShell string, scripts []string, custom_env *map[string]string) (*exec.Cmd, *os.File, error) {
+	argv := shellwords.ToArgv(cmdShell)
+
+	extension := ".sh"
+	if isPowershell(argv[0]) {
+		extension = ".ps1"
+	} else if strings.EqualFold(strings.TrimSuffix(filepath.Base(argv[0]), ".exe"), "cmd") {
+		extension = ".bat"
+	}
+
+	// There's no inline fallback, since the custom shell's command line expects a file
+	scriptFile, err := writeScriptFile(extension, scriptBody(nil, scripts))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for i := range argv {
+		argv[i] = strings.ReplaceAll(argv[i], customShellPlaceholder, scriptFile.Name())
+	}
+
+	cmd := exec.Command(argv[0], argv[1:]...)
+	return cmd, scriptFile, nil
+}
+
+func createPowershellCmd(cmdShell string, scripts []string, custom_env *map[string]string) (*exec.Cmd, *os.File, error) {
+	script := scriptBody([]string{
+		"$ErrorActionPreference = \"Stop\"",
+		"$ProgressPreference = \"SilentlyContinue\"",
+	}, scripts)
+
+	scriptFile, err := writeScriptFile(".ps1", script)
+	if err != nil {
+		return inlineScriptCmd(err, script, cmdShell, "-executionpolicy", "bypass", "-Command")
+	}
+
+	cmd := exec.Command(cmdShell, "-executionpolicy", "bypass", "-File", scriptFile.Name())
+	return cmd, scriptFile, nil
+}
+
+// scriptBody returns the preamble lines followed by the scripts, one per line.
+func scriptBody(preamble []string, scripts []string) string {
+	var body strings.Builder
+
+	for _, line := range append(preamble, scripts...) {
+		body.WriteString(line)
+		body.WriteString("\n")
+	}
+
+	return body.String()
+}
+
+// writeScriptFile writes the script into a temporary file with the extension the shell expects,
+// which avoids hitting the command line length limits with the long scripts.
+func writeScriptFile(extension string, script string) (*os.File, error) {
+	scriptFile, err := TempFileName(scriptFilePrefix, extension)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = scriptFile.WriteString(script)
+	if closeErr := scriptFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(scriptFile.Name())
+		return nil, err
+	}
+
+	return scriptFile, nil
+}
+
+// inlineScriptCmd passes the script via the shell's command line as the last argument,
+// which is only used as a fallback when the script file couldn't be created.
+func inlineScriptCmd(fileErr error, script string, name string, args ...string) (*exec.Cmd, *os.File, error) {
+	if len(script) > maxInlineScriptLength {
+		return nil, nil, fmt.Errorf("failed to create the script file (%v) and the script is too long "+
+			"(%d characters) to be passed via the command line", fileErr, len(script))
+	}
+
+	return exec.Command(name, append(args, script)...), nil, nil
+}
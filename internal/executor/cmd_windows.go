@@ -14,8 +14,10 @@ func createCmd(scripts []string, custom_env *map[string]string) (*exec.Cmd, *os.
 		}
 	}
 
-	if strings.HasSuffix(cmdShell, "powershell.exe") || strings.HasSuffix(cmdShell, "powershell") {
-		return createWindowsPowershellCmd(cmdShell, scripts, custom_env)
+	if isCustomShell(cmdShell) {
+		return createCustomShellCmd(cmdShell, scripts, custom_env)
+	} else if isPowershell(cmdShell) || strings.HasSuffix(cmdShell, "powershell.exe") || strings.HasSuffix(cmdShell, "powershell") {
+		return createPowershellCmd(cmdShell, scripts, custom_env)
 	} else if strings.HasSuffix(cmdShell, "bash.exe") || strings.HasSuffix(cmdShell, "bash") {
 		return createWindowsBashCmd(cmdShell, scripts, custom_env)
 	} else {
@@ -24,55 +26,35 @@ func createCmd(scripts []string, custom_env *map[string]string) (*exec.Cmd, *os.
 }
 
 func createWindowsBatchCmd(cmdShell string, scripts []string, custom_env *map[string]string) (*exec.Cmd, *os.File, error) {
-	scriptFile, err := TempFileName("scripts", ".bat")
-	if err != nil {
-		return nil, nil, err
+	var lines []string
+	for _, script := range scripts {
+		lines = append(lines, "call "+script, "if %errorlevel% neq 0 exit /b %errorlevel%")
 	}
-	for i := 0; i < len(scripts); i++ {
-		scriptFile.WriteString("call ")
-		scriptFile.WriteString(scripts[i])
-		scriptFile.WriteString("\n")
-		scriptFile.WriteString("if %errorlevel% neq 0 exit /b %errorlevel%\n")
+
+	scriptFile, err := writeScriptFile(".bat", scriptBody(nil, lines))
+	if err != nil {
+		// The batch lines can't be passed via the command line,
+		// so stop at the first failure the other way
+		return inlineScriptCmd(err, strings.Join(scripts, " && "), cmdShell, "/c")
 	}
-	scriptFile.Close()
 
 	cmd := exec.Command(cmdShell, "/c", scriptFile.Name())
 	return cmd, scriptFile, nil
 }
 
 func createWindowsBashCmd(cmdShell string, scripts []string, custom_env *map[string]string) (*exec.Cmd, *os.File, error) {
-	scriptFile, err := TempFileName("scripts", ".sh")
-	if err != nil {
-		return nil, nil, err
-	}
-	scriptFile.WriteString("set -e\n")
+	preamble := []string{"set -e"}
 	if strings.Contains(cmdShell, "bash") {
-		scriptFile.WriteString("set -o pipefail\n")
-	}
-	scriptFile.WriteString("set -o verbose\n")
-	for i := 0; i < len(scripts); i++ {
-		scriptFile.WriteString(scripts[i])
-		scriptFile.WriteString("\n")
+		preamble = append(preamble, "set -o pipefail")
 	}
-	scriptFile.Close()
+	preamble = append(preamble, "set -o verbose")
+	script := scriptBody(preamble, scripts)
 
-	cmd := exec.Command(cmdShell, scriptFile.Name())
-	return cmd, scriptFile, nil
-}
-
-func createWindowsPowershellCmd(cmdShell string, scripts []string, custom_env *map[string]string) (*exec.Cmd, *os.File, error) {
-	scriptFile, err := TempFileName("scripts", ".ps1")
+	scriptFile, err := writeScriptFile(".sh", script)
 	if err != nil {
-		return nil, nil, err
-	}
-	scriptFile.WriteString("$ErrorActionPreference = \"Stop\"\n")
-	scriptFile.WriteString("$ProgressPreference = \"SilentlyContinue\"\n")
-	for i := 0; i < len(scripts); i++ {
-		scriptFile.WriteString(scripts[i])
-		scriptFile.WriteString("\n")
+		return inlineScriptCmd(err, script, cmdShell, "-c")
 	}
-	scriptFile.Close()
 
-	cmd := exec.Command(cmdShell, "-executionpolicy", "bypass", "-File", scriptFile.Name())
+	cmd := exec.Command(cmdShell, scriptFile.Name())
 	return cmd, scriptFile, nil
 }
@@ -0,0 +1,313 @@
+package executor
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// commandUnsetEnvName is set by scriptEnv() to the comma-separated names of the variables
+// that the shell should remove from the agent's environment before running the scripts.
+const commandUnsetEnvName = "CIRRUS_COMMAND_UNSET_ENV"
+
+// commandWorkingDirEnvName is set by scriptEnv() to the directory to run the scripts in.
+const commandWorkingDirEnvName = "CIRRUS_COMMAND_WORKING_DIR"
+
+// commandLauncherEnvNames are the variables set by scriptEnv() for NewShellCommands() and
+// ShellCommandsAndWait() only, they're stripped from the environment of the scripts themselves.
+var commandLauncherEnvNames = map[string]bool{
+	commandUnsetEnvName:           true,
+	commandWorkingDirEnvName:      true,
+	commandNoOutputTimeoutEnvName: true,
+}
+
+// commandSpecificEnvName returns the name of the behavioral environment variable
+// that configures a single command, for example CIRRUS_TIMEOUT_INTEGRATION_TESTS
+// for the CIRRUS_TIMEOUT prefix and the "integration-tests" command.
+func commandSpecificEnvName(prefix string, commandName string) string {
+	suffix := strings.Map(func(r rune) rune {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, strings.ToUpper(commandName))
+
+	return prefix + "_" + suffix
+}
+
+// commandTimeout returns the timeout configured for the command via
+// the CIRRUS_TIMEOUT_<COMMAND> variable, either as a Go duration (e.g. "5m")
+// or as a number of seconds.
+func commandTimeout(env map[string]string, commandName string) (time.Duration, bool, error) {
+	name := commandSpecificEnvName("CIRRUS_TIMEOUT", commandName)
+
+	value, ok := env[name]
+	if !ok || value == "" {
+		return 0, false, nil
+	}
+
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		seconds, atoiErr := strconv.Atoi(value)
+		if atoiErr != nil {
+			return 0, false, fmt.Errorf("failed to parse %s: %w", name, err)
+		}
+		timeout = time.Duration(seconds) * time.Second
+	}
+
+	if timeout <= 0 {
+		return 0, false, fmt.Errorf("%s should be positive, got %q", name, value)
+	}
+
+	return timeout, true, nil
+}
+
+// commandRetries returns how many times the failed command should be retried
+// and the delay between the attempts, configured via the CIRRUS_RETRIES_<COMMAND>
+// and CIRRUS_RETRY_DELAY_<COMMAND> variables.
+func commandRetries(env map[string]string, commandName string) (int, time.Duration, error) {
+	retriesName := commandSpecificEnvName("CIRRUS_RETRIES", commandName)
+
+	value, ok := env[retriesName]
+	if !ok || value == "" {
+		return 0, 0, nil
+	}
+
+	retries, err := strconv.Atoi(value)
+	if err != nil || retries < 0 {
+		return 0, 0, fmt.Errorf("%s should be a non-negative number, got %q", retriesName, value)
+	}
+
+	delayName := commandSpecificEnvName("CIRRUS_RETRY_DELAY", commandName)
+
+	var delay time.Duration
+	if value := env[delayName]; value != "" {
+		delay, err = time.ParseDuration(value)
+		if err != nil || delay < 0 {
+			return 0, 0, fmt.Errorf("%s should be a non-negative duration, got %q", delayName, value)
+		}
+	}
+
+	return retries, delay, nil
+}
+
+// commandWorkingDir returns the directory to run the command's scripts in, configured
+// via the CIRRUS_WORKING_DIR_<COMMAND> variable. Relative paths are resolved against
+// the CIRRUS_WORKING_DIR and the missing directories are created.
+func commandWorkingDir(env map[string]string, commandName string) (string, bool, error) {
+	name := commandSpecificEnvName("CIRRUS_WORKING_DIR", commandName)
+
+	value, ok := env[name]
+	if !ok || value == "" {
+		return "", false, nil
+	}
+
+	dir := ExpandText(value, env)
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(env["CIRRUS_WORKING_DIR"], dir)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", false, fmt.Errorf("failed to create %s directory: %w", name, err)
+	}
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to use %s directory: %w", name, err)
+	}
+	if !info.IsDir() {
+		return "", false, fmt.Errorf("%s should point to a directory, but %q is not", name, dir)
+	}
+
+	return dir, true, nil
+}
+
+// commandShell returns the shell to run the command's scripts with, configured via
+// the CIRRUS_SHELL_<COMMAND> variable, in the same format as CIRRUS_SHELL. The shell
+// is looked up in advance, since exec's errors for a missing binary are rather cryptic.
+func commandShell(env map[string]string, commandName string) (string, bool, error) {
+	name := commandSpecificEnvName("CIRRUS_SHELL", commandName)
+
+	value, ok := env[name]
+	if !ok || value == "" {
+		return "", false, nil
+	}
+
+	if value == "direct" {
+		return value, true, nil
+	}
+
+	if _, err := exec.LookPath(shellBinary(value)); err != nil {
+		return "", false, fmt.Errorf("shell %q requested by %s is not available: %w", shellBinary(value), name, err)
+	}
+
+	return value, true, nil
+}
+
+// envAddition is a single variable added to the command's environment.
+type envAddition struct {
+	Name  string
+	Value string
+}
+
+// commandEnvChanges returns the variables added to the command's environment via the newline-separated
+// "KEY=VALUE" pairs in CIRRUS_ENV_<COMMAND>, in order, and the names of the variables removed from it
+// via the comma-separated CIRRUS_UNSET_ENV_<COMMAND>. The values are expanded against the task
+// environment merged with the preceding additions, so "PATH=$PATH:/opt/bin" works as expected.
+func commandEnvChanges(env map[string]string, commandName string) ([]envAddition, []string, error) {
+	name := commandSpecificEnvName("CIRRUS_ENV", commandName)
+
+	var additions []envAddition
+	merged := env
+
+	for _, line := range strings.Split(env[name], "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		key, value, ok := cutString(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, nil, fmt.Errorf("%s should contain KEY=VALUE lines, got %q", name, line)
+		}
+
+		if len(additions) == 0 {
+			merged = make(map[string]string, len(env))
+			for key, value := range env {
+				merged[key] = value
+			}
+		}
+
+		value = ExpandText(value, merged)
+		merged[key] = value
+		additions = append(additions, envAddition{Name: key, Value: value})
+	}
+
+	var removals []string
+
+	for _, key := range strings.Split(env[commandSpecificEnvName("CIRRUS_UNSET_ENV", commandName)], ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			removals = append(removals, key)
+		}
+	}
+
+	return additions, removals, nil
+}
+
+// scriptEnv returns the environment for running the command's scripts, taking
+// the CIRRUS_WORKING_DIR_<COMMAND>, CIRRUS_SHELL_<COMMAND>, CIRRUS_NO_OUTPUT_TIMEOUT_<COMMAND>,
+// CIRRUS_ENV_<COMMAND> and CIRRUS_UNSET_ENV_<COMMAND> overrides into account and describing
+// them in the command's log, with the values containing any of the sensitiveValues masked.
+//
+// Only the scripts are affected by these overrides: the cache and artifacts instructions
+// keep using the task environment, e.g. the relative paths in them are always resolved
+// against CIRRUS_WORKING_DIR.
+func scriptEnv(
+	output io.Writer,
+	env map[string]string,
+	commandName string,
+	sensitiveValues []string,
+) (map[string]string, error) {
+	overrides := map[string]string{}
+
+	dir, ok, err := commandWorkingDir(env, commandName)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		_, _ = fmt.Fprintf(output, "Working directory: %s\n", dir)
+		overrides[commandWorkingDirEnvName] = dir
+	}
+
+	shell, ok, err := commandShell(env, commandName)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		_, _ = fmt.Fprintf(output, "Shell: %s\n", shell)
+		overrides["CIRRUS_SHELL"] = shell
+	}
+
+	noOutputTimeout, err := commandNoOutputTimeout(env, commandName)
+	if err != nil {
+		return nil, err
+	}
+	if noOutputTimeout != 0 {
+		overrides[commandNoOutputTimeoutEnvName] = noOutputTimeout.String()
+	}
+
+	additions, removals, err := commandEnvChanges(env, commandName)
+	if err != nil {
+		return nil, err
+	}
+	for _, addition := range additions {
+		_, _ = fmt.Fprintf(output, "Environment: %s=%s\n", addition.Name, maskSensitiveValue(addition.Value, sensitiveValues))
+	}
+	if len(removals) != 0 {
+		_, _ = fmt.Fprintf(output, "Unset environment: %s\n", strings.Join(removals, ", "))
+		// Let the shell remove them from the agent's own environment too
+		overrides[commandUnsetEnvName] = strings.Join(removals, ",")
+	}
+
+	if len(overrides) == 0 && len(additions) == 0 {
+		return env, nil
+	}
+
+	result := make(map[string]string, len(env)+len(overrides)+len(additions))
+	for key, value := range env {
+		result[key] = value
+	}
+	for key, value := range overrides {
+		result[key] = value
+	}
+	for _, addition := range additions {
+		result[addition.Name] = addition.Value
+	}
+	for _, key := range removals {
+		delete(result, key)
+	}
+
+	return result, nil
+}
+
+// maskSensitiveValue hides the whole value if it contains any of the sensitiveValues.
+func maskSensitiveValue(value string, sensitiveValues []string) string {
+	for _, sensitiveValue := range sensitiveValues {
+		if sensitiveValue != "" && strings.Contains(value, sensitiveValue) {
+			return "HIDDEN-BY-CIRRUS-CI"
+		}
+	}
+
+	return value
+}
+
+// withoutEnvVariables returns the "KEY=VALUE" environment without the named variables,
+// which are case-insensitive on Windows.
+func withoutEnvVariables(environ []string, names []string) []string {
+	var result []string
+
+	for _, entry := range environ {
+		key, _, _ := cutString(entry, "=")
+
+		removed := false
+		for _, name := range names {
+			if key == name || (runtime.GOOS == "windows" && strings.EqualFold(key, name)) {
+				removed = true
+				break
+			}
+		}
+
+		if !removed {
+			result = append(result, entry)
+		}
+	}
+
+	return result
+}
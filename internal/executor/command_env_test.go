@@ -0,0 +1,287 @@
+package executor
+
+import (
+	"context"
+	"github.com/cirruslabs/cirrus-ci-agent/api"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestCommandSpecificEnvName(t *testing.T) {
+	assert.Equal(t, "CIRRUS_TIMEOUT_INTEGRATION_TESTS", commandSpecificEnvName("CIRRUS_TIMEOUT", "integration-tests"))
+	assert.Equal(t, "CIRRUS_TIMEOUT_MAIN", commandSpecificEnvName("CIRRUS_TIMEOUT", "main"))
+}
+
+func TestCommandTimeout(t *testing.T) {
+	_, ok, err := commandTimeout(map[string]string{}, "main")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	timeout, ok, err := commandTimeout(map[string]string{"CIRRUS_TIMEOUT_MAIN": "5m"}, "main")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, 5*time.Minute, timeout)
+
+	timeout, ok, err = commandTimeout(map[string]string{"CIRRUS_TIMEOUT_MAIN": "90"}, "main")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, 90*time.Second, timeout)
+
+	_, _, err = commandTimeout(map[string]string{"CIRRUS_TIMEOUT_MAIN": "soon"}, "main")
+	assert.Error(t, err)
+
+	_, _, err = commandTimeout(map[string]string{"CIRRUS_TIMEOUT_MAIN": "-1s"}, "main")
+	assert.Error(t, err)
+}
+
+func TestPerCommandTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("relies on the sleep command")
+	}
+
+	fake := &fakeCirrusClient{logStreamCapacities: []int{-1}}
+	withFakeClient(t, fake)
+
+	executor := newTestArtifactsExecutor()
+	executor.env = map[string]string{"CIRRUS_TIMEOUT_FLAKY": "1s"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	stepResult, err := executor.performStep(ctx, &api.Command{
+		Name: "flaky",
+		Instruction: &api.Command_ScriptInstruction{
+			ScriptInstruction: &api.ScriptInstruction{Scripts: []string{"sleep 30"}},
+		},
+	})
+	require.NoError(t, err)
+	assert.False(t, stepResult.Success)
+	assert.Less(t, stepResult.Duration, 30*time.Second)
+	assert.Contains(t, fake.Logs(), "Command 'flaky' timed out after")
+
+	// The task-level context is unaffected
+	assert.NoError(t, ctx.Err())
+}
+
+func TestCommandRetries(t *testing.T) {
+	retries, delay, err := commandRetries(map[string]string{}, "main")
+	require.NoError(t, err)
+	assert.Equal(t, 0, retries)
+	assert.Equal(t, time.Duration(0), delay)
+
+	retries, delay, err = commandRetries(map[string]string{
+		"CIRRUS_RETRIES_MAIN":     "2",
+		"CIRRUS_RETRY_DELAY_MAIN": "10s",
+	}, "main")
+	require.NoError(t, err)
+	assert.Equal(t, 2, retries)
+	assert.Equal(t, 10*time.Second, delay)
+
+	_, _, err = commandRetries(map[string]string{"CIRRUS_RETRIES_MAIN": "-1"}, "main")
+	assert.Error(t, err)
+}
+
+func TestCommandWorkingDir(t *testing.T) {
+	workingDir := testutil.TempDir(t)
+	writeTestFile(t, filepath.Join(workingDir, "file"), "")
+
+	env := map[string]string{
+		"CIRRUS_WORKING_DIR":          workingDir,
+		"PACKAGE":                     "backend",
+		"CIRRUS_WORKING_DIR_BACKEND":  "services/$PACKAGE",
+		"CIRRUS_WORKING_DIR_ABSOLUTE": filepath.Join(workingDir, "absolute"),
+		"CIRRUS_WORKING_DIR_FILE":     "file",
+	}
+
+	dir, ok, err := commandWorkingDir(env, "backend")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, filepath.Join(workingDir, "services", "backend"), dir)
+	assert.DirExists(t, dir)
+
+	dir, ok, err = commandWorkingDir(env, "absolute")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, filepath.Join(workingDir, "absolute"), dir)
+
+	_, _, err = commandWorkingDir(env, "file")
+	assert.Error(t, err)
+
+	_, ok, err = commandWorkingDir(env, "main")
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestPerCommandWorkingDir(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("relies on the POSIX shell")
+	}
+
+	fake := &fakeCirrusClient{logStreamCapacities: []int{-1}}
+	withFakeClient(t, fake)
+
+	workingDir := testutil.TempDir(t)
+
+	executor := newTestArtifactsExecutor()
+	executor.env = map[string]string{
+		"CIRRUS_WORKING_DIR":       workingDir,
+		"CIRRUS_WORKING_DIR_BUILD": "frontend",
+	}
+
+	stepResult, err := executor.performStep(context.Background(), scriptCommand("build",
+		"pwd", "echo \"working dir is $CIRRUS_WORKING_DIR\""))
+	require.NoError(t, err)
+	assert.True(t, stepResult.Success)
+
+	frontendDir, err := filepath.EvalSymlinks(filepath.Join(workingDir, "frontend"))
+	require.NoError(t, err)
+
+	logs := fake.Logs()
+	assert.Contains(t, logs, "Working directory: "+filepath.Join(workingDir, "frontend"))
+	assert.Contains(t, logs, "\n"+frontendDir+"\n")
+	assert.Contains(t, logs, "working dir is "+workingDir)
+}
+
+func TestPerCommandShell(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("relies on the POSIX shell")
+	}
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("no Bash found")
+	}
+
+	fake := &fakeCirrusClient{logStreamCapacities: []int{-1, -1, -1}}
+	withFakeClient(t, fake)
+
+	executor := newTestArtifactsExecutor()
+	executor.env = map[string]string{
+		"CIRRUS_SHELL_LENIENT": "bash %s",
+		"CIRRUS_SHELL_STRICT":  "bash -eo pipefail %s",
+		"CIRRUS_SHELL_MISSING": "/non-existent/zsh",
+	}
+
+	// The scripts are passed as is to the custom shells
+	stepResult, err := executor.performStep(context.Background(), scriptCommand("lenient", "false | true", "false", "true"))
+	require.NoError(t, err)
+	assert.True(t, stepResult.Success)
+
+	stepResult, err = executor.performStep(context.Background(), scriptCommand("strict", "false | true", "true"))
+	require.NoError(t, err)
+	assert.False(t, stepResult.Success)
+
+	stepResult, err = executor.performStep(context.Background(), scriptCommand("missing", "true"))
+	require.NoError(t, err)
+	assert.False(t, stepResult.Success)
+
+	logs := fake.Logs()
+	assert.Contains(t, logs, "Shell: bash -eo pipefail %s")
+	assert.Contains(t, logs, "shell \"/non-existent/zsh\" requested by CIRRUS_SHELL_MISSING is not available")
+}
+
+func TestCustomShellCommandLine(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("relies on the POSIX shell")
+	}
+
+	success, output := ShellCommandsAndGetOutput(context.Background(), []string{"echo \"running $0\""},
+		&map[string]string{"CIRRUS_SHELL": "sh -c '. \"$1\"' script-runner %s"})
+	assert.True(t, success)
+	assert.Contains(t, output, "running script-runner")
+}
+
+func TestCommandEnvChanges(t *testing.T) {
+	env := map[string]string{
+		"PATH": "/usr/bin",
+		"CIRRUS_ENV_BUILD": "GOFLAGS=-mod=vendor\n\n" +
+			"PATH=$PATH:/opt/bin\n" +
+			"EXTENDED_PATH = ${PATH}:/opt/sbin",
+		"CIRRUS_UNSET_ENV_BUILD": "DOCKER_HOST, DOCKER_CERT_PATH",
+	}
+
+	additions, removals, err := commandEnvChanges(env, "build")
+	require.NoError(t, err)
+	assert.Equal(t, []envAddition{
+		{Name: "GOFLAGS", Value: "-mod=vendor"},
+		{Name: "PATH", Value: "/usr/bin:/opt/bin"},
+		{Name: "EXTENDED_PATH", Value: " /usr/bin:/opt/bin:/opt/sbin"},
+	}, additions)
+	assert.Equal(t, []string{"DOCKER_HOST", "DOCKER_CERT_PATH"}, removals)
+	assert.Equal(t, "/usr/bin", env["PATH"], "the task environment should stay intact")
+
+	_, _, err = commandEnvChanges(map[string]string{"CIRRUS_ENV_BUILD": "GOFLAGS"}, "build")
+	require.Error(t, err)
+}
+
+func TestPerCommandEnv(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("relies on the POSIX shell")
+	}
+
+	t.Setenv("DOCKER_HOST", "tcp://docker:2375")
+	t.Setenv("GOFLAGS", "-mod=mod")
+
+	fake := &fakeCirrusClient{logStreamCapacities: []int{-1, -1}}
+	withFakeClient(t, fake)
+
+	executor := newTestArtifactsExecutor()
+	executor.sensitiveValues = []string{"s3cr3t"}
+	executor.env = map[string]string{
+		"CIRRUS_WORKING_DIR":     testutil.TempDir(t),
+		"TOKEN":                  "s3cr3t",
+		"CIRRUS_ENV_BUILD":       "GOFLAGS=-mod=vendor\nAUTH=Bearer $TOKEN",
+		"CIRRUS_UNSET_ENV_BUILD": "DOCKER_HOST",
+	}
+
+	script := `echo "flags=$GOFLAGS docker=${DOCKER_HOST:-unset}"`
+
+	stepResult, err := executor.performStep(context.Background(), scriptCommand("build", script))
+	require.NoError(t, err)
+	assert.True(t, stepResult.Success)
+
+	stepResult, err = executor.performStep(context.Background(), scriptCommand("test", script))
+	require.NoError(t, err)
+	assert.True(t, stepResult.Success)
+
+	buildLogs := fake.CommandLogs("build")
+	assert.Contains(t, buildLogs, "Environment: GOFLAGS=-mod=vendor\n")
+	assert.Contains(t, buildLogs, "Environment: AUTH=HIDDEN-BY-CIRRUS-CI\n")
+	assert.Contains(t, buildLogs, "Unset environment: DOCKER_HOST\n")
+	assert.Contains(t, buildLogs, "flags=-mod=vendor docker=unset")
+
+	assert.Contains(t, fake.CommandLogs("test"), "flags=-mod=mod docker=tcp://docker:2375")
+	assert.NotContains(t, executor.env, "GOFLAGS")
+}
+
+func TestCommandLauncherEnvIsNotLeaked(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("relies on the POSIX shell")
+	}
+
+	fake := &fakeCirrusClient{logStreamCapacities: []int{-1}}
+	withFakeClient(t, fake)
+
+	executor := newTestArtifactsExecutor()
+	executor.env = map[string]string{
+		"CIRRUS_WORKING_DIR":             testutil.TempDir(t),
+		"CIRRUS_WORKING_DIR_BUILD":       "frontend",
+		"CIRRUS_UNSET_ENV_BUILD":         "DOCKER_HOST",
+		"CIRRUS_NO_OUTPUT_TIMEOUT_BUILD": "1h",
+	}
+
+	stepResult, err := executor.performStep(context.Background(), scriptCommand("build",
+		"env | grep ^CIRRUS_COMMAND_ || echo no launcher variables"))
+	require.NoError(t, err)
+	assert.True(t, stepResult.Success)
+
+	logs := fake.Logs()
+	assert.Contains(t, logs, "no launcher variables")
+	for name := range commandLauncherEnvNames {
+		assert.NotContains(t, logs, name+"=")
+	}
+}
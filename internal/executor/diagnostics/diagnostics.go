@@ -0,0 +1,118 @@
+package diagnostics
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarning
+	LevelError
+	LevelOff
+)
+
+// Don't let the diagnostics grow unbounded in a long-running task
+const maxSize = 4 * 1024 * 1024
+
+var levelNames = map[Level]string{
+	LevelDebug:   "DEBUG",
+	LevelInfo:    "INFO",
+	LevelWarning: "WARN",
+	LevelError:   "ERROR",
+}
+
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LevelDebug, nil
+	case "", "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarning, nil
+	case "error":
+		return LevelError, nil
+	case "off":
+		return LevelOff, nil
+	default:
+		return LevelInfo, fmt.Errorf("unknown diagnostics level %q", s)
+	}
+}
+
+// Logger records the agent-internal diagnostics (reconnects, retries and so on)
+// separately from the command output, while still forwarding them to the standard logger.
+type Logger struct {
+	mutex     sync.Mutex
+	level     Level
+	buffer    bytes.Buffer
+	truncated bool
+	now       func() time.Time
+}
+
+func New(level Level) *Logger {
+	return &Logger{
+		level: level,
+		now:   time.Now,
+	}
+}
+
+func (logger *Logger) SetLevel(level Level) {
+	logger.mutex.Lock()
+	defer logger.mutex.Unlock()
+
+	logger.level = level
+}
+
+func (logger *Logger) Debugf(format string, args ...interface{}) {
+	logger.logf(LevelDebug, format, args...)
+}
+
+func (logger *Logger) Infof(format string, args ...interface{}) {
+	logger.logf(LevelInfo, format, args...)
+}
+
+func (logger *Logger) Warnf(format string, args ...interface{}) {
+	logger.logf(LevelWarning, format, args...)
+}
+
+func (logger *Logger) Errorf(format string, args ...interface{}) {
+	logger.logf(LevelError, format, args...)
+}
+
+// Bytes returns the recorded diagnostics.
+func (logger *Logger) Bytes() []byte {
+	logger.mutex.Lock()
+	defer logger.mutex.Unlock()
+
+	return append([]byte{}, logger.buffer.Bytes()...)
+}
+
+func (logger *Logger) logf(level Level, format string, args ...interface{}) {
+	message := strings.TrimRight(fmt.Sprintf(format, args...), "\n")
+
+	log.Println(message)
+
+	logger.mutex.Lock()
+	defer logger.mutex.Unlock()
+
+	if level < logger.level || logger.truncated {
+		return
+	}
+
+	line := fmt.Sprintf("%s [%s] %s\n", logger.now().UTC().Format(time.RFC3339Nano), levelNames[level], message)
+
+	if logger.buffer.Len()+len(line) > maxSize {
+		logger.buffer.WriteString("... diagnostics truncated\n")
+		logger.truncated = true
+		return
+	}
+
+	logger.buffer.WriteString(line)
+}
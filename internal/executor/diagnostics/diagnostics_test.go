@@ -0,0 +1,44 @@
+package diagnostics_test
+
+import (
+	"github.com/cirruslabs/cirrus-ci-agent/internal/executor/diagnostics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+func TestLevels(t *testing.T) {
+	logger := diagnostics.New(diagnostics.LevelWarning)
+
+	logger.Debugf("debug")
+	logger.Infof("info")
+	logger.Warnf("reconnecting after %d failures\n", 2)
+	logger.Errorf("error")
+
+	lines := strings.Split(strings.TrimSpace(string(logger.Bytes())), "\n")
+	require.Len(t, lines, 2)
+	assert.True(t, strings.HasSuffix(lines[0], " [WARN] reconnecting after 2 failures"))
+	assert.True(t, strings.HasSuffix(lines[1], " [ERROR] error"))
+}
+
+func TestOff(t *testing.T) {
+	logger := diagnostics.New(diagnostics.LevelOff)
+
+	logger.Errorf("error")
+
+	assert.Empty(t, logger.Bytes())
+}
+
+func TestParseLevel(t *testing.T) {
+	level, err := diagnostics.ParseLevel("DEBUG")
+	require.NoError(t, err)
+	assert.Equal(t, diagnostics.LevelDebug, level)
+
+	level, err = diagnostics.ParseLevel("")
+	require.NoError(t, err)
+	assert.Equal(t, diagnostics.LevelInfo, level)
+
+	_, err = diagnostics.ParseLevel("verbose")
+	assert.Error(t, err)
+}
@@ -0,0 +1,116 @@
+package executor
+
+import (
+	"errors"
+	"fmt"
+	"github.com/dustin/go-humanize"
+	"os"
+	"path/filepath"
+)
+
+// The commands failing with less free space than this get a hint that the disk is full
+const nearlyFullDiskThreshold = 100 * humanize.MByte
+
+var errDiskSpaceUnsupported = errors.New("checking the free disk space is not supported on this platform")
+
+// diskSpaceReport describes the free space of a filesystem containing the path.
+type diskSpaceReport struct {
+	Name string
+	Path string
+	Free uint64
+}
+
+func (report diskSpaceReport) String() string {
+	return fmt.Sprintf("%s free on the filesystem containing %s (%s)", humanize.Bytes(report.Free), report.Name, report.Path)
+}
+
+// diskSpaceReports returns the free space of the filesystems containing the CIRRUS_WORKING_DIR
+// and the temporary directory, skipping the ones that can't be checked.
+func diskSpaceReports(env map[string]string) []diskSpaceReport {
+	var result []diskSpaceReport
+
+	for _, candidate := range []struct {
+		Name string
+		Path string
+	}{
+		{Name: "CIRRUS_WORKING_DIR", Path: env["CIRRUS_WORKING_DIR"]},
+		{Name: "the temporary directory", Path: os.TempDir()},
+	} {
+		if candidate.Path == "" {
+			continue
+		}
+
+		free, err := freeDiskSpace(existingAncestor(candidate.Path))
+		if err != nil {
+			continue
+		}
+
+		result = append(result, diskSpaceReport{Name: candidate.Name, Path: candidate.Path, Free: free})
+	}
+
+	return result
+}
+
+// parseMinimumFreeDisk returns the free space the task requires to start, configured via
+// the CIRRUS_MINIMUM_FREE_DISK behavioral environment variable (e.g. "5GB"). Zero means no minimum.
+func parseMinimumFreeDisk(env map[string]string) (uint64, error) {
+	value := env["CIRRUS_MINIMUM_FREE_DISK"]
+	if value == "" {
+		return 0, nil
+	}
+
+	minimum, err := humanize.ParseBytes(value)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse CIRRUS_MINIMUM_FREE_DISK: %w", err)
+	}
+
+	return minimum, nil
+}
+
+// checkFreeDiskSpace describes the free space available to the task in the agent's log and fails
+// if any of the filesystems has less than the CIRRUS_MINIMUM_FREE_DISK.
+func checkFreeDiskSpace(env map[string]string, logf func(format string, args ...interface{})) error {
+	minimum, err := parseMinimumFreeDisk(env)
+	if err != nil {
+		return err
+	}
+
+	for _, report := range diskSpaceReports(env) {
+		logf("%s", report)
+
+		if report.Free < minimum {
+			return fmt.Errorf("only %s, while CIRRUS_MINIMUM_FREE_DISK requires at least %s",
+				report, humanize.Bytes(minimum))
+		}
+	}
+
+	return nil
+}
+
+// lowDiskSpaceHint returns a prominent hint for the failed command's log if the disk
+// is nearly full, since the tools' errors about it are often cryptic, or an empty string.
+func lowDiskSpaceHint(env map[string]string) string {
+	for _, report := range diskSpaceReports(env) {
+		if report.Free < nearlyFullDiskThreshold {
+			return fmt.Sprintf("!!! Only %s, which might be the cause of the failure !!!", report)
+		}
+	}
+
+	return ""
+}
+
+// existingAncestor returns the path or its closest ancestor that exists, since
+// the CIRRUS_WORKING_DIR might not have been created yet.
+func existingAncestor(path string) string {
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+
+		parent := filepath.Dir(path)
+		if parent == path {
+			return path
+		}
+		path = parent
+	}
+}
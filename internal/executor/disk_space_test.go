@@ -0,0 +1,51 @@
+package executor
+
+import (
+	"github.com/cirruslabs/cirrus-ci-agent/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"testing"
+)
+
+func TestFreeDiskSpace(t *testing.T) {
+	free, err := freeDiskSpace(testutil.TempDir(t))
+	if err == errDiskSpaceUnsupported {
+		t.Skip(err)
+	}
+	require.NoError(t, err)
+	assert.NotZero(t, free)
+}
+
+func TestCheckFreeDiskSpace(t *testing.T) {
+	if _, err := freeDiskSpace(testutil.TempDir(t)); err == errDiskSpaceUnsupported {
+		t.Skip(err)
+	}
+
+	env := map[string]string{
+		"CIRRUS_WORKING_DIR": filepath.Join(testutil.TempDir(t), "not", "created", "yet"),
+	}
+
+	var logged []string
+	logf := func(format string, args ...interface{}) {
+		logged = append(logged, format)
+	}
+
+	require.NoError(t, checkFreeDiskSpace(env, logf))
+	assert.Len(t, logged, 2)
+
+	env["CIRRUS_MINIMUM_FREE_DISK"] = "1 EB"
+	err := checkFreeDiskSpace(env, logf)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "while CIRRUS_MINIMUM_FREE_DISK requires at least 1.0 EB")
+
+	env["CIRRUS_MINIMUM_FREE_DISK"] = "plenty"
+	assert.Error(t, checkFreeDiskSpace(env, logf))
+}
+
+func TestExistingAncestor(t *testing.T) {
+	dir := testutil.TempDir(t)
+
+	assert.Equal(t, dir, existingAncestor(dir))
+	assert.Equal(t, dir, existingAncestor(filepath.Join(dir, "a", "b")))
+}
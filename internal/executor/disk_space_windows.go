@@ -0,0 +1,18 @@
+package executor
+
+import "golang.org/x/sys/windows"
+
+// freeDiskSpace returns the space available to the current user on the volume containing the path.
+func freeDiskSpace(path string) (uint64, error) {
+	pathPtr, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+
+	var freeBytesAvailable, totalBytes, totalFreeBytes uint64
+	if err := windows.GetDiskFreeSpaceEx(pathPtr, &freeBytesAvailable, &totalBytes, &totalFreeBytes); err != nil {
+		return 0, err
+	}
+
+	return freeBytesAvailable, nil
+}
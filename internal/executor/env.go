@@ -1,35 +1,61 @@
 package executor
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"regexp"
 	"strings"
 )
 
+var ErrUndefinedVariable = errors.New("undefined variable")
+
 func ExpandText(text string, customEnv map[string]string) string {
-	return expandTextExtended(text, func(name string) (string, bool) {
-		if userValue, ok := customEnv[name]; ok {
-			return userValue, true
-		}
+	result, _ := expandTextExtended(text, customEnvFirstLookup(customEnv))
 
-		return os.LookupEnv(name)
-	})
+	return result
+}
+
+// ExpandTextStrict works just like ExpandText, but fails when the text references
+// a variable that is neither defined nor has a default value (e.g. "${TAG:latest}").
+func ExpandTextStrict(text string, customEnv map[string]string) (string, error) {
+	result, undefined := expandTextExtended(text, customEnvFirstLookup(customEnv))
+	if len(undefined) != 0 {
+		return "", fmt.Errorf("%w %s referenced in %q", ErrUndefinedVariable, undefined[0], text)
+	}
+
+	return result, nil
 }
 
 func ExpandTextOSFirst(text string, customEnv map[string]string) string {
-	return expandTextExtended(text, func(name string) (string, bool) {
+	result, _ := expandTextExtended(text, func(name string) (string, bool) {
 		if osValue, ok := os.LookupEnv(name); ok {
 			return osValue, true
 		}
 		userValue, ok := customEnv[name]
 		return userValue, ok
 	})
+
+	return result
 }
 
-func expandTextExtended(text string, lookup func(string) (string, bool)) string {
+func customEnvFirstLookup(customEnv map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		if userValue, ok := customEnv[name]; ok {
+			return userValue, true
+		}
+
+		return os.LookupEnv(name)
+	}
+}
+
+// expandTextExtended expands the variables in text and additionally returns
+// the names of the variables that were not found and had no default value.
+func expandTextExtended(text string, lookup func(string) (string, bool)) (string, []string) {
+	var undefined []string
+
 	var re = regexp.MustCompile(`%(\w+)%`)
-	return os.Expand(re.ReplaceAllString(text, `${$1}`), func(text string) string {
+	result := os.Expand(re.ReplaceAllString(text, `${$1}`), func(text string) string {
 		parts := strings.SplitN(text, ":", 2)
 
 		name := parts[0]
@@ -42,8 +68,14 @@ func expandTextExtended(text string, lookup func(string) (string, bool)) string
 			return value
 		}
 
+		if len(parts) == 1 {
+			undefined = append(undefined, name)
+		}
+
 		return defaultValue
 	})
+
+	return result, undefined
 }
 
 func expandEnvironmentRecursively(environment map[string]string) map[string]string {
@@ -71,3 +71,30 @@ func Test_Recursive(t *testing.T) {
 func TestEnvMapAsSlice(t *testing.T) {
 	assert.Equal(t, EnvMapAsSlice(map[string]string{"A": "B"}), []string{"A=B"})
 }
+
+func TestExpandTextStrict(t *testing.T) {
+	result, err := ExpandTextStrict("${TAG}/${MISSING:default}", map[string]string{"TAG": "foo"})
+	assert.NoError(t, err)
+	assert.Equal(t, "foo/default", result)
+
+	_, err = ExpandTextStrict("build/$CIRRUS_TEST_MISSING/*.log", map[string]string{})
+	assert.ErrorIs(t, err, ErrUndefinedVariable)
+	assert.Contains(t, err.Error(), "CIRRUS_TEST_MISSING")
+
+	_, err = ExpandTextStrict("%CIRRUS_TEST_MISSING%", map[string]string{})
+	assert.ErrorIs(t, err, ErrUndefinedVariable)
+}
+
+func TestTaskAttempt(t *testing.T) {
+	executor := newTestArtifactsExecutor()
+	executor.preCreatedWorkingDir = "/tmp/cirrus-ci-build"
+
+	env := getExpandedScriptEnvironment(executor, map[string]string{
+		"ATTEMPT_SUFFIX": "attempt-$CIRRUS_TASK_ATTEMPT",
+	})
+	assert.Equal(t, "1", env["CIRRUS_TASK_ATTEMPT"])
+	assert.Equal(t, "attempt-1", env["ATTEMPT_SUFFIX"])
+
+	env = getExpandedScriptEnvironment(executor, map[string]string{"CIRRUS_TASK_ATTEMPT": "3"})
+	assert.Equal(t, "3", env["CIRRUS_TASK_ATTEMPT"])
+}
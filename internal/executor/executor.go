@@ -9,9 +9,12 @@ import (
 	"github.com/cirruslabs/cirrus-ci-agent/api"
 	"github.com/cirruslabs/cirrus-ci-agent/internal/cirrusenv"
 	"github.com/cirruslabs/cirrus-ci-agent/internal/client"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/executor/diagnostics"
 	"github.com/cirruslabs/cirrus-ci-agent/internal/executor/metrics"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/executor/tasktrace"
 	"github.com/cirruslabs/cirrus-ci-agent/internal/executor/terminalwrapper"
 	"github.com/cirruslabs/cirrus-ci-agent/internal/executor/updatebatcher"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/executor/uploadmetrics"
 	"github.com/cirruslabs/cirrus-ci-agent/internal/http_cache"
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/config"
@@ -19,6 +22,7 @@ import (
 	gitclient "github.com/go-git/go-git/v5/plumbing/transport/client"
 	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
 	"golang.org/x/net/context"
+	"io"
 	"io/ioutil"
 	"log"
 	"math"
@@ -29,14 +33,15 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
-	"syscall"
 	"time"
 )
 
 type CommandAndLogs struct {
-	Name string
-	Cmd  *exec.Cmd
-	Logs *LogUploader
+	Name    string
+	Cmd     *exec.Cmd
+	Shell   *ShellCommands
+	Logs    *LogUploader
+	Started time.Time
 }
 
 type Executor struct {
@@ -51,14 +56,26 @@ type Executor struct {
 	cacheAttempts        *CacheAttempts
 	env                  map[string]string
 	terminalWrapper      *terminalwrapper.Wrapper
+	diagnostics          *diagnostics.Logger
+	uploadMetrics        *uploadmetrics.Metrics
+	artifactsGzip        artifactsGzip
+
+	// Set when the CIRRUS_AGENT_TRACE behavioral environment variable is enabled
+	trace *tasktrace.Recorder
 }
 
 type StepResult struct {
 	Success        bool
 	SignaledToExit bool
+	Flaky          bool
 	Duration       time.Duration
+
+	// Only available for script commands
+	Outcome *CommandOutcome
 }
 
+const backgroundOutputDrainTimeout = 5 * time.Second
+
 var (
 	ErrStepExit = errors.New("executor step requested to terminate execution")
 )
@@ -86,6 +103,7 @@ func NewExecutor(
 		preCreatedWorkingDir: preCreatedWorkingDir,
 		cacheAttempts:        NewCacheAttempts(),
 		env:                  make(map[string]string),
+		diagnostics:          diagnostics.New(diagnostics.LevelInfo),
 	}
 }
 
@@ -97,6 +115,10 @@ func (executor *Executor) RunBuild(ctx context.Context) {
 
 	log.Println("Getting initial commands...")
 
+	// Whether the trace is needed is only known once we have the environment
+	trace := tasktrace.New()
+	initialCommandsSpan := trace.Start("initial commands", tasktrace.CategoryAgent)
+
 	var response *api.CommandsResponse
 	var err error
 	var numRetries uint
@@ -118,6 +140,8 @@ func (executor *Executor) RunBuild(ctx context.Context) {
 		retry.Attempts(math.MaxUint32), retry.LastErrorOnly(true),
 		retry.Context(ctx),
 	)
+	initialCommandsSpan.SetArg("retries", numRetries)
+	initialCommandsSpan.End()
 	if err != nil {
 		// Context was cancelled before we had a chance to get initial commands
 		return
@@ -128,7 +152,37 @@ func (executor *Executor) RunBuild(ctx context.Context) {
 		return
 	}
 
+	taskAttemptProvided := response.Environment["CIRRUS_TASK_ATTEMPT"] != ""
 	executor.env = getExpandedScriptEnvironment(executor, response.Environment)
+	if taskAttemptProvided {
+		log.Printf("Task attempt: %s", executor.env["CIRRUS_TASK_ATTEMPT"])
+	} else {
+		log.Printf("Task attempt: %s (not provided by the server, assuming the default)",
+			executor.env["CIRRUS_TASK_ATTEMPT"])
+	}
+
+	diagnosticsLevel, err := diagnostics.ParseLevel(executor.env["CIRRUS_AGENT_DIAGNOSTICS_LEVEL"])
+	if err != nil {
+		log.Printf("Ignoring CIRRUS_AGENT_DIAGNOSTICS_LEVEL: %v", err)
+	}
+	executor.diagnostics.SetLevel(diagnosticsLevel)
+
+	if taskTraceEnabled(executor.env) {
+		executor.trace = trace
+	}
+
+	metricsAddr := executor.env["CIRRUS_METRICS_ADDR"]
+	if metricsAddr == "" {
+		metricsAddr = os.Getenv("CIRRUS_METRICS_ADDR")
+	}
+	if metricsAddr != "" {
+		executor.uploadMetrics, err = uploadmetrics.Serve(metricsAddr)
+		if err != nil {
+			log.Printf("Failed to expose the metrics on %s: %v", metricsAddr, err)
+		} else {
+			defer executor.uploadMetrics.Close(context.Background())
+		}
+	}
 
 	workingDir, ok := executor.env["CIRRUS_WORKING_DIR"]
 	if ok {
@@ -140,6 +194,17 @@ func (executor *Executor) RunBuild(ctx context.Context) {
 		log.Printf("Not changing current working directory because CIRRUS_WORKING_DIR is not set")
 	}
 
+	// Fail fast instead of failing deep into the build with cryptic "no space left on device" errors
+	if err := checkFreeDiskSpace(executor.env, log.Printf); err != nil {
+		message := fmt.Sprintf("Not enough free disk space to run the task: %v", err)
+		log.Print(message)
+		_, _ = client.CirrusClient.ReportAgentError(ctx, &api.ReportAgentProblemRequest{
+			TaskIdentification: executor.taskIdentification,
+			Message:            message,
+		})
+		return
+	}
+
 	commands := response.Commands
 
 	if cacheHost, ok := os.LookupEnv("CIRRUS_HTTP_CACHE_HOST"); ok {
@@ -192,13 +257,13 @@ func (executor *Executor) RunBuild(ctx context.Context) {
 
 	failedAtLeastOnce := response.FailedAtLeastOnce
 
+	// Empty when the task has failed in a previous agent run
+	var firstFailedCommand string
+
 	ub := updatebatcher.New()
 
 	for _, command := range BoundedCommands(commands, executor.commandFrom, executor.commandTo) {
-		shouldRun := (command.ExecutionBehaviour == api.Command_ON_SUCCESS && !failedAtLeastOnce) ||
-			(command.ExecutionBehaviour == api.Command_ON_FAILURE && failedAtLeastOnce) ||
-			command.ExecutionBehaviour == api.Command_ALWAYS
-		if !shouldRun {
+		if !shouldRunCommand(command, failedAtLeastOnce) {
 			ub.Queue(&api.CommandResult{
 				Name:   command.Name,
 				Status: api.Status_SKIPPED,
@@ -216,14 +281,31 @@ func (executor *Executor) RunBuild(ctx context.Context) {
 
 		stepResult, err := executor.performStep(subCtx, command)
 		if err != nil {
+			executor.cleanupBackgroundCommands()
+			executor.uploadTaskTrace(ctx)
 			return
 		}
 
 		if !stepResult.Success {
+			if failedAtLeastOnce {
+				message := subsequentFailureMessage(command.Name, firstFailedCommand)
+				log.Print(message)
+				_, _ = client.CirrusClient.ReportAgentWarning(ctx, &api.ReportAgentProblemRequest{
+					TaskIdentification: executor.taskIdentification,
+					Message:            message,
+				})
+			} else {
+				firstFailedCommand = command.Name
+			}
+
 			failedAtLeastOnce = true
 		}
 
-		log.Printf("%s finished!", command.Name)
+		if stepResult.Outcome != nil {
+			log.Print(stepResult.Outcome.Footer())
+		} else {
+			log.Printf("%s finished!", command.Name)
+		}
 
 		var currentCommandStatus api.Status
 		if stepResult.Success {
@@ -241,16 +323,7 @@ func (executor *Executor) RunBuild(ctx context.Context) {
 
 	ub.Flush(ctx, executor.taskIdentification)
 
-	log.Printf("Background commands to clean up after: %d!\n", len(executor.backgroundCommands))
-	for i := 0; i < len(executor.backgroundCommands); i++ {
-		backgroundCommand := executor.backgroundCommands[i]
-		log.Printf("Cleaning up after background command %s...\n", backgroundCommand.Name)
-		err := backgroundCommand.Cmd.Process.Kill()
-		if err != nil {
-			backgroundCommand.Logs.Write([]byte(fmt.Sprintf("\nFailed to stop background script %s: %s!", backgroundCommand.Name, err)))
-		}
-		backgroundCommand.Logs.Finalize()
-	}
+	executor.cleanupBackgroundCommands()
 
 	// Retrieve resource utilization metrics
 	metricsCancel()
@@ -281,6 +354,13 @@ func (executor *Executor) RunBuild(ctx context.Context) {
 		})
 	}
 
+	if failedAtLeastOnce {
+		executor.uploadDiagnostics(ctx)
+	}
+
+	executor.uploadTaskTrace(ctx)
+	executor.uploadCacheReport(ctx)
+
 	_ = retry.Do(
 		func() error {
 			_, err = client.CirrusClient.ReportAgentFinished(ctx, &api.ReportAgentFinishedRequest{
@@ -329,6 +409,13 @@ func getExpandedScriptEnvironment(executor *Executor, responseEnvironment map[st
 	responseEnvironment["CIRRUS_OS"] = runtime.GOOS
 	responseEnvironment["CIRRUS_ARCH"] = runtime.GOARCH
 
+	// Neither the task identification nor the commands response carry the attempt number,
+	// so it's only accurate when the server passes it in the task environment, otherwise
+	// it's the documented default of 1, even if the task is actually being re-run
+	if responseEnvironment["CIRRUS_TASK_ATTEMPT"] == "" {
+		responseEnvironment["CIRRUS_TASK_ATTEMPT"] = "1"
+	}
+
 	// Use directory created by the persistent worker if CIRRUS_WORKING_DIR
 	// was not overridden in the task specification by the user
 	_, hasWorkingDir := responseEnvironment["CIRRUS_WORKING_DIR"]
@@ -357,8 +444,14 @@ func getExpandedScriptEnvironment(executor *Executor, responseEnvironment map[st
 func (executor *Executor) performStep(ctx context.Context, currentStep *api.Command) (*StepResult, error) {
 	success := false
 	signaledToExit := false
+	flaky := false
+	var outcome *CommandOutcome
 	start := time.Now()
 
+	span := executor.trace.Start(currentStep.Name, tasktrace.CategoryCommand)
+	span.SetArg("type", instructionType(currentStep))
+	defer span.End()
+
 	logUploader, err := NewLogUploader(ctx, executor, currentStep.Name)
 	if err != nil {
 		message := fmt.Sprintf("Failed to initialize command %s log upload: %v", currentStep.Name, err)
@@ -368,14 +461,44 @@ func (executor *Executor) performStep(ctx context.Context, currentStep *api.Comm
 			Message:            message,
 		})
 
+		span.SetArg("success", false)
 		return &StepResult{
 			Success:  false,
 			Duration: time.Since(start),
 		}, nil
 	}
+	defer func() {
+		span.SetArg("output_bytes", logUploader.BytesWritten())
+	}()
+
+	// The command timeout below replaces ctx, but the post-command hook should still
+	// be able to clean up after a timed out command, so it only honors its own timeout
+	taskCtx := ctx
+
+	_, isBackground := currentStep.Instruction.(*api.Command_BackgroundScriptInstruction)
+	if !isBackground {
+		defer func() {
+			if taskCtx.Err() == nil {
+				logUploader.Finalize()
+				return
+			}
+
+			// The task is being stopped, send what's left without holding up the shutdown for too long
+			if err := logUploader.Close(logFlushTimeout); err != nil {
+				log.Printf("Failed to finish log upload for %s: %v\n", currentStep.Name, err)
+			}
+		}()
 
-	if _, ok := currentStep.Instruction.(*api.Command_BackgroundScriptInstruction); !ok {
-		defer logUploader.Finalize()
+		// Background scripts outlive this function, so the command
+		// timeout only applies to the rest of the instructions
+		timeout, ok, err := commandTimeout(executor.env, currentStep.Name)
+		if err != nil {
+			_, _ = fmt.Fprintf(logUploader, "Ignoring the command timeout: %v\n", err)
+		} else if ok {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
 	}
 
 	cirrusEnv, err := cirrusenv.New(executor.taskIdentification.TaskId)
@@ -391,33 +514,67 @@ func (executor *Executor) performStep(ctx context.Context, currentStep *api.Comm
 	defer cirrusEnv.Close()
 	executor.env["CIRRUS_ENV"] = cirrusEnv.Path()
 
+	_, isExit := currentStep.Instruction.(*api.Command_ExitInstruction)
+	if !isExit {
+		err := runCommandHook(ctx, logUploader, executor.env, preCommandHookEnvName, currentStep.Name,
+			api.Status_EXECUTING.String())
+		if err == nil {
+			err = waitForReadiness(ctx, logUploader, executor.env, currentStep.Name)
+		}
+		if err != nil {
+			_, _ = fmt.Fprintf(logUploader, "Failing the command: %v\n", err)
+			if isBackground {
+				logUploader.Finalize()
+			}
+			return &StepResult{
+				Success:  false,
+				Duration: time.Since(start),
+			}, nil
+		}
+	}
+
 	switch instruction := currentStep.Instruction.(type) {
 	case *api.Command_ExitInstruction:
 		return nil, ErrStepExit
 	case *api.Command_CloneInstruction:
 		success = executor.CloneRepository(ctx, logUploader, executor.env)
 	case *api.Command_FileInstruction:
-		success = executor.CreateFile(ctx, logUploader, instruction.FileInstruction, executor.env)
+		success = executor.CreateFile(ctx, logUploader, currentStep.Name, instruction.FileInstruction, executor.env)
 	case *api.Command_ScriptInstruction:
-		cmd, err := executor.ExecuteScriptsStreamLogsAndWait(ctx, logUploader, currentStep.Name,
-			instruction.ScriptInstruction.Scripts, executor.env)
-		success = err == nil && cmd.ProcessState.Success()
-		if err == nil {
-			if ws, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok {
-				signaledToExit = ws.Signaled()
-			}
+		result := executor.executeScriptCommand(ctx, logUploader, currentStep.Name,
+			instruction.ScriptInstruction.Scripts)
+		success = result.Success
+		signaledToExit = result.SignaledToExit
+		flaky = result.Flaky
+		outcome = result.Outcome
+
+		span.SetArg("attempts", result.Attempts)
+		if outcome != nil && outcome.Exited {
+			span.SetArg("exit_code", outcome.ExitCode)
 		}
-		if err == TimeOutError {
-			signaledToExit = false
+
+		if flaky {
+			message := fmt.Sprintf("Command '%s' has succeeded only after being retried", currentStep.Name)
+			log.Print(message)
+			_, _ = client.CirrusClient.ReportAgentWarning(ctx, &api.ReportAgentProblemRequest{
+				TaskIdentification: executor.taskIdentification,
+				Message:            message,
+			})
 		}
 	case *api.Command_BackgroundScriptInstruction:
-		cmd, err := executor.ExecuteScriptsAndStreamLogs(ctx, logUploader,
-			instruction.BackgroundScriptInstruction.Scripts, executor.env)
+		env, err := scriptEnv(logUploader, executor.env, currentStep.Name, executor.sensitiveValues)
+		var sc *ShellCommands
+		if err == nil {
+			sc, err = executor.ExecuteScriptsAndStreamLogs(ctx, logUploader,
+				instruction.BackgroundScriptInstruction.Scripts, env)
+		}
 		if err == nil {
 			executor.backgroundCommands = append(executor.backgroundCommands, CommandAndLogs{
-				Name: currentStep.Name,
-				Cmd:  cmd,
-				Logs: logUploader,
+				Name:    currentStep.Name,
+				Cmd:     sc.cmd,
+				Shell:   sc,
+				Logs:    logUploader,
+				Started: time.Now(),
 			})
 			log.Printf("Started execution of #%d background command %s\n", len(executor.backgroundCommands), currentStep.Name)
 			success = true
@@ -430,12 +587,14 @@ func (executor *Executor) performStep(ctx context.Context, currentStep *api.Comm
 	case *api.Command_CacheInstruction:
 		success = executor.DownloadCache(ctx, logUploader, currentStep.Name, executor.httpCacheHost,
 			instruction.CacheInstruction, executor.env)
+		executor.traceCacheAttempt(span, currentStep.Name)
 	case *api.Command_UploadCacheInstruction:
 		success = executor.UploadCache(ctx, logUploader, currentStep.Name, executor.httpCacheHost,
 			instruction.UploadCacheInstruction, executor.env)
+		executor.traceCacheAttempt(span, instruction.UploadCacheInstruction.CacheName)
 	case *api.Command_ArtifactsInstruction:
 		success = executor.UploadArtifacts(ctx, logUploader, currentStep.Name,
-			instruction.ArtifactsInstruction, executor.env)
+			instruction.ArtifactsInstruction, executor.env, &traceUploadObserver{recorder: executor.trace})
 	case *api.Command_WaitForTerminalInstruction:
 		operationChan := executor.terminalWrapper.Wait()
 
@@ -455,6 +614,25 @@ func (executor *Executor) performStep(ctx context.Context, currentStep *api.Comm
 		success = false
 	}
 
+	// The scripts show the hint before their footer (see executeScriptCommand())
+	if !success && outcome == nil && !isBackground {
+		if hint := lowDiskSpaceHint(executor.env); hint != "" {
+			_, _ = fmt.Fprintf(logUploader, "\n%s\n", hint)
+		}
+	}
+
+	postHookStatus := api.Status_COMPLETED
+	if !success {
+		postHookStatus = api.Status_FAILED
+	}
+	err = runCommandHook(taskCtx, logUploader, executor.env, postCommandHookEnvName, currentStep.Name,
+		postHookStatus.String())
+	if err != nil {
+		_, _ = fmt.Fprintf(logUploader, "Ignoring the failure: %v\n", err)
+	}
+
+	span.SetArg("success", success)
+
 	cirrusEnvVariables, err := cirrusEnv.Consume()
 	if err != nil {
 		message := fmt.Sprintf("Failed collect CIRRUS_ENV subsystem results: %v", err)
@@ -473,7 +651,9 @@ func (executor *Executor) performStep(ctx context.Context, currentStep *api.Comm
 	return &StepResult{
 		Success:        success,
 		SignaledToExit: signaledToExit,
+		Flaky:          flaky,
 		Duration:       time.Since(start),
+		Outcome:        outcome,
 	}, nil
 }
 
@@ -483,8 +663,21 @@ func (executor *Executor) ExecuteScriptsStreamLogsAndWait(
 	commandName string,
 	scripts []string,
 	env map[string]string) (*exec.Cmd, error) {
+	var output io.Writer = logUploader
+
+	if value, ok := env["CIRRUS_SILENCE_HEARTBEAT"]; ok {
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval <= 0 {
+			_, _ = fmt.Fprintf(logUploader, "Ignoring invalid CIRRUS_SILENCE_HEARTBEAT value %q\n", value)
+		} else {
+			heartbeat := newSilenceHeartbeat(logUploader, interval)
+			defer heartbeat.Stop()
+			output = heartbeat
+		}
+	}
+
 	cmd, err := ShellCommandsAndWait(ctx, scripts, &env, func(bytes []byte) (int, error) {
-		return logUploader.Write(bytes)
+		return output.Write(bytes)
 	}, executor.shouldKillProcesses())
 	return cmd, err
 }
@@ -494,20 +687,60 @@ func (executor *Executor) ExecuteScriptsAndStreamLogs(
 	logUploader *LogUploader,
 	scripts []string,
 	env map[string]string,
-) (*exec.Cmd, error) {
-	sc, err := NewShellCommands(ctx, scripts, &env, func(bytes []byte) (int, error) {
+) (*ShellCommands, error) {
+	return NewShellCommands(ctx, scripts, &env, func(bytes []byte) (int, error) {
 		return logUploader.Write(bytes)
 	})
-	var cmd *exec.Cmd
-	if sc != nil {
-		cmd = sc.cmd
+}
+
+// cleanupBackgroundCommands kills the background commands along with all
+// of the processes they've spawned. Safe to call multiple times.
+func (executor *Executor) cleanupBackgroundCommands() {
+	log.Printf("Background commands to clean up after: %d!\n", len(executor.backgroundCommands))
+	if len(executor.backgroundCommands) != 0 {
+		span := executor.trace.Start("background commands cleanup", tasktrace.CategoryAgent)
+		span.SetArg("commands", len(executor.backgroundCommands))
+		defer span.End()
 	}
-	return cmd, err
+	for _, backgroundCommand := range executor.backgroundCommands {
+		log.Printf("Cleaning up after background command %s...\n", backgroundCommand.Name)
+		processes := backgroundCommand.Shell.processes()
+		err := backgroundCommand.Shell.kill()
+		if err != nil {
+			backgroundCommand.Logs.Write([]byte(fmt.Sprintf("\nFailed to stop background script %s: %s!", backgroundCommand.Name, err)))
+		} else {
+			// Reap the shell
+			_ = backgroundCommand.Cmd.Wait()
+		}
+		backgroundCommand.Shell.removeScriptFile()
+
+		// Make sure that the output produced right before stopping the script is not lost
+		if err := backgroundCommand.Shell.drainOutput(backgroundOutputDrainTimeout); err != nil {
+			backgroundCommand.Logs.Write([]byte(fmt.Sprintf("\nShell session I/O error: %s", err)))
+		}
+
+		if err == nil && len(processes) != 0 {
+			message := fmt.Sprintf("Stopped background script %s along with its %d processes: %s",
+				backgroundCommand.Name, len(processes), strings.Join(processes, ", "))
+			log.Println(message)
+			backgroundCommand.Logs.Write([]byte("\n" + message))
+		}
+
+		// Snapshot of the resources used by the background script over the whole task
+		outcome := NewCommandOutcome(context.Background(), backgroundCommand.Name, backgroundCommand.Cmd,
+			nil, time.Since(backgroundCommand.Started))
+		if outcome.Exited {
+			backgroundCommand.Logs.Write([]byte("\n" + outcome.Footer()))
+		}
+		backgroundCommand.Logs.Finalize()
+	}
+	executor.backgroundCommands = executor.backgroundCommands[:0]
 }
 
 func (executor *Executor) CreateFile(
 	ctx context.Context,
 	logUploader *LogUploader,
+	commandName string,
 	instruction *api.FileInstruction,
 	env map[string]string,
 ) bool {
@@ -523,10 +756,13 @@ func (executor *Executor) CreateFile(
 			logUploader.Write([]byte(fmt.Sprintf("Environment variable %s wasn't decrypted! Skipping file creation...", envName)))
 			return true
 		}
-		filePath := ExpandText(instruction.DestinationPath, env)
-		EnsureFolderExists(filepath.Dir(filePath))
-		err := ioutil.WriteFile(filePath, []byte(content), 0644)
+		options, err := parseFileInstructionOptions(env, commandName)
 		if err != nil {
+			logUploader.Write([]byte(fmt.Sprintf("Failed to create file: %s!", err)))
+			return false
+		}
+		filePath := fileInstructionPath(instruction.DestinationPath, env)
+		if err := writeFileInstructionContent(filePath, content, options); err != nil {
 			logUploader.Write([]byte(fmt.Sprintf("Failed to write file %s: %s!", filePath, err)))
 			return false
 		}
@@ -606,12 +842,15 @@ func (executor *Executor) CloneRepository(ctx context.Context, logUploader *LogU
 		if clone_depth > 0 {
 			fetchOptions.Depth = clone_depth
 		}
+		span := executor.trace.Start("git fetch", tasktrace.CategoryAgent)
 		err = repo.FetchContext(ctx, fetchOptions)
 		if err != nil && retryableCloneError(err) {
 			logUploader.Write([]byte(fmt.Sprintf("\nFetch failed: %s!", err)))
 			logUploader.Write([]byte("\nRe-trying to fetch..."))
+			span.SetArg("retried", true)
 			err = repo.Fetch(fetchOptions)
 		}
+		span.End()
 		if err != nil {
 			logUploader.Write([]byte(fmt.Sprintf("\nFailed fetch: %s!", err)))
 			return false
@@ -653,14 +892,17 @@ func (executor *Executor) CloneRepository(ctx context.Context, logUploader *LogU
 		}
 		logUploader.Write([]byte(fmt.Sprintf("\nCloning %s...\n", cloneOptions.ReferenceName)))
 
+		span := executor.trace.Start("git clone", tasktrace.CategoryAgent)
 		repo, err = git.PlainCloneContext(ctx, working_dir, false, &cloneOptions)
 
 		if err != nil && retryableCloneError(err) {
 			logUploader.Write([]byte(fmt.Sprintf("\nRetryable error '%s' while cloning! Trying again...", err)))
 			os.RemoveAll(working_dir)
 			EnsureFolderExists(working_dir)
+			span.SetArg("retried", true)
 			repo, err = git.PlainClone(working_dir, false, &cloneOptions)
 		}
+		span.End()
 
 		if err != nil {
 			if strings.Contains(strings.ToLower(err.Error()), "timeout") || strings.Contains(strings.ToLower(err.Error()), "timed out") {
@@ -0,0 +1,158 @@
+package executor
+
+import (
+	"github.com/cirruslabs/cirrus-ci-agent/internal/targz"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/testutil"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeCacheServer mimics the agent's HTTP cache, keeping the entries in memory.
+type fakeCacheServer struct {
+	mutex     sync.Mutex
+	entries   map[string][]byte
+	uploads   []string
+	downloads []string
+
+	// Number of the subsequent checksum uploads to reject
+	checksumUploadFailures int
+
+	// Number of the subsequent archive uploads to reject
+	archiveUploadFailures int
+
+	server *httptest.Server
+}
+
+func newFakeCacheServer(t *testing.T) *fakeCacheServer {
+	fake := &fakeCacheServer{entries: map[string][]byte{}}
+	fake.server = httptest.NewServer(http.HandlerFunc(fake.handle))
+	t.Cleanup(fake.server.Close)
+
+	// The caches are global, so don't let them leak between the tests
+	t.Cleanup(func() { caches = caches[:0] })
+
+	return fake
+}
+
+// Host returns the host to pass as the cacheHost to the executor.
+func (fake *fakeCacheServer) Host() string {
+	return strings.TrimPrefix(fake.server.URL, "http://")
+}
+
+func (fake *fakeCacheServer) handle(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/")
+
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		contents, ok := fake.entries[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method == http.MethodGet && !isCacheChecksumKey(key) {
+			fake.downloads = append(fake.downloads, key)
+		}
+		_, _ = w.Write(contents)
+	case http.MethodPost, http.MethodPut:
+		if isCacheChecksumKey(key) && fake.checksumUploadFailures > 0 {
+			fake.checksumUploadFailures--
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if !isCacheChecksumKey(key) && fake.archiveUploadFailures > 0 {
+			fake.archiveUploadFailures--
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		contents, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fake.entries[key] = contents
+		if !isCacheChecksumKey(key) {
+			fake.uploads = append(fake.uploads, key)
+		}
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// Put stores an archive of the files (relative path to contents) under the key.
+func (fake *fakeCacheServer) Put(t *testing.T, key string, files map[string]string) {
+	dir := testutil.TempDir(t)
+	for path, contents := range files {
+		writeTestFile(t, filepath.Join(dir, filepath.FromSlash(path)), contents)
+	}
+
+	archivePath := filepath.Join(testutil.TempDir(t), "archive.tar.gz")
+	require.NoError(t, targz.Archive(dir, []string{dir}, archivePath))
+
+	contents, err := ioutil.ReadFile(archivePath)
+	require.NoError(t, err)
+
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	fake.entries[key] = contents
+}
+
+// PutRaw stores the contents under the key as is, e.g. to simulate a corrupted archive.
+func (fake *fakeCacheServer) PutRaw(key string, contents []byte) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	fake.entries[key] = contents
+}
+
+// Get returns the contents stored under the key, nil if there's none.
+func (fake *fakeCacheServer) Get(key string) []byte {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	return fake.entries[key]
+}
+
+// Uploads returns the keys of the archives (but not their checksums) uploaded so far, in order.
+func (fake *fakeCacheServer) Uploads() []string {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	return append([]string{}, fake.uploads...)
+}
+
+// Downloads returns the keys of the archives (but not their checksums) downloaded so far, in order.
+func (fake *fakeCacheServer) Downloads() []string {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	return append([]string{}, fake.downloads...)
+}
+
+// Restore unpacks the entry stored under the key into a temporary directory and returns it.
+func (fake *fakeCacheServer) Restore(t *testing.T, key string) string {
+	fake.mutex.Lock()
+	contents, ok := fake.entries[key]
+	fake.mutex.Unlock()
+	require.True(t, ok, "no cache entry for %s", key)
+
+	archivePath := filepath.Join(testutil.TempDir(t), "archive")
+	require.NoError(t, ioutil.WriteFile(archivePath, contents, 0600))
+
+	dir := testutil.TempDir(t)
+	require.NoError(t, targz.Unarchive(archivePath, dir))
+
+	return dir
+}
+
+func isCacheChecksumKey(key string) bool {
+	return strings.HasSuffix(key, ".sha256")
+}
@@ -0,0 +1,325 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"github.com/cirruslabs/cirrus-ci-agent/api"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/client"
+	"github.com/golang/protobuf/ptypes/empty"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCirrusClient records artifact uploads and logs instead of sending them over the network.
+type fakeCirrusClient struct {
+	api.CirrusCIServiceClient
+
+	mutex           sync.Mutex
+	artifactEntries []*api.ArtifactEntry
+	logs            bytes.Buffer
+	logChunks       int
+	commandLogs     map[string]*bytes.Buffer
+	annotations     []*api.Annotation
+
+	// Number of log chunks each subsequently opened log stream accepts before breaking
+	logStreamCapacities []int
+	logStreamsOpened    int
+
+	// Whether the chunks accepted by a log stream are kept when it breaks, rather than lost
+	logStreamKeepsReceived bool
+
+	// Logs uploaded once the command has finished
+	savedLogs bytes.Buffer
+
+	// Simulates a slow log stream
+	logChunkDelay time.Duration
+
+	// Errors returned by the subsequently closed artifact upload streams
+	uploadCloseErrors []error
+	uploadsClosed     int
+
+	// Number of times sending each of the artifact files fails, keyed by the artifact path
+	uploadSendFailures map[string]int
+
+	// Simulates a server without the gzip decompressor
+	rejectCompressedUploads bool
+	compressedUploads       int
+}
+
+func (fake *fakeCirrusClient) StreamLogs(ctx context.Context, opts ...grpc.CallOption) (api.CirrusCIService_StreamLogsClient, error) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	logsClient := &fakeLogsClient{fake: fake, capacity: -1}
+	if fake.logStreamsOpened < len(fake.logStreamCapacities) {
+		logsClient.capacity = fake.logStreamCapacities[fake.logStreamsOpened]
+	}
+	fake.logStreamsOpened++
+
+	return logsClient, nil
+}
+
+func (fake *fakeCirrusClient) SaveLogs(ctx context.Context, opts ...grpc.CallOption) (api.CirrusCIService_SaveLogsClient, error) {
+	return &fakeLogsClient{fake: fake, saved: true}, nil
+}
+
+func (fake *fakeCirrusClient) UploadArtifacts(ctx context.Context, opts ...grpc.CallOption) (api.CirrusCIService_UploadArtifactsClient, error) {
+	uploadClient := &fakeUploadArtifactsClient{fake: fake}
+	for _, opt := range opts {
+		if compressor, ok := opt.(grpc.CompressorCallOption); ok && compressor.CompressorType != "" {
+			uploadClient.compressed = true
+		}
+	}
+
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	if uploadClient.compressed {
+		fake.compressedUploads++
+	}
+
+	return uploadClient, nil
+}
+
+func (fake *fakeCirrusClient) ReportAnnotations(ctx context.Context, in *api.ReportAnnotationsCommandRequest, opts ...grpc.CallOption) (*empty.Empty, error) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	fake.annotations = append(fake.annotations, in.Annotations...)
+
+	return &empty.Empty{}, nil
+}
+
+func (fake *fakeCirrusClient) Annotations() []*api.Annotation {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	return append([]*api.Annotation{}, fake.annotations...)
+}
+
+func (fake *fakeCirrusClient) ReportAgentWarning(ctx context.Context, in *api.ReportAgentProblemRequest, opts ...grpc.CallOption) (*empty.Empty, error) {
+	return &empty.Empty{}, nil
+}
+
+func (fake *fakeCirrusClient) Entries() []*api.ArtifactEntry {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	return append([]*api.ArtifactEntry{}, fake.artifactEntries...)
+}
+
+// UploadedFiles returns the contents of the uploaded files keyed by their relative path.
+func (fake *fakeCirrusClient) UploadedFiles() map[string]string {
+	result := map[string]string{}
+
+	for _, entry := range fake.Entries() {
+		if isArtifactsKeepaliveEntry(entry) {
+			continue
+		}
+		if chunk := entry.GetChunk(); chunk != nil {
+			result[chunk.ArtifactPath] += string(chunk.Data)
+		}
+	}
+
+	return result
+}
+
+func (fake *fakeCirrusClient) Logs() string {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	return fake.logs.String()
+}
+
+// SavedLogs returns the logs uploaded once the command has finished.
+func (fake *fakeCirrusClient) SavedLogs() string {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	return fake.savedLogs.String()
+}
+
+// LogChunks returns the number of log chunks streamed so far.
+func (fake *fakeCirrusClient) LogChunks() int {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	return fake.logChunks
+}
+
+// CommandLogs returns the logs streamed for a particular command.
+func (fake *fakeCirrusClient) CommandLogs(commandName string) string {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	if buffer, ok := fake.commandLogs[commandName]; ok {
+		return buffer.String()
+	}
+
+	return ""
+}
+
+type fakeLogsClient struct {
+	grpc.ClientStream
+
+	fake        *fakeCirrusClient
+	saved       bool
+	commandName string
+
+	// Number of chunks to accept before breaking the stream, negative means unlimited
+	capacity int
+
+	// Chunks accepted by a stream with a limited capacity, which are only recorded once
+	// the stream is closed, since the broken stream loses the unacknowledged chunks
+	pending [][]byte
+}
+
+func (logsClient *fakeLogsClient) Send(entry *api.LogEntry) error {
+	if key := entry.GetKey(); key != nil {
+		logsClient.commandName = key.CommandName
+	}
+
+	chunk := entry.GetChunk()
+	if chunk == nil {
+		return nil
+	}
+
+	if logsClient.saved {
+		logsClient.fake.mutex.Lock()
+		defer logsClient.fake.mutex.Unlock()
+
+		logsClient.fake.savedLogs.Write(chunk.Data)
+		return nil
+	}
+
+	time.Sleep(logsClient.fake.logChunkDelay)
+
+	logsClient.fake.mutex.Lock()
+	defer logsClient.fake.mutex.Unlock()
+
+	if logsClient.capacity == 0 {
+		logsClient.pending = nil
+		return io.EOF
+	}
+	if logsClient.capacity > 0 && logsClient.fake.logStreamKeepsReceived {
+		logsClient.capacity--
+		logsClient.record(chunk.Data)
+		return nil
+	}
+	if logsClient.capacity > 0 {
+		logsClient.capacity--
+		logsClient.pending = append(logsClient.pending, append([]byte{}, chunk.Data...))
+		return nil
+	}
+
+	logsClient.record(chunk.Data)
+
+	return nil
+}
+
+func (logsClient *fakeLogsClient) record(data []byte) {
+	logsClient.fake.logs.Write(data)
+	logsClient.fake.logChunks++
+
+	if logsClient.fake.commandLogs == nil {
+		logsClient.fake.commandLogs = map[string]*bytes.Buffer{}
+	}
+	if _, ok := logsClient.fake.commandLogs[logsClient.commandName]; !ok {
+		logsClient.fake.commandLogs[logsClient.commandName] = &bytes.Buffer{}
+	}
+	logsClient.fake.commandLogs[logsClient.commandName].Write(data)
+}
+
+func (logsClient *fakeLogsClient) CloseSend() error {
+	return nil
+}
+
+func (logsClient *fakeLogsClient) CloseAndRecv() (*api.UploadLogsResponse, error) {
+	logsClient.fake.mutex.Lock()
+	defer logsClient.fake.mutex.Unlock()
+
+	for _, chunk := range logsClient.pending {
+		logsClient.record(chunk)
+	}
+	logsClient.pending = nil
+
+	return &api.UploadLogsResponse{}, nil
+}
+
+type fakeUploadArtifactsClient struct {
+	grpc.ClientStream
+
+	fake       *fakeCirrusClient
+	compressed bool
+}
+
+func (uploadClient *fakeUploadArtifactsClient) Send(entry *api.ArtifactEntry) error {
+	uploadClient.fake.mutex.Lock()
+	defer uploadClient.fake.mutex.Unlock()
+
+	if chunk := entry.GetChunk(); chunk != nil && uploadClient.fake.uploadSendFailures[chunk.ArtifactPath] > 0 {
+		uploadClient.fake.uploadSendFailures[chunk.ArtifactPath]--
+		return status.Errorf(codes.Unavailable, "connection reset")
+	}
+
+	// Chunk data is backed by a re-used buffer, so make a copy
+	if chunk := entry.GetChunk(); chunk != nil {
+		entry = &api.ArtifactEntry{Value: &api.ArtifactEntry_Chunk{Chunk: &api.ArtifactEntry_ArtifactChunk{
+			ArtifactPath: chunk.ArtifactPath,
+			Data:         append([]byte{}, chunk.Data...),
+		}}}
+	}
+
+	uploadClient.fake.artifactEntries = append(uploadClient.fake.artifactEntries, entry)
+
+	return nil
+}
+
+func (uploadClient *fakeUploadArtifactsClient) CloseAndRecv() (*api.UploadArtifactsResponse, error) {
+	uploadClient.fake.mutex.Lock()
+	defer uploadClient.fake.mutex.Unlock()
+
+	if uploadClient.compressed && uploadClient.fake.rejectCompressedUploads {
+		return nil, status.Errorf(codes.Unimplemented, "grpc: Decompressor is not installed for grpc-encoding %q", "gzip")
+	}
+
+	var err error
+	if uploadClient.fake.uploadsClosed < len(uploadClient.fake.uploadCloseErrors) {
+		err = uploadClient.fake.uploadCloseErrors[uploadClient.fake.uploadsClosed]
+	}
+	uploadClient.fake.uploadsClosed++
+
+	return &api.UploadArtifactsResponse{}, err
+}
+
+// withFakeClient replaces the global Cirrus client for the duration of the test.
+func withFakeClient(t *testing.T, fake *fakeCirrusClient) {
+	previousClient := client.CirrusClient
+	client.CirrusClient = fake
+	t.Cleanup(func() {
+		client.CirrusClient = previousClient
+	})
+}
+
+func newTestLogUploader(t *testing.T, executor *Executor) *LogUploader {
+	logUploader, err := NewLogUploader(context.Background(), executor, "artifacts")
+	require.NoError(t, err)
+
+	return logUploader
+}
+
+func newTestArtifactsExecutor() *Executor {
+	return NewExecutor(0, "", "", "", "", "")
+}
+
+func writeTestFile(t *testing.T, path string, contents string) {
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, os.WriteFile(path, []byte(contents), 0600))
+}
@@ -0,0 +1,85 @@
+package executor
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// fileInstructionOptions configure how the file instruction materializes its content.
+type fileInstructionOptions struct {
+	// Decode the content from base64, e.g. for binary keystores
+	Base64 bool
+
+	// Applied after writing the file when set, e.g. 0600 for the SSH keys
+	Mode    os.FileMode
+	HasMode bool
+}
+
+// parseFileInstructionOptions returns the options configured via the CIRRUS_FILE_ENCODING_<COMMAND>
+// ("plain" or "base64") and the CIRRUS_FILE_MODE_<COMMAND> (octal, e.g. "0600") variables.
+func parseFileInstructionOptions(env map[string]string, commandName string) (fileInstructionOptions, error) {
+	var options fileInstructionOptions
+
+	encodingName := commandSpecificEnvName("CIRRUS_FILE_ENCODING", commandName)
+	switch value := env[encodingName]; value {
+	case "", "plain":
+	case "base64":
+		options.Base64 = true
+	default:
+		return options, fmt.Errorf("%s should be either \"plain\" or \"base64\", got %q", encodingName, value)
+	}
+
+	modeName := commandSpecificEnvName("CIRRUS_FILE_MODE", commandName)
+	if value := env[modeName]; value != "" {
+		mode, err := strconv.ParseUint(value, 8, 32)
+		if err != nil || mode > 0777 {
+			return options, fmt.Errorf("%s should be an octal permission mode (e.g. 0600), got %q", modeName, value)
+		}
+		options.Mode = os.FileMode(mode)
+		options.HasMode = true
+	}
+
+	return options, nil
+}
+
+// fileInstructionPath expands the file instruction's destination path, resolving
+// the relative paths against the CIRRUS_WORKING_DIR just like the artifact paths.
+func fileInstructionPath(destinationPath string, env map[string]string) string {
+	filePath := ExpandText(destinationPath, env)
+	if !filepath.IsAbs(filePath) {
+		filePath = filepath.Join(env["CIRRUS_WORKING_DIR"], filePath)
+	}
+
+	return filePath
+}
+
+// writeFileInstructionContent writes the content to the filePath, creating the intermediate directories.
+func writeFileInstructionContent(filePath string, content string, options fileInstructionOptions) error {
+	data := []byte(content)
+
+	if options.Base64 {
+		var err error
+		data, err = base64.StdEncoding.DecodeString(content)
+		if err != nil {
+			return fmt.Errorf("the content is not valid base64: %w", err)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(filePath, data, 0644); err != nil {
+		return err
+	}
+
+	// The mode passed to os.WriteFile() only applies to the new files and is subject to umask
+	if options.HasMode {
+		return os.Chmod(filePath, options.Mode)
+	}
+
+	return nil
+}
@@ -0,0 +1,87 @@
+package executor
+
+import (
+	"context"
+	"github.com/cirruslabs/cirrus-ci-agent/api"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func fileFromEnv(destinationPath string, envName string) *api.FileInstruction {
+	return &api.FileInstruction{
+		DestinationPath: destinationPath,
+		Source:          &api.FileInstruction_FromEnvironmentVariable{FromEnvironmentVariable: envName},
+	}
+}
+
+func TestCreateFileBase64WithMode(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	workingDir := testutil.TempDir(t)
+
+	executor := newTestArtifactsExecutor()
+	logUploader := newTestLogUploader(t, executor)
+
+	success := executor.CreateFile(context.Background(), logUploader, "keystore",
+		fileFromEnv("secrets/$KEYSTORE_NAME", "KEYSTORE"), map[string]string{
+			"CIRRUS_WORKING_DIR":            workingDir,
+			"KEYSTORE_NAME":                 "release.jks",
+			"KEYSTORE":                      "AAEC/w==",
+			"CIRRUS_FILE_ENCODING_KEYSTORE": "base64",
+			"CIRRUS_FILE_MODE_KEYSTORE":     "0600",
+		})
+	logUploader.Finalize()
+	require.True(t, success, fake.Logs())
+
+	filePath := filepath.Join(workingDir, "secrets", "release.jks")
+
+	content, err := os.ReadFile(filePath)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x00, 0x01, 0x02, 0xff}, content)
+
+	if runtime.GOOS != "windows" {
+		info, err := os.Stat(filePath)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+}
+
+func TestCreateFileInvalidBase64(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	workingDir := testutil.TempDir(t)
+
+	executor := newTestArtifactsExecutor()
+	logUploader := newTestLogUploader(t, executor)
+
+	success := executor.CreateFile(context.Background(), logUploader, "keystore",
+		fileFromEnv("release.jks", "KEYSTORE"), map[string]string{
+			"CIRRUS_WORKING_DIR":            workingDir,
+			"KEYSTORE":                      "not base64!",
+			"CIRRUS_FILE_ENCODING_KEYSTORE": "base64",
+		})
+	logUploader.Finalize()
+
+	assert.False(t, success)
+	assert.Contains(t, fake.Logs(), "the content is not valid base64")
+	assert.NoFileExists(t, filepath.Join(workingDir, "release.jks"))
+}
+
+func TestParseFileInstructionOptions(t *testing.T) {
+	options, err := parseFileInstructionOptions(map[string]string{}, "main")
+	require.NoError(t, err)
+	assert.Equal(t, fileInstructionOptions{}, options)
+
+	_, err = parseFileInstructionOptions(map[string]string{"CIRRUS_FILE_ENCODING_MAIN": "hex"}, "main")
+	assert.Error(t, err)
+
+	_, err = parseFileInstructionOptions(map[string]string{"CIRRUS_FILE_MODE_MAIN": "0999"}, "main")
+	assert.Error(t, err)
+}
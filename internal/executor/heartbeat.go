@@ -0,0 +1,107 @@
+package executor
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+const heartbeatPrefix = "[cirrus-agent]"
+
+// silenceHeartbeat passes the command's output through and injects a reminder
+// that the command is still running each time it stays silent for the interval.
+type silenceHeartbeat struct {
+	writer   io.Writer
+	interval time.Duration
+	started  time.Time
+
+	mutex         sync.Mutex
+	lastOutput    time.Time
+	lastHeartbeat time.Time
+	atLineStart   bool
+
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+func newSilenceHeartbeat(writer io.Writer, interval time.Duration) *silenceHeartbeat {
+	now := time.Now()
+
+	heartbeat := &silenceHeartbeat{
+		writer:      writer,
+		interval:    interval,
+		started:     now,
+		lastOutput:  now,
+		atLineStart: true,
+		stop:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+
+	go heartbeat.run()
+
+	return heartbeat
+}
+
+func (heartbeat *silenceHeartbeat) Write(p []byte) (int, error) {
+	heartbeat.mutex.Lock()
+	defer heartbeat.mutex.Unlock()
+
+	if len(p) != 0 {
+		heartbeat.lastOutput = time.Now()
+		heartbeat.atLineStart = p[len(p)-1] == '\n'
+	}
+
+	return heartbeat.writer.Write(p)
+}
+
+// Stop stops the heartbeat, no reminders are written once it returns.
+func (heartbeat *silenceHeartbeat) Stop() {
+	close(heartbeat.stop)
+	<-heartbeat.stopped
+}
+
+func (heartbeat *silenceHeartbeat) run() {
+	defer close(heartbeat.stopped)
+
+	timer := time.NewTimer(heartbeat.interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-heartbeat.stop:
+			return
+		case now := <-timer.C:
+			timer.Reset(heartbeat.beatIfSilent(now))
+		}
+	}
+}
+
+// beatIfSilent writes the reminder when there was neither output nor a reminder
+// for the whole interval and returns the time to wait until the next check.
+func (heartbeat *silenceHeartbeat) beatIfSilent(now time.Time) time.Duration {
+	heartbeat.mutex.Lock()
+	defer heartbeat.mutex.Unlock()
+
+	lastActivity := heartbeat.lastOutput
+	if heartbeat.lastHeartbeat.After(lastActivity) {
+		lastActivity = heartbeat.lastHeartbeat
+	}
+
+	if wait := lastActivity.Add(heartbeat.interval).Sub(now); wait > 0 {
+		return wait
+	}
+
+	var message string
+	if !heartbeat.atLineStart {
+		message = "\n"
+	}
+	message += fmt.Sprintf("%s … still running (%s elapsed, no output for %s) …\n", heartbeatPrefix,
+		formatFooterDuration(now.Sub(heartbeat.started)), formatFooterDuration(now.Sub(heartbeat.lastOutput)))
+
+	_, _ = heartbeat.writer.Write([]byte(message))
+	heartbeat.lastHeartbeat = now
+	heartbeat.atLineStart = true
+
+	return heartbeat.interval
+}
@@ -0,0 +1,63 @@
+package executor
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type lockedBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (buffer *lockedBuffer) Write(p []byte) (int, error) {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+
+	return buffer.buffer.Write(p)
+}
+
+func (buffer *lockedBuffer) String() string {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+
+	return buffer.buffer.String()
+}
+
+func TestSilenceHeartbeat(t *testing.T) {
+	output := &lockedBuffer{}
+
+	heartbeat := newSilenceHeartbeat(output, 100*time.Millisecond)
+	_, _ = heartbeat.Write([]byte("compiling..."))
+
+	assert.Eventually(t, func() bool {
+		return strings.Count(output.String(), "still running") >= 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	heartbeat.Stop()
+
+	// The reminder starts on its own line
+	assert.True(t, strings.HasPrefix(output.String(), "compiling...\n[cirrus-agent] … still running ("))
+	assert.Contains(t, output.String(), "no output for")
+
+	stoppedOutput := output.String()
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, stoppedOutput, output.String())
+}
+
+func TestSilenceHeartbeatQuietWhileThereIsOutput(t *testing.T) {
+	output := &lockedBuffer{}
+
+	heartbeat := newSilenceHeartbeat(output, 200*time.Millisecond)
+	for i := 0; i < 10; i++ {
+		_, _ = heartbeat.Write([]byte("line\n"))
+		time.Sleep(50 * time.Millisecond)
+	}
+	heartbeat.Stop()
+
+	assert.NotContains(t, output.String(), "still running")
+}
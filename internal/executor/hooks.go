@@ -0,0 +1,119 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"time"
+)
+
+const (
+	preCommandHookEnvName  = "CIRRUS_PRE_COMMAND_HOOK"
+	postCommandHookEnvName = "CIRRUS_POST_COMMAND_HOOK"
+
+	defaultCommandHookTimeout = 5 * time.Minute
+)
+
+// commandHook returns the executable configured via the hookEnvName and its timeout, letting
+// the persistent worker operators configure the hooks in the agent's environment instead of
+// in every repository (CIRRUS_COMMAND_HOOK_TIMEOUT accepts a Go duration).
+func commandHook(env map[string]string, hookEnvName string) (string, time.Duration, error) {
+	lookup := func(name string) string {
+		if value := env[name]; value != "" {
+			return value
+		}
+
+		return os.Getenv(name)
+	}
+
+	path := lookup(hookEnvName)
+	if path == "" {
+		return "", 0, nil
+	}
+
+	timeout := defaultCommandHookTimeout
+	if value := lookup("CIRRUS_COMMAND_HOOK_TIMEOUT"); value != "" {
+		var err error
+		timeout, err = time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			return "", 0, fmt.Errorf("CIRRUS_COMMAND_HOOK_TIMEOUT should be a positive duration, got %q", value)
+		}
+	}
+
+	return path, timeout, nil
+}
+
+// runCommandHook runs the hook executable around the command, passing the command name and status
+// via CIRRUS_HOOK_COMMAND_NAME and CIRRUS_HOOK_COMMAND_STATUS, and copies its output to the command's
+// log with each line prefixed by the hook's name. Does nothing when the hook is not configured.
+func runCommandHook(
+	ctx context.Context,
+	output io.Writer,
+	env map[string]string,
+	hookEnvName string,
+	commandName string,
+	status string,
+) error {
+	path, timeout, err := commandHook(env, hookEnvName)
+	if err != nil || path == "" {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// Capture the output in a file instead of a pipe, since otherwise exec.Cmd.Wait()
+	// would block until the processes spawned by the hook exit too
+	outputFile, err := TempFileName("cirrus-hook-", ".log")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(outputFile.Name())
+	defer outputFile.Close()
+
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Env = append(os.Environ(), EnvMapAsSlice(env)...)
+	cmd.Env = append(cmd.Env, "CIRRUS_HOOK_COMMAND_NAME="+commandName, "CIRRUS_HOOK_COMMAND_STATUS="+status)
+	cmd.Stdout = outputFile
+	cmd.Stderr = outputFile
+	if info, err := os.Stat(env["CIRRUS_WORKING_DIR"]); err == nil && info.IsDir() {
+		cmd.Dir = env["CIRRUS_WORKING_DIR"]
+	}
+
+	runErr := cmd.Run()
+
+	if hookOutput, err := os.ReadFile(outputFile.Name()); err == nil && len(hookOutput) != 0 {
+		writeHookOutput(output, hookEnvName, hookOutput)
+	}
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%s %s has timed out after %s", hookEnvName, path, timeout)
+	}
+	if runErr != nil {
+		return fmt.Errorf("%s %s has failed: %w", hookEnvName, path, runErr)
+	}
+
+	return nil
+}
+
+func writeHookOutput(output io.Writer, hookEnvName string, hookOutput []byte) {
+	prefix := []byte("[" + hookEnvName + "] ")
+
+	var result []byte
+	for _, line := range bytes.SplitAfter(hookOutput, []byte{'\n'}) {
+		if len(line) == 0 {
+			continue
+		}
+		result = append(result, prefix...)
+		result = append(result, line...)
+	}
+	if !bytes.HasSuffix(result, []byte{'\n'}) {
+		result = append(result, '\n')
+	}
+
+	_, _ = output.Write(result)
+}
@@ -0,0 +1,119 @@
+package executor
+
+import (
+	"context"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func writeTestHook(t *testing.T, dir string, name string, script string) string {
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0700))
+
+	return path
+}
+
+func TestCommandHooks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("relies on the POSIX shell")
+	}
+
+	fake := &fakeCirrusClient{logStreamCapacities: []int{-1}}
+	withFakeClient(t, fake)
+
+	dir := testutil.TempDir(t)
+
+	executor := newTestArtifactsExecutor()
+	executor.env = map[string]string{
+		"CIRRUS_WORKING_DIR": dir,
+		"CIRRUS_PRE_COMMAND_HOOK": writeTestHook(t, dir, "pre.sh",
+			`echo "before $CIRRUS_HOOK_COMMAND_NAME ($CIRRUS_HOOK_COMMAND_STATUS)"`),
+		"CIRRUS_POST_COMMAND_HOOK": writeTestHook(t, dir, "post.sh",
+			`echo "after $CIRRUS_HOOK_COMMAND_NAME ($CIRRUS_HOOK_COMMAND_STATUS)"; exit 1`),
+	}
+
+	stepResult, err := executor.performStep(context.Background(), scriptCommand("main", "echo running"))
+	require.NoError(t, err)
+	assert.True(t, stepResult.Success, "a failing post-command hook should only warn")
+
+	logs := fake.CommandLogs("main")
+	assert.Contains(t, logs, "[CIRRUS_PRE_COMMAND_HOOK] before main (EXECUTING)")
+	assert.Contains(t, logs, "running")
+	assert.Contains(t, logs, "[CIRRUS_POST_COMMAND_HOOK] after main (COMPLETED)")
+	assert.Contains(t, logs, "Ignoring the failure: CIRRUS_POST_COMMAND_HOOK")
+}
+
+func TestFailingPreCommandHook(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("relies on the POSIX shell")
+	}
+
+	fake := &fakeCirrusClient{logStreamCapacities: []int{-1}}
+	withFakeClient(t, fake)
+
+	dir := testutil.TempDir(t)
+
+	executor := newTestArtifactsExecutor()
+	executor.env = map[string]string{
+		"CIRRUS_WORKING_DIR":      dir,
+		"CIRRUS_PRE_COMMAND_HOOK": writeTestHook(t, dir, "pre.sh", "exit 1"),
+	}
+
+	stepResult, err := executor.performStep(context.Background(), scriptCommand("main", "echo unreachable"))
+	require.NoError(t, err)
+	assert.False(t, stepResult.Success)
+	assert.NotContains(t, fake.CommandLogs("main"), "unreachable")
+	assert.Contains(t, fake.CommandLogs("main"), "Failing the command: CIRRUS_PRE_COMMAND_HOOK")
+}
+
+func TestPostCommandHookAfterCommandTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("relies on the POSIX shell")
+	}
+
+	fake := &fakeCirrusClient{logStreamCapacities: []int{-1}}
+	withFakeClient(t, fake)
+
+	dir := testutil.TempDir(t)
+
+	executor := newTestArtifactsExecutor()
+	executor.env = map[string]string{
+		"CIRRUS_WORKING_DIR":  dir,
+		"CIRRUS_TIMEOUT_MAIN": "500ms",
+		"CIRRUS_POST_COMMAND_HOOK": writeTestHook(t, dir, "post.sh",
+			`sleep 1; echo "cleaned up after $CIRRUS_HOOK_COMMAND_NAME ($CIRRUS_HOOK_COMMAND_STATUS)"`),
+	}
+
+	stepResult, err := executor.performStep(context.Background(), scriptCommand("main", "sleep 60"))
+	require.NoError(t, err)
+	assert.False(t, stepResult.Success)
+
+	// The hook outlives the command's deadline
+	logs := fake.CommandLogs("main")
+	assert.Contains(t, logs, "[CIRRUS_POST_COMMAND_HOOK] cleaned up after main (FAILED)")
+	assert.NotContains(t, logs, "has timed out")
+}
+
+func TestCommandHookTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("relies on the POSIX shell")
+	}
+
+	dir := testutil.TempDir(t)
+
+	env := map[string]string{
+		"CIRRUS_PRE_COMMAND_HOOK":     writeTestHook(t, dir, "pre.sh", "echo started; exec sleep 60"),
+		"CIRRUS_COMMAND_HOOK_TIMEOUT": "100ms",
+	}
+
+	var output lockedBuffer
+	err := runCommandHook(context.Background(), &output, env, preCommandHookEnvName, "main", "EXECUTING")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "has timed out after 100ms")
+	assert.Equal(t, "[CIRRUS_PRE_COMMAND_HOOK] started\n", output.String())
+}
@@ -0,0 +1,100 @@
+package jsonlines
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+)
+
+// maxPendingLength bounds the memory used by the line that's still being written,
+// once reached, the line is emitted in parts
+const maxPendingLength = 1024 * 1024
+
+const maskedValue = "HIDDEN-BY-CIRRUS-CI"
+
+type envelope struct {
+	Timestamp string `json:"ts"`
+	Stream    string `json:"stream"`
+	Message   string `json:"msg"`
+}
+
+// Encoder wraps each line of a stream of chunks in a JSON object, producing newline-delimited JSON.
+type Encoder struct {
+	stream       string
+	valuesToMask []string
+	now          func() time.Time
+
+	pending          []byte
+	pendingTimestamp time.Time
+}
+
+// New creates an encoder for the named stream. The values to mask are hidden
+// before the encoding, since their escaped form wouldn't be recognized afterwards.
+func New(stream string, valuesToMask []string, now func() time.Time) *Encoder {
+	return &Encoder{
+		stream:       stream,
+		valuesToMask: valuesToMask,
+		now:          now,
+	}
+}
+
+// Process returns a JSON object for each of the lines completed by the chunk, the incomplete
+// line at the end of the chunk (if any) is held back until the next call.
+func (encoder *Encoder) Process(chunk []byte) []byte {
+	var result []byte
+
+	for len(chunk) != 0 {
+		if len(encoder.pending) == 0 {
+			encoder.pendingTimestamp = encoder.now()
+		}
+
+		newlineIndex := bytes.IndexByte(chunk, '\n')
+		if newlineIndex == -1 {
+			encoder.pending = append(encoder.pending, chunk...)
+			if len(encoder.pending) >= maxPendingLength {
+				result = encoder.appendPending(result)
+			}
+			break
+		}
+
+		encoder.pending = append(encoder.pending, chunk[:newlineIndex]...)
+		result = encoder.appendPending(result)
+		chunk = chunk[newlineIndex+1:]
+	}
+
+	return result
+}
+
+// Flush returns a JSON object for the line held back by Process(),
+// which should be called once the stream has ended.
+func (encoder *Encoder) Flush() []byte {
+	if len(encoder.pending) == 0 {
+		return nil
+	}
+
+	return encoder.appendPending(nil)
+}
+
+func (encoder *Encoder) appendPending(result []byte) []byte {
+	line := bytes.TrimSuffix(encoder.pending, []byte{'\r'})
+	for _, valueToMask := range encoder.valuesToMask {
+		if valueToMask != "" {
+			line = bytes.ReplaceAll(line, []byte(valueToMask), []byte(maskedValue))
+		}
+	}
+
+	var buffer bytes.Buffer
+	jsonEncoder := json.NewEncoder(&buffer)
+	jsonEncoder.SetEscapeHTML(false)
+
+	// Can't fail, the envelope only consists of strings
+	_ = jsonEncoder.Encode(envelope{
+		Timestamp: encoder.pendingTimestamp.UTC().Format(time.RFC3339Nano),
+		Stream:    encoder.stream,
+		Message:   string(line),
+	})
+
+	encoder.pending = encoder.pending[:0]
+
+	return append(result, buffer.Bytes()...)
+}
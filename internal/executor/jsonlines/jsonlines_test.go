@@ -0,0 +1,43 @@
+package jsonlines_test
+
+import (
+	"github.com/cirruslabs/cirrus-ci-agent/internal/executor/jsonlines"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func encode(valuesToMask []string, chunks ...string) string {
+	now := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+	encoder := jsonlines.New("build", valuesToMask, func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	})
+
+	var result []byte
+	for _, chunk := range chunks {
+		result = append(result, encoder.Process([]byte(chunk))...)
+	}
+	result = append(result, encoder.Flush()...)
+
+	return string(result)
+}
+
+func TestLines(t *testing.T) {
+	assert.Equal(t, `{"ts":"2022-01-02T03:04:06Z","stream":"build","msg":"hello"}
+{"ts":"2022-01-02T03:04:07Z","stream":"build","msg":""}
+{"ts":"2022-01-02T03:04:08Z","stream":"build","msg":"<world> & \"friends\""}
+`, encode(nil, "hello\n\n<world> & \"friends\"\r\n"))
+}
+
+func TestLineSplitAcrossChunks(t *testing.T) {
+	// The timestamp is taken once the line starts
+	assert.Equal(t, `{"ts":"2022-01-02T03:04:06Z","stream":"build","msg":"hello, world"}
+{"ts":"2022-01-02T03:04:07Z","stream":"build","msg":"unterminated"}
+`, encode(nil, "hel", "lo, ", "world\nunter", "minated"))
+}
+
+func TestMasking(t *testing.T) {
+	assert.Equal(t, `{"ts":"2022-01-02T03:04:06Z","stream":"build","msg":"token HIDDEN-BY-CIRRUS-CI"}
+`, encode([]string{`s3"cr\t`}, "token s3\"cr\\t\n"))
+}
@@ -0,0 +1,116 @@
+package linetruncator
+
+import (
+	"bytes"
+	"fmt"
+	"unicode/utf8"
+)
+
+// DefaultMaxLineLength is generous enough for the legitimately long lines
+// (e.g. a minified JSON), yet keeps a runaway base64 blob from reaching the web viewer.
+const DefaultMaxLineLength = 256 * 1024
+
+// Truncator cuts the lines longer than the limit in a stream of chunks,
+// replacing the rest of each such line with a "...[truncated N bytes]" suffix.
+type Truncator struct {
+	maxLineLength int
+
+	lineLength     int
+	truncatedBytes int
+}
+
+func New(maxLineLength int) *Truncator {
+	return &Truncator{
+		maxLineLength: maxLineLength,
+	}
+}
+
+// Process returns the chunk with the overly long lines truncated. The lines are tracked
+// across the calls, so the suffix for a line that's still being written is only emitted
+// once its end is seen (or by Flush()).
+//
+// When the chunk has nothing to truncate (which is the case for the vast majority
+// of the output) the chunk is returned as is, without copying.
+func (truncator *Truncator) Process(chunk []byte) []byte {
+	if truncator.truncatedBytes == 0 && truncator.fits(chunk) {
+		return chunk
+	}
+
+	result := make([]byte, 0, len(chunk))
+
+	for len(chunk) != 0 {
+		line := chunk
+		newlineIndex := bytes.IndexByte(chunk, '\n')
+		if newlineIndex != -1 {
+			line = chunk[:newlineIndex]
+		}
+		chunk = chunk[len(line):]
+
+		keep := truncator.maxLineLength - truncator.lineLength
+		if keep < 0 {
+			keep = 0
+		}
+		if keep < len(line) {
+			// Don't leave a rune cut in half
+			for keep > 0 && !utf8.RuneStart(line[keep]) {
+				keep--
+			}
+			truncator.truncatedBytes += len(line) - keep
+			line = line[:keep]
+		}
+		result = append(result, line...)
+		truncator.lineLength += len(line)
+
+		if newlineIndex != -1 {
+			result = append(result, truncator.Flush()...)
+			result = append(result, '\n')
+			chunk = chunk[1:]
+		}
+	}
+
+	return result
+}
+
+// Flush returns the suffix for the truncated line that wasn't terminated yet (if any)
+// and starts a new line, it should be called once the stream has ended.
+func (truncator *Truncator) Flush() []byte {
+	truncatedBytes := truncator.truncatedBytes
+
+	truncator.lineLength = 0
+	truncator.truncatedBytes = 0
+
+	if truncatedBytes == 0 {
+		return nil
+	}
+
+	return []byte(fmt.Sprintf("...[truncated %d bytes]", truncatedBytes))
+}
+
+// fits tells whether none of the chunk's lines push the current one over the limit,
+// updating the current line's length if so.
+func (truncator *Truncator) fits(chunk []byte) bool {
+	lineLength := truncator.lineLength
+
+	for len(chunk) != 0 {
+		newlineIndex := bytes.IndexByte(chunk, '\n')
+		if newlineIndex == -1 {
+			lineLength += len(chunk)
+			break
+		}
+
+		if lineLength+newlineIndex > truncator.maxLineLength {
+			return false
+		}
+
+		lineLength = 0
+		chunk = chunk[newlineIndex+1:]
+	}
+
+	if lineLength > truncator.maxLineLength {
+		return false
+	}
+
+	truncator.lineLength = lineLength
+
+	return true
+}
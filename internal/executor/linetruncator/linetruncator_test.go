@@ -0,0 +1,60 @@
+package linetruncator_test
+
+import (
+	"bytes"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/executor/linetruncator"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func truncate(maxLineLength int, chunks ...string) string {
+	truncator := linetruncator.New(maxLineLength)
+
+	var result []byte
+	for _, chunk := range chunks {
+		result = append(result, truncator.Process([]byte(chunk))...)
+	}
+	result = append(result, truncator.Flush()...)
+
+	return string(result)
+}
+
+func TestShortLines(t *testing.T) {
+	assert.Equal(t, "abc\ndefgh\n", truncate(5, "abc\nde", "fgh\n"))
+}
+
+func TestLongLine(t *testing.T) {
+	assert.Equal(t, "abcde...[truncated 3 bytes]\nxy\n", truncate(5, "abcdefgh\nxy\n"))
+}
+
+func TestLongLineAcrossWrites(t *testing.T) {
+	assert.Equal(t, "abcde...[truncated 7 bytes]\nxy", truncate(5, "abc", "defg", "hijkl", "\nxy"))
+}
+
+func TestLongLineAtTheEnd(t *testing.T) {
+	assert.Equal(t, "ok\nabcde...[truncated 2 bytes]", truncate(5, "ok\nabcdefg"))
+}
+
+func TestRuneIsNotCutInHalf(t *testing.T) {
+	// "ж" is encoded as 0xD0 0xB6
+	assert.Equal(t, "abcd...[truncated 3 bytes]\n", truncate(5, "abcdжx\n"))
+}
+
+func TestChunkWithinLimitIsNotCopied(t *testing.T) {
+	chunk := []byte("short\nlines\n")
+
+	result := linetruncator.New(10).Process(chunk)
+	assert.Equal(t, &chunk[0], &result[0])
+}
+
+func BenchmarkProcessShortLines(b *testing.B) {
+	chunk := bytes.Repeat([]byte("The quick brown fox jumps over the lazy dog\n"), 1024)
+	truncator := linetruncator.New(linetruncator.DefaultMaxLineLength)
+
+	b.SetBytes(int64(len(chunk)))
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		truncator.Process(chunk)
+	}
+}
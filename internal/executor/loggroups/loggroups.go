@@ -0,0 +1,178 @@
+package loggroups
+
+import (
+	"bytes"
+	"strings"
+)
+
+const (
+	markerPrefix = "##cirrus["
+	groupPrefix  = markerPrefix + "group:"
+	endGroup     = markerPrefix + "endgroup]"
+
+	// Lines longer than this are never considered to be markers,
+	// which bounds the amount of output we hold back
+	maxMarkerLength = 1024
+
+	DefaultMaxDepth = 8
+)
+
+// Tracker recognizes the log grouping markers in a stream of command output
+// chunks, normalizes them and keeps track of the currently open groups
+// so that they can be closed once the command finishes.
+//
+// Markers are only recognized when they occupy the whole line:
+//
+//	##cirrus[group:Install dependencies]
+//	...
+//	##cirrus[endgroup]
+type Tracker struct {
+	maxDepth    int
+	depth       int
+	atLineStart bool
+	pending     []byte
+}
+
+func New(maxDepth int) *Tracker {
+	return &Tracker{
+		maxDepth:    maxDepth,
+		atLineStart: true,
+	}
+}
+
+// Depth returns the number of currently open groups.
+func (tracker *Tracker) Depth() int {
+	return tracker.depth
+}
+
+// Process returns the chunk with the markers normalized. A line that looks
+// like an incomplete marker is held back until the rest of it arrives.
+func (tracker *Tracker) Process(chunk []byte) []byte {
+	// Fast path: nothing to hold back and no markers in sight
+	if len(tracker.pending) == 0 && !bytes.Contains(chunk, []byte("##")) &&
+		!bytes.HasSuffix(chunk, []byte("#")) {
+		if len(chunk) != 0 {
+			tracker.atLineStart = chunk[len(chunk)-1] == '\n'
+		}
+		return chunk
+	}
+
+	data := chunk
+	if len(tracker.pending) != 0 {
+		data = append(tracker.pending, chunk...)
+		tracker.pending = nil
+	}
+
+	result := make([]byte, 0, len(data))
+
+	for len(data) != 0 {
+		newlineIndex := bytes.IndexByte(data, '\n')
+
+		if !tracker.atLineStart {
+			if newlineIndex == -1 {
+				return append(result, data...)
+			}
+			result = append(result, data[:newlineIndex+1]...)
+			data = data[newlineIndex+1:]
+			tracker.atLineStart = true
+			continue
+		}
+
+		if newlineIndex == -1 {
+			if len(data) < maxMarkerLength && mayBecomeMarker(data) {
+				tracker.pending = append([]byte{}, data...)
+				return result
+			}
+			tracker.atLineStart = false
+			return append(result, data...)
+		}
+
+		line := data[:newlineIndex+1]
+		data = data[newlineIndex+1:]
+
+		if normalized, ok := tracker.processMarker(line); ok {
+			result = append(result, normalized...)
+		} else {
+			result = append(result, line...)
+		}
+	}
+
+	return result
+}
+
+// Close returns the held back output (if any) followed by the markers
+// that close all of the groups that are still open.
+func (tracker *Tracker) Close() []byte {
+	var result []byte
+
+	if len(tracker.pending) != 0 {
+		line := tracker.pending
+		tracker.pending = nil
+		tracker.atLineStart = false
+
+		if normalized, ok := tracker.processMarker(line); ok {
+			result = append(result, normalized...)
+			tracker.atLineStart = true
+		} else {
+			result = append(result, line...)
+		}
+	}
+
+	if tracker.depth == 0 {
+		return result
+	}
+
+	if !tracker.atLineStart {
+		result = append(result, '\n')
+	}
+
+	for ; tracker.depth > 0; tracker.depth-- {
+		if tracker.depth <= tracker.maxDepth {
+			result = append(result, endGroup+"\n"...)
+		}
+	}
+	tracker.atLineStart = true
+
+	return result
+}
+
+func (tracker *Tracker) processMarker(line []byte) ([]byte, bool) {
+	text := strings.TrimRight(string(line), "\r\n")
+
+	switch {
+	case strings.HasPrefix(text, groupPrefix) && strings.HasSuffix(text, "]"):
+		name := strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(text, groupPrefix), "]"))
+
+		tracker.depth++
+
+		// Groups nested too deep are flattened into their parent
+		if tracker.depth > tracker.maxDepth {
+			return nil, true
+		}
+
+		return []byte(groupPrefix + name + "]\n"), true
+	case text == endGroup:
+		// Keep the stray markers as is
+		if tracker.depth == 0 {
+			return nil, false
+		}
+
+		tracker.depth--
+
+		if tracker.depth >= tracker.maxDepth {
+			return nil, true
+		}
+
+		return []byte(endGroup + "\n"), true
+	default:
+		return nil, false
+	}
+}
+
+func mayBecomeMarker(data []byte) bool {
+	if len(data) < len(markerPrefix) {
+		return bytes.HasPrefix([]byte(markerPrefix), data)
+	}
+
+	return bytes.HasPrefix(data, []byte(markerPrefix))
+}
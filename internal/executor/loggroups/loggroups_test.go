@@ -0,0 +1,69 @@
+package loggroups_test
+
+import (
+	"github.com/cirruslabs/cirrus-ci-agent/internal/executor/loggroups"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func process(tracker *loggroups.Tracker, chunks ...string) string {
+	var result []byte
+
+	for _, chunk := range chunks {
+		result = append(result, tracker.Process([]byte(chunk))...)
+	}
+	result = append(result, tracker.Close()...)
+
+	return string(result)
+}
+
+func TestGroups(t *testing.T) {
+	tracker := loggroups.New(loggroups.DefaultMaxDepth)
+
+	assert.Equal(t, "before\n##cirrus[group:Install deps]\ninstalling\n##cirrus[endgroup]\nafter\n",
+		process(tracker, "before\n##cirrus[group: Install deps ]\r\ninstalling\n##cirrus[endgroup]\nafter\n"))
+	assert.Equal(t, 0, tracker.Depth())
+}
+
+func TestMarkerSplitAcrossChunks(t *testing.T) {
+	tracker := loggroups.New(loggroups.DefaultMaxDepth)
+
+	assert.Equal(t, "output\n##cirrus[group:Build]\nbuilding\n##cirrus[endgroup]\n",
+		process(tracker, "output\n#", "#cir", "rus[group:Build]", "\nbuilding\n", "##cirrus[endgroup]\n"))
+}
+
+func TestMarkersInTheMiddleOfTheLineAreIgnored(t *testing.T) {
+	tracker := loggroups.New(loggroups.DefaultMaxDepth)
+
+	assert.Equal(t, "echo ##cirrus[group:Build]\n",
+		process(tracker, "echo ##cirrus[group:Build]\n"))
+	assert.Equal(t, 0, tracker.Depth())
+}
+
+func TestStrayEndGroup(t *testing.T) {
+	tracker := loggroups.New(loggroups.DefaultMaxDepth)
+
+	assert.Equal(t, "##cirrus[endgroup]\n", process(tracker, "##cirrus[endgroup]\n"))
+}
+
+func TestUnclosedGroupsAreClosed(t *testing.T) {
+	tracker := loggroups.New(loggroups.DefaultMaxDepth)
+
+	assert.Equal(t, "##cirrus[group:Outer]\n##cirrus[group:Inner]\nno newline\n##cirrus[endgroup]\n##cirrus[endgroup]\n",
+		process(tracker, "##cirrus[group:Outer]\n##cirrus[group:Inner]\nno newline"))
+	assert.Equal(t, 0, tracker.Depth())
+}
+
+func TestNestingIsLimited(t *testing.T) {
+	tracker := loggroups.New(1)
+
+	assert.Equal(t, "##cirrus[group:Outer]\ninner\n##cirrus[endgroup]\nafter\n",
+		process(tracker, "##cirrus[group:Outer]\n##cirrus[group:Inner]\ninner\n##cirrus[endgroup]\n##cirrus[endgroup]\nafter\n"))
+}
+
+func TestIncompleteMarkerAtTheEnd(t *testing.T) {
+	tracker := loggroups.New(loggroups.DefaultMaxDepth)
+
+	assert.Equal(t, "##cirrus[group:Last]\n##cirrus[endgroup]\n", process(tracker, "##cirrus[group:Last]"))
+	assert.Equal(t, "##cir", process(loggroups.New(loggroups.DefaultMaxDepth), "##cir"))
+}
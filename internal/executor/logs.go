@@ -4,10 +4,19 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"github.com/avast/retry-go"
 	"github.com/cirruslabs/cirrus-ci-agent/api"
 	"github.com/cirruslabs/cirrus-ci-agent/internal/client"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/executor/backlog"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/executor/diagnostics"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/executor/jsonlines"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/executor/linetruncator"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/executor/loggroups"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/executor/logsampler"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/executor/utf8sanitizer"
+	"github.com/dustin/go-humanize"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/encoding/gzip"
 	"io"
@@ -15,10 +24,43 @@ import (
 	"log"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const logStreamReconnectMaxDelay = 30 * time.Second
+
+// How long to wait for the logs to be sent when the task is being stopped,
+// so that a broken log stream can't hang the agent's shutdown
+const logFlushTimeout = 10 * time.Second
+
+var ErrLogFlushTimeout = errors.New("timed out waiting for the logs to be sent")
+
+var (
+	// How much of the not yet streamed logs to keep in memory while reconnecting
+	logBacklogSize = 8 * 1024 * 1024
+
+	// The live log stream is only acknowledged by the server once it's closed, so when it breaks,
+	// there's no telling which of the sent chunks were received. Only the most recently sent ones
+	// (up to this many bytes, roughly what can be in flight) are kept to be re-sent to the new stream.
+	//
+	// The server might have received some of them already, in which case they're duplicated
+	// in the live log. That's acceptable, since the log is replaced by the stored output
+	// (see UploadStoredOutput()) once the command finishes, which has no duplicates.
+	logStreamResendSize = 256 * 1024
+
+	// How much of the command's output can be in flight between the command and the log
+	// stream, once reached, the command's writes block until the stream catches up
+	defaultLogBufferSize = 4 * 1024 * 1024
+
+	logStreamReconnectMinDelay = time.Second
+)
+
 type LogUploader struct {
+	// The command's output consumed so far, before any masking or sampling
+	// (first in the struct to be 64-bit aligned for the atomic operations on 32-bit platforms)
+	bytesWritten int64
+
 	taskIdentification *api.TaskIdentification
 	commandName        string
 	client             api.CirrusCIService_StreamLogsClient
@@ -28,6 +70,52 @@ type LogUploader struct {
 	doneLogUpload      chan bool
 	valuesToMask       []string
 	closed             bool
+	finalizeOnce       sync.Once
+	diagnostics        *diagnostics.Logger
+
+	// Chunks that are yet to be acknowledged by the live log stream
+	backlog        *backlog.Backlog
+	streamBroken   bool
+	reconnectDelay time.Duration
+	nextReconnect  time.Time
+
+	// Serializes the writes, since the processors below are stateful and the output can be written
+	// from multiple goroutines at once (e.g. the timeout warning while the command is still running)
+	writeMutex sync.Mutex
+
+	// Tracks the ##cirrus[group:...] markers to close the groups left open by the command
+	logGroups *loggroups.Tracker
+
+	// Set when the CIRRUS_AGENT_LOG_TO_STDOUT behavioral environment variable is enabled
+	mirror *logMirror
+
+	// Set unless the CIRRUS_LOG_MAX_LINE_LENGTH behavioral environment variable is "0"
+	lineTruncator *linetruncator.Truncator
+
+	// Set when the CIRRUS_LOG_RATE_LIMIT behavioral environment variable is specified
+	logSampler *logsampler.Sampler
+
+	// Set when the CIRRUS_LOG_SANITIZE_UTF8 behavioral environment variable is "true"
+	// (invalid bytes are replaced) or "hex" (invalid bytes are hex-escaped)
+	utf8Sanitizer *utf8sanitizer.Sanitizer
+
+	// Bytes enqueued, but not yet written by StreamLogs(), bounded by the bufferSize
+	// (see the CIRRUS_LOG_BUFFER_SIZE behavioral environment variable)
+	bufferSize     int
+	bufferedBytes  int
+	bufferMutex    sync.Mutex
+	bufferReleased *sync.Cond
+
+	// Set when the CIRRUS_LOG_FLUSH_INTERVAL behavioral environment variable is specified,
+	// the chunks written in between the flushes are coalesced into one (but at most flushSize
+	// bytes, see the CIRRUS_LOG_FLUSH_SIZE behavioral environment variable)
+	flushInterval time.Duration
+	flushSize     int
+	lastFlush     time.Time
+
+	// Set when the CIRRUS_LOG_JSON behavioral environment variable is enabled,
+	// takes precedence over the CIRRUS_LOG_TIMESTAMP
+	jsonLines *jsonlines.Encoder
 
 	// Fields related to the CIRRUS_LOG_TIMESTAMP behavioral environment variable
 	LogTimestamps bool
@@ -57,11 +145,79 @@ func NewLogUploader(ctx context.Context, executor *Executor, commandName string)
 		doneLogUpload:      make(chan bool),
 		valuesToMask:       executor.sensitiveValues,
 		closed:             false,
+		diagnostics:        executor.diagnostics,
+		backlog:            backlog.New(logBacklogSize),
+		reconnectDelay:     logStreamReconnectMinDelay,
+		logGroups:          loggroups.New(loggroups.DefaultMaxDepth),
+		bufferSize:         defaultLogBufferSize,
+		lastFlush:          time.Now(),
 
 		LogTimestamps: executor.env["CIRRUS_LOG_TIMESTAMP"] == "true",
 		GetTimestamp:  time.Now,
 		OweTimestamp:  true,
 	}
+	if executor.env["CIRRUS_AGENT_LOG_TO_STDOUT"] == "true" || os.Getenv("CIRRUS_AGENT_LOG_TO_STDOUT") == "true" {
+		logUploader.mirror = newLogMirror(commandName, executor.sensitiveValues)
+	}
+	maxLineLength := uint64(linetruncator.DefaultMaxLineLength)
+	if value := executor.env["CIRRUS_LOG_MAX_LINE_LENGTH"]; value != "" {
+		parsedMaxLineLength, err := humanize.ParseBytes(value)
+		if err != nil {
+			log.Printf("Ignoring invalid CIRRUS_LOG_MAX_LINE_LENGTH value %q: %v\n", value, err)
+		} else {
+			maxLineLength = parsedMaxLineLength
+		}
+	}
+	if maxLineLength != 0 {
+		logUploader.lineTruncator = linetruncator.New(int(maxLineLength))
+	}
+	if rateLimit := executor.env["CIRRUS_LOG_RATE_LIMIT"]; rateLimit != "" {
+		bytesPerSecond, err := humanize.ParseBytes(rateLimit)
+		if err != nil {
+			log.Printf("Ignoring invalid CIRRUS_LOG_RATE_LIMIT value %q: %v\n", rateLimit, err)
+		} else {
+			logUploader.logSampler = logsampler.New(bytesPerSecond, logsampler.DefaultKeepEvery, time.Now)
+		}
+	}
+	if executor.env["CIRRUS_LOG_JSON"] == "true" {
+		logUploader.jsonLines = jsonlines.New(commandName, executor.sensitiveValues, func() time.Time {
+			return logUploader.GetTimestamp()
+		})
+	}
+	switch sanitizeUTF8 := executor.env["CIRRUS_LOG_SANITIZE_UTF8"]; sanitizeUTF8 {
+	case "", "false":
+	case "true":
+		logUploader.utf8Sanitizer = utf8sanitizer.New()
+	case "hex":
+		logUploader.utf8Sanitizer = utf8sanitizer.NewWithMode(utf8sanitizer.ModeHexEscape)
+	default:
+		log.Printf("Ignoring invalid CIRRUS_LOG_SANITIZE_UTF8 value %q, expected \"true\" or \"hex\"\n", sanitizeUTF8)
+	}
+	if bufferSize := executor.env["CIRRUS_LOG_BUFFER_SIZE"]; bufferSize != "" {
+		parsedBufferSize, err := humanize.ParseBytes(bufferSize)
+		if err != nil || parsedBufferSize == 0 {
+			log.Printf("Ignoring invalid CIRRUS_LOG_BUFFER_SIZE value %q\n", bufferSize)
+		} else {
+			logUploader.bufferSize = int(parsedBufferSize)
+		}
+	}
+	if flushInterval := executor.env["CIRRUS_LOG_FLUSH_INTERVAL"]; flushInterval != "" {
+		parsedFlushInterval, err := time.ParseDuration(flushInterval)
+		if err != nil || parsedFlushInterval < 0 {
+			log.Printf("Ignoring invalid CIRRUS_LOG_FLUSH_INTERVAL value %q\n", flushInterval)
+		} else {
+			logUploader.flushInterval = parsedFlushInterval
+		}
+	}
+	if flushSize := executor.env["CIRRUS_LOG_FLUSH_SIZE"]; flushSize != "" {
+		parsedFlushSize, err := humanize.ParseBytes(flushSize)
+		if err != nil || parsedFlushSize == 0 {
+			log.Printf("Ignoring invalid CIRRUS_LOG_FLUSH_SIZE value %q\n", flushSize)
+		} else {
+			logUploader.flushSize = int(parsedFlushSize)
+		}
+	}
+	logUploader.bufferReleased = sync.NewCond(&logUploader.bufferMutex)
 	go logUploader.StreamLogs()
 	return &logUploader, nil
 }
@@ -117,19 +273,92 @@ func (uploader *LogUploader) Write(bytes []byte) (int, error) {
 
 	// Make potential bytes expansion below transparent to the caller
 	originalLen := len(bytes)
+	atomic.AddInt64(&uploader.bytesWritten, int64(originalLen))
+
+	uploader.writeMutex.Lock()
+	defer uploader.writeMutex.Unlock()
+
+	if uploader.mirror != nil {
+		uploader.mirror.Write(bytes)
+	}
+
+	// Masked before truncating, otherwise a line cut in the middle of
+	// a secret would leave the secret's prefix that no longer matches it
+	bytes = uploader.maskSensitiveValues(bytes)
+
+	// Only degrade what gets uploaded, the command's output is consumed in full regardless
+	if uploader.lineTruncator != nil {
+		bytes = uploader.lineTruncator.Process(bytes)
+	}
+	if uploader.logSampler != nil {
+		bytes = uploader.logSampler.Process(bytes)
+	}
+
+	uploader.enqueue(uploader.logGroups.Process(bytes))
 
-	if uploader.LogTimestamps {
+	return originalLen, nil
+}
+
+// BytesWritten returns how many bytes of output were written to the uploader.
+func (uploader *LogUploader) BytesWritten() int64 {
+	return atomic.LoadInt64(&uploader.bytesWritten)
+}
+
+func (uploader *LogUploader) enqueue(bytes []byte) {
+	if len(bytes) == 0 {
+		return
+	}
+
+	if uploader.jsonLines != nil {
+		bytes = uploader.jsonLines.Process(bytes)
+	} else if uploader.LogTimestamps {
 		bytes = uploader.WithTimestamps(bytes)
 	}
 
+	uploader.push(bytes)
+}
+
+func (uploader *LogUploader) push(bytes []byte) {
+	if len(bytes) == 0 {
+		return
+	}
+
 	uploader.mutex.RLock()
 	defer uploader.mutex.RUnlock()
 	if !uploader.closed {
+		uploader.reserveBuffer(len(bytes))
 		bytesCopy := make([]byte, len(bytes))
 		copy(bytesCopy, bytes)
 		uploader.logsChannel <- bytesCopy
 	}
-	return originalLen, nil
+}
+
+// reserveBuffer blocks until there's enough room for n more bytes, which in turn stops
+// reading from the command's output pipe and lets the OS apply the backpressure to the command.
+//
+// A chunk bigger than the whole buffer is let through once the buffer is empty,
+// zero buffer size means no limit.
+func (uploader *LogUploader) reserveBuffer(n int) {
+	uploader.bufferMutex.Lock()
+	defer uploader.bufferMutex.Unlock()
+
+	for uploader.bufferSize > 0 && uploader.bufferedBytes != 0 && uploader.bufferedBytes+n > uploader.bufferSize {
+		uploader.bufferReleased.Wait()
+	}
+
+	uploader.bufferedBytes += n
+}
+
+func (uploader *LogUploader) releaseBuffer(n int) {
+	if n == 0 {
+		return
+	}
+
+	uploader.bufferMutex.Lock()
+	defer uploader.bufferMutex.Unlock()
+
+	uploader.bufferedBytes -= n
+	uploader.bufferReleased.Broadcast()
 }
 
 func (uploader *LogUploader) StreamLogs() {
@@ -137,26 +366,43 @@ func (uploader *LogUploader) StreamLogs() {
 
 	for {
 		logs, finished := uploader.ReadAvailableChunks()
+		consumed := len(logs)
+		if uploader.utf8Sanitizer != nil {
+			logs = uploader.utf8Sanitizer.Sanitize(logs)
+			if finished {
+				logs = append(logs, uploader.utf8Sanitizer.Flush()...)
+			}
+		}
 		_, err := uploader.WriteChunk(logs)
+		if err != nil {
+			uploader.diagnostics.Warnf("Failed to stream logs for %s, will try again in %v: %v",
+				uploader.commandName, time.Until(uploader.nextReconnect).Round(time.Second), err)
+		}
+		uploader.releaseBuffer(consumed)
+		uploader.lastFlush = time.Now()
 		if finished {
 			log.Printf("Finished streaming logs for %s!\n", uploader.commandName)
 			break
 		}
-		if err == io.EOF {
-			log.Printf("Got EOF while streaming logs for %s! Trying to reinitilize logs uploader...\n", uploader.commandName)
-			err := uploader.reInitializeClient(ctx)
-			if err == nil {
-				log.Printf("Successfully reinitilized log uploader for %s!\n", uploader.commandName)
-			} else {
-				log.Printf("Failed to reinitilized log uploader for %s: %s\n", uploader.commandName, err.Error())
-			}
+	}
+
+	// Last chance to stream what's left in the backlog
+	if uploader.backlog.Len() != 0 {
+		if err := uploader.streamBacklog(ctx, true); err != nil {
+			uploader.diagnostics.Errorf("Failed to stream the remaining %d bytes of logs for %s: %v",
+				uploader.backlog.Size(), uploader.commandName, err)
 		}
 	}
-	uploader.client.CloseAndRecv()
+	if _, err := uploader.client.CloseAndRecv(); err != nil && uploader.backlog.SentSize() != 0 {
+		uploader.diagnostics.Errorf("Failed to stream the last %d bytes of logs for %s: %v",
+			uploader.backlog.SentSize(), uploader.commandName, err)
+	} else {
+		uploader.backlog.Acknowledge()
+	}
 
 	err := uploader.UploadStoredOutput(ctx)
 	if err != nil {
-		log.Printf("Failed to upload stored logs for %s: %s", uploader.commandName, err.Error())
+		uploader.diagnostics.Errorf("Failed to upload stored logs for %s: %s", uploader.commandName, err.Error())
 	} else {
 		log.Printf("Uploaded stored logs for %s!", uploader.commandName)
 	}
@@ -164,12 +410,34 @@ func (uploader *LogUploader) StreamLogs() {
 	uploader.storedOutput.Close()
 	os.Remove(uploader.storedOutput.Name())
 
-	uploader.doneLogUpload <- true
+	close(uploader.doneLogUpload)
 }
 
 func (uploader *LogUploader) ReadAvailableChunks() ([]byte, bool) {
-	result := <-uploader.logsChannel
-	for {
+	var result []byte
+
+	if uploader.backlog.Len() == 0 {
+		result = <-uploader.logsChannel
+	} else {
+		// Wake up in time for the next reconnection attempt
+		// even if there's no new logs
+		select {
+		case nextChunk, more := <-uploader.logsChannel:
+			if !more {
+				return nil, true
+			}
+			result = nextChunk
+		case <-time.After(time.Until(uploader.nextReconnect)):
+			return nil, false
+		}
+	}
+
+	if uploader.flushInterval > 0 {
+		return uploader.coalesceChunks(result)
+	}
+
+	// Don't accumulate more than the buffer allows if the command keeps writing
+	for len(result) < uploader.bufferSize {
 		select {
 		case nextChunk, more := <-uploader.logsChannel:
 			result = append(result, nextChunk...)
@@ -181,35 +449,205 @@ func (uploader *LogUploader) ReadAvailableChunks() ([]byte, bool) {
 			return result, false
 		}
 	}
+
+	return result, false
 }
 
-func (uploader *LogUploader) WriteChunk(bytesToWrite []byte) (int, error) {
-	if len(bytesToWrite) == 0 {
-		return 0, nil
+// coalesceChunks keeps appending the subsequent chunks to the result until the flush interval
+// since the last flush elapses or the flush size is reached, so that a command producing lots
+// of small writes results in a few big chunks sent to the log stream. Nothing is dropped.
+func (uploader *LogUploader) coalesceChunks(result []byte) ([]byte, bool) {
+	// Don't accumulate more than the buffer allows, otherwise the command would block
+	// until the flush interval elapses
+	flushSize := uploader.bufferSize
+	if uploader.flushSize > 0 && uploader.flushSize < flushSize {
+		flushSize = uploader.flushSize
 	}
+
+	flushTimer := time.NewTimer(time.Until(uploader.lastFlush.Add(uploader.flushInterval)))
+	defer flushTimer.Stop()
+
+	for len(result) < flushSize {
+		select {
+		case nextChunk, more := <-uploader.logsChannel:
+			result = append(result, nextChunk...)
+			if !more {
+				log.Printf("No more log chunks for %s\n", uploader.commandName)
+				return result, true
+			}
+		case <-flushTimer.C:
+			return result, false
+		}
+	}
+
+	return result, false
+}
+
+// maskSensitiveValues replaces the sensitive values in the chunk. It's done both for each write
+// and once the writes are coalesced into a chunk, to also catch the values split across the writes.
+func (uploader *LogUploader) maskSensitiveValues(chunk []byte) []byte {
 	for _, valueToMask := range uploader.valuesToMask {
-		bytesToWrite = bytes.Replace(bytesToWrite, []byte(valueToMask), []byte("HIDDEN-BY-CIRRUS-CI"), -1)
+		chunk = bytes.Replace(chunk, []byte(valueToMask), []byte("HIDDEN-BY-CIRRUS-CI"), -1)
 	}
 
+	return chunk
+}
+
+func (uploader *LogUploader) WriteChunk(bytesToWrite []byte) (int, error) {
+	bytesToWrite = uploader.maskSensitiveValues(bytesToWrite)
+
 	uploader.storedOutput.Write(bytesToWrite)
-	dataChunk := api.DataChunk{Data: bytesToWrite}
+	uploader.backlog.Push(bytesToWrite)
+
+	if err := uploader.streamBacklog(context.Background(), false); err != nil {
+		return 0, err
+	}
+	return len(bytesToWrite), nil
+}
+
+// streamBacklog sends the backlog to the live log stream, re-opening the stream
+// first if it was previously broken and the reconnection backoff has elapsed.
+func (uploader *LogUploader) streamBacklog(ctx context.Context, ignoreBackoff bool) error {
+	if uploader.backlog.Len() == 0 {
+		return nil
+	}
+
+	if uploader.streamBroken {
+		if !ignoreBackoff && time.Now().Before(uploader.nextReconnect) {
+			return nil
+		}
+
+		log.Printf("Trying to reinitialize logs uploader for %s...\n", uploader.commandName)
+		if err := uploader.reInitializeClient(ctx); err != nil {
+			uploader.scheduleReconnect()
+			return err
+		}
+		log.Printf("Successfully reinitialized log uploader for %s!\n", uploader.commandName)
+		uploader.streamBroken = false
+	}
+
+	if dropped := uploader.backlog.TakeDropped(); dropped != 0 {
+		marker := fmt.Sprintf("\nlog gap: dropped %d KB while reconnecting\n", (dropped+1023)/1024)
+		if err := uploader.sendChunk([]byte(marker)); err != nil {
+			uploader.backlog.ReturnDropped(dropped)
+			return err
+		}
+	}
+
+	for uploader.backlog.Len() != 0 {
+		if err := uploader.sendChunk(uploader.backlog.Peek()); err != nil {
+			return err
+		}
+		uploader.backlog.MarkSent()
+	}
+
+	uploader.reconnectDelay = logStreamReconnectMinDelay
+	uploader.backlog.Forget(logStreamResendSize)
+
+	return nil
+}
+
+func (uploader *LogUploader) sendChunk(chunk []byte) error {
+	dataChunk := api.DataChunk{Data: chunk}
 	logEntry := api.LogEntry_Chunk{Chunk: &dataChunk}
 	err := uploader.client.Send(&api.LogEntry{Value: &logEntry})
 	if err != nil {
-		log.Printf("Failed to send logs! %s For %s", err.Error(), string(bytesToWrite))
+		log.Printf("Failed to send logs for %s: %v\n", uploader.commandName, err)
 		uploader.erroredChunks++
-		return 0, err
+		uploader.breakStream()
+		return err
 	}
-	return len(bytesToWrite), nil
+	return nil
+}
+
+// breakStream schedules re-opening the live log stream, the recently sent chunks
+// might have been lost along with the broken stream, so they'll be re-sent to the new one.
+func (uploader *LogUploader) breakStream() {
+	uploader.backlog.Resend()
+	uploader.streamBroken = true
+	uploader.scheduleReconnect()
+}
+
+func (uploader *LogUploader) scheduleReconnect() {
+	uploader.nextReconnect = time.Now().Add(uploader.reconnectDelay)
+
+	uploader.reconnectDelay *= 2
+	if uploader.reconnectDelay > logStreamReconnectMaxDelay {
+		uploader.reconnectDelay = logStreamReconnectMaxDelay
+	}
+}
+
+// Flush waits for the output written so far to be handed to the log stream, giving up after the timeout.
+// Unlike Finalize(), the lines that are still being written are kept intact.
+func (uploader *LogUploader) Flush(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	// Wake up the wait below once the timeout expires
+	timer := time.AfterFunc(timeout, func() {
+		uploader.bufferMutex.Lock()
+		uploader.bufferReleased.Broadcast()
+		uploader.bufferMutex.Unlock()
+	})
+	defer timer.Stop()
+
+	uploader.bufferMutex.Lock()
+	defer uploader.bufferMutex.Unlock()
+
+	for uploader.bufferedBytes != 0 {
+		if !time.Now().Before(deadline) {
+			return ErrLogFlushTimeout
+		}
+		uploader.bufferReleased.Wait()
+	}
+
+	return nil
 }
 
+// Close finalizes the log upload similarly to Finalize(), but gives up waiting for it after the timeout,
+// which is useful when the agent is shutting down. The upload keeps going in the background.
+func (uploader *LogUploader) Close(timeout time.Duration) error {
+	uploader.finalizeOnce.Do(uploader.finalize)
+
+	select {
+	case <-uploader.doneLogUpload:
+		return nil
+	case <-time.After(timeout):
+		return ErrLogFlushTimeout
+	}
+}
+
+// Finalize sends the rest of the output and waits for the log upload to finish,
+// it's safe to call it more than once.
 func (uploader *LogUploader) Finalize() {
+	uploader.finalizeOnce.Do(uploader.finalize)
+	<-uploader.doneLogUpload
+}
+
+func (uploader *LogUploader) finalize() {
 	log.Printf("Finilizing log uploading for %s!\n", uploader.commandName)
+
+	uploader.writeMutex.Lock()
+	defer uploader.writeMutex.Unlock()
+
+	var tail []byte
+	if uploader.lineTruncator != nil {
+		tail = uploader.lineTruncator.Flush()
+	}
+	if uploader.logSampler != nil {
+		tail = append(uploader.logSampler.Process(tail), uploader.logSampler.Flush()...)
+	}
+	uploader.enqueue(uploader.logGroups.Process(tail))
+	uploader.enqueue(uploader.logGroups.Close())
+	if uploader.jsonLines != nil {
+		uploader.push(uploader.jsonLines.Flush())
+	}
+	if uploader.mirror != nil {
+		uploader.mirror.Flush()
+	}
 	uploader.mutex.Lock()
 	uploader.closed = true
 	close(uploader.logsChannel)
 	uploader.mutex.Unlock()
-	<-uploader.doneLogUpload
 }
 
 func (uploader *LogUploader) UploadStoredOutput(ctx context.Context) error {
@@ -239,10 +677,14 @@ func (uploader *LogUploader) UploadStoredOutput(ctx context.Context) error {
 		if n > 0 {
 			dataChunk := api.DataChunk{Data: readBuffer[:n]}
 			logEntry := api.LogEntry_Chunk{Chunk: &dataChunk}
-			err = logClient.Send(&api.LogEntry{Value: &logEntry})
+			if err := logClient.Send(&api.LogEntry{Value: &logEntry}); err != nil {
+				return err
+			}
 		}
 
-		if err == io.EOF || n == 0 {
+		// bufio.Reader takes care of the readers that keep returning no data
+		// without an error by returning io.ErrNoProgress
+		if err == io.EOF {
 			break
 		}
 		if err != nil {
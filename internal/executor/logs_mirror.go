@@ -0,0 +1,90 @@
+package executor
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+)
+
+// Flush incomplete lines that grow too long anyway
+const logMirrorMaxPendingLine = 64 * 1024
+
+var (
+	// Shared by the mirrors of all commands to avoid interleaving their lines,
+	// also protects the mirrors state since a command's output can have multiple writers
+	logMirrorMutex  sync.Mutex
+	logMirrorOutput io.Writer = os.Stdout
+)
+
+// logMirror copies the command output to the agent's stdout for local debugging
+// (see the CIRRUS_AGENT_LOG_TO_STDOUT behavioral environment variable), prefixing
+// each line with the command name.
+type logMirror struct {
+	prefix       []byte
+	valuesToMask []string
+	pending      []byte
+}
+
+func newLogMirror(commandName string, valuesToMask []string) *logMirror {
+	return &logMirror{
+		prefix:       []byte("[" + commandName + "] "),
+		valuesToMask: valuesToMask,
+	}
+}
+
+func (mirror *logMirror) Write(data []byte) {
+	logMirrorMutex.Lock()
+	defer logMirrorMutex.Unlock()
+
+	mirror.pending = append(mirror.pending, data...)
+
+	// Only output the complete lines, so that the concurrently
+	// running commands don't get their lines mixed up
+	lastNewline := bytes.LastIndexByte(mirror.pending, '\n')
+	if lastNewline == -1 && len(mirror.pending) < logMirrorMaxPendingLine {
+		return
+	}
+
+	var lines []byte
+	if lastNewline == -1 {
+		lines, mirror.pending = mirror.pending, nil
+	} else {
+		lines = mirror.pending[:lastNewline+1]
+		mirror.pending = append([]byte{}, mirror.pending[lastNewline+1:]...)
+	}
+
+	mirror.output(lines)
+}
+
+func (mirror *logMirror) Flush() {
+	logMirrorMutex.Lock()
+	defer logMirrorMutex.Unlock()
+
+	if len(mirror.pending) == 0 {
+		return
+	}
+
+	mirror.output(append(mirror.pending, '\n'))
+	mirror.pending = nil
+}
+
+func (mirror *logMirror) output(lines []byte) {
+	for _, valueToMask := range mirror.valuesToMask {
+		lines = bytes.ReplaceAll(lines, []byte(valueToMask), []byte("HIDDEN-BY-CIRRUS-CI"))
+	}
+
+	var result []byte
+	for _, line := range bytes.SplitAfter(lines, []byte{'\n'}) {
+		if len(line) == 0 {
+			continue
+		}
+		result = append(result, mirror.prefix...)
+		result = append(result, line...)
+	}
+	if !bytes.HasSuffix(result, []byte{'\n'}) {
+		result = append(result, '\n')
+	}
+
+	_, _ = logMirrorOutput.Write(result)
+}
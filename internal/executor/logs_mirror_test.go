@@ -0,0 +1,76 @@
+package executor
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+)
+
+func withLogMirrorOutput(t *testing.T) *bytes.Buffer {
+	var output bytes.Buffer
+
+	previousOutput := logMirrorOutput
+	logMirrorOutput = &output
+	t.Cleanup(func() {
+		logMirrorOutput = previousOutput
+	})
+
+	return &output
+}
+
+func TestLogMirror(t *testing.T) {
+	output := withLogMirrorOutput(t)
+
+	mirror := newLogMirror("main", []string{"secret"})
+	mirror.Write([]byte("first line\nsecond "))
+	assert.Equal(t, "[main] first line\n", output.String())
+
+	mirror.Write([]byte("line with a secret\nunterminated"))
+	mirror.Flush()
+	assert.Equal(t, "[main] first line\n[main] second line with a HIDDEN-BY-CIRRUS-CI\n[main] unterminated\n",
+		output.String())
+}
+
+func TestLogMirrorConcurrentCommands(t *testing.T) {
+	output := withLogMirrorOutput(t)
+
+	var wg sync.WaitGroup
+	for _, commandName := range []string{"first", "second"} {
+		mirror := newLogMirror(commandName, nil)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := 0; i < 100; i++ {
+				mirror.Write([]byte("partial "))
+				mirror.Write([]byte("line\n"))
+			}
+		}()
+	}
+	wg.Wait()
+
+	lines := bytes.Split(bytes.TrimSuffix(output.Bytes(), []byte{'\n'}), []byte{'\n'})
+	assert.Len(t, lines, 200)
+	for _, line := range lines {
+		assert.Regexp(t, `^\[(first|second)\] partial line$`, string(line))
+	}
+}
+
+func TestLogStreamMirrorDoesNotChangeUploadedLogs(t *testing.T) {
+	output := withLogMirrorOutput(t)
+
+	fake := &fakeCirrusClient{logStreamCapacities: []int{-1}}
+	withFakeClient(t, fake)
+
+	executor := newTestArtifactsExecutor()
+	executor.env = map[string]string{"CIRRUS_AGENT_LOG_TO_STDOUT": "true"}
+	logUploader := newTestLogUploader(t, executor)
+
+	_, _ = logUploader.Write([]byte("hello\nworld"))
+	logUploader.Finalize()
+
+	assert.Equal(t, "hello\nworld", fake.Logs())
+	assert.Equal(t, "[artifacts] hello\n[artifacts] world\n", output.String())
+}
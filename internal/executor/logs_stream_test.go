@@ -0,0 +1,345 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func withFastLogStreamReconnects(t *testing.T, backlogSize int) {
+	previousMinDelay, previousBacklogSize := logStreamReconnectMinDelay, logBacklogSize
+	logStreamReconnectMinDelay, logBacklogSize = 10*time.Millisecond, backlogSize
+	t.Cleanup(func() {
+		logStreamReconnectMinDelay, logBacklogSize = previousMinDelay, previousBacklogSize
+	})
+}
+
+func TestLogStreamReconnectsWithoutLosingLogs(t *testing.T) {
+	withFastLogStreamReconnects(t, 1024)
+
+	// First log stream breaks after accepting a single chunk
+	fake := &fakeCirrusClient{logStreamCapacities: []int{1}}
+	withFakeClient(t, fake)
+
+	logUploader := newTestLogUploader(t, newTestArtifactsExecutor())
+
+	_, _ = logUploader.Write([]byte("first\n"))
+	time.Sleep(50 * time.Millisecond)
+	_, _ = logUploader.Write([]byte("second\n"))
+	time.Sleep(50 * time.Millisecond)
+	_, _ = logUploader.Write([]byte("third\n"))
+	logUploader.Finalize()
+
+	assert.Equal(t, "first\nsecond\nthird\n", fake.Logs())
+	assert.Equal(t, 2, fake.logStreamsOpened)
+}
+
+func TestLogStreamMarksDroppedLogs(t *testing.T) {
+	withFastLogStreamReconnects(t, 8)
+
+	// First log stream breaks after accepting a single chunk
+	// and the second one breaks immediately
+	fake := &fakeCirrusClient{logStreamCapacities: []int{1, 0}}
+	withFakeClient(t, fake)
+
+	logUploader := newTestLogUploader(t, newTestArtifactsExecutor())
+
+	_, _ = logUploader.Write([]byte("hello\n"))
+	time.Sleep(50 * time.Millisecond)
+	_, _ = logUploader.Write([]byte("0123456789"))
+	time.Sleep(100 * time.Millisecond)
+	logUploader.Finalize()
+
+	// "hello\n" was lost along with the first stream and dropped from the backlog before it could be re-sent
+	assert.Equal(t, "\nlog gap: dropped 1 KB while reconnecting\n23456789", fake.Logs())
+	assert.Equal(t, 3, fake.logStreamsOpened)
+}
+
+func TestLogStreamResendsRecentLogs(t *testing.T) {
+	withFastLogStreamReconnects(t, 1024)
+
+	previousResendSize := logStreamResendSize
+	logStreamResendSize = 7
+	t.Cleanup(func() {
+		logStreamResendSize = previousResendSize
+	})
+
+	// The first log stream breaks after accepting two chunks, but the server keeps them
+	fake := &fakeCirrusClient{logStreamCapacities: []int{2}, logStreamKeepsReceived: true}
+	withFakeClient(t, fake)
+
+	logUploader := newTestLogUploader(t, newTestArtifactsExecutor())
+
+	for _, line := range []string{"first\n", "second\n", "third\n"} {
+		_, _ = logUploader.Write([]byte(line))
+		time.Sleep(50 * time.Millisecond)
+	}
+	logUploader.Finalize()
+
+	// The stream isn't re-opened until it breaks
+	assert.Equal(t, 2, fake.logStreamsOpened)
+
+	// Only the most recently sent chunk is re-sent and duplicated in the live log...
+	assert.Equal(t, "first\nsecond\nsecond\nthird\n", fake.Logs())
+
+	// ...but not in the log saved once the command has finished
+	assert.Equal(t, "first\nsecond\nthird\n", fake.SavedLogs())
+}
+
+func TestLogStreamSanitizesUTF8(t *testing.T) {
+	fake := &fakeCirrusClient{logStreamCapacities: []int{-1}}
+	withFakeClient(t, fake)
+
+	executor := newTestArtifactsExecutor()
+	executor.env = map[string]string{"CIRRUS_LOG_SANITIZE_UTF8": "true"}
+	logUploader := newTestLogUploader(t, executor)
+
+	// "ж" is split across the writes and shouldn't be mangled
+	_, _ = logUploader.Write([]byte("bad \xff, good \xd0"))
+	time.Sleep(50 * time.Millisecond)
+	_, _ = logUploader.Write([]byte("\xb6\n\xf0"))
+	logUploader.Finalize()
+
+	assert.Equal(t, "bad �, good ж\n�", fake.Logs())
+}
+
+func TestLogStreamHexEscapesInvalidUTF8(t *testing.T) {
+	fake := &fakeCirrusClient{logStreamCapacities: []int{-1}}
+	withFakeClient(t, fake)
+
+	executor := newTestArtifactsExecutor()
+	executor.env = map[string]string{"CIRRUS_LOG_SANITIZE_UTF8": "hex"}
+	logUploader := newTestLogUploader(t, executor)
+
+	_, _ = logUploader.Write([]byte("bad \xff, good \xd0"))
+	time.Sleep(50 * time.Millisecond)
+	_, _ = logUploader.Write([]byte("\xb6\n\xf0"))
+	logUploader.Finalize()
+
+	assert.Equal(t, "bad \\xff, good ж\n\\xf0", fake.Logs())
+}
+
+func TestLogStreamClosesLogGroups(t *testing.T) {
+	fake := &fakeCirrusClient{logStreamCapacities: []int{-1}}
+	withFakeClient(t, fake)
+
+	logUploader := newTestLogUploader(t, newTestArtifactsExecutor())
+
+	_, _ = logUploader.Write([]byte("##cirrus[group:Install deps]\ninstalling..."))
+	logUploader.Finalize()
+
+	assert.Equal(t, "##cirrus[group:Install deps]\ninstalling...\n##cirrus[endgroup]\n", fake.Logs())
+}
+
+func TestLogStreamConcurrentWrites(t *testing.T) {
+	fake := &fakeCirrusClient{logStreamCapacities: []int{-1}}
+	withFakeClient(t, fake)
+
+	executor := newTestArtifactsExecutor()
+	executor.env = map[string]string{"CIRRUS_LOG_TIMESTAMP": "true"}
+	logUploader := newTestLogUploader(t, executor)
+
+	// E.g. the command's output and the timeout warning
+	var wg sync.WaitGroup
+	for _, writer := range []string{"command", "warning"} {
+		writer := writer
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := 0; i < 200; i++ {
+				_, _ = logUploader.Write([]byte(fmt.Sprintf("%s line %d\n", writer, i)))
+			}
+		}()
+	}
+	wg.Wait()
+	logUploader.Finalize()
+
+	lines := strings.Split(strings.TrimSuffix(fake.Logs(), "\n"), "\n")
+	require.Len(t, lines, 400)
+	for _, line := range lines {
+		assert.Regexp(t, `^\[\d\d:\d\d:\d\d\.\d{3}\] (command|warning) line \d+$`, line)
+	}
+}
+
+func TestLogStreamRateLimit(t *testing.T) {
+	fake := &fakeCirrusClient{logStreamCapacities: []int{-1}}
+	withFakeClient(t, fake)
+
+	executor := newTestArtifactsExecutor()
+	executor.env = map[string]string{"CIRRUS_LOG_RATE_LIMIT": "16B"}
+	logUploader := newTestLogUploader(t, executor)
+
+	_, _ = logUploader.Write([]byte("0\n1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n"))
+	logUploader.Finalize()
+
+	assert.Equal(t, "0\n10\noutput rate-limited, skipped 10 lines\n", fake.Logs())
+}
+
+func TestLogStreamTruncatesLongLines(t *testing.T) {
+	fake := &fakeCirrusClient{logStreamCapacities: []int{-1}}
+	withFakeClient(t, fake)
+
+	executor := newTestArtifactsExecutor()
+	executor.env = map[string]string{"CIRRUS_LOG_MAX_LINE_LENGTH": "8B"}
+	logUploader := newTestLogUploader(t, executor)
+
+	_, _ = logUploader.Write([]byte("short\n0123456"))
+	_, _ = logUploader.Write([]byte("789abcdef\nalso short\n0123456789"))
+	logUploader.Finalize()
+
+	assert.Equal(t, "short\n01234567...[truncated 8 bytes]\nalso sho...[truncated 2 bytes]\n01234567...[truncated 2 bytes]", fake.Logs())
+	assert.EqualValues(t, 44, logUploader.BytesWritten())
+}
+
+func TestLogStreamTruncationDoesNotUnmaskSecrets(t *testing.T) {
+	fake := &fakeCirrusClient{logStreamCapacities: []int{-1}}
+	withFakeClient(t, fake)
+
+	executor := newTestArtifactsExecutor()
+	executor.env = map[string]string{"CIRRUS_LOG_MAX_LINE_LENGTH": "8B"}
+	executor.sensitiveValues = []string{"supersecret"}
+	logUploader := newTestLogUploader(t, executor)
+
+	// The line is cut right in the middle of the secret
+	_, _ = logUploader.Write([]byte("key=supersecret\n"))
+	logUploader.Finalize()
+
+	assert.Equal(t, "key=HIDD...[truncated 15 bytes]\n", fake.Logs())
+}
+
+func TestLogStreamCoalescesWrites(t *testing.T) {
+	fake := &fakeCirrusClient{logStreamCapacities: []int{-1}}
+	withFakeClient(t, fake)
+
+	executor := newTestArtifactsExecutor()
+	executor.env = map[string]string{"CIRRUS_LOG_FLUSH_INTERVAL": "1h", "CIRRUS_LOG_FLUSH_SIZE": "100B"}
+	logUploader := newTestLogUploader(t, executor)
+
+	var expectedLogs string
+	for i := 0; i < 100; i++ {
+		line := fmt.Sprintf("line %d\n", i)
+		expectedLogs += line
+		_, _ = logUploader.Write([]byte(line))
+	}
+	logUploader.Finalize()
+
+	// Only reaching the flush size or the end of the stream trigger the flush,
+	// so the 790 bytes of logs are sent in chunks of 102, 104, ..., 104 and 64 bytes
+	assert.Equal(t, expectedLogs, fake.Logs())
+	assert.Equal(t, 8, fake.LogChunks())
+}
+
+func TestLogStreamJSON(t *testing.T) {
+	fake := &fakeCirrusClient{logStreamCapacities: []int{-1}}
+	withFakeClient(t, fake)
+
+	executor := newTestArtifactsExecutor()
+	executor.env = map[string]string{"CIRRUS_LOG_JSON": "true", "CIRRUS_LOG_TIMESTAMP": "true"}
+	logUploader := newTestLogUploader(t, executor)
+	logUploader.GetTimestamp = func() time.Time {
+		return time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+	}
+
+	_, _ = logUploader.Write([]byte("##cirrus[group:Install deps]\ninstall"))
+	_, _ = logUploader.Write([]byte("ing..."))
+	logUploader.Finalize()
+
+	assert.Equal(t, `{"ts":"2022-01-02T03:04:05Z","stream":"artifacts","msg":"##cirrus[group:Install deps]"}
+{"ts":"2022-01-02T03:04:05Z","stream":"artifacts","msg":"installing..."}
+{"ts":"2022-01-02T03:04:05Z","stream":"artifacts","msg":"##cirrus[endgroup]"}
+`, fake.Logs())
+}
+
+func TestLogBufferAppliesBackpressure(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("relies on the POSIX shell")
+	}
+
+	// Every chunk takes a while to be streamed
+	fake := &fakeCirrusClient{logStreamCapacities: []int{-1}, logChunkDelay: time.Millisecond}
+	withFakeClient(t, fake)
+
+	const bufferSize = 64 * 1024
+
+	executor := newTestArtifactsExecutor()
+	executor.env = map[string]string{"CIRRUS_LOG_BUFFER_SIZE": "64KiB"}
+	logUploader := newTestLogUploader(t, executor)
+
+	var maxBufferedBytes int
+	stopSampling := make(chan struct{})
+	samplingDone := make(chan struct{})
+	go func() {
+		defer close(samplingDone)
+		for {
+			select {
+			case <-stopSampling:
+				return
+			case <-time.After(100 * time.Microsecond):
+			}
+			logUploader.bufferMutex.Lock()
+			if logUploader.bufferedBytes > maxBufferedBytes {
+				maxBufferedBytes = logUploader.bufferedBytes
+			}
+			logUploader.bufferMutex.Unlock()
+		}
+	}()
+
+	// The command keeps writing way faster than the stream can keep up,
+	// which shouldn't prevent it from finishing with the complete output
+	cmd, err := executor.ExecuteScriptsStreamLogsAndWait(context.Background(), logUploader, "main",
+		// "yes" is killed with SIGPIPE once "head" exits
+		[]string{"yes | head -c 8000000 || true"}, map[string]string{})
+	require.NoError(t, err)
+	assert.True(t, cmd.ProcessState.Success())
+	logUploader.Finalize()
+
+	close(stopSampling)
+	<-samplingDone
+
+	assert.LessOrEqual(t, maxBufferedBytes, bufferSize)
+	assert.Equal(t, 4000000, strings.Count(fake.Logs(), "y\n"))
+}
+
+func TestLogUploaderFlush(t *testing.T) {
+	fake := &fakeCirrusClient{logStreamCapacities: []int{-1}}
+	withFakeClient(t, fake)
+
+	logUploader := newTestLogUploader(t, newTestArtifactsExecutor())
+
+	_, _ = logUploader.Write([]byte("last words before being killed"))
+	require.NoError(t, logUploader.Flush(time.Second))
+	assert.Equal(t, "last words before being killed", fake.Logs())
+
+	// Finalizing more than once is harmless
+	logUploader.Finalize()
+	require.NoError(t, logUploader.Close(time.Second))
+}
+
+func TestLogUploaderCloseDoesNotHang(t *testing.T) {
+	fake := &fakeCirrusClient{logStreamCapacities: []int{-1}, logChunkDelay: time.Second}
+	withFakeClient(t, fake)
+
+	logUploader := newTestLogUploader(t, newTestArtifactsExecutor())
+
+	_, _ = logUploader.Write([]byte("slowly streamed"))
+
+	// Nothing keeps waiting for the flush after the timeout
+	goroutines := runtime.NumGoroutine()
+	assert.ErrorIs(t, logUploader.Flush(10*time.Millisecond), ErrLogFlushTimeout)
+	time.Sleep(50 * time.Millisecond)
+	assert.LessOrEqual(t, runtime.NumGoroutine(), goroutines)
+
+	assert.ErrorIs(t, logUploader.Close(10*time.Millisecond), ErrLogFlushTimeout)
+
+	// The upload still finishes in the background
+	logUploader.Finalize()
+	assert.Equal(t, "slowly streamed", fake.Logs())
+}
@@ -0,0 +1,167 @@
+package logsampler
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+)
+
+const (
+	// Keep 1 out of DefaultKeepEvery lines when the output is rate-limited
+	DefaultKeepEvery = 10
+
+	window = time.Second
+)
+
+// Sampler degrades the overly chatty output by only keeping every N-th line
+// while the output rate exceeds the limit, marking the skipped lines
+// both periodically and once the rate drops back.
+type Sampler struct {
+	limit     uint64
+	keepEvery int
+	now       func() time.Time
+
+	windowStart time.Time
+	windowBytes uint64
+
+	sampling     bool
+	markerDue    bool
+	lineIndex    int
+	skippedLines int
+	atLineStart  bool
+	keepLine     bool
+}
+
+// New creates a sampler that kicks in when the output rate exceeds the limit (in bytes per second).
+func New(limit uint64, keepEvery int, now func() time.Time) *Sampler {
+	return &Sampler{
+		limit:       limit,
+		keepEvery:   keepEvery,
+		now:         now,
+		atLineStart: true,
+		keepLine:    true,
+	}
+}
+
+// Process returns the part of the chunk that should be uploaded.
+func (sampler *Sampler) Process(chunk []byte) []byte {
+	if len(chunk) == 0 {
+		return chunk
+	}
+
+	sampler.updateRate(uint64(len(chunk)))
+
+	// Fast path: the output is not rate-limited
+	if !sampler.sampling && !sampler.markerDue && sampler.keepLine {
+		sampler.atLineStart = chunk[len(chunk)-1] == '\n'
+		return chunk
+	}
+
+	result := make([]byte, 0, len(chunk))
+
+	for len(chunk) != 0 {
+		if sampler.atLineStart {
+			result = sampler.appendMarker(result)
+
+			if sampler.sampling {
+				sampler.keepLine = sampler.lineIndex%sampler.keepEvery == 0
+				sampler.lineIndex++
+			} else {
+				sampler.keepLine = true
+			}
+
+			if !sampler.keepLine {
+				sampler.skippedLines++
+			}
+		}
+
+		var line []byte
+
+		newlineIndex := bytes.IndexByte(chunk, '\n')
+		if newlineIndex == -1 {
+			line, chunk = chunk, nil
+			sampler.atLineStart = false
+		} else {
+			line, chunk = chunk[:newlineIndex+1], chunk[newlineIndex+1:]
+			sampler.atLineStart = true
+		}
+
+		if sampler.keepLine {
+			result = append(result, line...)
+		}
+	}
+
+	if sampler.atLineStart {
+		result = sampler.appendMarker(result)
+	}
+
+	return result
+}
+
+// Flush returns the marker for the lines that were skipped
+// since the last marker (if any).
+func (sampler *Sampler) Flush() []byte {
+	if sampler.skippedLines == 0 {
+		return nil
+	}
+
+	var result []byte
+
+	if !sampler.atLineStart {
+		result = append(result, '\n')
+		sampler.atLineStart = true
+	}
+
+	sampler.markerDue = true
+
+	return sampler.appendMarker(result)
+}
+
+func (sampler *Sampler) updateRate(n uint64) {
+	now := sampler.now()
+
+	if sampler.windowStart.IsZero() {
+		sampler.windowStart = now
+	}
+
+	if elapsed := now.Sub(sampler.windowStart); elapsed >= window {
+		wasSampling := sampler.sampling
+
+		// Nothing was written during the windows in-between,
+		// so the rate has surely dropped below the limit
+		sampler.sampling = sampler.windowBytes > sampler.limit && elapsed < 2*window
+
+		if wasSampling {
+			sampler.markerDue = true
+		}
+		if !sampler.sampling {
+			sampler.lineIndex = 0
+		}
+
+		sampler.windowStart = now
+		sampler.windowBytes = 0
+	}
+
+	sampler.windowBytes += n
+
+	if sampler.windowBytes > sampler.limit {
+		sampler.sampling = true
+	}
+}
+
+func (sampler *Sampler) appendMarker(result []byte) []byte {
+	if !sampler.markerDue {
+		return result
+	}
+
+	sampler.markerDue = false
+
+	if sampler.skippedLines == 0 {
+		return result
+	}
+
+	result = append(result, fmt.Sprintf("output rate-limited, skipped %d lines\n", sampler.skippedLines)...)
+	sampler.skippedLines = 0
+
+	return result
+}
@@ -0,0 +1,82 @@
+package logsampler_test
+
+import (
+	"fmt"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/executor/logsampler"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (clock *fakeClock) Now() time.Time {
+	return clock.now
+}
+
+func lines(from int, to int) string {
+	var result string
+
+	for i := from; i <= to; i++ {
+		result += fmt.Sprintf("%d\n", i)
+	}
+
+	return result
+}
+
+func TestBelowLimit(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	sampler := logsampler.New(1024, 10, clock.Now)
+
+	assert.Equal(t, "hello\n", string(sampler.Process([]byte("hello\n"))))
+	assert.Empty(t, sampler.Flush())
+}
+
+func TestSampling(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	sampler := logsampler.New(10, 5, clock.Now)
+
+	// Limit is exceeded within the chunk, so only every 5th line is kept
+	assert.Equal(t, "1\n6\n", string(sampler.Process([]byte(lines(1, 10)))))
+
+	// Still exceeding the limit, a periodic marker is inserted
+	clock.now = clock.now.Add(time.Second)
+	assert.Equal(t, "output rate-limited, skipped 8 lines\n11\n16\n",
+		string(sampler.Process([]byte(lines(11, 20)))))
+
+	// The rate has dropped, back to full fidelity
+	clock.now = clock.now.Add(time.Second)
+	assert.Equal(t, "output rate-limited, skipped 8 lines\n21\n",
+		string(sampler.Process([]byte("21\n"))))
+	assert.Empty(t, sampler.Flush())
+}
+
+func TestIdleResetsSampling(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	sampler := logsampler.New(10, 5, clock.Now)
+
+	assert.Equal(t, "1\n6\n", string(sampler.Process([]byte(lines(1, 10)))))
+
+	clock.now = clock.now.Add(time.Minute)
+	assert.Equal(t, "output rate-limited, skipped 8 lines\nok\n", string(sampler.Process([]byte("ok\n"))))
+}
+
+func TestPartialLines(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	sampler := logsampler.New(4, 2, clock.Now)
+
+	// The first line is kept, the second one is skipped even when split across the chunks
+	assert.Equal(t, "first\n", string(sampler.Process([]byte("first\nsec"))))
+	assert.Equal(t, "third\n", string(sampler.Process([]byte("ond\nthird\n"))))
+	assert.Equal(t, "output rate-limited, skipped 1 lines\n", string(sampler.Flush()))
+}
+
+func TestFlushTerminatesTheLine(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	sampler := logsampler.New(1, 2, clock.Now)
+
+	assert.Equal(t, "a\nc", string(sampler.Process([]byte("a\nb\nc"))))
+	assert.Equal(t, "\noutput rate-limited, skipped 1 lines\n", string(sampler.Flush()))
+}
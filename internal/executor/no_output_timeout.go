@@ -0,0 +1,136 @@
+package executor
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// commandNoOutputTimeoutEnvName is set by scriptEnv() to the no output timeout of the command,
+// so that ShellCommandsAndWait() can pick it up without knowing the command's name.
+const commandNoOutputTimeoutEnvName = "CIRRUS_COMMAND_NO_OUTPUT_TIMEOUT"
+
+// NoOutputTimeoutError is returned by ShellCommandsAndWait() when the command was killed
+// for not producing any output for too long.
+type NoOutputTimeoutError struct {
+	Timeout time.Duration
+}
+
+func (err *NoOutputTimeoutError) Error() string {
+	return fmt.Sprintf("no output for %s, assuming hung", formatFooterDuration(err.Timeout))
+}
+
+// commandNoOutputTimeout returns for how long the command may stay silent before it's considered hung,
+// configured via the CIRRUS_NO_OUTPUT_TIMEOUT_<COMMAND> variable, either as a Go duration (e.g. "10m")
+// or as a number of seconds. Zero disables the timeout, which is the default.
+func commandNoOutputTimeout(env map[string]string, commandName string) (time.Duration, error) {
+	name := commandSpecificEnvName("CIRRUS_NO_OUTPUT_TIMEOUT", commandName)
+
+	value := env[name]
+	if value == "" {
+		return 0, nil
+	}
+
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		seconds, atoiErr := strconv.Atoi(value)
+		if atoiErr != nil {
+			return 0, fmt.Errorf("failed to parse %s: %w", name, err)
+		}
+		timeout = time.Duration(seconds) * time.Second
+	}
+
+	if timeout < 0 {
+		return 0, fmt.Errorf("%s should not be negative, got %q", name, value)
+	}
+
+	return timeout, nil
+}
+
+func noOutputTimeoutFromEnv(env *map[string]string) (time.Duration, bool) {
+	if env == nil {
+		return 0, false
+	}
+
+	timeout, err := time.ParseDuration((*env)[commandNoOutputTimeoutEnvName])
+	if err != nil || timeout <= 0 {
+		return 0, false
+	}
+
+	return timeout, true
+}
+
+// noOutputWatchdog fires when no output passes through its handler for the whole timeout.
+type noOutputWatchdog struct {
+	handler ShellOutputHandler
+	timeout time.Duration
+
+	mutex      sync.Mutex
+	lastOutput time.Time
+
+	fired   chan struct{}
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+func newNoOutputWatchdog(handler ShellOutputHandler, timeout time.Duration) *noOutputWatchdog {
+	watchdog := &noOutputWatchdog{
+		handler:    handler,
+		timeout:    timeout,
+		lastOutput: time.Now(),
+		fired:      make(chan struct{}),
+		stop:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+	}
+
+	go watchdog.run()
+
+	return watchdog
+}
+
+// Handler passes the output through, resetting the timeout.
+func (watchdog *noOutputWatchdog) Handler(bytes []byte) (int, error) {
+	if len(bytes) != 0 {
+		watchdog.mutex.Lock()
+		watchdog.lastOutput = time.Now()
+		watchdog.mutex.Unlock()
+	}
+
+	return watchdog.handler(bytes)
+}
+
+// Fired returns a channel that is closed once the timeout is reached.
+func (watchdog *noOutputWatchdog) Fired() <-chan struct{} {
+	return watchdog.fired
+}
+
+func (watchdog *noOutputWatchdog) Stop() {
+	close(watchdog.stop)
+	<-watchdog.stopped
+}
+
+func (watchdog *noOutputWatchdog) run() {
+	defer close(watchdog.stopped)
+
+	timer := time.NewTimer(watchdog.timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-watchdog.stop:
+			return
+		case now := <-timer.C:
+			watchdog.mutex.Lock()
+			wait := watchdog.lastOutput.Add(watchdog.timeout).Sub(now)
+			watchdog.mutex.Unlock()
+
+			if wait <= 0 {
+				close(watchdog.fired)
+				return
+			}
+
+			timer.Reset(wait)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package executor
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestCommandNoOutputTimeout(t *testing.T) {
+	timeout, err := commandNoOutputTimeout(map[string]string{}, "main")
+	require.NoError(t, err)
+	assert.Equal(t, time.Duration(0), timeout)
+
+	timeout, err = commandNoOutputTimeout(map[string]string{"CIRRUS_NO_OUTPUT_TIMEOUT_MAIN": "10m"}, "main")
+	require.NoError(t, err)
+	assert.Equal(t, 10*time.Minute, timeout)
+
+	timeout, err = commandNoOutputTimeout(map[string]string{"CIRRUS_NO_OUTPUT_TIMEOUT_MAIN": "0"}, "main")
+	require.NoError(t, err)
+	assert.Equal(t, time.Duration(0), timeout)
+
+	_, err = commandNoOutputTimeout(map[string]string{"CIRRUS_NO_OUTPUT_TIMEOUT_MAIN": "-1s"}, "main")
+	assert.Error(t, err)
+
+	_, err = commandNoOutputTimeout(map[string]string{"CIRRUS_NO_OUTPUT_TIMEOUT_MAIN": "never"}, "main")
+	assert.Error(t, err)
+}
+
+func TestNoOutputTimeoutKillsHungCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("relies on the sleep command")
+	}
+
+	fake := &fakeCirrusClient{logStreamCapacities: []int{-1}}
+	withFakeClient(t, fake)
+
+	executor := newTestArtifactsExecutor()
+	executor.env = map[string]string{
+		"CIRRUS_NO_OUTPUT_TIMEOUT_HUNG":   "2s",
+		"CIRRUS_TERMINATION_GRACE_PERIOD": "0s",
+	}
+
+	// The output on stderr keeps the command alive for a while
+	stepResult, err := executor.performStep(context.Background(), scriptCommand("hung",
+		"for i in 1 2 3; do echo tick >&2; sleep 1; done", "sleep 30"))
+	require.NoError(t, err)
+	assert.False(t, stepResult.Success)
+	assert.Greater(t, stepResult.Duration, 4*time.Second)
+	assert.Less(t, stepResult.Duration, 30*time.Second)
+
+	logs := fake.Logs()
+	assert.Contains(t, logs, "No output for 2s, assuming hung!")
+	assert.Contains(t, logs, "Command 'hung' was killed after")
+}
@@ -0,0 +1,119 @@
+package executor
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/dustin/go-humanize"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// E.g. "Out of memory: Killed process 1234 (stress) total-vm:2085036kB, anon-rss:1964172kB, ..."
+// or "Memory cgroup out of memory: Killed process 1234 (stress) ..."
+var kernelLogOOMKillRegex = regexp.MustCompile(`Killed process (\d+) \(([^)]*)\)(?:.*anon-rss:(\d+)kB)?`)
+
+// oomKill describes a process killed by the OOM killer.
+type oomKill struct {
+	PID     int
+	Process string
+
+	// Resident anonymous memory of the process at the time it was killed, zero when unknown
+	AnonRSS uint64
+}
+
+// Message returns the prominent explanation written to the command's log, peakUsage is used
+// when the kernel didn't tell the usage of the killed process.
+func (kill *oomKill) Message(peakUsage uint64) string {
+	usage := peakUsage
+	if kill.AnonRSS != 0 {
+		usage = kill.AnonRSS
+	}
+
+	process := "Process"
+	if kill.Process != "" {
+		process = fmt.Sprintf("Process '%s' (PID %d)", kill.Process, kill.PID)
+	}
+
+	if usage == 0 {
+		return fmt.Sprintf("!!! %s was killed by the OOM killer !!!", process)
+	}
+
+	return fmt.Sprintf("!!! %s was killed by the OOM killer (peak usage ~%s) !!!", process, humanize.Bytes(usage))
+}
+
+// parseKernelLogOOMKills returns the OOM kills found in the /dev/kmsg formatted records
+// (e.g. "3,1234,5678901234,-;Out of memory: Killed process ...") logged after the since
+// timestamp, which is the time since the boot just like the records' timestamps.
+func parseKernelLogOOMKills(reader io.Reader, since time.Duration) []*oomKill {
+	var result []*oomKill
+
+	scanner := bufio.NewScanner(reader)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		// Skip the continuation lines with the record's dictionary
+		header, message, ok := cutString(line, ";")
+		if !ok || strings.HasPrefix(line, " ") {
+			continue
+		}
+
+		fields := strings.Split(header, ",")
+		if len(fields) < 3 {
+			continue
+		}
+
+		usec, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil || time.Duration(usec)*time.Microsecond < since {
+			continue
+		}
+
+		matches := kernelLogOOMKillRegex.FindStringSubmatch(message)
+		if matches == nil {
+			continue
+		}
+
+		pid, _ := strconv.Atoi(matches[1])
+		kill := &oomKill{PID: pid, Process: matches[2]}
+		if anonRSSKB, err := strconv.ParseUint(matches[3], 10, 64); err == nil {
+			kill.AnonRSS = anonRSSKB * 1024
+		}
+
+		result = append(result, kill)
+	}
+
+	return result
+}
+
+// parseCgroupOOMKills returns the "oom_kill" counter from the cgroup v2 memory.events file.
+func parseCgroupOOMKills(reader io.Reader) (uint64, bool) {
+	scanner := bufio.NewScanner(reader)
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || fields[0] != "oom_kill" {
+			continue
+		}
+
+		value, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0, false
+		}
+
+		return value, true
+	}
+
+	return 0, false
+}
+
+// cutString is strings.Cut(), which is not available in Go 1.17.
+func cutString(s string, sep string) (string, string, bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+
+	return s, "", false
+}
@@ -0,0 +1,238 @@
+package executor
+
+import (
+	"golang.org/x/sys/unix"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The kernel log timestamps and CLOCK_MONOTONIC might be slightly off
+const oomDetectorClockSlack = time.Second
+
+var (
+	// How often the sessions of the running processes are recorded. The OOM killer prefers
+	// the processes that have been accumulating memory for a while, so they're rarely missed.
+	oomDetectorPollInterval = 500 * time.Millisecond
+
+	// Replaced in tests
+	openKernelLog = func() (io.ReadCloser, error) {
+		// Non-blocking, otherwise reading stops only when the new records arrive
+		fd, err := unix.Open("/dev/kmsg", unix.O_RDONLY|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		return &kmsgReader{fd: fd}, nil
+	}
+	cgroupMemoryEventsPath = func() string {
+		cgroups, err := os.ReadFile("/proc/self/cgroup")
+		if err != nil {
+			return ""
+		}
+
+		// Only the cgroup v2 unified hierarchy has memory.events with the "oom_kill" counter
+		for _, line := range strings.Split(string(cgroups), "\n") {
+			if strings.HasPrefix(line, "0::") {
+				return filepath.Join("/sys/fs/cgroup", strings.TrimPrefix(line, "0::"), "memory.events")
+			}
+		}
+
+		return ""
+	}
+)
+
+// oomDetector finds out whether the OOM killer has killed something in the middle of a command,
+// either by looking at the kernel log records or at the OOM kill counter of the cgroup the command
+// inherits from the agent.
+//
+// The victims found in the kernel log are only attributed to the command if they belonged to its
+// session, which is recorded while the command is running, since the victims are long gone by
+// the time the command finishes.
+type oomDetector struct {
+	started        time.Duration
+	cgroupOOMKills uint64
+	hasCgroup      bool
+
+	// Session IDs of the processes seen while the command was running
+	sessions     map[int]int
+	sessionsLock sync.Mutex
+	stopOnce     sync.Once
+	stop         chan struct{}
+	stopped      chan struct{}
+}
+
+// newOOMDetector remembers the state before the command is started and starts recording
+// the sessions of the running processes until Stop() or Detect() is called.
+func newOOMDetector() *oomDetector {
+	detector := &oomDetector{
+		sessions: map[int]int{},
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err == nil {
+		detector.started = time.Duration(ts.Nano()) - oomDetectorClockSlack
+	}
+
+	detector.cgroupOOMKills, detector.hasCgroup = readCgroupOOMKills()
+
+	go detector.recordSessions()
+
+	return detector
+}
+
+func (detector *oomDetector) recordSessions() {
+	defer close(detector.stopped)
+
+	ticker := time.NewTicker(oomDetectorPollInterval)
+	defer ticker.Stop()
+
+	for {
+		detector.recordSessionsOnce()
+
+		select {
+		case <-ticker.C:
+		case <-detector.stop:
+			return
+		}
+	}
+}
+
+func (detector *oomDetector) recordSessionsOnce() {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return
+	}
+
+	detector.sessionsLock.Lock()
+	defer detector.sessionsLock.Unlock()
+
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		if sid, err := unix.Getsid(pid); err == nil {
+			detector.sessions[pid] = sid
+		}
+	}
+}
+
+// Stop stops recording the sessions of the running processes, it's safe to call it more than once.
+func (detector *oomDetector) Stop() {
+	if detector == nil {
+		return
+	}
+
+	detector.stopOnce.Do(func() {
+		close(detector.stop)
+	})
+	<-detector.stopped
+}
+
+// belongsToCommand returns whether the process was seen in the session of the command's shell,
+// which runs in its own session and passes it on to all of the processes it spawns.
+func (detector *oomDetector) belongsToCommand(pid int, commandPID int) bool {
+	detector.sessionsLock.Lock()
+	defer detector.sessionsLock.Unlock()
+
+	sid, ok := detector.sessions[pid]
+
+	return ok && sid == commandPID
+}
+
+// Detect returns the OOM kill of one of the processes of the command, whose shell had the commandPID,
+// that happened since the detector's creation or nil.
+func (detector *oomDetector) Detect(commandPID int) *oomKill {
+	if detector == nil {
+		return nil
+	}
+
+	detector.Stop()
+
+	if kernelLog, err := openKernelLog(); err == nil {
+		kills := parseKernelLogOOMKills(kernelLog, detector.started)
+		_ = kernelLog.Close()
+
+		for i := len(kills) - 1; i >= 0; i-- {
+			if detector.belongsToCommand(kills[i].PID, commandPID) {
+				return kills[i]
+			}
+		}
+
+		// The cgroup counter below includes these unrelated kills too
+		if len(kills) != 0 {
+			return nil
+		}
+	}
+
+	// The kernel log is often inaccessible in containers, but the cgroup is not
+	if detector.hasCgroup {
+		if oomKills, ok := readCgroupOOMKills(); ok && oomKills > detector.cgroupOOMKills {
+			return &oomKill{}
+		}
+	}
+
+	return nil
+}
+
+func readCgroupOOMKills() (uint64, bool) {
+	path := cgroupMemoryEventsPath()
+	if path == "" {
+		return 0, false
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, false
+	}
+	defer file.Close()
+
+	return parseCgroupOOMKills(file)
+}
+
+// kmsgReader reads the records available in /dev/kmsg without waiting for the new ones.
+//
+// Not using os.File, since it would wait for the non-blocking descriptor to become readable.
+type kmsgReader struct {
+	fd      int
+	pending []byte
+}
+
+func (reader *kmsgReader) Read(p []byte) (int, error) {
+	// Each read returns a single record and fails if the buffer is too small for it
+	for len(reader.pending) == 0 {
+		buf := make([]byte, 8192)
+
+		n, err := unix.Read(reader.fd, buf)
+		switch {
+		case err == unix.EPIPE:
+			// Some records were overwritten before we've read them
+			continue
+		case err == unix.EAGAIN:
+			return 0, io.EOF
+		case err != nil:
+			return 0, err
+		case n <= 0:
+			return 0, io.EOF
+		}
+
+		reader.pending = buf[:n]
+	}
+
+	n := copy(p, reader.pending)
+	reader.pending = reader.pending[n:]
+
+	return n, nil
+}
+
+func (reader *kmsgReader) Close() error {
+	return unix.Close(reader.fd)
+}
@@ -0,0 +1,129 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func withFakeKernelLog(t *testing.T, kernelLog func() string) {
+	previousOpenKernelLog := openKernelLog
+	openKernelLog = func() (io.ReadCloser, error) {
+		return io.NopCloser(strings.NewReader(kernelLog())), nil
+	}
+	t.Cleanup(func() {
+		openKernelLog = previousOpenKernelLog
+	})
+}
+
+func withFakeCgroup(t *testing.T, memoryEventsPath string) {
+	previousCgroupMemoryEventsPath := cgroupMemoryEventsPath
+	cgroupMemoryEventsPath = func() string {
+		return memoryEventsPath
+	}
+	t.Cleanup(func() {
+		cgroupMemoryEventsPath = previousCgroupMemoryEventsPath
+	})
+}
+
+func withFastOOMDetectorPolling(t *testing.T) {
+	previousPollInterval := oomDetectorPollInterval
+	oomDetectorPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() {
+		oomDetectorPollInterval = previousPollInterval
+	})
+}
+
+func TestOOMKilledScriptIsReported(t *testing.T) {
+	withFastOOMDetectorPolling(t)
+
+	fake := &fakeCirrusClient{logStreamCapacities: []int{-1}}
+	withFakeClient(t, fake)
+
+	// The victim is the process started by the script below
+	pidFile := filepath.Join(testutil.TempDir(t), "victim.pid")
+
+	// Far in the future relative to the boot time
+	withFakeKernelLog(t, func() string {
+		pid, _ := os.ReadFile(pidFile)
+		return fmt.Sprintf("3,1,%d,-;Out of memory: Killed process %s (sleep) anon-rss:2048kB\n",
+			int64(1)<<50, strings.TrimSpace(string(pid)))
+	})
+	withFakeCgroup(t, "")
+
+	executor := newTestArtifactsExecutor()
+
+	stepResult, err := executor.performStep(context.Background(), scriptCommand("test",
+		"sleep 30 &", "echo $! > "+pidFile, "sleep 0.5", "kill -9 $!", "exit 137"))
+	require.NoError(t, err)
+	assert.False(t, stepResult.Success)
+	require.NotNil(t, stepResult.Outcome)
+	assert.True(t, stepResult.Outcome.OOMKilled)
+	assert.Regexp(t, `!!! Process 'sleep' \(PID \d+\) was killed by the OOM killer \(peak usage ~2.1 MB\) !!!`,
+		fake.CommandLogs("test"))
+}
+
+func TestUnrelatedOOMKillsAreNotReported(t *testing.T) {
+	withFastOOMDetectorPolling(t)
+
+	fake := &fakeCirrusClient{logStreamCapacities: []int{-1}}
+	withFakeClient(t, fake)
+
+	// The victim is the agent itself, which is surely not a part of the command
+	withFakeKernelLog(t, func() string {
+		return fmt.Sprintf("3,1,%d,-;Out of memory: Killed process %d (agent) anon-rss:2048kB\n",
+			int64(1)<<50, os.Getpid())
+	})
+
+	// ...even though the kill is accounted in the shared cgroup
+	memoryEventsPath := filepath.Join(testutil.TempDir(t), "memory.events")
+	require.NoError(t, os.WriteFile(memoryEventsPath, []byte("oom_kill 1\n"), 0600))
+	withFakeCgroup(t, memoryEventsPath)
+
+	stepResult, err := newTestArtifactsExecutor().performStep(context.Background(), scriptCommand("test",
+		"echo oom_kill 2 > "+memoryEventsPath, "sleep 0.5", "exit 137"))
+	require.NoError(t, err)
+	assert.False(t, stepResult.Success)
+	assert.False(t, stepResult.Outcome.OOMKilled)
+	assert.NotContains(t, fake.CommandLogs("test"), "OOM killer")
+}
+
+func TestOOMDetectorCgroupFallback(t *testing.T) {
+	withFakeKernelLog(t, func() string {
+		return "6,1,1,-;an unrelated record\n"
+	})
+
+	memoryEventsPath := filepath.Join(testutil.TempDir(t), "memory.events")
+	require.NoError(t, os.WriteFile(memoryEventsPath, []byte("oom 1\noom_kill 1\n"), 0600))
+	withFakeCgroup(t, memoryEventsPath)
+
+	detector := newOOMDetector()
+	assert.Nil(t, detector.Detect(os.Getpid()))
+
+	require.NoError(t, os.WriteFile(memoryEventsPath, []byte("oom 2\noom_kill 2\n"), 0600))
+	assert.Equal(t, &oomKill{}, detector.Detect(os.Getpid()))
+}
+
+func TestSucceededScriptIsNotCheckedForOOMKills(t *testing.T) {
+	fake := &fakeCirrusClient{logStreamCapacities: []int{-1}}
+	withFakeClient(t, fake)
+
+	withFakeKernelLog(t, func() string {
+		return fmt.Sprintf("3,1,%d,-;Out of memory: Killed process 4242 (java)\n", int64(1)<<50)
+	})
+	withFakeCgroup(t, "")
+
+	stepResult, err := newTestArtifactsExecutor().performStep(context.Background(), scriptCommand("test", "true"))
+	require.NoError(t, err)
+	assert.True(t, stepResult.Success)
+	assert.False(t, stepResult.Outcome.OOMKilled)
+	assert.NotContains(t, fake.CommandLogs("test"), "OOM killer")
+}
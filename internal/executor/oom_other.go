@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package executor
+
+// oomDetector is only supported on Linux.
+type oomDetector struct{}
+
+func newOOMDetector() *oomDetector {
+	return nil
+}
+
+func (detector *oomDetector) Stop() {}
+
+func (detector *oomDetector) Detect(commandPID int) *oomKill {
+	return nil
+}
@@ -0,0 +1,44 @@
+package executor
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseKernelLogOOMKills(t *testing.T) {
+	kernelLog := strings.Join([]string{
+		"6,100,1000000,-;Out of memory: Killed process 10 (old) total-vm:1000kB, anon-rss:500kB, file-rss:0kB",
+		"6,101,5000000,-;eth0: link up",
+		"3,102,6000000,-;Out of memory: Killed process 1234 (stress) total-vm:2085036kB, " +
+			"anon-rss:1964172kB, file-rss:4kB, shmem-rss:0kB, UID:0 pgtables:3900kB oom_score_adj:0",
+		" SUBSYSTEM=memory",
+		"6,103,7000000,-;node invoked oom-killer",
+	}, "\n")
+
+	kills := parseKernelLogOOMKills(strings.NewReader(kernelLog), 2*time.Second)
+	assert.Equal(t, []*oomKill{{PID: 1234, Process: "stress", AnonRSS: 1964172 * 1024}}, kills)
+	assert.Equal(t, "!!! Process 'stress' (PID 1234) was killed by the OOM killer (peak usage ~2.0 GB) !!!",
+		kills[0].Message(0))
+
+	assert.Len(t, parseKernelLogOOMKills(strings.NewReader(kernelLog), 0), 2)
+
+	// Only the records logged after the command has started count
+	assert.Empty(t, parseKernelLogOOMKills(strings.NewReader(kernelLog), 10*time.Second))
+}
+
+func TestParseCgroupOOMKills(t *testing.T) {
+	oomKills, ok := parseCgroupOOMKills(strings.NewReader("low 0\nhigh 0\nmax 12\noom 2\noom_kill 2\n"))
+	assert.True(t, ok)
+	assert.EqualValues(t, 2, oomKills)
+
+	_, ok = parseCgroupOOMKills(strings.NewReader("low 0\n"))
+	assert.False(t, ok)
+}
+
+func TestOOMKillMessageWithoutDetails(t *testing.T) {
+	assert.Equal(t, "!!! Process was killed by the OOM killer !!!", (&oomKill{}).Message(0))
+	assert.Equal(t, "!!! Process was killed by the OOM killer (peak usage ~1.0 GB) !!!",
+		(&oomKill{}).Message(1000*1000*1000))
+}
@@ -0,0 +1,158 @@
+package executor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dustin/go-humanize"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// CommandOutcome summarizes how a script command has finished.
+type CommandOutcome struct {
+	Name     string
+	Duration time.Duration
+
+	// Only meaningful when the process has actually exited
+	Exited     bool
+	ExitCode   int
+	Signal     syscall.Signal
+	Signaled   bool
+	UserTime   time.Duration
+	SystemTime time.Duration
+
+	// Zero when not supported by the platform
+	MaxRSS      uint64
+	BlockInput  uint64
+	BlockOutput uint64
+
+	// The command or one of its children was killed by the OOM killer
+	OOMKilled bool
+
+	TimedOut  bool
+	Cancelled bool
+	StartErr  error
+
+	// Non-zero when the command was killed for not producing any output for this long
+	NoOutputFor time.Duration
+}
+
+// NewCommandOutcome derives the command outcome from the results of ShellCommandsAndWait().
+func NewCommandOutcome(
+	ctx context.Context,
+	name string,
+	cmd *exec.Cmd,
+	err error,
+	duration time.Duration,
+) *CommandOutcome {
+	outcome := &CommandOutcome{
+		Name:     name,
+		Duration: duration,
+	}
+
+	if errors.Is(err, TimeOutError) {
+		if errors.Is(ctx.Err(), context.Canceled) {
+			outcome.Cancelled = true
+		} else {
+			outcome.TimedOut = true
+		}
+
+		return outcome
+	}
+
+	var noOutputErr *NoOutputTimeoutError
+	if errors.As(err, &noOutputErr) {
+		outcome.NoOutputFor = noOutputErr.Timeout
+
+		return outcome
+	}
+
+	if err != nil {
+		outcome.StartErr = err
+
+		return outcome
+	}
+
+	if cmd == nil || cmd.ProcessState == nil {
+		return outcome
+	}
+
+	outcome.Exited = true
+	outcome.ExitCode = cmd.ProcessState.ExitCode()
+	outcome.UserTime = cmd.ProcessState.UserTime()
+	outcome.SystemTime = cmd.ProcessState.SystemTime()
+	fillResourceUsage(outcome, cmd.ProcessState)
+
+	if ws, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		outcome.Signaled = true
+		outcome.Signal = ws.Signal()
+	}
+
+	return outcome
+}
+
+// Footer returns a single line summary that is appended to the command's log.
+//
+// Please keep the format stable since people might rely on it when grepping the logs,
+// e.g. "Command 'test' exited with 1 after 3m42s (user 2m1s, system 4.2s, max RSS 1.2 GB)".
+func (outcome *CommandOutcome) Footer() string {
+	duration := formatFooterDuration(outcome.Duration)
+
+	switch {
+	case outcome.TimedOut:
+		return fmt.Sprintf("Command '%s' timed out after %s", outcome.Name, duration)
+	case outcome.NoOutputFor != 0:
+		return fmt.Sprintf("Command '%s' was killed after %s: no output for %s, assuming hung", outcome.Name,
+			duration, formatFooterDuration(outcome.NoOutputFor))
+	case outcome.Cancelled:
+		return fmt.Sprintf("Command '%s' was cancelled after %s", outcome.Name, duration)
+	case outcome.StartErr != nil:
+		return fmt.Sprintf("Command '%s' failed to start after %s: %v", outcome.Name, duration, outcome.StartErr)
+	case !outcome.Exited:
+		return fmt.Sprintf("Command '%s' finished after %s", outcome.Name, duration)
+	}
+
+	var result string
+
+	if outcome.Signaled {
+		result = fmt.Sprintf("Command '%s' was killed by signal %d (%v) after %s",
+			outcome.Name, int(outcome.Signal), outcome.Signal, duration)
+	} else {
+		result = fmt.Sprintf("Command '%s' exited with %d after %s", outcome.Name, outcome.ExitCode, duration)
+	}
+
+	var usage []string
+
+	if outcome.UserTime != 0 || outcome.SystemTime != 0 {
+		usage = append(usage, fmt.Sprintf("user %s", formatFooterDuration(outcome.UserTime)),
+			fmt.Sprintf("system %s", formatFooterDuration(outcome.SystemTime)))
+	}
+	if outcome.MaxRSS != 0 {
+		usage = append(usage, fmt.Sprintf("max RSS %s", humanize.Bytes(outcome.MaxRSS)))
+	}
+	if outcome.BlockInput != 0 || outcome.BlockOutput != 0 {
+		usage = append(usage, fmt.Sprintf("disk read %s", humanize.Bytes(outcome.BlockInput)),
+			fmt.Sprintf("disk written %s", humanize.Bytes(outcome.BlockOutput)))
+	}
+
+	if len(usage) != 0 {
+		result += fmt.Sprintf(" (%s)", strings.Join(usage, ", "))
+	}
+
+	return result
+}
+
+func formatFooterDuration(duration time.Duration) string {
+	if duration < time.Second {
+		return duration.Round(time.Millisecond).String()
+	}
+
+	if duration < time.Minute {
+		return duration.Round(100 * time.Millisecond).String()
+	}
+
+	return duration.Round(time.Second).String()
+}
@@ -0,0 +1,33 @@
+//go:build !windows
+// +build !windows
+
+package executor
+
+import (
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// fillResourceUsage populates the metrics that are only available from the rusage
+// structure returned by wait4(2). Note that these also cover the descendant processes
+// that were waited for by the shell, but not the ones that were orphaned.
+func fillResourceUsage(outcome *CommandOutcome, state *os.ProcessState) {
+	rusage, ok := state.SysUsage().(*syscall.Rusage)
+	if !ok || rusage == nil {
+		return
+	}
+
+	// macOS reports the maximum resident set size in bytes, while other systems in kilobytes
+	if runtime.GOOS == "darwin" {
+		outcome.MaxRSS = uint64(rusage.Maxrss)
+	} else {
+		outcome.MaxRSS = uint64(rusage.Maxrss) * 1024
+	}
+
+	// Only Linux reports the block I/O in 512-byte units, other systems count the operations
+	if runtime.GOOS == "linux" {
+		outcome.BlockInput = uint64(rusage.Inblock) * 512
+		outcome.BlockOutput = uint64(rusage.Oublock) * 512
+	}
+}
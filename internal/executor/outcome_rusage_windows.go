@@ -0,0 +1,6 @@
+package executor
+
+import "os"
+
+// fillResourceUsage is a no-op on Windows, where only the CPU times are available.
+func fillResourceUsage(outcome *CommandOutcome, state *os.ProcessState) {}
@@ -0,0 +1,90 @@
+package executor
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os/exec"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestCommandOutcomeFooter(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Outcome  CommandOutcome
+		Expected string
+	}{
+		{
+			"exited",
+			CommandOutcome{Name: "test", Duration: 3*time.Minute + 42*time.Second + 300*time.Millisecond,
+				Exited: true, ExitCode: 1},
+			"Command 'test' exited with 1 after 3m42s",
+		},
+		{
+			"exited with CPU time",
+			CommandOutcome{Name: "build", Duration: 1500 * time.Millisecond, Exited: true,
+				UserTime: 1200 * time.Millisecond, SystemTime: 5 * time.Millisecond},
+			"Command 'build' exited with 0 after 1.5s (user 1.2s, system 5ms)",
+		},
+		{
+			"exited with resource usage",
+			CommandOutcome{Name: "build", Duration: 2 * time.Second, Exited: true,
+				UserTime: time.Second, SystemTime: time.Second, MaxRSS: 120 * 1000 * 1000,
+				BlockInput: 4096, BlockOutput: 3 * 1000 * 1000},
+			"Command 'build' exited with 0 after 2s (user 1s, system 1s, max RSS 120 MB, " +
+				"disk read 4.1 kB, disk written 3.0 MB)",
+		},
+		{
+			"timed out",
+			CommandOutcome{Name: "test", Duration: time.Hour, TimedOut: true},
+			"Command 'test' timed out after 1h0m0s",
+		},
+		{
+			"no output",
+			CommandOutcome{Name: "test", Duration: 11 * time.Minute, NoOutputFor: 10 * time.Minute},
+			"Command 'test' was killed after 11m0s: no output for 10m0s, assuming hung",
+		},
+		{
+			"cancelled",
+			CommandOutcome{Name: "test", Duration: 10 * time.Second, Cancelled: true},
+			"Command 'test' was cancelled after 10s",
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+
+		t.Run(testCase.Name, func(t *testing.T) {
+			assert.Equal(t, testCase.Expected, testCase.Outcome.Footer())
+		})
+	}
+}
+
+func TestNewCommandOutcome(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("relies on Unix shell")
+	}
+
+	cmd, err := ShellCommandsAndWait(context.Background(), []string{"exit 3"}, nil,
+		func(bytes []byte) (int, error) { return len(bytes), nil }, false)
+	require.NoError(t, err)
+
+	outcome := NewCommandOutcome(context.Background(), "fail", cmd, err, time.Second)
+	assert.True(t, outcome.Exited)
+	assert.Equal(t, 3, outcome.ExitCode)
+	assert.Contains(t, outcome.Footer(), "Command 'fail' exited with 3 after 1s")
+	if runtime.GOOS == "linux" || runtime.GOOS == "darwin" {
+		assert.NotZero(t, outcome.MaxRSS)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	<-ctx.Done()
+	assert.True(t, NewCommandOutcome(ctx, "slow", &exec.Cmd{}, TimeOutError, time.Second).TimedOut)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	assert.True(t, NewCommandOutcome(ctx, "slow", &exec.Cmd{}, TimeOutError, time.Second).Cancelled)
+}
@@ -0,0 +1,31 @@
+//go:build !windows && !openbsd && !netbsd
+// +build !windows,!openbsd,!netbsd
+
+package executor
+
+import (
+	"fmt"
+	"github.com/mitchellh/go-ps"
+	"syscall"
+)
+
+// processGroupMembers describes the processes that belong to the process group.
+func processGroupMembers(pgid int) []string {
+	processes, err := ps.Processes()
+	if err != nil {
+		return nil
+	}
+
+	var result []string
+
+	for _, process := range processes {
+		processPgid, err := syscall.Getpgid(process.Pid())
+		if err != nil || processPgid != pgid {
+			continue
+		}
+
+		result = append(result, fmt.Sprintf("%s (PID %d)", process.Executable(), process.Pid()))
+	}
+
+	return result
+}
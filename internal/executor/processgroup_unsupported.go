@@ -0,0 +1,8 @@
+//go:build openbsd || netbsd
+// +build openbsd netbsd
+
+package executor
+
+func processGroupMembers(pgid int) []string {
+	return nil
+}
@@ -0,0 +1,193 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultReadinessTimeout  = time.Minute
+	defaultReadinessInterval = time.Second
+
+	// Don't let a single unresponsive attempt eat the whole timeout
+	readinessAttemptTimeout = 5 * time.Second
+)
+
+// readinessCheck is a single thing the command waits for, e.g. a TCP port to accept connections.
+type readinessCheck struct {
+	Target string
+	Check  func(ctx context.Context) error
+}
+
+// readinessChecks parses the comma-separated targets the command waits for before it's run
+// from CIRRUS_WAIT_FOR_<COMMAND>. The "tcp://host:port" targets wait for the port to accept
+// connections, the "http://" and "https://" ones for the URL to return a 2xx status (or the status
+// from CIRRUS_WAIT_FOR_HTTP_STATUS_<COMMAND>) and the "file://path" ones for the path to exist,
+// with relative paths resolved against the CIRRUS_WORKING_DIR.
+func readinessChecks(env map[string]string, commandName string) ([]readinessCheck, error) {
+	name := commandSpecificEnvName("CIRRUS_WAIT_FOR", commandName)
+
+	var expectedStatus int
+	statusName := commandSpecificEnvName("CIRRUS_WAIT_FOR_HTTP_STATUS", commandName)
+	if value := env[statusName]; value != "" {
+		var err error
+		expectedStatus, err = strconv.Atoi(value)
+		if err != nil || expectedStatus < 100 || expectedStatus > 999 {
+			return nil, fmt.Errorf("%s should be an HTTP status code, got %q", statusName, value)
+		}
+	}
+
+	var result []readinessCheck
+
+	for _, target := range strings.Split(env[name], ",") {
+		target = strings.TrimSpace(target)
+		if target == "" {
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(target, "tcp://"):
+			address := strings.TrimPrefix(target, "tcp://")
+			result = append(result, readinessCheck{Target: target, Check: func(ctx context.Context) error {
+				return checkTCPReadiness(ctx, address)
+			}})
+		case strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://"):
+			url := target
+			result = append(result, readinessCheck{Target: target, Check: func(ctx context.Context) error {
+				return checkHTTPReadiness(ctx, url, expectedStatus)
+			}})
+		case strings.HasPrefix(target, "file://"):
+			path := strings.TrimPrefix(target, "file://")
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(env["CIRRUS_WORKING_DIR"], path)
+			}
+			result = append(result, readinessCheck{Target: target, Check: func(ctx context.Context) error {
+				_, err := os.Stat(path)
+				return err
+			}})
+		default:
+			return nil, fmt.Errorf("%s contains %q, which is not a tcp://, http://, https:// or file:// target",
+				name, target)
+		}
+	}
+
+	return result, nil
+}
+
+// readinessTimings returns how long to wait for all the targets in total and how often to check them,
+// configured via CIRRUS_WAIT_FOR_TIMEOUT_<COMMAND> and CIRRUS_WAIT_FOR_INTERVAL_<COMMAND> Go durations.
+func readinessTimings(env map[string]string, commandName string) (time.Duration, time.Duration, error) {
+	parse := func(prefix string, defaultValue time.Duration) (time.Duration, error) {
+		name := commandSpecificEnvName(prefix, commandName)
+
+		value := env[name]
+		if value == "" {
+			return defaultValue, nil
+		}
+
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration <= 0 {
+			return 0, fmt.Errorf("%s should be a positive duration, got %q", name, value)
+		}
+
+		return duration, nil
+	}
+
+	timeout, err := parse("CIRRUS_WAIT_FOR_TIMEOUT", defaultReadinessTimeout)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	interval, err := parse("CIRRUS_WAIT_FOR_INTERVAL", defaultReadinessInterval)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return timeout, interval, nil
+}
+
+// waitForReadiness waits for the targets configured for the command (see readinessChecks())
+// one after another, failing once the overall timeout is reached.
+func waitForReadiness(ctx context.Context, output io.Writer, env map[string]string, commandName string) error {
+	checks, err := readinessChecks(env, commandName)
+	if err != nil || len(checks) == 0 {
+		return err
+	}
+
+	timeout, interval, err := readinessTimings(env, commandName)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for _, check := range checks {
+		_, _ = fmt.Fprintf(output, "Waiting for %s...\n", check.Target)
+
+		start := time.Now()
+
+		for {
+			attemptCtx, attemptCancel := context.WithTimeout(ctx, readinessAttemptTimeout)
+			err := check.Check(attemptCtx)
+			attemptCancel()
+
+			if err == nil {
+				_, _ = fmt.Fprintf(output, "%s is ready after %s\n", check.Target,
+					formatFooterDuration(time.Since(start)))
+				break
+			}
+
+			select {
+			case <-time.After(interval):
+			case <-ctx.Done():
+				return fmt.Errorf("timed out after %s waiting for %s: %v", timeout, check.Target, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func checkTCPReadiness(ctx context.Context, address string) error {
+	var dialer net.Dialer
+
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
+
+// checkHTTPReadiness succeeds when the URL returns the expectedStatus, or any 2xx status if it's zero.
+func checkHTTPReadiness(ctx context.Context, url string, expectedStatus int) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, response.Body)
+	_ = response.Body.Close()
+
+	if expectedStatus != 0 && response.StatusCode != expectedStatus {
+		return fmt.Errorf("got HTTP status %d instead of %d", response.StatusCode, expectedStatus)
+	}
+	if expectedStatus == 0 && (response.StatusCode < 200 || response.StatusCode > 299) {
+		return fmt.Errorf("got HTTP status %d", response.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,102 @@
+package executor
+
+import (
+	"context"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWaitForReadiness(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	// Becomes healthy after a couple of requests
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if atomic.AddInt32(&requests, 1) < 3 {
+			writer.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		writer.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	workingDir := testutil.TempDir(t)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_ = os.WriteFile(filepath.Join(workingDir, "ready"), nil, 0600)
+	}()
+
+	env := map[string]string{
+		"CIRRUS_WORKING_DIR":                workingDir,
+		"CIRRUS_WAIT_FOR_TESTS":             "tcp://" + listener.Addr().String() + ", " + server.URL + ", file://ready",
+		"CIRRUS_WAIT_FOR_HTTP_STATUS_TESTS": "204",
+		"CIRRUS_WAIT_FOR_INTERVAL_TESTS":    "10ms",
+	}
+
+	var output lockedBuffer
+	require.NoError(t, waitForReadiness(context.Background(), &output, env, "tests"))
+	assert.Contains(t, output.String(), "tcp://"+listener.Addr().String()+" is ready after")
+	assert.Contains(t, output.String(), server.URL+" is ready after")
+	assert.Contains(t, output.String(), "file://ready is ready after")
+	assert.EqualValues(t, 3, atomic.LoadInt32(&requests))
+}
+
+func TestWaitForReadinessTimeout(t *testing.T) {
+	env := map[string]string{
+		"CIRRUS_WORKING_DIR":             testutil.TempDir(t),
+		"CIRRUS_WAIT_FOR_TESTS":          "file://never",
+		"CIRRUS_WAIT_FOR_TIMEOUT_TESTS":  "100ms",
+		"CIRRUS_WAIT_FOR_INTERVAL_TESTS": "10ms",
+	}
+
+	var output lockedBuffer
+	err := waitForReadiness(context.Background(), &output, env, "tests")
+	require.Error(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "timed out after 100ms waiting for file://never"), err.Error())
+}
+
+func TestReadinessChecksValidation(t *testing.T) {
+	_, err := readinessChecks(map[string]string{"CIRRUS_WAIT_FOR_TESTS": "localhost:5432"}, "tests")
+	assert.Error(t, err)
+
+	_, err = readinessChecks(map[string]string{
+		"CIRRUS_WAIT_FOR_TESTS":             "http://localhost",
+		"CIRRUS_WAIT_FOR_HTTP_STATUS_TESTS": "ok",
+	}, "tests")
+	assert.Error(t, err)
+
+	checks, err := readinessChecks(map[string]string{}, "tests")
+	require.NoError(t, err)
+	assert.Empty(t, checks)
+}
+
+func TestReadinessFailsCommand(t *testing.T) {
+	fake := &fakeCirrusClient{logStreamCapacities: []int{-1}}
+	withFakeClient(t, fake)
+
+	executor := newTestArtifactsExecutor()
+	executor.env = map[string]string{
+		"CIRRUS_WORKING_DIR":            testutil.TempDir(t),
+		"CIRRUS_WAIT_FOR_MAIN":          "file://never",
+		"CIRRUS_WAIT_FOR_TIMEOUT_MAIN":  "50ms",
+		"CIRRUS_WAIT_FOR_INTERVAL_MAIN": "10ms",
+	}
+
+	stepResult, err := executor.performStep(context.Background(), scriptCommand("main", "echo unreachable"))
+	require.NoError(t, err)
+	assert.False(t, stepResult.Success)
+	assert.Contains(t, fake.CommandLogs("main"), "Failing the command: timed out after 50ms waiting for file://never")
+	assert.NotContains(t, fake.CommandLogs("main"), "unreachable")
+}
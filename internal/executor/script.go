@@ -0,0 +1,90 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+type scriptResult struct {
+	Success        bool
+	SignaledToExit bool
+
+	// Succeeded only after being retried
+	Flaky bool
+
+	// How many times the script was run, including the retries
+	Attempts int
+
+	// How the last attempt has finished
+	Outcome *CommandOutcome
+}
+
+// executeScriptCommand runs the script command, re-running it on failure
+// if the command is configured to be retried. Only the last attempt
+// determines whether the command has succeeded.
+func (executor *Executor) executeScriptCommand(
+	ctx context.Context,
+	logUploader *LogUploader,
+	commandName string,
+	scripts []string,
+) scriptResult {
+	retries, retryDelay, err := commandRetries(executor.env, commandName)
+	if err != nil {
+		_, _ = fmt.Fprintf(logUploader, "Not retrying the command: %v\n", err)
+	}
+
+	var result scriptResult
+
+	env, err := scriptEnv(logUploader, executor.env, commandName, executor.sensitiveValues)
+	if err != nil {
+		_, _ = fmt.Fprintf(logUploader, "%v\n", err)
+		return result
+	}
+
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 {
+			_, _ = fmt.Fprintf(logUploader, "\nAttempt %d of %d\n", attempt, retries+1)
+		}
+
+		result.Attempts = attempt
+		scriptStart := time.Now()
+		oomDetector := newOOMDetector()
+		cmd, err := executor.ExecuteScriptsStreamLogsAndWait(ctx, logUploader, commandName, scripts, env)
+		oomDetector.Stop()
+		result.Success = err == nil && cmd.ProcessState.Success()
+		result.Outcome = NewCommandOutcome(ctx, commandName, cmd, err, time.Since(scriptStart))
+		result.SignaledToExit = result.Outcome.Signaled
+
+		// The OOM killer might have killed one of the children, which the shell
+		// then reports as an ordinary failure (e.g. exit code 137)
+		if result.Outcome.Exited && !result.Success {
+			if kill := oomDetector.Detect(cmd.Process.Pid); kill != nil {
+				result.Outcome.OOMKilled = true
+				_, _ = fmt.Fprintf(logUploader, "\n%s\n", kill.Message(result.Outcome.MaxRSS))
+			}
+		}
+		if !result.Success {
+			if hint := lowDiskSpaceHint(env); hint != "" {
+				_, _ = fmt.Fprintf(logUploader, "\n%s\n", hint)
+			}
+		}
+		_, _ = fmt.Fprintf(logUploader, "\n%s\n", result.Outcome.Footer())
+
+		if result.Success {
+			result.Flaky = attempt > 1
+			return result
+		}
+
+		// Only retry the commands that ran to completion and failed
+		if err != nil || attempt > retries {
+			return result
+		}
+
+		select {
+		case <-time.After(retryDelay):
+		case <-ctx.Done():
+			return result
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package executor
+
+import (
+	"context"
+	"github.com/cirruslabs/cirrus-ci-agent/api"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func scriptCommand(name string, scripts ...string) *api.Command {
+	return &api.Command{
+		Name: name,
+		Instruction: &api.Command_ScriptInstruction{
+			ScriptInstruction: &api.ScriptInstruction{Scripts: scripts},
+		},
+	}
+}
+
+func TestScriptRetriesUntilSuccess(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("relies on the POSIX shell")
+	}
+
+	fake := &fakeCirrusClient{logStreamCapacities: []int{-1}}
+	withFakeClient(t, fake)
+
+	// Fails on the first two attempts
+	counter := filepath.Join(testutil.TempDir(t), "attempts")
+
+	executor := newTestArtifactsExecutor()
+	executor.env = map[string]string{"CIRRUS_RETRIES_FLAKY": "2"}
+
+	stepResult, err := executor.performStep(context.Background(), scriptCommand("flaky",
+		"echo attempt >> "+counter, "test $(wc -l < "+counter+") -ge 3"))
+	require.NoError(t, err)
+	assert.True(t, stepResult.Success)
+	assert.True(t, stepResult.Flaky)
+
+	logs := fake.Logs()
+	assert.Contains(t, logs, "Attempt 2 of 3")
+	assert.Contains(t, logs, "Attempt 3 of 3")
+	assert.Equal(t, 2, strings.Count(logs, "Command 'flaky' exited with 1"))
+	assert.Equal(t, 1, strings.Count(logs, "Command 'flaky' exited with 0"))
+}
+
+func TestScriptOutcomeIsReported(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("relies on the POSIX shell")
+	}
+
+	fake := &fakeCirrusClient{logStreamCapacities: []int{-1, -1}}
+	withFakeClient(t, fake)
+
+	executor := newTestArtifactsExecutor()
+
+	stepResult, err := executor.performStep(context.Background(), scriptCommand("fail", "exit 42"))
+	require.NoError(t, err)
+	assert.False(t, stepResult.Success)
+	require.NotNil(t, stepResult.Outcome)
+	assert.True(t, stepResult.Outcome.Exited)
+	assert.Equal(t, 42, stepResult.Outcome.ExitCode)
+	assert.False(t, stepResult.SignaledToExit)
+
+	stepResult, err = executor.performStep(context.Background(), scriptCommand("killed", "kill -9 $$"))
+	require.NoError(t, err)
+	assert.False(t, stepResult.Success)
+	require.NotNil(t, stepResult.Outcome)
+	assert.True(t, stepResult.Outcome.Signaled)
+	assert.True(t, stepResult.SignaledToExit)
+	assert.Contains(t, fake.CommandLogs("killed"), "Command 'killed' was killed by signal 9 (killed)")
+}
+
+func TestScriptRetriesExhausted(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("relies on the POSIX shell")
+	}
+
+	fake := &fakeCirrusClient{logStreamCapacities: []int{-1}}
+	withFakeClient(t, fake)
+
+	executor := newTestArtifactsExecutor()
+	executor.env = map[string]string{"CIRRUS_RETRIES_BROKEN": "1"}
+
+	stepResult, err := executor.performStep(context.Background(), scriptCommand("broken", "exit 3"))
+	require.NoError(t, err)
+	assert.False(t, stepResult.Success)
+	assert.False(t, stepResult.Flaky)
+	assert.Contains(t, fake.Logs(), "Attempt 2 of 2")
+	assert.NotContains(t, fake.Logs(), "Attempt 3")
+}
@@ -11,6 +11,8 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -36,10 +38,21 @@ func ShellCommandsAndWait(
 	handler ShellOutputHandler,
 	shouldKillProcesses bool,
 ) (*exec.Cmd, error) {
+	// Both stdout and stderr pass through the handler, so either of them resets the timeout
+	var noOutput <-chan struct{}
+	noOutputTimeout, ok := noOutputTimeoutFromEnv(custom_env)
+	if ok {
+		watchdog := newNoOutputWatchdog(handler, noOutputTimeout)
+		defer watchdog.Stop()
+		handler = watchdog.Handler
+		noOutput = watchdog.Fired()
+	}
+
 	sc, err := NewShellCommands(ctx, scripts, custom_env, handler)
 	if err != nil {
 		return nil, err
 	}
+	defer sc.removeScriptFile()
 
 	cmd := sc.cmd
 
@@ -58,43 +71,82 @@ func ShellCommandsAndWait(
 		}
 	}()
 
-	select {
-	case <-ctx.Done():
-		handler([]byte("\nTimed out!"))
+	var timeoutWarning <-chan time.Time
+	timeoutWarningSettings, ok := timeoutWarningSettingsFromEnv(custom_env)
+	if ok {
+		var stopTimeoutWarning func()
+		timeoutWarning, stopTimeoutWarning = timeoutWarningTimer(ctx, timeoutWarningSettings)
+		defer stopTimeoutWarning()
+	}
 
-		processdumper.Dump()
+	// The diagnostics are collected in the background, so that they can't delay the timeout handling,
+	// and are cut short if the command finishes in the meantime
+	warningCtx, cancelWarning := context.WithCancel(ctx)
+	var warningWG sync.WaitGroup
+	defer func() {
+		cancelWarning()
+		warningWG.Wait()
+	}()
 
-		if err = sc.kill(); err != nil {
-			handler([]byte(fmt.Sprintf("\nFailed to kill a timed out shell session: %s", err)))
-		}
+	for {
+		select {
+		case <-timeoutWarning:
+			// Only warn once
+			timeoutWarning = nil
 
-		return cmd, TimeOutError
-	case <-done:
-		var forcePiperClosure bool
+			warningWG.Add(1)
+			go func() {
+				defer warningWG.Done()
+				sc.warnAboutTimeout(warningCtx, timeoutWarningSettings, custom_env, handler)
+			}()
+		case <-ctx.Done():
+			handler([]byte("\nTimed out!"))
 
-		if shouldKillProcesses {
-			_ = sc.kill()
-		} else {
-			forcePiperClosure = true
-		}
+			processdumper.Dump()
 
-		if err := sc.piper.Close(ctx, forcePiperClosure); err != nil {
-			handler([]byte(fmt.Sprintf("\nShell session I/O error: %s", err)))
-		}
+			if err = sc.terminate(terminationSettingsFromEnv(custom_env), handler); err != nil {
+				handler([]byte(fmt.Sprintf("\nFailed to kill a timed out shell session: %s", err)))
+			}
+
+			return cmd, TimeOutError
+		case <-noOutput:
+			handler([]byte(fmt.Sprintf("\nNo output for %s, assuming hung!", formatFooterDuration(noOutputTimeout))))
 
-		if ws, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok {
-			if ws.Signaled() {
-				message := fmt.Sprintf("\nSignaled to exit (%v)!", ws.Signal())
-				handler([]byte(message))
+			processdumper.Dump()
+
+			if err = sc.terminate(terminationSettingsFromEnv(custom_env), handler); err != nil {
+				handler([]byte(fmt.Sprintf("\nFailed to kill a hung shell session: %s", err)))
 			}
-			exitStatus := ws.ExitStatus()
-			if exitStatus > 1 {
-				handler([]byte(fmt.Sprintf("\nExit status: %d", exitStatus)))
+
+			return cmd, &NoOutputTimeoutError{Timeout: noOutputTimeout}
+		case <-done:
+			var forcePiperClosure bool
+
+			if shouldKillProcesses {
+				_ = sc.kill()
+			} else {
+				_ = sc.release()
+				forcePiperClosure = true
+			}
+
+			if err := sc.piper.Close(ctx, forcePiperClosure); err != nil {
+				handler([]byte(fmt.Sprintf("\nShell session I/O error: %s", err)))
 			}
-		} else {
-			log.Printf("Failed to get wait status: %v", cmd.ProcessState.Sys())
+
+			if ws, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok {
+				if ws.Signaled() {
+					message := fmt.Sprintf("\nSignaled to exit (%v)!", ws.Signal())
+					handler([]byte(message))
+				}
+				exitStatus := ws.ExitStatus()
+				if exitStatus > 1 {
+					handler([]byte(fmt.Sprintf("\nExit status: %d", exitStatus)))
+				}
+			} else {
+				log.Printf("Failed to get wait status: %v", cmd.ProcessState.Sys())
+			}
+			return cmd, nil
 		}
-		return cmd, nil
 	}
 }
 
@@ -111,6 +163,12 @@ func NewShellCommands(
 	cmd, scriptFile, err = createCmd(scripts, custom_env)
 
 	sc := &ShellCommands{cmd: cmd}
+	if scriptFile != nil {
+		sc.scriptFile = scriptFile.Name()
+	}
+	if custom_env != nil {
+		_, sc.escapingProcesses = (*custom_env)["CIRRUS_ESCAPING_PROCESSES"]
+	}
 
 	if scriptFile != nil {
 		sigs := make(chan os.Signal, 1)
@@ -129,13 +187,20 @@ func NewShellCommands(
 
 	env := os.Environ()
 	if custom_env != nil {
+		if unset, ok := (*custom_env)[commandUnsetEnvName]; ok {
+			env = withoutEnvVariables(env, strings.Split(unset, ","))
+		}
+
 		for k, v := range *custom_env {
+			if commandLauncherEnvNames[k] {
+				continue
+			}
 			env = append(env, fmt.Sprintf("%s=%s", k, v))
 		}
 
 		if _, environmentAlreadyHasShell := os.LookupEnv("SHELL"); environmentAlreadyHasShell {
 			_, userSpecifiedShell := (*custom_env)["SHELL"]
-			if shellOverride, userSpecifiedCustomShell := (*custom_env)["CIRRUS_SHELL"]; userSpecifiedCustomShell && !userSpecifiedShell {
+			if shellOverride, userSpecifiedCustomShell := (*custom_env)["CIRRUS_SHELL"]; userSpecifiedCustomShell && !userSpecifiedShell && !isCustomShell(shellOverride) {
 				env = append(env, fmt.Sprintf("SHELL=%s", shellOverride))
 			}
 		}
@@ -143,7 +208,9 @@ func NewShellCommands(
 
 	cmd.Env = env
 	if custom_env != nil {
-		if workingDir, ok := (*custom_env)["CIRRUS_WORKING_DIR"]; ok {
+		if workingDir, ok := (*custom_env)[commandWorkingDirEnvName]; ok {
+			cmd.Dir = workingDir
+		} else if workingDir, ok := (*custom_env)["CIRRUS_WORKING_DIR"]; ok {
 			EnsureFolderExists(workingDir)
 			cmd.Dir = workingDir
 		}
@@ -160,18 +227,23 @@ func NewShellCommands(
 	// other processes that run in the background
 	sc.piper, err = piper.New(writer)
 	if err != nil {
+		sc.removeScriptFile()
 		return nil, err
 	}
 
 	cmd.Stderr = sc.piper.FileProxy()
 	cmd.Stdout = sc.piper.FileProxy()
 
+	sc.beforeStart()
+
 	err = cmd.Start()
 	if err != nil {
 		if err := sc.piper.Close(ctx, true); err != nil {
 			_, _ = fmt.Fprintf(writer, "Shell session I/O error: %s", err)
 		}
 
+		sc.removeScriptFile()
+
 		message := fmt.Sprintf("Error starting command: %s", err)
 		handler([]byte(message))
 		return nil, errors.New(message)
@@ -187,3 +259,28 @@ func NewShellCommands(
 
 	return sc, nil
 }
+
+// removeScriptFile removes the file the scripts were written to, once the shell is done with it.
+func (sc *ShellCommands) removeScriptFile() {
+	if sc.scriptFile == "" {
+		return
+	}
+
+	if err := os.Remove(sc.scriptFile); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove the script file %s: %v", sc.scriptFile, err)
+	}
+}
+
+// drainOutput waits for the output of the finished (or killed) shell to be fully consumed,
+// giving up after the timeout in case an escaped process still holds the output pipe.
+func (sc *ShellCommands) drainOutput(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := sc.piper.Close(ctx, false)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return sc.piper.Close(context.Background(), true)
+	}
+
+	return err
+}
@@ -5,10 +5,14 @@ package executor
 
 import (
 	"context"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
+	"strings"
 	"testing"
 	"time"
 )
@@ -144,3 +148,103 @@ func TestShellStartFailureDoesNotHang(t *testing.T) {
 
 	require.False(t, success)
 }
+
+func TestTimeoutTerminatesGracefully(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	_, output := ShellCommandsAndGetOutput(ctx, []string{
+		"trap 'echo Flushing coverage data; exit 0' TERM",
+		"sleep 30 & wait",
+	}, nil)
+	assert.Contains(t, output, "Flushing coverage data")
+	assert.NotContains(t, output, "killing")
+}
+
+func TestTimeoutEscalatesToKill(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	_, output := ShellCommandsAndGetOutput(ctx, []string{
+		"trap '' TERM",
+		"sleep 30",
+	}, &map[string]string{"CIRRUS_TERMINATION_GRACE_PERIOD": "1s"})
+	assert.Less(t, time.Since(start), 10*time.Second)
+	assert.Regexp(t, `Still running 1s after sending SIGTERM, killing: .*sleep`, output)
+}
+
+func TestTimeoutWarningCollectsDiagnostics(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, output := ShellCommandsAndGetOutput(ctx, []string{
+		"trap 'echo Dumping stack traces' QUIT",
+		"while true; do sleep 0.1 || true; done",
+	}, &map[string]string{
+		"CIRRUS_TIMEOUT_WARNING_PERIOD": "2s",
+		"CIRRUS_TIMEOUT_WARNING_SIGNAL": "SIGQUIT",
+		"CIRRUS_TIMEOUT_WARNING_SCRIPT": "echo Inspecting $CIRRUS_TIMEOUT_WARNING_PID",
+	})
+	assert.Contains(t, output, "!!! The command is going to time out in")
+	assert.Contains(t, output, "Dumping stack traces")
+	assert.Regexp(t, `Inspecting \d+`, output)
+
+	// The usual timeout handling still applies afterwards
+	assert.Contains(t, output, "Timed out!")
+	assert.Less(t, strings.Index(output, "Dumping stack traces"), strings.Index(output, "Timed out!"))
+}
+
+func TestTimeoutWarningScriptIsCapped(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 6*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	_, output := ShellCommandsAndGetOutput(ctx, []string{
+		"while true; do echo still running; sleep 0.5 || true; done",
+	}, &map[string]string{
+		"CIRRUS_TIMEOUT_WARNING_PERIOD": "4s",
+		"CIRRUS_TIMEOUT_WARNING_SCRIPT": "sleep 30",
+	})
+	assert.Less(t, time.Since(start), 10*time.Second)
+
+	// The hanging script is stopped before the command's deadline
+	scriptStopped := strings.Index(output, "The diagnostic script didn't finish in 2s, stopped it")
+	require.NotEqual(t, -1, scriptStopped, output)
+	assert.Less(t, scriptStopped, strings.LastIndex(output, "Timed out!"))
+
+	// ...while the command keeps running meanwhile
+	assert.Contains(t, output[strings.Index(output, "Running the diagnostic script"):scriptStopped], "still running")
+}
+
+func TestLongScriptsRunViaScriptFile(t *testing.T) {
+	tempDir := testutil.TempDir(t)
+	t.Setenv("TMPDIR", tempDir)
+
+	// Way above what could be passed via the command line on Windows
+	longScript := "echo '" + strings.Repeat("a", 64*1024) + "' | wc -c"
+
+	success, output := ShellCommandsAndGetOutput(context.Background(), []string{longScript, "exit 0"}, nil)
+	assert.True(t, success)
+	assert.Contains(t, output, "65537")
+
+	// The script file is removed afterwards
+	entries, err := os.ReadDir(tempDir)
+	require.NoError(t, err)
+	for _, entry := range entries {
+		assert.False(t, strings.HasPrefix(entry.Name(), scriptFilePrefix), entry.Name())
+	}
+}
+
+func TestScriptsRunInlineWithoutScriptFile(t *testing.T) {
+	t.Setenv("TMPDIR", filepath.Join(testutil.TempDir(t), "non-existent"))
+
+	success, output := ShellCommandsAndGetOutput(context.Background(), []string{"echo 'Foo'", "false", "echo 'Bar'"}, nil)
+	assert.False(t, success)
+	assert.Contains(t, output, "Foo\n")
+	assert.NotContains(t, output, "Bar\n")
+
+	success, output = ShellCommandsAndGetOutput(context.Background(), []string{strings.Repeat("true;", 10*1024)}, nil)
+	assert.False(t, success)
+	assert.Contains(t, output, "too long")
+}
@@ -4,6 +4,7 @@
 package executor
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"github.com/mitchellh/go-ps"
@@ -13,6 +14,7 @@ import (
 	"os/signal"
 	"regexp"
 	"strconv"
+	"sync"
 	"testing"
 	"time"
 )
@@ -81,6 +83,49 @@ func TestJobObjectTermination(t *testing.T) {
 	assert.Nil(t, process)
 }
 
+// TestJobObjectKillOnClose ensures that closing the job handle alone is enough
+// to terminate the whole process tree, which is what happens when the agent dies.
+func TestJobObjectKillOnClose(t *testing.T) {
+	output := &bytes.Buffer{}
+	var outputMutex sync.Mutex
+
+	sc, err := NewShellCommands(context.Background(), []string{os.Args[0]},
+		&map[string]string{"MODE": modeProcessTreeSpawner}, func(data []byte) (int, error) {
+			outputMutex.Lock()
+			defer outputMutex.Unlock()
+			return output.Write(data)
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	re := regexp.MustCompile(".*target PID is ([0-9]+).*")
+	var matches []string
+	for i := 0; i < 100 && len(matches) != 2; i++ {
+		time.Sleep(100 * time.Millisecond)
+		outputMutex.Lock()
+		matches = re.FindStringSubmatch(output.String())
+		outputMutex.Unlock()
+	}
+	if len(matches) != 2 {
+		t.Fatal("failed to find target PID")
+	}
+
+	pid, err := strconv.ParseInt(matches[1], 10, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NoError(t, sc.release())
+
+	// Job object closure is asynchronous
+	time.Sleep(5 * time.Second)
+
+	process, err := ps.FindProcess(int(pid))
+	assert.NoError(t, err)
+	assert.Nil(t, process)
+}
+
 func Test_ShellCommands_Windows(t *testing.T) {
 	test_env := map[string]string{
 		"CIRRUS_WORKING_DIR": "C:\\Windows\\TEMP",
@@ -4,20 +4,100 @@
 package executor
 
 import (
+	"errors"
+	"fmt"
 	"github.com/cirruslabs/cirrus-ci-agent/internal/executor/piper"
 	"os/exec"
+	"strings"
 	"syscall"
+	"time"
 )
 
 type ShellCommands struct {
 	cmd   *exec.Cmd
 	piper *piper.Piper
+
+	// Empty when the scripts are passed via the command line
+	scriptFile string
+
+	// only used on Windows
+	escapingProcesses bool
+}
+
+func (sc *ShellCommands) beforeStart() {
+	// only used on Windows
 }
 
 func (sc *ShellCommands) afterStart() {
 	// only used on Windows
 }
 
+func (sc *ShellCommands) release() error {
+	// only used on Windows
+	return nil
+}
+
 func (sc *ShellCommands) kill() error {
-	return syscall.Kill(-sc.cmd.Process.Pid, syscall.SIGKILL)
+	// The shell runs in its own session, so this also
+	// kills all of the processes it has spawned
+	err := syscall.Kill(-sc.cmd.Process.Pid, syscall.SIGKILL)
+	if errors.Is(err, syscall.ESRCH) {
+		return nil
+	}
+	return err
+}
+
+// processes describes the processes that are still running in the shell's process group.
+func (sc *ShellCommands) processes() []string {
+	return processGroupMembers(sc.cmd.Process.Pid)
+}
+
+// signalDiagnostics asks the processes in the shell's process group to dump their state.
+func (sc *ShellCommands) signalDiagnostics() error {
+	err := syscall.Kill(-sc.cmd.Process.Pid, syscall.SIGQUIT)
+	if errors.Is(err, syscall.ESRCH) {
+		return nil
+	}
+	return err
+}
+
+// terminate gives the processes in the shell's process group a chance to exit
+// gracefully before killing them.
+func (sc *ShellCommands) terminate(settings terminationSettings, handler ShellOutputHandler) error {
+	if settings.GracePeriod == 0 {
+		return sc.kill()
+	}
+
+	pgid := sc.cmd.Process.Pid
+
+	signal := syscall.SIGTERM
+	if settings.Signal == "SIGINT" {
+		signal = syscall.SIGINT
+	}
+
+	if err := syscall.Kill(-pgid, signal); err != nil {
+		if errors.Is(err, syscall.ESRCH) {
+			return nil
+		}
+		return sc.kill()
+	}
+
+	deadline := time.Now().Add(settings.GracePeriod)
+
+	for time.Now().Before(deadline) {
+		if err := syscall.Kill(-pgid, 0); errors.Is(err, syscall.ESRCH) {
+			return nil
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	survivors := sc.processes()
+	if len(survivors) == 0 {
+		survivors = []string{fmt.Sprintf("process group %d", pgid)}
+	}
+	handler([]byte(fmt.Sprintf("\nStill running %s after sending %s, killing: %s", settings.GracePeriod,
+		settings.Signal, strings.Join(survivors, ", "))))
+
+	return sc.kill()
 }
@@ -1,15 +1,58 @@
 package executor
 
 import (
+	"errors"
+	"fmt"
 	"github.com/cirruslabs/cirrus-ci-agent/internal/executor/piper"
 	"golang.org/x/sys/windows"
 	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
 )
 
+const (
+	jobObjectBasicAccountingInformation = 1
+	jobObjectBasicProcessIdList         = 3
+)
+
+type jobObjectBasicAccountingInformationStruct struct {
+	TotalUserTime             int64
+	TotalKernelTime           int64
+	ThisPeriodTotalUserTime   int64
+	ThisPeriodTotalKernelTime int64
+	TotalPageFaultCount       uint32
+	TotalProcesses            uint32
+	ActiveProcesses           uint32
+	TotalTerminatedProcesses  uint32
+}
+
+type jobObjectBasicProcessIdListStruct struct {
+	NumberOfAssignedProcesses uint32
+	NumberOfProcessIdsInList  uint32
+	ProcessIdList             [64]uintptr
+}
+
 type ShellCommands struct {
 	cmd       *exec.Cmd
 	piper     *piper.Piper
 	jobHandle windows.Handle
+
+	// Empty when the scripts are passed via the command line
+	scriptFile string
+
+	// Set when CIRRUS_ESCAPING_PROCESSES is specified, in which case the processes
+	// spawned by the shell are allowed to outlive it
+	escapingProcesses bool
+}
+
+func (sc *ShellCommands) beforeStart() {
+	// Allows sending CTRL_BREAK_EVENT to the shell and its children
+	// when gracefully terminating them
+	sc.cmd.SysProcAttr = &syscall.SysProcAttr{
+		CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP,
+	}
 }
 
 func (sc *ShellCommands) afterStart() {
@@ -19,6 +62,18 @@ func (sc *ShellCommands) afterStart() {
 	}
 	sc.jobHandle = jobHandle
 
+	// Make sure that the whole process tree dies once the job handle is closed,
+	// even if the agent itself crashes or gets killed
+	if !sc.escapingProcesses {
+		info := windows.JOBOBJECT_EXTENDED_LIMIT_INFORMATION{
+			BasicLimitInformation: windows.JOBOBJECT_BASIC_LIMIT_INFORMATION{
+				LimitFlags: windows.JOB_OBJECT_LIMIT_KILL_ON_JOB_CLOSE,
+			},
+		}
+		_, _ = windows.SetInformationJobObject(jobHandle, windows.JobObjectExtendedLimitInformation,
+			uintptr(unsafe.Pointer(&info)), uint32(unsafe.Sizeof(info)))
+	}
+
 	process, err := windows.OpenProcess(windows.PROCESS_SET_QUOTA|windows.PROCESS_TERMINATE,
 		false, uint32(sc.cmd.Process.Pid))
 	if err != nil {
@@ -40,5 +95,93 @@ func (sc *ShellCommands) kill() error {
 		return err
 	}
 
-	return windows.CloseHandle(sc.jobHandle)
+	return sc.release()
+}
+
+// release closes the job handle, which also kills the remaining processes
+// unless they're allowed to escape.
+func (sc *ShellCommands) release() error {
+	if sc.jobHandle == 0 {
+		return nil
+	}
+
+	err := windows.CloseHandle(sc.jobHandle)
+	sc.jobHandle = 0
+
+	return err
+}
+
+// signalDiagnostics is not supported on Windows, since there's no SIGQUIT equivalent.
+func (sc *ShellCommands) signalDiagnostics() error {
+	return errors.New("not supported on Windows")
+}
+
+// terminate gives the processes in the shell's job object a chance to exit
+// gracefully before killing them.
+func (sc *ShellCommands) terminate(settings terminationSettings, handler ShellOutputHandler) error {
+	if settings.GracePeriod == 0 || sc.jobHandle == 0 {
+		return sc.kill()
+	}
+
+	if err := windows.GenerateConsoleCtrlEvent(windows.CTRL_BREAK_EVENT, uint32(sc.cmd.Process.Pid)); err != nil {
+		return sc.kill()
+	}
+
+	deadline := time.Now().Add(settings.GracePeriod)
+
+	for time.Now().Before(deadline) {
+		if activeProcesses, err := sc.activeProcesses(); err == nil && activeProcesses == 0 {
+			return sc.kill()
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	survivors := sc.processIDs()
+	if len(survivors) == 0 {
+		survivors = []string{"job object processes"}
+	}
+	handler([]byte(fmt.Sprintf("\nStill running %s after sending CTRL_BREAK_EVENT, killing: %s",
+		settings.GracePeriod, strings.Join(survivors, ", "))))
+
+	return sc.kill()
+}
+
+func (sc *ShellCommands) activeProcesses() (uint32, error) {
+	var info jobObjectBasicAccountingInformationStruct
+
+	err := windows.QueryInformationJobObject(sc.jobHandle, jobObjectBasicAccountingInformation,
+		uintptr(unsafe.Pointer(&info)), uint32(unsafe.Sizeof(info)), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	return info.ActiveProcesses, nil
+}
+
+// processes describes the processes that are still running in the shell's job object.
+func (sc *ShellCommands) processes() []string {
+	if sc.jobHandle == 0 {
+		return nil
+	}
+
+	return sc.processIDs()
+}
+
+func (sc *ShellCommands) processIDs() []string {
+	var list jobObjectBasicProcessIdListStruct
+
+	err := windows.QueryInformationJobObject(sc.jobHandle, jobObjectBasicProcessIdList,
+		uintptr(unsafe.Pointer(&list)), uint32(unsafe.Sizeof(list)), nil)
+	if err != nil && err != windows.ERROR_MORE_DATA {
+		return nil
+	}
+
+	var result []string
+
+	for i := uint32(0); i < list.NumberOfProcessIdsInList && i < uint32(len(list.ProcessIdList)); i++ {
+		result = append(result, fmt.Sprintf("PID %d", list.ProcessIdList[i]))
+	}
+
+	return result
 }
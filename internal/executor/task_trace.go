@@ -0,0 +1,150 @@
+package executor
+
+import (
+	"context"
+	"github.com/cirruslabs/cirrus-ci-agent/api"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/executor/tasktrace"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const taskTraceArtifactName = "cirrus-trace.json"
+
+// taskTraceEnabled tells whether the task timeline should be recorded,
+// configured via the CIRRUS_AGENT_TRACE behavioral environment variable.
+func taskTraceEnabled(env map[string]string) bool {
+	return env["CIRRUS_AGENT_TRACE"] == "true"
+}
+
+// uploadTaskTrace makes the task timeline available as an artifact,
+// including the phases that were still running when the task has been aborted.
+func (executor *Executor) uploadTaskTrace(ctx context.Context) {
+	if executor.trace == nil {
+		return
+	}
+
+	contents, err := executor.trace.Bytes()
+	if err != nil {
+		log.Printf("Failed to serialize the task trace: %v", err)
+		return
+	}
+
+	dir, err := ioutil.TempDir("", "cirrus-agent-trace")
+	if err != nil {
+		log.Printf("Failed to create a directory for the task trace: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, taskTraceArtifactName), contents, 0600); err != nil {
+		log.Printf("Failed to write the task trace: %v", err)
+		return
+	}
+
+	_, err = executor.uploadArtifactsAndParseAnnotations(ctx, "cirrus-trace",
+		&api.ArtifactsInstruction{Paths: []string{taskTraceArtifactName}},
+		map[string]string{"CIRRUS_WORKING_DIR": dir}, stdLogUploadObserver{})
+	if err != nil {
+		log.Printf("Failed to upload the task trace: %v", err)
+	}
+}
+
+// instructionType returns the short name of the command's instruction for the task trace.
+func instructionType(command *api.Command) string {
+	switch command.Instruction.(type) {
+	case *api.Command_ExitInstruction:
+		return "exit"
+	case *api.Command_ScriptInstruction:
+		return "script"
+	case *api.Command_BackgroundScriptInstruction:
+		return "background_script"
+	case *api.Command_CacheInstruction:
+		return "cache"
+	case *api.Command_UploadCacheInstruction:
+		return "upload_cache"
+	case *api.Command_CloneInstruction:
+		return "clone"
+	case *api.Command_FileInstruction:
+		return "file"
+	case *api.Command_ArtifactsInstruction:
+		return "artifacts"
+	case *api.Command_WaitForTerminalInstruction:
+		return "wait_for_terminal"
+	default:
+		return "unknown"
+	}
+}
+
+// traceCacheAttempt annotates the span with the outcome of the cache retrieval, if any.
+func (executor *Executor) traceCacheAttempt(span *tasktrace.Span, cacheName string) {
+	cache := FindCache(cacheName)
+	if cache == nil {
+		return
+	}
+
+	span.SetArg("cache_key", cache.Key)
+
+	attempt, ok := executor.cacheAttempts.ToProto()[cache.Key]
+	if !ok {
+		return
+	}
+
+	switch result := attempt.Result.(type) {
+	case *api.CacheRetrievalAttempt_Hit_:
+		span.SetArg("cache", "hit")
+		span.SetArg("cache_bytes", result.Hit.SizeBytes)
+	case *api.CacheRetrievalAttempt_Miss_:
+		span.SetArg("cache", "miss")
+		if result.Miss.SizeBytes != 0 {
+			span.SetArg("cache_bytes", result.Miss.SizeBytes)
+		}
+	default:
+		if attempt.Error != "" {
+			span.SetArg("cache", "failed")
+		}
+	}
+}
+
+// traceUploadObserver records a span for each of the uploaded artifacts patterns.
+type traceUploadObserver struct {
+	recorder *tasktrace.Recorder
+
+	span  *tasktrace.Span
+	bytes int64
+}
+
+func (observer *traceUploadObserver) OnPatternStart(pattern string, paths []string) {
+	observer.span.End()
+
+	observer.span = observer.recorder.Start("artifacts upload", tasktrace.CategoryAgent)
+	observer.span.SetArg("pattern", pattern)
+	observer.span.SetArg("files", len(paths))
+	observer.bytes = 0
+}
+
+func (observer *traceUploadObserver) OnStaleFilesSkipped(pattern string, numSkipped int, modifiedSince time.Time) {
+}
+
+func (observer *traceUploadObserver) OnFileStart(path string, size int64) {}
+
+func (observer *traceUploadObserver) OnFileSkipped(path string, reason string) {}
+
+func (observer *traceUploadObserver) OnFileDone(path string, bytes int64, duration time.Duration) {
+	observer.bytes += bytes
+	observer.span.SetArg("bytes", observer.bytes)
+}
+
+func (observer *traceUploadObserver) OnPatternDone(pattern string, numUploaded int) {
+	observer.span.SetArg("uploaded", numUploaded)
+	observer.span.End()
+	observer.span = nil
+}
+
+func (observer *traceUploadObserver) OnError(err error) {
+	observer.span.SetArg("error", err.Error())
+	observer.span.End()
+	observer.span = nil
+}
@@ -0,0 +1,63 @@
+package executor
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/executor/tasktrace"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"runtime"
+	"testing"
+)
+
+func TestUploadTaskTrace(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("relies on the POSIX shell")
+	}
+
+	fake := &fakeCirrusClient{logStreamCapacities: []int{-1, -1}}
+	withFakeClient(t, fake)
+
+	executor := newTestArtifactsExecutor()
+	executor.trace = tasktrace.New()
+
+	stepResult, err := executor.performStep(context.Background(), scriptCommand("build", "echo hello", "exit 3"))
+	require.NoError(t, err)
+	require.False(t, stepResult.Success)
+
+	// The task gets aborted in the middle of a phase
+	executor.trace.Start("cache fetch", tasktrace.CategoryAgent)
+
+	executor.uploadTaskTrace(context.Background())
+
+	var trace struct {
+		TraceEvents []struct {
+			Name string                 `json:"name"`
+			Cat  string                 `json:"cat"`
+			Args map[string]interface{} `json:"args"`
+		} `json:"traceEvents"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(fake.UploadedFiles()["cirrus-trace.json"]), &trace))
+	require.Len(t, trace.TraceEvents, 2)
+
+	build := trace.TraceEvents[0]
+	assert.Equal(t, "build", build.Name)
+	assert.Equal(t, "command", build.Cat)
+	assert.Equal(t, "script", build.Args["type"])
+	assert.Equal(t, false, build.Args["success"])
+	assert.EqualValues(t, 3, build.Args["exit_code"])
+	assert.EqualValues(t, 1, build.Args["attempts"])
+	assert.Greater(t, build.Args["output_bytes"], float64(len("hello\n")))
+
+	assert.Equal(t, "cache fetch", trace.TraceEvents[1].Name)
+	assert.Equal(t, true, trace.TraceEvents[1].Args["unfinished"])
+}
+
+func TestUploadTaskTraceDisabled(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	newTestArtifactsExecutor().uploadTaskTrace(context.Background())
+
+	assert.Empty(t, fake.Entries())
+}
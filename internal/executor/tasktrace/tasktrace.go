@@ -0,0 +1,165 @@
+package tasktrace
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+const (
+	CategoryCommand = "command"
+	CategoryAgent   = "agent"
+)
+
+// Don't let the trace grow unbounded in a task with lots of commands
+const maxEvents = 100000
+
+// Recorder accumulates the task timeline in the Chrome trace event format[1],
+// so that it can be loaded into chrome://tracing or Perfetto.
+//
+// A nil Recorder is valid and records nothing, which makes the tracing opt-in.
+//
+// [1]: https://docs.google.com/document/d/1CvAClvFfyA5R-PhYUmn5OOQtYMH4h6I0nSsKchNAySU
+type Recorder struct {
+	mutex  sync.Mutex
+	origin time.Time
+	events []event
+	open   map[*Span]struct{}
+	now    func() time.Time
+}
+
+// Span is a single phase of the task, like a command or a cache download.
+// A nil Span is valid and records nothing.
+type Span struct {
+	recorder *Recorder
+	name     string
+	category string
+	start    time.Time
+	args     map[string]interface{}
+}
+
+// Timestamp is relative to the start of the recording, both it and Duration are in microseconds.
+type event struct {
+	Name      string                 `json:"name"`
+	Category  string                 `json:"cat"`
+	Phase     string                 `json:"ph"`
+	Timestamp int64                  `json:"ts"`
+	Duration  int64                  `json:"dur"`
+	PID       int                    `json:"pid"`
+	TID       int                    `json:"tid"`
+	Args      map[string]interface{} `json:"args,omitempty"`
+}
+
+type document struct {
+	TraceEvents     []event `json:"traceEvents"`
+	DisplayTimeUnit string  `json:"displayTimeUnit"`
+}
+
+func New() *Recorder {
+	return &Recorder{
+		origin: time.Now(),
+		open:   map[*Span]struct{}{},
+		now:    time.Now,
+	}
+}
+
+// Start begins a new span, which should be finished with End().
+func (recorder *Recorder) Start(name string, category string) *Span {
+	if recorder == nil {
+		return nil
+	}
+
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	span := &Span{
+		recorder: recorder,
+		name:     name,
+		category: category,
+		start:    recorder.now(),
+		args:     map[string]interface{}{},
+	}
+	recorder.open[span] = struct{}{}
+
+	return span
+}
+
+// SetArg attaches the value to the span, e.g. the command's exit code.
+func (span *Span) SetArg(key string, value interface{}) {
+	if span == nil {
+		return
+	}
+
+	span.recorder.mutex.Lock()
+	defer span.recorder.mutex.Unlock()
+
+	span.args[key] = value
+}
+
+// End finishes the span. Calling it more than once is a no-op.
+func (span *Span) End() {
+	if span == nil {
+		return
+	}
+
+	recorder := span.recorder
+
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	if _, ok := recorder.open[span]; !ok {
+		return
+	}
+	delete(recorder.open, span)
+
+	recorder.appendEvent(span, recorder.now())
+}
+
+// Bytes returns the trace document. The spans that are not finished yet (e.g. because the task
+// was aborted midway) are included as ending now, marked with the "unfinished" argument.
+func (recorder *Recorder) Bytes() ([]byte, error) {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	events := append([]event{}, recorder.events...)
+
+	now := recorder.now()
+	for span := range recorder.open {
+		args := map[string]interface{}{"unfinished": true}
+		for key, value := range span.args {
+			args[key] = value
+		}
+		events = append(events, recorder.newEvent(span, now, args))
+	}
+
+	return json.Marshal(&document{
+		TraceEvents:     events,
+		DisplayTimeUnit: "ms",
+	})
+}
+
+func (recorder *Recorder) appendEvent(span *Span, end time.Time) {
+	if len(recorder.events) >= maxEvents {
+		return
+	}
+
+	recorder.events = append(recorder.events, recorder.newEvent(span, end, span.args))
+}
+
+func (recorder *Recorder) newEvent(span *Span, end time.Time, args map[string]interface{}) event {
+	result := event{
+		Name:      span.name,
+		Category:  span.category,
+		Phase:     "X",
+		Timestamp: span.start.Sub(recorder.origin).Microseconds(),
+		Duration:  end.Sub(span.start).Microseconds(),
+		PID:       1,
+		TID:       1,
+	}
+
+	if len(args) != 0 {
+		result.Args = args
+	}
+
+	return result
+}
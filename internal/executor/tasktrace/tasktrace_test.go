@@ -0,0 +1,73 @@
+package tasktrace_test
+
+import (
+	"encoding/json"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/executor/tasktrace"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+type traceEvent struct {
+	Name     string                 `json:"name"`
+	Category string                 `json:"cat"`
+	Phase    string                 `json:"ph"`
+	Duration int64                  `json:"dur"`
+	Args     map[string]interface{} `json:"args"`
+}
+
+func parse(t *testing.T, recorder *tasktrace.Recorder) []traceEvent {
+	contents, err := recorder.Bytes()
+	require.NoError(t, err)
+
+	var document struct {
+		TraceEvents []traceEvent `json:"traceEvents"`
+	}
+	require.NoError(t, json.Unmarshal(contents, &document))
+
+	return document.TraceEvents
+}
+
+func TestSpans(t *testing.T) {
+	recorder := tasktrace.New()
+
+	span := recorder.Start("main", tasktrace.CategoryCommand)
+	span.SetArg("exit_code", 1)
+	span.End()
+	span.End()
+
+	events := parse(t, recorder)
+	require.Len(t, events, 1)
+	assert.Equal(t, "main", events[0].Name)
+	assert.Equal(t, "command", events[0].Category)
+	assert.Equal(t, "X", events[0].Phase)
+	assert.Equal(t, map[string]interface{}{"exit_code": float64(1)}, events[0].Args)
+}
+
+func TestUnfinishedSpans(t *testing.T) {
+	recorder := tasktrace.New()
+
+	span := recorder.Start("cache fetch", tasktrace.CategoryAgent)
+	span.SetArg("key", "node_modules")
+
+	events := parse(t, recorder)
+	require.Len(t, events, 1)
+	assert.Equal(t, map[string]interface{}{"key": "node_modules", "unfinished": true}, events[0].Args)
+
+	// Still can be finished properly afterwards
+	span.End()
+
+	events = parse(t, recorder)
+	require.Len(t, events, 1)
+	assert.Equal(t, map[string]interface{}{"key": "node_modules"}, events[0].Args)
+}
+
+func TestNilRecorder(t *testing.T) {
+	var recorder *tasktrace.Recorder
+
+	span := recorder.Start("main", tasktrace.CategoryCommand)
+	span.SetArg("exit_code", 0)
+	span.End()
+
+	assert.Nil(t, span)
+}
@@ -0,0 +1,41 @@
+package executor
+
+import (
+	"strings"
+	"time"
+)
+
+const defaultTerminationGracePeriod = 10 * time.Second
+
+// terminationSettings control how the timed out or cancelled commands are terminated
+type terminationSettings struct {
+	// Either SIGTERM or SIGINT, on Windows CTRL_BREAK_EVENT is sent instead
+	Signal string
+
+	// How long to wait after sending the signal before forcefully
+	// killing the processes that are still running
+	GracePeriod time.Duration
+}
+
+func terminationSettingsFromEnv(env *map[string]string) terminationSettings {
+	settings := terminationSettings{
+		Signal:      "SIGTERM",
+		GracePeriod: defaultTerminationGracePeriod,
+	}
+
+	if env == nil {
+		return settings
+	}
+
+	if signal := strings.ToUpper((*env)["CIRRUS_TERMINATION_SIGNAL"]); signal == "SIGINT" || signal == "INT" {
+		settings.Signal = "SIGINT"
+	}
+
+	if value, ok := (*env)["CIRRUS_TERMINATION_GRACE_PERIOD"]; ok {
+		if gracePeriod, err := time.ParseDuration(value); err == nil && gracePeriod >= 0 {
+			settings.GracePeriod = gracePeriod
+		}
+	}
+
+	return settings
+}
@@ -0,0 +1,122 @@
+package executor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// timeoutWarningSettings control what happens shortly before a command times out,
+// so that the users get a chance to see where the command got stuck
+type timeoutWarningSettings struct {
+	// How long before the deadline to warn
+	Period time.Duration
+
+	// Signal to send to the command's processes, only SIGQUIT is supported at the moment
+	// since it makes the runtimes like Go and Java dump the stack traces. Note that
+	// the processes that don't handle SIGQUIT are terminated by it.
+	Signal string
+
+	// Diagnostic script (e.g. "py-spy dump --pid $CIRRUS_TIMEOUT_WARNING_PID") to run,
+	// its output is captured into the command's log
+	Script string
+}
+
+func timeoutWarningSettingsFromEnv(env *map[string]string) (timeoutWarningSettings, bool) {
+	var settings timeoutWarningSettings
+
+	if env == nil {
+		return settings, false
+	}
+
+	period, err := time.ParseDuration((*env)["CIRRUS_TIMEOUT_WARNING_PERIOD"])
+	if err != nil || period <= 0 {
+		return settings, false
+	}
+	settings.Period = period
+
+	if signal := strings.ToUpper((*env)["CIRRUS_TIMEOUT_WARNING_SIGNAL"]); signal == "SIGQUIT" || signal == "QUIT" {
+		settings.Signal = "SIGQUIT"
+	}
+
+	settings.Script = (*env)["CIRRUS_TIMEOUT_WARNING_SCRIPT"]
+
+	return settings, true
+}
+
+// timeoutWarningTimer returns a channel that fires the warning period before the context's deadline,
+// or a nil channel that never fires when there's no deadline.
+func timeoutWarningTimer(ctx context.Context, settings timeoutWarningSettings) (<-chan time.Time, func()) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return nil, func() {}
+	}
+
+	timer := time.NewTimer(time.Until(deadline.Add(-settings.Period)))
+
+	return timer.C, func() {
+		timer.Stop()
+	}
+}
+
+func (sc *ShellCommands) warnAboutTimeout(
+	ctx context.Context,
+	settings timeoutWarningSettings,
+	env *map[string]string,
+	handler ShellOutputHandler,
+) {
+	var remaining string
+	if deadline, ok := ctx.Deadline(); ok {
+		remaining = fmt.Sprintf(" in %s", formatFooterDuration(time.Until(deadline)))
+	}
+	handler([]byte(fmt.Sprintf("\n\n!!! The command is going to time out%s !!!\n", remaining)))
+
+	if settings.Signal != "" {
+		if err := sc.signalDiagnostics(); err != nil {
+			handler([]byte(fmt.Sprintf("Failed to send %s: %v\n", settings.Signal, err)))
+		} else {
+			handler([]byte(fmt.Sprintf("Sent %s to collect the diagnostics\n", settings.Signal)))
+		}
+	}
+
+	if settings.Script == "" {
+		return
+	}
+
+	// Don't let the diagnostic script warn about its own timeout or get killed for being silent
+	scriptEnv := make(map[string]string)
+	if env != nil {
+		for key, value := range *env {
+			scriptEnv[key] = value
+		}
+	}
+	delete(scriptEnv, "CIRRUS_TIMEOUT_WARNING_PERIOD")
+	delete(scriptEnv, commandNoOutputTimeoutEnvName)
+	scriptEnv["CIRRUS_TIMEOUT_WARNING_PID"] = strconv.Itoa(sc.cmd.Process.Pid)
+
+	// Nor wait for it to exit gracefully once it runs out of time
+	scriptEnv["CIRRUS_TERMINATION_GRACE_PERIOD"] = "0"
+
+	handler([]byte(fmt.Sprintf("Running the diagnostic script: %s\n", settings.Script)))
+
+	// The script has to finish halfway through the warning period, well before the command's deadline
+	scriptCtx := ctx
+	if deadline, ok := ctx.Deadline(); ok {
+		var cancel context.CancelFunc
+		scriptCtx, cancel = context.WithDeadline(ctx, deadline.Add(-settings.Period/2))
+		defer cancel()
+	}
+
+	cmd, err := ShellCommandsAndWait(scriptCtx, []string{settings.Script}, &scriptEnv, handler, true)
+	if errors.Is(err, TimeOutError) {
+		handler([]byte(fmt.Sprintf("\nThe diagnostic script didn't finish in %s, stopped it\n",
+			formatFooterDuration(settings.Period/2))))
+	} else if err != nil {
+		handler([]byte(fmt.Sprintf("\nFailed to run the diagnostic script: %v\n", err)))
+	} else if !cmd.ProcessState.Success() {
+		handler([]byte(fmt.Sprintf("\nThe diagnostic script has failed with %d\n", cmd.ProcessState.ExitCode())))
+	}
+}
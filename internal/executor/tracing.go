@@ -0,0 +1,62 @@
+package executor
+
+import (
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"time"
+)
+
+// Spans are only recorded when the tracer provider is configured
+// (e.g. by the agent's embedder), otherwise the global tracer is a no-op.
+func tracer() trace.Tracer {
+	return otel.Tracer("github.com/cirruslabs/cirrus-ci-agent/internal/executor")
+}
+
+// recordSpanError marks the span as failed if there was an error.
+func recordSpanError(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// spanUploadObserver annotates the span with the artifacts upload totals.
+type spanUploadObserver struct {
+	span trace.Span
+
+	files      int64
+	bytes      int64
+	staleFiles int64
+}
+
+func (observer *spanUploadObserver) OnPatternStart(pattern string, paths []string) {}
+
+func (observer *spanUploadObserver) OnStaleFilesSkipped(pattern string, numSkipped int, modifiedSince time.Time) {
+	observer.staleFiles += int64(numSkipped)
+
+	observer.span.SetAttributes(attribute.Int64("artifacts.stale_files", observer.staleFiles))
+}
+
+func (observer *spanUploadObserver) OnFileStart(path string, size int64) {}
+
+func (observer *spanUploadObserver) OnFileSkipped(path string, reason string) {}
+
+func (observer *spanUploadObserver) OnFileDone(path string, bytes int64, duration time.Duration) {
+	observer.files++
+	observer.bytes += bytes
+
+	observer.span.SetAttributes(
+		attribute.Int64("artifacts.files", observer.files),
+		attribute.Int64("artifacts.bytes", observer.bytes),
+	)
+}
+
+func (observer *spanUploadObserver) OnPatternDone(pattern string, numUploaded int) {}
+
+func (observer *spanUploadObserver) OnError(err error) {
+	observer.span.AddEvent("upload error", trace.WithAttributes(attribute.String("error", err.Error())))
+}
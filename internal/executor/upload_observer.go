@@ -0,0 +1,139 @@
+package executor
+
+import (
+	"fmt"
+	"github.com/dustin/go-humanize"
+	"time"
+)
+
+// UploadObserver receives the artifacts upload events.
+type UploadObserver interface {
+	OnPatternStart(pattern string, paths []string)
+	OnStaleFilesSkipped(pattern string, numSkipped int, modifiedSince time.Time)
+	OnFileStart(path string, size int64)
+	OnFileSkipped(path string, reason string)
+	OnFileDone(path string, bytes int64, duration time.Duration)
+	OnPatternDone(pattern string, numUploaded int)
+	OnError(err error)
+}
+
+const defaultHeftyArtifactThreshold = 100 * humanize.MByte
+
+// LogUploadObserver presents the artifacts upload events in the command's log.
+type LogUploadObserver struct {
+	logUploader *LogUploader
+	patterns    int
+
+	// Files larger than this are called out in the log, zero disables the warning
+	heftyThreshold uint64
+}
+
+func NewLogUploadObserver(logUploader *LogUploader) *LogUploadObserver {
+	return &LogUploadObserver{
+		logUploader:    logUploader,
+		heftyThreshold: defaultHeftyArtifactThreshold,
+	}
+}
+
+// parseHeftyArtifactThreshold returns the size starting from which the uploaded files are called out
+// as hefty, configured via the CIRRUS_HEFTY_ARTIFACT_THRESHOLD behavioral environment variable.
+func parseHeftyArtifactThreshold(customEnv map[string]string) (uint64, error) {
+	value := customEnv["CIRRUS_HEFTY_ARTIFACT_THRESHOLD"]
+	if value == "" {
+		return defaultHeftyArtifactThreshold, nil
+	}
+
+	threshold, err := humanize.ParseBytes(value)
+	if err != nil {
+		return 0, fmt.Errorf("%w: failed to parse CIRRUS_HEFTY_ARTIFACT_THRESHOLD: %v", ErrArtifactsInvalidOption, err)
+	}
+
+	return threshold, nil
+}
+
+func (observer *LogUploadObserver) OnPatternStart(pattern string, paths []string) {
+	if observer.patterns > 0 {
+		observer.logUploader.Write([]byte("\n"))
+	}
+	observer.patterns++
+
+	if len(paths) == 0 {
+		observer.logUploader.Write([]byte(fmt.Sprintf("No files matched %s, skipping", pattern)))
+		return
+	}
+
+	observer.logUploader.Write([]byte(fmt.Sprintf("Uploading %d artifacts for %s", len(paths), pattern)))
+}
+
+func (observer *LogUploadObserver) OnStaleFilesSkipped(pattern string, numSkipped int, modifiedSince time.Time) {
+	observer.logUploader.Write([]byte(fmt.Sprintf("\nSkipping %d files matching %s that weren't modified since %s",
+		numSkipped, pattern, modifiedSince.Format(time.RFC3339))))
+}
+
+func (observer *LogUploadObserver) OnFileStart(path string, size int64) {
+	if observer.heftyThreshold != 0 && uint64(size) > observer.heftyThreshold {
+		humanFriendlySize := humanize.Bytes(uint64(size))
+		observer.logUploader.Write([]byte(fmt.Sprintf("\nUploading a quite hefty artifact '%s' of size %s",
+			path, humanFriendlySize)))
+	}
+}
+
+func (observer *LogUploadObserver) OnFileSkipped(path string, reason string) {
+	observer.logUploader.Write([]byte(fmt.Sprintf("\nSkipping uploading of '%s' because %s", path, reason)))
+}
+
+func (observer *LogUploadObserver) OnFileDone(path string, bytes int64, duration time.Duration) {
+	observer.logUploader.Write([]byte(fmt.Sprintf("\nUploaded %s", path)))
+}
+
+func (observer *LogUploadObserver) OnPatternDone(pattern string, numUploaded int) {
+	// nothing to show
+}
+
+func (observer *LogUploadObserver) OnError(err error) {
+	observer.logUploader.Write([]byte(fmt.Sprintf("\nFailed to upload artifacts: %s", err)))
+}
+
+type multiUploadObserver []UploadObserver
+
+func (observers multiUploadObserver) OnPatternStart(pattern string, paths []string) {
+	for _, observer := range observers {
+		observer.OnPatternStart(pattern, paths)
+	}
+}
+
+func (observers multiUploadObserver) OnStaleFilesSkipped(pattern string, numSkipped int, modifiedSince time.Time) {
+	for _, observer := range observers {
+		observer.OnStaleFilesSkipped(pattern, numSkipped, modifiedSince)
+	}
+}
+
+func (observers multiUploadObserver) OnFileStart(path string, size int64) {
+	for _, observer := range observers {
+		observer.OnFileStart(path, size)
+	}
+}
+
+func (observers multiUploadObserver) OnFileSkipped(path string, reason string) {
+	for _, observer := range observers {
+		observer.OnFileSkipped(path, reason)
+	}
+}
+
+func (observers multiUploadObserver) OnFileDone(path string, bytes int64, duration time.Duration) {
+	for _, observer := range observers {
+		observer.OnFileDone(path, bytes, duration)
+	}
+}
+
+func (observers multiUploadObserver) OnPatternDone(pattern string, numUploaded int) {
+	for _, observer := range observers {
+		observer.OnPatternDone(pattern, numUploaded)
+	}
+}
+
+func (observers multiUploadObserver) OnError(err error) {
+	for _, observer := range observers {
+		observer.OnError(err)
+	}
+}
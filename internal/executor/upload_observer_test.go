@@ -0,0 +1,125 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"github.com/cirruslabs/cirrus-ci-agent/api"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type recordingUploadObserver struct {
+	events []string
+}
+
+func (observer *recordingUploadObserver) OnPatternStart(pattern string, paths []string) {
+	observer.events = append(observer.events, fmt.Sprintf("pattern start %s (%d files)", filepath.Base(pattern), len(paths)))
+}
+
+func (observer *recordingUploadObserver) OnStaleFilesSkipped(pattern string, numSkipped int, modifiedSince time.Time) {
+	observer.events = append(observer.events, fmt.Sprintf("stale files skipped %s (%d files)", filepath.Base(pattern), numSkipped))
+}
+
+func (observer *recordingUploadObserver) OnFileStart(path string, size int64) {
+	observer.events = append(observer.events, fmt.Sprintf("file start %s (%d bytes)", filepath.Base(path), size))
+}
+
+func (observer *recordingUploadObserver) OnFileSkipped(path string, reason string) {
+	observer.events = append(observer.events, fmt.Sprintf("file skipped %s: %s", filepath.Base(path), reason))
+}
+
+func (observer *recordingUploadObserver) OnFileDone(path string, bytes int64, duration time.Duration) {
+	observer.events = append(observer.events, fmt.Sprintf("file done %s (%d bytes)", filepath.Base(path), bytes))
+}
+
+func (observer *recordingUploadObserver) OnPatternDone(pattern string, numUploaded int) {
+	observer.events = append(observer.events, fmt.Sprintf("pattern done %s (%d files)", filepath.Base(pattern), numUploaded))
+}
+
+func (observer *recordingUploadObserver) OnError(err error) {
+	observer.events = append(observer.events, fmt.Sprintf("error: %v", err))
+}
+
+func TestUploadArtifactsObserver(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	workingDir := testutil.TempDir(t)
+	writeTestFile(t, filepath.Join(workingDir, "a.txt"), "first")
+	writeTestFile(t, filepath.Join(workingDir, "dir.txt", "b"), "second")
+
+	executor := newTestArtifactsExecutor()
+	logUploader := newTestLogUploader(t, executor)
+	observer := &recordingUploadObserver{}
+
+	success := executor.UploadArtifacts(context.Background(), logUploader, "artifacts",
+		&api.ArtifactsInstruction{Paths: []string{"*.missing", "*.txt"}},
+		map[string]string{"CIRRUS_WORKING_DIR": workingDir}, observer)
+	logUploader.Finalize()
+
+	assert.True(t, success)
+	assert.Equal(t, []string{
+		"pattern start *.missing (0 files)",
+		"pattern done *.missing (0 files)",
+		"pattern start *.txt (2 files)",
+		"file start a.txt (5 bytes)",
+		"file done a.txt (5 bytes)",
+		"file skipped dir.txt: it's a folder",
+		"pattern done *.txt (1 files)",
+	}, observer.events)
+}
+
+func TestUploadArtifactsObserverErrors(t *testing.T) {
+	fake := &fakeCirrusClient{}
+	withFakeClient(t, fake)
+
+	executor := newTestArtifactsExecutor()
+	logUploader := newTestLogUploader(t, executor)
+	observer := &recordingUploadObserver{}
+
+	success := executor.UploadArtifacts(context.Background(), logUploader, "artifacts",
+		&api.ArtifactsInstruction{Paths: []string{"*.txt"}}, map[string]string{}, observer)
+	logUploader.Finalize()
+
+	assert.False(t, success)
+	assert.Equal(t, []string{"error: invalid CIRRUS_WORKING_DIR: variable is not set"}, observer.events)
+}
+
+func TestHeftyArtifactThreshold(t *testing.T) {
+	for _, testCase := range []struct {
+		threshold string
+		expected  bool
+	}{
+		{threshold: "", expected: false},
+		{threshold: "1kB", expected: true},
+		{threshold: "0", expected: false},
+	} {
+		fake := &fakeCirrusClient{}
+		withFakeClient(t, fake)
+
+		workingDir := testutil.TempDir(t)
+		writeTestFile(t, filepath.Join(workingDir, "video.mp4"), strings.Repeat("x", 2000))
+
+		executor := newTestArtifactsExecutor()
+		logUploader := newTestLogUploader(t, executor)
+
+		success := executor.UploadArtifacts(context.Background(), logUploader, "artifacts",
+			&api.ArtifactsInstruction{Paths: []string{"*.mp4"}},
+			map[string]string{
+				"CIRRUS_WORKING_DIR":              workingDir,
+				"CIRRUS_HEFTY_ARTIFACT_THRESHOLD": testCase.threshold,
+			})
+		logUploader.Finalize()
+
+		assert.True(t, success)
+		assert.Equal(t, testCase.expected, strings.Contains(fake.Logs(), "Uploading a quite hefty artifact"),
+			"threshold %q", testCase.threshold)
+	}
+
+	_, err := parseHeftyArtifactThreshold(map[string]string{"CIRRUS_HEFTY_ARTIFACT_THRESHOLD": "huge"})
+	assert.ErrorIs(t, err, ErrArtifactsInvalidOption)
+}
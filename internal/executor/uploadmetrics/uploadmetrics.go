@@ -0,0 +1,136 @@
+// Package uploadmetrics exposes the artifact upload statistics in the Prometheus format.
+//
+// All methods are safe to call on a nil *Metrics, in which case they do nothing,
+// so that the callers don't need to check whether the metrics are enabled.
+package uploadmetrics
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+type Metrics struct {
+	registry *prometheus.Registry
+
+	bytesUploaded       *prometheus.CounterVec
+	filesUploaded       *prometheus.CounterVec
+	uploadDuration      *prometheus.HistogramVec
+	uploadRetries       *prometheus.CounterVec
+	annotationsReported *prometheus.CounterVec
+
+	server   *http.Server
+	listener net.Listener
+}
+
+// New creates the metrics with their own registry, so that multiple instances
+// (e.g. in tests) don't collide in the global one.
+func New() *Metrics {
+	labels := []string{"type"}
+
+	metrics := &Metrics{
+		registry: prometheus.NewRegistry(),
+		bytesUploaded: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "cirrus_agent_artifacts_uploaded_bytes_total",
+			Help: "Total number of artifact bytes uploaded.",
+		}, labels),
+		filesUploaded: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "cirrus_agent_artifacts_uploaded_files_total",
+			Help: "Total number of artifact files uploaded.",
+		}, labels),
+		uploadDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "cirrus_agent_artifact_upload_duration_seconds",
+			Help:    "Time it took to upload a single artifact file.",
+			Buckets: prometheus.ExponentialBuckets(0.01, 4, 10),
+		}, labels),
+		uploadRetries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "cirrus_agent_artifacts_upload_retries_total",
+			Help: "Total number of artifact upload retries.",
+		}, labels),
+		annotationsReported: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "cirrus_agent_artifacts_annotations_total",
+			Help: "Total number of annotations parsed from the artifacts.",
+		}, labels),
+	}
+
+	metrics.registry.MustRegister(metrics.bytesUploaded, metrics.filesUploaded, metrics.uploadDuration,
+		metrics.uploadRetries, metrics.annotationsReported)
+
+	return metrics
+}
+
+// Serve creates the metrics and exposes them on the /metrics endpoint of the address.
+func Serve(addr string) (*Metrics, error) {
+	metrics := New()
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	metrics.server = &http.Server{Handler: mux}
+	metrics.listener = listener
+
+	go func() {
+		if err := metrics.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Failed to serve the metrics on %s: %v", addr, err)
+		}
+	}()
+
+	return metrics, nil
+}
+
+// Addr returns the address the metrics are served on, which is useful when listening on port 0.
+func (metrics *Metrics) Addr() string {
+	if metrics == nil || metrics.listener == nil {
+		return ""
+	}
+
+	return metrics.listener.Addr().String()
+}
+
+func (metrics *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(metrics.registry, promhttp.HandlerOpts{})
+}
+
+func (metrics *Metrics) FileUploaded(artifactType string, bytes int64, duration time.Duration) {
+	if metrics == nil {
+		return
+	}
+
+	metrics.bytesUploaded.WithLabelValues(artifactType).Add(float64(bytes))
+	metrics.filesUploaded.WithLabelValues(artifactType).Inc()
+	metrics.uploadDuration.WithLabelValues(artifactType).Observe(duration.Seconds())
+}
+
+func (metrics *Metrics) UploadRetried(artifactType string) {
+	if metrics == nil {
+		return
+	}
+
+	metrics.uploadRetries.WithLabelValues(artifactType).Inc()
+}
+
+func (metrics *Metrics) AnnotationsParsed(artifactType string, count int) {
+	if metrics == nil {
+		return
+	}
+
+	metrics.annotationsReported.WithLabelValues(artifactType).Add(float64(count))
+}
+
+// Close stops serving the metrics, if they were served at all.
+func (metrics *Metrics) Close(ctx context.Context) error {
+	if metrics == nil || metrics.server == nil {
+		return nil
+	}
+
+	return metrics.server.Shutdown(ctx)
+}
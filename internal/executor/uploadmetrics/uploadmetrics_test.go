@@ -0,0 +1,45 @@
+package uploadmetrics_test
+
+import (
+	"context"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/executor/uploadmetrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestNilMetricsAreNoop(t *testing.T) {
+	var metrics *uploadmetrics.Metrics
+
+	metrics.FileUploaded("text/plain", 42, time.Second)
+	metrics.UploadRetried("text/plain")
+	metrics.AnnotationsParsed("text/plain", 3)
+	assert.Empty(t, metrics.Addr())
+	assert.NoError(t, metrics.Close(context.Background()))
+}
+
+func TestServe(t *testing.T) {
+	metrics, err := uploadmetrics.Serve("127.0.0.1:0")
+	require.NoError(t, err)
+	defer metrics.Close(context.Background())
+
+	metrics.FileUploaded("text/plain", 42, time.Second)
+	metrics.FileUploaded("text/plain", 8, time.Second)
+	metrics.UploadRetried("application/octet-stream")
+	metrics.AnnotationsParsed("text/xml", 3)
+
+	response, err := http.Get("http://" + metrics.Addr() + "/metrics")
+	require.NoError(t, err)
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), `cirrus_agent_artifacts_uploaded_bytes_total{type="text/plain"} 50`)
+	assert.Contains(t, string(body), `cirrus_agent_artifacts_uploaded_files_total{type="text/plain"} 2`)
+	assert.Contains(t, string(body), `cirrus_agent_artifact_upload_duration_seconds_count{type="text/plain"} 2`)
+	assert.Contains(t, string(body), `cirrus_agent_artifacts_upload_retries_total{type="application/octet-stream"} 1`)
+	assert.Contains(t, string(body), `cirrus_agent_artifacts_annotations_total{type="text/xml"} 3`)
+}
@@ -0,0 +1,108 @@
+package utf8sanitizer
+
+import (
+	"unicode/utf8"
+)
+
+var replacementChar = []byte(string(utf8.RuneError))
+
+// Mode is how the invalid bytes are represented in the sanitized output.
+type Mode int
+
+const (
+	// ModeReplace replaces each invalid byte with the Unicode replacement character.
+	ModeReplace Mode = iota
+
+	// ModeHexEscape replaces each invalid byte with its "\xNN" escape,
+	// which keeps the original bytes recoverable from the log.
+	ModeHexEscape
+)
+
+// Sanitizer replaces invalid UTF-8 sequences in a stream of chunks with the
+// Unicode replacement character (or the hex escapes), while keeping the valid
+// multi-byte runes that happen to be split across the chunk boundaries intact.
+type Sanitizer struct {
+	mode       Mode
+	pending    [utf8.UTFMax]byte
+	numPending int
+}
+
+func New() *Sanitizer {
+	return NewWithMode(ModeReplace)
+}
+
+func NewWithMode(mode Mode) *Sanitizer {
+	return &Sanitizer{mode: mode}
+}
+
+// Sanitize returns the sanitized version of the chunk. The incomplete rune
+// at the end of the chunk (if any) is held back until the next call.
+//
+// When the chunk is valid UTF-8 and there's nothing held back (which is the case
+// for the vast majority of the output) the chunk is returned as is, without copying.
+func (sanitizer *Sanitizer) Sanitize(chunk []byte) []byte {
+	if sanitizer.numPending == 0 && utf8.Valid(chunk) {
+		return chunk
+	}
+
+	input := chunk
+	if sanitizer.numPending != 0 {
+		input = make([]byte, 0, sanitizer.numPending+len(chunk))
+		input = append(input, sanitizer.pending[:sanitizer.numPending]...)
+		input = append(input, chunk...)
+		sanitizer.numPending = 0
+	}
+
+	result := make([]byte, 0, len(input)+len(replacementChar))
+
+	for i := 0; i < len(input); {
+		r, size := utf8.DecodeRune(input[i:])
+
+		if r == utf8.RuneError && size <= 1 {
+			// Possibly a valid rune that will be completed by the next chunk
+			if !utf8.FullRune(input[i:]) {
+				sanitizer.numPending = copy(sanitizer.pending[:], input[i:])
+				break
+			}
+
+			result = sanitizer.appendInvalid(result, input[i])
+			i++
+			continue
+		}
+
+		result = append(result, input[i:i+size]...)
+		i += size
+	}
+
+	return result
+}
+
+// Flush returns the sanitized version of the bytes held back by Sanitize(),
+// which should be called once the stream has ended.
+func (sanitizer *Sanitizer) Flush() []byte {
+	if sanitizer.numPending == 0 {
+		return nil
+	}
+
+	pending := sanitizer.pending[:sanitizer.numPending]
+	sanitizer.numPending = 0
+
+	if sanitizer.mode == ModeHexEscape {
+		var result []byte
+		for _, b := range pending {
+			result = sanitizer.appendInvalid(result, b)
+		}
+		return result
+	}
+
+	return append([]byte{}, replacementChar...)
+}
+
+func (sanitizer *Sanitizer) appendInvalid(result []byte, b byte) []byte {
+	if sanitizer.mode == ModeHexEscape {
+		const hexDigits = "0123456789abcdef"
+		return append(result, '\\', 'x', hexDigits[b>>4], hexDigits[b&0xf])
+	}
+
+	return append(result, replacementChar...)
+}
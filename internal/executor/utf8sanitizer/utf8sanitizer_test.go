@@ -0,0 +1,82 @@
+package utf8sanitizer_test
+
+import (
+	"bytes"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/executor/utf8sanitizer"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func sanitize(chunks ...string) string {
+	return sanitizeWithMode(utf8sanitizer.ModeReplace, chunks...)
+}
+
+func sanitizeWithMode(mode utf8sanitizer.Mode, chunks ...string) string {
+	sanitizer := utf8sanitizer.NewWithMode(mode)
+
+	var result []byte
+	for _, chunk := range chunks {
+		result = append(result, sanitizer.Sanitize([]byte(chunk))...)
+	}
+	result = append(result, sanitizer.Flush()...)
+
+	return string(result)
+}
+
+func TestValid(t *testing.T) {
+	assert.Equal(t, "hello, мир", sanitize("hello, ", "мир"))
+}
+
+func TestInvalid(t *testing.T) {
+	assert.Equal(t, "a�b��c", sanitize("a\xffb", "\xfe\xfdc"))
+}
+
+func TestRuneSplitAcrossChunks(t *testing.T) {
+	// "ж" is encoded as 0xD0 0xB6 and "😀" as 0xF0 0x9F 0x98 0x80
+	assert.Equal(t, "жx😀", sanitize("\xd0", "\xb6x\xf0\x9f", "\x98", "\x80"))
+}
+
+func TestIncompleteRuneAtTheEnd(t *testing.T) {
+	assert.Equal(t, "abc�", sanitize("abc\xf0\x9f"))
+}
+
+func TestInvalidContinuation(t *testing.T) {
+	assert.Equal(t, "�a", sanitize("\xd0", "a"))
+}
+
+func TestHexEscape(t *testing.T) {
+	assert.Equal(t, `a\xffb\xfe\xfdc`, sanitizeWithMode(utf8sanitizer.ModeHexEscape, "a\xffb", "\xfe\xfdc"))
+	assert.Equal(t, "жx", sanitizeWithMode(utf8sanitizer.ModeHexEscape, "\xd0", "\xb6x"))
+	assert.Equal(t, `abc\xf0\x9f`, sanitizeWithMode(utf8sanitizer.ModeHexEscape, "abc\xf0\x9f"))
+}
+
+func TestValidChunkIsNotCopied(t *testing.T) {
+	chunk := []byte("plain ASCII")
+
+	result := utf8sanitizer.New().Sanitize(chunk)
+	assert.Equal(t, &chunk[0], &result[0])
+}
+
+func BenchmarkSanitizeASCII(b *testing.B) {
+	chunk := bytes.Repeat([]byte("The quick brown fox jumps over the lazy dog\n"), 1024)
+	sanitizer := utf8sanitizer.New()
+
+	b.SetBytes(int64(len(chunk)))
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		sanitizer.Sanitize(chunk)
+	}
+}
+
+func BenchmarkSanitizeInvalid(b *testing.B) {
+	chunk := bytes.Repeat([]byte("The quick brown fox \xff jumps over the lazy dog\n"), 1024)
+	sanitizer := utf8sanitizer.New()
+
+	b.SetBytes(int64(len(chunk)))
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		sanitizer.Sanitize(chunk)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 type DiffEntry struct {
@@ -36,18 +37,72 @@ func (det DiffEntryType) String() string {
 	}
 }
 
+// Mode decides how the files are told apart.
+type Mode int
+
+const (
+	// The files are compared by their contents, but the ones whose size and modification time
+	// haven't changed since the previous hasher (see NewIncremental()) aren't read again
+	ModeDefault Mode = iota
+
+	// The files are only compared by their size and modification time, so they're never read,
+	// at the cost of reporting the identical files rewritten by some tool as modified
+	ModeFast
+
+	// The files are always compared by their contents, which also catches the in-place
+	// modifications that preserve both the size and the modification time
+	ModeExact
+)
+
 type Hasher struct {
+	mode       Mode
 	globalHash hash.Hash
 	fileHashes map[string]string
+
+	// Size and modification time of the hashed files, which tell whether
+	// the hash can be reused by the hasher created with NewIncremental()
+	fileStats map[string]fileStat
+	previous  *Hasher
+	numReused int
+}
+
+type fileStat struct {
+	size    int64
+	modTime time.Time
+	digest  []byte
 }
 
 func New() *Hasher {
+	return NewWithMode(ModeDefault)
+}
+
+func NewWithMode(mode Mode) *Hasher {
 	return &Hasher{
+		mode:       mode,
 		globalHash: sha256.New(),
 		fileHashes: make(map[string]string),
+		fileStats:  make(map[string]fileStat),
 	}
 }
 
+// NewIncremental creates a hasher that skips reading the files whose size and modification time
+// haven't changed since they were hashed by the previous hasher. The files with the same size,
+// but a different modification time are still read, so that the tools that rewrite the identical
+// files don't cause false positives.
+//
+// The hasher uses the same mode as the previous one, and only ModeDefault reuses the hashes.
+func NewIncremental(previous *Hasher) *Hasher {
+	hasher := NewWithMode(previous.mode)
+	hasher.previous = previous
+
+	return hasher
+}
+
+// NumReused returns how many files weren't read thanks to the previous hasher.
+func (hasher *Hasher) NumReused() int {
+	return hasher.numReused
+}
+
 func (hasher *Hasher) SHA() string {
 	digest := hasher.globalHash.Sum(nil)
 	return fmt.Sprintf("%x", digest)
@@ -80,6 +135,16 @@ func (hasher *Hasher) DiffWithNewer(newer *Hasher) []DiffEntry {
 }
 
 func (hasher *Hasher) AddFolder(baseFolder string, folderPath string) error {
+	return hasher.AddFolderExcluding(baseFolder, folderPath, nil)
+}
+
+// AddFolderExcluding is like AddFolder, but skips the entries the exclude function matches,
+// which receives the slash-separated path relative to the folder (not the base folder).
+func (hasher *Hasher) AddFolderExcluding(
+	baseFolder string,
+	folderPath string,
+	exclude func(relativePath string, info os.FileInfo) bool,
+) error {
 	if _, err := os.Stat(folderPath); os.IsNotExist(err) {
 		return nil
 	}
@@ -87,9 +152,32 @@ func (hasher *Hasher) AddFolder(baseFolder string, folderPath string) error {
 		if err != nil {
 			return err
 		}
+		if exclude != nil && path != folderPath {
+			pathInFolder, err := filepath.Rel(folderPath, path)
+			if err != nil {
+				return err
+			}
+			if exclude(filepath.ToSlash(pathInFolder), info) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
 		if info.IsDir() {
 			return nil
 		}
+		relativePath, err := filepath.Rel(baseFolder, path)
+		if err != nil {
+			return err
+		}
+		if hasher.mode == ModeFast {
+			return hasher.add(relativePath, info, statDigest(info))
+		}
+		if digest, ok := hasher.reusableDigest(relativePath, info); ok {
+			hasher.numReused++
+			return hasher.add(relativePath, info, digest)
+		}
 		fileHash, err := fileHash(path)
 		// symlink can still be a directory
 		if err != nil && strings.Contains(err.Error(), "is a directory") {
@@ -106,16 +194,41 @@ func (hasher *Hasher) AddFolder(baseFolder string, folderPath string) error {
 		if err != nil {
 			return err
 		}
-		relativePath, err := filepath.Rel(baseFolder, path)
-		if err != nil {
-			return err
-		}
-		hasher.fileHashes[relativePath] = fmt.Sprintf("%x", fileHash)
-		_, err = hasher.globalHash.Write(fileHash)
-		return err
+		return hasher.add(relativePath, info, fileHash)
 	})
 }
 
+func (hasher *Hasher) reusableDigest(relativePath string, info os.FileInfo) ([]byte, bool) {
+	if hasher.previous == nil || hasher.mode != ModeDefault {
+		return nil, false
+	}
+
+	stat, ok := hasher.previous.fileStats[relativePath]
+	if !ok || stat.size != info.Size() || !stat.modTime.Equal(info.ModTime()) {
+		return nil, false
+	}
+
+	return stat.digest, true
+}
+
+func (hasher *Hasher) add(relativePath string, info os.FileInfo, digest []byte) error {
+	hasher.fileHashes[relativePath] = fmt.Sprintf("%x", digest)
+	hasher.fileStats[relativePath] = fileStat{
+		size:    info.Size(),
+		modTime: info.ModTime(),
+		digest:  digest,
+	}
+	_, err := hasher.globalHash.Write(digest)
+	return err
+}
+
+// statDigest stands in for the contents hash in ModeFast.
+func statDigest(info os.FileInfo) []byte {
+	digest := sha256.Sum256([]byte(fmt.Sprintf("%d\x00%d", info.Size(), info.ModTime().UnixNano())))
+
+	return digest[:]
+}
+
 func fileHash(path string) ([]byte, error) {
 	f, err := os.Open(path)
 	if err != nil {
@@ -4,9 +4,12 @@ import (
 	"github.com/cirruslabs/cirrus-ci-agent/internal/hasher"
 	"github.com/cirruslabs/cirrus-ci-agent/internal/testutil"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"io/ioutil"
+	"os"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestDiffWithNewer(t *testing.T) {
@@ -105,3 +108,78 @@ func TestDiffWithNewer(t *testing.T) {
 		})
 	}
 }
+
+func TestIncremental(t *testing.T) {
+	dir := testutil.TempDir(t)
+	unchangedPath := filepath.Join(dir, "unchanged.txt")
+	rewrittenPath := filepath.Join(dir, "rewritten.txt")
+	modifiedPath := filepath.Join(dir, "modified.txt")
+
+	for _, path := range []string{unchangedPath, rewrittenPath, modifiedPath} {
+		require.NoError(t, ioutil.WriteFile(path, []byte("contents"), 0600))
+	}
+
+	oldHasher := hasher.New()
+	require.NoError(t, oldHasher.AddFolder(dir, dir))
+
+	// A tool rewrites the identical file, while another one modifies a file without changing
+	// its size and modification time, which is indistinguishable from not modifying it at all
+	// (the same trade-off that rsync's quick check makes)
+	later := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(rewrittenPath, later, later))
+	info, err := os.Stat(modifiedPath)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(modifiedPath, []byte("CONTENTS"), 0600))
+	require.NoError(t, os.Chtimes(modifiedPath, info.ModTime(), info.ModTime()))
+
+	newHasher := hasher.NewIncremental(oldHasher)
+	require.NoError(t, newHasher.AddFolder(dir, dir))
+
+	// Only the files that look modified were read
+	assert.Equal(t, 2, newHasher.NumReused())
+	assert.Equal(t, oldHasher.SHA(), newHasher.SHA())
+	assert.Empty(t, oldHasher.DiffWithNewer(newHasher))
+
+	// A size change is detected though
+	require.NoError(t, ioutil.WriteFile(unchangedPath, []byte("longer contents"), 0600))
+
+	newHasher = hasher.NewIncremental(oldHasher)
+	require.NoError(t, newHasher.AddFolder(dir, dir))
+	assert.NotEqual(t, oldHasher.SHA(), newHasher.SHA())
+	assert.Equal(t, []hasher.DiffEntry{{Type: hasher.Modified, Path: "unchanged.txt"}}, oldHasher.DiffWithNewer(newHasher))
+}
+
+func TestModes(t *testing.T) {
+	dir := testutil.TempDir(t)
+	rewrittenPath := filepath.Join(dir, "rewritten.txt")
+	modifiedPath := filepath.Join(dir, "modified.txt")
+
+	for _, path := range []string{rewrittenPath, modifiedPath} {
+		require.NoError(t, ioutil.WriteFile(path, []byte("contents"), 0600))
+	}
+
+	oldFastHasher := hasher.NewWithMode(hasher.ModeFast)
+	require.NoError(t, oldFastHasher.AddFolder(dir, dir))
+	oldExactHasher := hasher.NewWithMode(hasher.ModeExact)
+	require.NoError(t, oldExactHasher.AddFolder(dir, dir))
+
+	later := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(rewrittenPath, later, later))
+	info, err := os.Stat(modifiedPath)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(modifiedPath, []byte("CONTENTS"), 0600))
+	require.NoError(t, os.Chtimes(modifiedPath, info.ModTime(), info.ModTime()))
+
+	// The fast mode only looks at the size and modification time
+	newFastHasher := hasher.NewIncremental(oldFastHasher)
+	require.NoError(t, newFastHasher.AddFolder(dir, dir))
+	assert.Equal(t, []hasher.DiffEntry{{Type: hasher.Modified, Path: "rewritten.txt"}},
+		oldFastHasher.DiffWithNewer(newFastHasher))
+
+	// While the exact mode only looks at the contents
+	newExactHasher := hasher.NewIncremental(oldExactHasher)
+	require.NoError(t, newExactHasher.AddFolder(dir, dir))
+	assert.Zero(t, newExactHasher.NumReused())
+	assert.Equal(t, []hasher.DiffEntry{{Type: hasher.Modified, Path: "modified.txt"}},
+		oldExactHasher.DiffWithNewer(newExactHasher))
+}
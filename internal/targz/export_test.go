@@ -0,0 +1,11 @@
+package targz
+
+// SetSymlink replaces the function creating the symbolic links, returning the function restoring it.
+func SetSymlink(f func(oldname, newname string) error) func() {
+	original := symlink
+	symlink = f
+
+	return func() {
+		symlink = original
+	}
+}
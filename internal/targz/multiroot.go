@@ -0,0 +1,145 @@
+package targz
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// multiRootManifestName is the first entry of the archives created by ArchiveMultiRoot(),
+// the contents of the i-th root are stored under the "/<i>" prefix.
+const multiRootManifestName = ".cirrus-roots.json"
+
+type multiRootManifest struct {
+	Roots []string `json:"roots"`
+}
+
+// ArchiveMultiRoot creates a tar archive of the folders located anywhere on the filesystem,
+// along with a manifest that lets UnarchiveMultiRoot() put each of them back where it came from.
+func ArchiveMultiRoot(roots []string, dest string, options ArchiveOptions) error {
+	manifest, err := json.Marshal(multiRootManifest{Roots: roots})
+	if err != nil {
+		return err
+	}
+
+	return writeArchive(dest, options, func(tarWriter *tar.Writer, buffer []byte) error {
+		unixEpoch := time.Unix(0, 0)
+
+		if err := tarWriter.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     multiRootManifestName,
+			Size:     int64(len(manifest)),
+			Mode:     0644,
+			ModTime:  unixEpoch,
+		}); err != nil {
+			return fmt.Errorf("%s: writing header: %v", multiRootManifestName, err)
+		}
+		if _, err := tarWriter.Write(manifest); err != nil {
+			return fmt.Errorf("%s: writing contents: %v", multiRootManifestName, err)
+		}
+
+		for i, root := range roots {
+			namePrefix := string(filepath.Separator) + strconv.Itoa(i)
+
+			if err := archiveSingleFolder(root, root, namePrefix, options.Exclude, tarWriter, buffer); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// UnarchiveMultiRoot restores the archive created by ArchiveMultiRoot(), creating the parents
+// of the roots as needed. Only the roots that are among the allowed ones are restored,
+// the rest are returned to let the caller know.
+func UnarchiveMultiRoot(tarPath string, allowedRoots []string, options UnarchiveOptions) ([]string, error) {
+	var skippedRoots []string
+
+	err := readArchive(tarPath, options, func(tarReader *tar.Reader, extraction *extraction) error {
+		header, err := tarReader.Next()
+		if err != nil {
+			return fmt.Errorf("failed to read the manifest: %v", err)
+		}
+		if header.Name != multiRootManifestName {
+			return fmt.Errorf("%w: no manifest found, expected %s but got %s",
+				ErrUnknownFormat, multiRootManifestName, header.Name)
+		}
+
+		manifestBytes, err := ioutil.ReadAll(tarReader)
+		if err != nil {
+			return fmt.Errorf("failed to read the manifest: %v", err)
+		}
+
+		var manifest multiRootManifest
+		if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+			return fmt.Errorf("failed to parse the manifest: %v", err)
+		}
+
+		allowed := map[string]struct{}{}
+		for _, root := range allowedRoots {
+			allowed[filepath.Clean(root)] = struct{}{}
+		}
+
+		destinations := make([]string, len(manifest.Roots))
+		for i, root := range manifest.Roots {
+			if _, ok := allowed[filepath.Clean(root)]; !ok {
+				skippedRoots = append(skippedRoots, root)
+			} else if options.RootDestination != nil {
+				destinations[i] = options.RootDestination(root)
+			} else {
+				destinations[i] = root
+			}
+		}
+
+		for {
+			header, err := tarReader.Next()
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+
+			index, name, err := splitMultiRootName(header.Name, len(destinations))
+			if err != nil {
+				return err
+			}
+			if destinations[index] == "" {
+				continue
+			}
+
+			header.Name = name
+			if err := extraction.untarFile(tarReader, header, destinations[index]); err != nil {
+				return err
+			}
+			if options.OnEntry != nil {
+				options.OnEntry(header)
+			}
+		}
+	})
+
+	return skippedRoots, err
+}
+
+// splitMultiRootName splits the "/<i>/path" entry name into the root index and the path within the root.
+func splitMultiRootName(name string, numRoots int) (int, string, error) {
+	trimmed := strings.TrimLeft(name, `/\`)
+
+	rawIndex, rest := trimmed, ""
+	if separatorIndex := strings.IndexAny(trimmed, `/\`); separatorIndex != -1 {
+		rawIndex, rest = trimmed[:separatorIndex], trimmed[separatorIndex:]
+	}
+
+	index, err := strconv.Atoi(rawIndex)
+	if err != nil || index < 0 || index >= numRoots {
+		return 0, "", fmt.Errorf("%s: entry doesn't belong to any of the %d roots", name, numRoots)
+	}
+
+	return index, rest, nil
+}
@@ -0,0 +1,52 @@
+package targz_test
+
+import (
+	"github.com/cirruslabs/cirrus-ci-agent/internal/targz"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMultiRoot(t *testing.T) {
+	home := testutil.TempDir(t)
+	caches := filepath.Join(home, ".gradle", "caches")
+	wrapper := filepath.Join(home, ".gradle", "wrapper")
+	other := filepath.Join(home, "other")
+
+	for _, root := range []string{caches, wrapper, other} {
+		require.NoError(t, os.MkdirAll(filepath.Join(root, "nested"), 0700))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(root, "nested", "file.txt"), []byte(root), 0600))
+	}
+
+	dest := filepath.Join(testutil.TempDir(t), "archive")
+	require.NoError(t, targz.ArchiveMultiRoot([]string{caches, wrapper, other}, dest, targz.ArchiveOptions{}))
+
+	require.NoError(t, os.RemoveAll(home))
+
+	// Only the allowed roots are restored, parents included
+	skipped, err := targz.UnarchiveMultiRoot(dest, []string{caches, wrapper}, targz.UnarchiveOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{other}, skipped)
+
+	for _, root := range []string{caches, wrapper} {
+		contents, err := ioutil.ReadFile(filepath.Join(root, "nested", "file.txt"))
+		require.NoError(t, err)
+		assert.Equal(t, root, string(contents))
+	}
+
+	_, err = os.Stat(other)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestUnarchiveMultiRootWithoutManifest(t *testing.T) {
+	folderPath := testutil.TempDir(t)
+	dest := filepath.Join(testutil.TempDir(t), "archive")
+	require.NoError(t, targz.Archive(folderPath, []string{folderPath}, dest))
+
+	_, err := targz.UnarchiveMultiRoot(dest, []string{folderPath}, targz.UnarchiveOptions{})
+	assert.ErrorIs(t, err, targz.ErrUnknownFormat)
+}
@@ -3,7 +3,10 @@ package targz
 import (
 	"archive/tar"
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
+	"github.com/klauspost/compress/zstd"
 	gzip "github.com/klauspost/pgzip"
 	"io"
 	"os"
@@ -15,50 +18,206 @@ import (
 
 const DEFAULT_BUFFER_SIZE = 1024 * 1024
 
+// Overridden in the tests to simulate the platforms without symbolic links
+var symlink = os.Symlink
+
+// Compression is the codec the tar archive is compressed with.
+type Compression string
+
+const (
+	CompressionGzip Compression = "gzip"
+	CompressionZstd Compression = "zstd"
+	CompressionNone Compression = "none"
+)
+
+var ErrUnknownFormat = errors.New("unknown archive format")
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	// tar has no magic at the start of the file, but the POSIX and GNU formats have one in the header
+	tarMagic       = []byte("ustar")
+	tarMagicOffset = 257
+)
+
+// ParseCompression validates the codec name, as used in CIRRUS_CACHE_COMPRESSION.
+func ParseCompression(name string) (Compression, error) {
+	switch compression := Compression(name); compression {
+	case CompressionGzip, CompressionZstd, CompressionNone:
+		return compression, nil
+	default:
+		return "", fmt.Errorf("unsupported compression %q, expected %q, %q or %q",
+			name, CompressionGzip, CompressionZstd, CompressionNone)
+	}
+}
+
+// ExcludeFunc tells whether the entry should be left out of the archive, the path is slash-separated
+// and relative to the archived folder. Excluding a directory excludes everything inside of it.
+type ExcludeFunc func(relativePath string, info os.FileInfo) bool
+
+// ArchiveOptions tune the archive creation, the zero value means a gzip-compressed archive
+// created with all the available CPUs.
+type ArchiveOptions struct {
+	// The codec to compress the archive with, Unarchive() picks the right one automatically
+	Compression Compression
+
+	// Optional, the matching entries are left out of the archive
+	Exclude ExcludeFunc
+
+	// How many blocks of the archive are compressed in parallel, while the next files are
+	// being read, zero means runtime.NumCPU()
+	Concurrency int
+}
+
+// UnarchiveOptions tune the archive extraction, the zero value means using all the available CPUs.
+type UnarchiveOptions struct {
+	// How many blocks of the archive are decompressed ahead in parallel,
+	// while the files are being written, zero means runtime.NumCPU()
+	Concurrency int
+
+	// Optional, called after each entry is extracted
+	OnEntry func(header *tar.Header)
+
+	// Optional, called when an entry can't be restored faithfully, e.g. when a symbolic link
+	// is restored as a copy of its target because symbolic links aren't available on Windows
+	OnWarning func(message string)
+
+	// Optional, returns the folder to extract the root restored by UnarchiveMultiRoot() into,
+	// e.g. a temporary one to move into place once the whole archive is extracted
+	RootDestination func(root string) string
+}
+
+// Archive creates a gzip-compressed tar archive.
 func Archive(baseFolder string, folderPaths []string, dest string) error {
+	return ArchiveWithOptions(baseFolder, folderPaths, dest, ArchiveOptions{})
+}
+
+// ArchiveWithOptions creates a tar archive of the folders, naming the entries relative to the base folder.
+func ArchiveWithOptions(baseFolder string, folderPaths []string, dest string, options ArchiveOptions) error {
+	return writeArchive(dest, options, func(tarWriter *tar.Writer, buffer []byte) error {
+		for _, folderPath := range folderPaths {
+			if err := archiveSingleFolder(baseFolder, folderPath, "", options.Exclude, tarWriter, buffer); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func concurrencyOrDefault(concurrency int) int {
+	if concurrency <= 0 {
+		return runtime.NumCPU()
+	}
+
+	return concurrency
+}
+
+func writeArchive(
+	dest string,
+	options ArchiveOptions,
+	write func(tarWriter *tar.Writer, buffer []byte) error,
+) error {
 	out, err := os.Create(dest)
 	if err != nil {
 		return fmt.Errorf("error creating %s: %v", dest, err)
 	}
 	defer out.Close()
 
-	gzipWriter := gzip.NewWriter(out)
-	defer gzipWriter.Close()
+	concurrency := concurrencyOrDefault(options.Concurrency)
 
-	tarWriter := tar.NewWriter(gzipWriter)
-	defer tarWriter.Close()
+	var compressedWriter io.WriteCloser
 
-	buffer := make([]byte, DEFAULT_BUFFER_SIZE)
-
-	for _, folderPath := range folderPaths {
-		if err := archiveSingleFolder(baseFolder, folderPath, tarWriter, buffer); err != nil {
-			return err
+	switch compression := options.Compression; compression {
+	case CompressionGzip, "":
+		gzipWriter := gzip.NewWriter(out)
+		if err := gzipWriter.SetConcurrency(DEFAULT_BUFFER_SIZE, concurrency); err != nil {
+			return fmt.Errorf("failed to configure gzip writer %s: %v", dest, err)
 		}
+		compressedWriter = gzipWriter
+	case CompressionZstd:
+		compressedWriter, err = zstd.NewWriter(out, zstd.WithEncoderLevel(zstd.SpeedDefault),
+			zstd.WithEncoderConcurrency(concurrency))
+		if err != nil {
+			return fmt.Errorf("failed to create new zstd writer %s: %v", dest, err)
+		}
+	case CompressionNone:
+		compressedWriter = nopWriteCloser{out}
+	default:
+		return fmt.Errorf("unsupported compression %q", compression)
 	}
 
+	tarWriter := tar.NewWriter(compressedWriter)
+
+	if err := write(tarWriter, make([]byte, DEFAULT_BUFFER_SIZE)); err != nil {
+		_ = tarWriter.Close()
+		_ = compressedWriter.Close()
+		return err
+	}
+
+	if err := tarWriter.Close(); err != nil {
+		_ = compressedWriter.Close()
+		return fmt.Errorf("failed to finish the archive %s: %v", dest, err)
+	}
+
+	if err := compressedWriter.Close(); err != nil {
+		return fmt.Errorf("failed to finish compressing %s: %v", dest, err)
+	}
+
+	return out.Close()
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
 	return nil
 }
 
-func archiveSingleFolder(baseFolder string, folderPath string, tarWriter *tar.Writer, buffer []byte) error {
+func archiveSingleFolder(
+	baseFolder string,
+	folderPath string,
+	namePrefix string,
+	exclude ExcludeFunc,
+	tarWriter *tar.Writer,
+	buffer []byte,
+) error {
 	return filepath.Walk(folderPath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return fmt.Errorf("error walking folder %s: %v", path, err)
 		}
 
+		if exclude != nil && path != folderPath {
+			relativePath, err := filepath.Rel(folderPath, path)
+			if err != nil {
+				return err
+			}
+
+			if exclude(filepath.ToSlash(relativePath), info) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+
 		header, err := tar.FileInfoHeader(info, path)
 		if err != nil {
 			return fmt.Errorf("error  making header %s: %v", path, err)
 		}
-		header.Name = strings.TrimPrefix(path, baseFolder)
+		header.Name = namePrefix + strings.TrimPrefix(path, baseFolder)
 		unixEpoch := time.Unix(0, 0)
 		header.ModTime = unixEpoch
 		header.AccessTime = unixEpoch
 		header.ChangeTime = unixEpoch
 
+		// Links are stored as is instead of being followed, with the absolute links pointing
+		// within the archived folder made relative so that they survive the relocation
 		if header.Typeflag == tar.TypeSymlink {
 			linkDest, _ := os.Readlink(path)
-			if filepath.IsAbs(linkDest) {
-				linkDest, _ = filepath.Rel(baseFolder, linkDest)
+			if filepath.IsAbs(linkDest) && pathIsWithin(folderPath, linkDest) {
+				linkDest, _ = filepath.Rel(filepath.Dir(path), linkDest)
 			}
 			header.Linkname = linkDest
 		}
@@ -89,52 +248,206 @@ func archiveSingleFolder(baseFolder string, folderPath string, tarWriter *tar.Wr
 }
 
 func Unarchive(tarPath string, destFolder string) error {
+	return UnarchiveWithOptions(tarPath, destFolder, UnarchiveOptions{})
+}
+
+func UnarchiveWithOptions(tarPath string, destFolder string, options UnarchiveOptions) error {
+	return readArchive(tarPath, options, func(tarReader *tar.Reader, extraction *extraction) error {
+		for {
+			header, err := tarReader.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+
+			if err := extraction.untarFile(tarReader, header, destFolder); err != nil {
+				return err
+			}
+			if options.OnEntry != nil {
+				options.OnEntry(header)
+			}
+		}
+		return nil
+	})
+}
+
+func readArchive(
+	tarPath string,
+	options UnarchiveOptions,
+	read func(tarReader *tar.Reader, extraction *extraction) error,
+) error {
 	tarFile, err := os.Open(tarPath)
 	if err != nil {
 		return fmt.Errorf("failed to open tar %s: %v", tarPath, err)
 	}
 	defer tarFile.Close()
 
-	gzipReader, err := gzip.NewReader(bufio.NewReaderSize(tarFile, DEFAULT_BUFFER_SIZE))
+	decompressedReader, err := newDecompressingReader(bufio.NewReaderSize(tarFile, DEFAULT_BUFFER_SIZE),
+		concurrencyOrDefault(options.Concurrency))
 	if err != nil {
-		return fmt.Errorf("failed to create new gzip reader %s: %v", tarPath, err)
+		return fmt.Errorf("failed to read archive %s: %w", tarPath, err)
+	}
+	defer decompressedReader.Close()
+
+	extraction := &extraction{buffer: make([]byte, DEFAULT_BUFFER_SIZE), onWarning: options.OnWarning}
+
+	if err := read(tar.NewReader(decompressedReader), extraction); err != nil {
+		return err
 	}
-	defer gzipReader.Close()
 
-	gzipTar := tar.NewReader(gzipReader)
+	return extraction.finish()
+}
 
-	buffer := make([]byte, DEFAULT_BUFFER_SIZE)
+// newDecompressingReader picks the decompressor based on the magic bytes of the archive,
+// so that the archives created with any of the supported codecs can be read.
+func newDecompressingReader(reader *bufio.Reader, concurrency int) (io.ReadCloser, error) {
+	header, err := reader.Peek(tarMagicOffset + len(tarMagic))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
 
-	for {
-		header, err := gzipTar.Next()
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			return err
+	switch {
+	case bytes.HasPrefix(header, gzipMagic):
+		gzipReader, err := gzip.NewReaderN(reader, DEFAULT_BUFFER_SIZE, concurrency)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create new gzip reader: %v", err)
 		}
-
-		if err := untarFile(gzipTar, header, destFolder, buffer); err != nil {
-			return err
+		return gzipReader, nil
+	case bytes.HasPrefix(header, zstdMagic):
+		zstdReader, err := zstd.NewReader(reader, zstd.WithDecoderConcurrency(concurrency))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create new zstd reader: %v", err)
 		}
+		return zstdReader.IOReadCloser(), nil
+	case len(header) >= tarMagicOffset+len(tarMagic) && bytes.Equal(header[tarMagicOffset:], tarMagic):
+		return io.NopCloser(reader), nil
+	default:
+		return nil, ErrUnknownFormat
 	}
-	return nil
 }
 
-func untarFile(tr *tar.Reader, header *tar.Header, destination string, buffer []byte) error {
+// extraction keeps track of what has to be done once all the entries are extracted.
+type extraction struct {
+	buffer    []byte
+	onWarning func(message string)
+
+	// The directories get their modes at the very end, since the read-only ones can't be populated
+	dirModes []pendingDirMode
+
+	// The symbolic links that couldn't be created become copies of their targets,
+	// which might not be extracted yet at the time the link is encountered
+	linkCopies []pendingLinkCopy
+}
+
+type pendingDirMode struct {
+	path string
+	mode os.FileMode
+}
+
+type pendingLinkCopy struct {
+	path   string
+	target string
+}
+
+func (extraction *extraction) untarFile(tr *tar.Reader, header *tar.Header, destination string) error {
+	path := filepath.Join(destination, header.Name)
+
 	switch header.Typeflag {
 	case tar.TypeDir:
-		return mkdir(filepath.Join(destination, header.Name))
+		if err := mkdir(path); err != nil {
+			return err
+		}
+		extraction.dirModes = append(extraction.dirModes, pendingDirMode{path: path, mode: header.FileInfo().Mode().Perm()})
+		return nil
 	case tar.TypeReg, tar.TypeRegA, tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
-		return writeNewFile(filepath.Join(destination, header.Name), tr, header.FileInfo(), buffer)
+		return writeNewFile(path, tr, header.FileInfo(), extraction.buffer)
 	case tar.TypeSymlink:
-		return writeNewSymbolicLink(filepath.Join(destination, header.Name), header.Linkname)
+		if err := writeNewSymbolicLink(path, header.Linkname); err != nil {
+			// Creating symbolic links on Windows requires either a privilege or the developer mode
+			extraction.linkCopies = append(extraction.linkCopies, pendingLinkCopy{path: path, target: header.Linkname})
+		}
+		return nil
 	case tar.TypeLink:
-		return writeNewHardLink(filepath.Join(destination, header.Name), filepath.Join(destination, header.Linkname))
+		return writeNewHardLink(path, filepath.Join(destination, header.Linkname))
 	default:
 		return fmt.Errorf("%s: unknown type flag: %c", header.Name, header.Typeflag)
 	}
 }
 
+func (extraction *extraction) finish() error {
+	for _, linkCopy := range extraction.linkCopies {
+		target := linkCopy.target
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(linkCopy.path), target)
+		}
+
+		if err := copyPath(target, linkCopy.path, extraction.buffer); err != nil {
+			extraction.warnf("%s: failed to create a symbolic link to %s or to copy it instead: %v",
+				linkCopy.path, linkCopy.target, err)
+			continue
+		}
+
+		extraction.warnf("%s: symbolic links aren't supported, restored as a copy of %s",
+			linkCopy.path, linkCopy.target)
+	}
+
+	// Deepest directories first, so that the parents are still writable while their children are processed
+	for i := len(extraction.dirModes) - 1; i >= 0; i-- {
+		dirMode := extraction.dirModes[i]
+
+		if err := os.Chmod(dirMode.path, dirMode.mode); err != nil && runtime.GOOS != "windows" {
+			return fmt.Errorf("%s: changing directory mode: %v", dirMode.path, err)
+		}
+	}
+
+	return nil
+}
+
+func (extraction *extraction) warnf(format string, args ...interface{}) {
+	if extraction.onWarning != nil {
+		extraction.onWarning(fmt.Sprintf(format, args...))
+	}
+}
+
+// copyPath recursively copies the file or the directory.
+func copyPath(source string, dest string, buffer []byte) error {
+	return filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relativePath, err := filepath.Rel(source, path)
+		if err != nil {
+			return err
+		}
+		destPath := filepath.Join(dest, relativePath)
+
+		if info.IsDir() {
+			return mkdir(destPath)
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		return writeNewFile(destPath, file, info, buffer)
+	})
+}
+
+// pathIsWithin tells whether the path is the folder itself or is located inside of it.
+func pathIsWithin(folder string, path string) bool {
+	relativePath, err := filepath.Rel(folder, path)
+
+	return err == nil && relativePath != ".." && !strings.HasPrefix(relativePath, ".."+string(filepath.Separator))
+}
+
 func writeNewFile(fpath string, in io.Reader, fi os.FileInfo, buffer []byte) error {
 	err := os.MkdirAll(filepath.Dir(fpath), 0755)
 	if err != nil {
@@ -165,7 +478,14 @@ func writeNewSymbolicLink(fpath string, target string) error {
 		return fmt.Errorf("%s: making directory for file: %v", fpath, err)
 	}
 
-	err = os.Symlink(target, fpath)
+	// The restored link should point to where the archived one did
+	if info, err := os.Lstat(fpath); err == nil && !info.IsDir() {
+		if err := os.Remove(fpath); err != nil {
+			return fmt.Errorf("%s: removing the existing file: %v", fpath, err)
+		}
+	}
+
+	err = symlink(target, fpath)
 	if err != nil && !os.IsExist(err) {
 		return fmt.Errorf("%s: making symbolic link for: %v", fpath, err)
 	}
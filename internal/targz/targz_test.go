@@ -2,14 +2,20 @@ package targz_test
 
 import (
 	"archive/tar"
+	"bytes"
 	"compress/gzip"
+	"fmt"
 	"github.com/cirruslabs/cirrus-ci-agent/internal/targz"
 	"github.com/cirruslabs/cirrus-ci-agent/internal/testutil"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"io"
 	"io/ioutil"
+	mathrand "math/rand"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
 )
 
@@ -158,3 +164,263 @@ func TestArchiveMultiple(t *testing.T) {
 	}
 	assert.Equal(t, expected, TarGzContentsHelper(t, dest))
 }
+
+func TestArchiveWithOptionsRoundTrip(t *testing.T) {
+	for _, compression := range []targz.Compression{targz.CompressionGzip, targz.CompressionZstd, targz.CompressionNone} {
+		compression := compression
+
+		t.Run(string(compression), func(t *testing.T) {
+			folderPath := testutil.TempDir(t)
+			subDir := filepath.Join(folderPath, "sub-directory")
+			require.NoError(t, os.Mkdir(subDir, 0700))
+			require.NoError(t, ioutil.WriteFile(filepath.Join(subDir, "file.txt"), []byte("contents"), 0600))
+
+			dest := filepath.Join(testutil.TempDir(t), "archive")
+			require.NoError(t, targz.ArchiveWithOptions(folderPath, []string{folderPath}, dest,
+				targz.ArchiveOptions{Compression: compression}))
+
+			// The codec is detected from the archive itself
+			destFolder := testutil.TempDir(t)
+			require.NoError(t, targz.Unarchive(dest, destFolder))
+
+			contents, err := ioutil.ReadFile(filepath.Join(destFolder, "sub-directory", "file.txt"))
+			require.NoError(t, err)
+			assert.Equal(t, "contents", string(contents))
+		})
+	}
+}
+
+// writeBenchmarkFixture creates the files resembling a dependency cache: lots of compressible
+// sources along with a few incompressible binaries, totalling the specified size.
+func writeBenchmarkFixture(tb testing.TB, folderPath string, size int) {
+	random := mathrand.New(mathrand.NewSource(42))
+
+	for i, written := 0, 0; written < size; i++ {
+		var contents []byte
+
+		if i%10 == 0 {
+			contents = make([]byte, 1024*1024)
+			random.Read(contents)
+		} else {
+			var buffer bytes.Buffer
+			for buffer.Len() < 128*1024 {
+				fmt.Fprintf(&buffer, "func generated%d(argument%d int) int { return argument%d * %d }\n",
+					random.Intn(1000), random.Intn(10), random.Intn(10), random.Int())
+			}
+			contents = buffer.Bytes()
+		}
+
+		path := filepath.Join(folderPath, fmt.Sprintf("package%d", i%16), fmt.Sprintf("file%d", i))
+		require.NoError(tb, os.MkdirAll(filepath.Dir(path), 0700))
+		require.NoError(tb, ioutil.WriteFile(path, contents, 0600))
+
+		written += len(contents)
+	}
+}
+
+func TestConcurrentRoundTrip(t *testing.T) {
+	folderPath := testutil.TempDir(t)
+	writeBenchmarkFixture(t, folderPath, 8*1024*1024)
+
+	for _, compression := range []targz.Compression{targz.CompressionGzip, targz.CompressionZstd} {
+		dest := filepath.Join(testutil.TempDir(t), "archive")
+		require.NoError(t, targz.ArchiveWithOptions(folderPath, []string{folderPath}, dest,
+			targz.ArchiveOptions{Compression: compression, Concurrency: 3}))
+
+		destFolder := testutil.TempDir(t)
+		require.NoError(t, targz.UnarchiveWithOptions(dest, destFolder, targz.UnarchiveOptions{Concurrency: 3}))
+
+		original, err := ioutil.ReadFile(filepath.Join(folderPath, "package1", "file1"))
+		require.NoError(t, err)
+		restored, err := ioutil.ReadFile(filepath.Join(destFolder, "package1", "file1"))
+		require.NoError(t, err)
+		assert.Equal(t, original, restored)
+	}
+}
+
+// BenchmarkArchive compares the sequential and the parallel archiving,
+// the latter is expected to be at least 2x faster on a machine with 4+ CPUs.
+func BenchmarkArchive(b *testing.B) {
+	folderPath := b.TempDir()
+	writeBenchmarkFixture(b, folderPath, 64*1024*1024)
+
+	concurrencies := []int{1}
+	if runtime.NumCPU() > 1 {
+		concurrencies = append(concurrencies, runtime.NumCPU())
+	}
+
+	for _, compression := range []targz.Compression{targz.CompressionGzip, targz.CompressionZstd} {
+		for _, concurrency := range concurrencies {
+			options := targz.ArchiveOptions{Compression: compression, Concurrency: concurrency}
+
+			b.Run(fmt.Sprintf("%s-%d", compression, concurrency), func(b *testing.B) {
+				dest := filepath.Join(b.TempDir(), "archive")
+
+				b.SetBytes(64 * 1024 * 1024)
+
+				for i := 0; i < b.N; i++ {
+					require.NoError(b, targz.ArchiveWithOptions(folderPath, []string{folderPath}, dest, options))
+				}
+			})
+		}
+	}
+}
+
+func TestArchiveExcluding(t *testing.T) {
+	folderPath := testutil.TempDir(t)
+	for _, path := range []string{"keep.txt", "selfcheck/state.json", "nested/pip.lock", "nested/keep.txt"} {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(folderPath, path)), 0700))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(folderPath, path), []byte(path), 0600))
+	}
+
+	var excluded []string
+	exclude := func(relativePath string, info os.FileInfo) bool {
+		if relativePath == "selfcheck" || strings.HasSuffix(relativePath, ".lock") {
+			excluded = append(excluded, relativePath)
+			return true
+		}
+		return false
+	}
+
+	dest := filepath.Join(testutil.TempDir(t), "archive.tar.gz")
+	require.NoError(t, targz.ArchiveWithOptions(folderPath, []string{folderPath}, dest, targz.ArchiveOptions{Exclude: exclude}))
+
+	// The contents of the excluded directory aren't even visited
+	assert.ElementsMatch(t, []string{"selfcheck", "nested/pip.lock"}, excluded)
+
+	var names []string
+	for _, header := range TarGzContentsHelper(t, dest) {
+		names = append(names, filepath.ToSlash(strings.TrimPrefix(header.Name, folderPath)))
+	}
+	assert.ElementsMatch(t, []string{"", "/keep.txt", "/nested", "/nested/keep.txt"}, names)
+}
+
+func TestUnarchiveUnknownFormat(t *testing.T) {
+	dest := filepath.Join(testutil.TempDir(t), "archive")
+	require.NoError(t, ioutil.WriteFile(dest, []byte("definitely not an archive"), 0600))
+
+	err := targz.Unarchive(dest, testutil.TempDir(t))
+	assert.ErrorIs(t, err, targz.ErrUnknownFormat)
+}
+
+func TestParseCompression(t *testing.T) {
+	compression, err := targz.ParseCompression("zstd")
+	require.NoError(t, err)
+	assert.Equal(t, targz.CompressionZstd, compression)
+
+	_, err = targz.ParseCompression("lz4")
+	assert.Error(t, err)
+}
+
+// writeLinksFixture creates a tree with symbolic links, an executable script and an empty folder.
+func writeLinksFixture(t *testing.T, folderPath string) {
+	for path, mode := range map[string]os.FileMode{"bin/tool": 0755, "lib/data.txt": 0644} {
+		require.NoError(t, os.MkdirAll(filepath.Join(folderPath, filepath.Dir(path)), 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(folderPath, path), []byte(path), mode))
+	}
+	require.NoError(t, os.MkdirAll(filepath.Join(folderPath, "node_modules", ".bin"), 0755))
+	require.NoError(t, os.Mkdir(filepath.Join(folderPath, "empty"), 0750))
+
+	for link, target := range map[string]string{
+		"node_modules/.bin/tool": "../../bin/tool",
+		"node_modules/data.txt":  filepath.Join(folderPath, "lib", "data.txt"),
+		"lib-link":               filepath.Join(folderPath, "lib"),
+	} {
+		require.NoError(t, os.Symlink(target, filepath.Join(folderPath, link)))
+	}
+}
+
+func TestRoundTripPreservesLinksModesAndEmptyDirs(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("creating symbolic links requires a privilege on Windows")
+	}
+
+	folderPath := testutil.TempDir(t)
+	writeLinksFixture(t, folderPath)
+
+	dest := filepath.Join(testutil.TempDir(t), "archive")
+	require.NoError(t, targz.Archive(folderPath, []string{folderPath}, dest))
+
+	destFolder := filepath.Join(testutil.TempDir(t), "restored")
+	require.NoError(t, targz.Unarchive(dest, destFolder))
+
+	// The links are restored as links, with the absolute ones now pointing within the restored tree
+	for link, expectedTarget := range map[string]string{
+		"node_modules/.bin/tool": "../../bin/tool",
+		"node_modules/data.txt":  "../lib/data.txt",
+		"lib-link":               "lib",
+	} {
+		target, err := os.Readlink(filepath.Join(destFolder, link))
+		require.NoError(t, err)
+		assert.Equal(t, expectedTarget, target)
+	}
+
+	contents, err := ioutil.ReadFile(filepath.Join(destFolder, "lib-link", "data.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "lib/data.txt", string(contents))
+
+	info, err := os.Stat(filepath.Join(destFolder, "node_modules", ".bin", "tool"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), info.Mode().Perm())
+
+	info, err = os.Stat(filepath.Join(destFolder, "empty"))
+	require.NoError(t, err)
+	assert.True(t, info.IsDir())
+	assert.Equal(t, os.FileMode(0750), info.Mode().Perm())
+
+	// Restoring over an existing tree re-points the links
+	require.NoError(t, os.Remove(filepath.Join(destFolder, "lib-link")))
+	require.NoError(t, os.Symlink("bin", filepath.Join(destFolder, "lib-link")))
+	require.NoError(t, targz.Unarchive(dest, destFolder))
+	target, err := os.Readlink(filepath.Join(destFolder, "lib-link"))
+	require.NoError(t, err)
+	assert.Equal(t, "lib", target)
+}
+
+func TestUnarchiveWithoutSymlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("creating symbolic links requires a privilege on Windows")
+	}
+
+	folderPath := testutil.TempDir(t)
+	writeLinksFixture(t, folderPath)
+
+	dest := filepath.Join(testutil.TempDir(t), "archive")
+	require.NoError(t, targz.Archive(folderPath, []string{folderPath}, dest))
+
+	defer targz.SetSymlink(func(oldname, newname string) error {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: os.ErrPermission}
+	})()
+
+	var warnings []string
+	destFolder := testutil.TempDir(t)
+	require.NoError(t, targz.UnarchiveWithOptions(dest, destFolder, targz.UnarchiveOptions{
+		OnWarning: func(message string) {
+			warnings = append(warnings, message)
+		},
+	}))
+
+	// The links degrade to the copies of their targets
+	for link, expectedContents := range map[string]string{
+		"node_modules/.bin/tool": "bin/tool",
+		"node_modules/data.txt":  "lib/data.txt",
+		"lib-link/data.txt":      "lib/data.txt",
+	} {
+		info, err := os.Lstat(filepath.Join(destFolder, link))
+		require.NoError(t, err)
+		assert.Zero(t, info.Mode()&os.ModeSymlink)
+
+		contents, err := ioutil.ReadFile(filepath.Join(destFolder, link))
+		require.NoError(t, err)
+		assert.Equal(t, expectedContents, string(contents))
+	}
+
+	info, err := os.Stat(filepath.Join(destFolder, "node_modules", ".bin", "tool"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), info.Mode().Perm())
+
+	assert.Len(t, warnings, 3)
+	for _, warning := range warnings {
+		assert.Contains(t, warning, "restored as a copy of")
+	}
+}